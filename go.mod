@@ -2,7 +2,4 @@ module github.com/lzambarda/tmancer
 
 go 1.18
 
-require (
-	github.com/ahmetb/go-cursor v0.0.0-20131010032410-8136607ea412
-	github.com/pkg/errors v0.9.1
-)
+require github.com/pkg/errors v0.9.1
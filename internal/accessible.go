@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// accessibleRenderer announces the meaningful changes of the session as plain
+// sentences, without tables nor cursor movements, which suits screen readers
+// and very narrow terminals. Transient statuses and connection counts are left
+// out to keep the noise down.
+type accessibleRenderer struct {
+	last map[string]Status
+	w    io.Writer
+}
+
+func (r *accessibleRenderer) Render(s *Snapshot) {
+	for i := range s.Tunnels {
+		t := &s.Tunnels[i]
+		if previous, ok := r.last[t.Name]; ok && previous == t.Status {
+			continue
+		}
+		r.last[t.Name] = t.Status
+		if sentence := t.announcement(); sentence != "" {
+			fmt.Fprintln(r.w, sentence)
+		}
+	}
+}
+
+func (r *accessibleRenderer) Close() {}
+
+// announcement returns a sentence describing the status of the tunnel, empty
+// if it is not worth announcing.
+func (t *TunnelSnapshot) announcement() string {
+	var sentence string
+	switch t.Status {
+	case Close, Opening, Undefined:
+		return ""
+	case Open:
+		sentence = fmt.Sprintf("Tunnel %s is now open on port %s.", t.Name, t.Ports)
+	case Degraded:
+		sentence = fmt.Sprintf("Tunnel %s is open but failing its health checks.", t.Name)
+	case Error, Signal, Cooper:
+		sentence = fmt.Sprintf("Tunnel %s failed.", t.Name)
+	case Reopening:
+		sentence = fmt.Sprintf("Tunnel %s is reopening.", t.Name)
+	case PortBusy:
+		sentence = fmt.Sprintf("Tunnel %s cannot open, port %s is already in use.", t.Name, t.Ports)
+	case Refreshing:
+		sentence = fmt.Sprintf("Tunnel %s is refreshing its credentials.", t.Name)
+	case Failed:
+		sentence = fmt.Sprintf("Tunnel %s gave up.", t.Name)
+	case Exited:
+		sentence = fmt.Sprintf("Tunnel %s exited.", t.Name)
+	case Flapping:
+		sentence = fmt.Sprintf("Tunnel %s keeps dropping, waiting before reopening.", t.Name)
+	case Crashed:
+		sentence = fmt.Sprintf("Tunnel %s crashed, a crash report was written.", t.Name)
+	case WaitingForTarget:
+		sentence = fmt.Sprintf("Tunnel %s is waiting for its target to exist.", t.Name)
+	case Throttled:
+		sentence = fmt.Sprintf("Tunnel %s is throttled, waiting before reopening.", t.Name)
+	case Paused:
+		sentence = fmt.Sprintf("Tunnel %s is paused.", t.Name)
+	case Idle:
+		sentence = fmt.Sprintf("Tunnel %s was stopped as nobody used it.", t.Name)
+	case Waiting:
+		sentence = fmt.Sprintf("Tunnel %s is waiting for its preconditions.", t.Name)
+	case PreflightFailed:
+		sentence = fmt.Sprintf("Tunnel %s failed its preflight check.", t.Name)
+	case Scheduled:
+		sentence = fmt.Sprintf("Tunnel %s is closed outside its active hours.", t.Name)
+	default:
+		sentence = fmt.Sprintf("Tunnel %s is now %s.", t.Name, strings.ToLower(t.Status.String()))
+	}
+	if t.Status == Open {
+		// The details are about the previous failure, if any.
+		return sentence
+	}
+	if t.Details != "" {
+		// The last line of the error is usually the one explaining it.
+		lines := strings.Split(strings.TrimSpace(t.Details), "\n")
+		sentence += fmt.Sprintf(" Reason: %s.", strings.TrimSuffix(lines[len(lines)-1], "."))
+	}
+	if t.Hint != "" {
+		sentence += fmt.Sprintf(" Try: %s.", t.Hint)
+	}
+	return sentence
+}
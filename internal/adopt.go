@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// adoptedPollInterval is how often adopted processes are checked for being
+// alive, as they cannot be waited for.
+const adoptedPollInterval = time.Second
+
+// adopt takes over the process listening on the local port if it runs exactly
+// the command the tunnel would have started, e.g. a kubectl port-forward
+// started by hand, rather than reporting the port as busy. The exit of the
+// process is then reported on ch like the ones tmancer started. Nothing is
+// looked up while the port is free, and the lookups run with the tunnel lock
+// released. The caller must hold the tunnel lock through lock, see
+// setPortBusy.
+func (t *Tunnel) adopt(lock sync.Locker, port int, ch chan<- error) bool {
+	if canListen(t.config.network(), t.config.listenHosts(), port) {
+		return false
+	}
+	config := t.config
+	lock.Unlock()
+	pid, _ := portOwner(config.processNetwork(), config.processBind(), port)
+	var running string
+	if pid != 0 {
+		running = processCommand(pid)
+	}
+	lock.Lock()
+	if pid == 0 {
+		return false
+	}
+	cmd, err := t.config.getCommand(port)
+	if err != nil || !sameCommand(running, cmd.Args) {
+		return false
+	}
+	if cmd.Process, err = os.FindProcess(pid); err != nil {
+		return false
+	}
+	t.cmd = cmd
+	t.drift = ""
+	t.exited = make(chan struct{})
+	t.markOutput("adopted process " + strconv.Itoa(pid))
+	go func(exited chan<- struct{}) {
+		for isAlive(pid) {
+			time.Sleep(adoptedPollInterval)
+		}
+		close(exited)
+		// The exit status of a process which is not a child is unknown.
+		ch <- errors.New("adopted process exited")
+	}(t.exited)
+	// It is already listening.
+	t.ready = true
+	t.openingAt = time.Now()
+	t.status = Opening
+	return true
+}
+
+// sameCommand tells whether the command line of a running process is the one
+// of args, allowing for the executable to have been resolved to a full path,
+// e.g. by a version manager shim.
+func sameCommand(running string, args []string) bool {
+	if running == "" {
+		return false
+	}
+	rest := strings.Join(args[1:], " ")
+	executable := running
+	if rest != "" {
+		if !strings.HasSuffix(running, " "+rest) {
+			return false
+		}
+		executable = strings.TrimSuffix(running, " "+rest)
+	}
+	return executable == args[0] || filepath.Base(executable) == filepath.Base(args[0])
+}
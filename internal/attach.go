@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ControlSnapshot returns the current state of the running session.
+func ControlSnapshot(ctx context.Context) (*Snapshot, error) {
+	s := &Snapshot{}
+	if err := controlRequest(ctx, http.MethodGet, "/snapshot", s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Attach displays the table of the running session, refreshed from its control
+// socket, until the session ends, ctx is done or q is pressed. Unless
+// readOnly, the keys acting on the tunnels are sent to the session.
+func Attach(ctx context.Context, s *Settings, w io.Writer, readOnly bool) error {
+	renderer, err := NewRenderer(s, w)
+	if err != nil {
+		return err
+	}
+	// Fail before taking over the screen if there is nothing to attach to.
+	snapshot, err := ControlSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	redraw := make(chan struct{}, 1)
+	if h, ok := renderer.(KeyHandler); ok {
+		if keys, restore, err := ReadKeys(); err == nil {
+			defer restore()
+			winch := make(chan os.Signal, 1)
+			NotifyResize(winch)
+			defer signal.Stop(winch)
+			go func() {
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-winch:
+					case key, ok := <-keys:
+						if !ok {
+							return
+						}
+						if attachKey(ctx, h, key, readOnly) {
+							cancel()
+							return
+						}
+					}
+					select {
+					case redraw <- struct{}{}:
+					default:
+					}
+				}
+			}()
+		}
+	}
+	defer renderer.Close()
+	for {
+		renderer.Render(snapshot)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-redraw:
+		case <-time.After(s.GetRefreshInterval()):
+		}
+		if snapshot, err = ControlSnapshot(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "session ended")
+		}
+	}
+}
+
+// attachKey handles a key pressed while attached, the renderer getting the
+// first go like in the session itself. It tells whether to detach.
+func attachKey(ctx context.Context, h KeyHandler, key byte, readOnly bool) bool {
+	if h.HandleKey(key) {
+		if c, _, ok := h.TakeTunnel(); ok {
+			h.Flash(attachAdd(ctx, c, readOnly))
+		}
+		return false
+	}
+	selected := h.Selected()
+	var err error
+	switch key {
+	case 'q':
+		return true
+	case 'R', 'p':
+		if readOnly {
+			h.Flash("read-only: attach without --read-only to act on tunnels")
+			return false
+		}
+		err = attachAction(ctx, key, selected)
+	case 'r', 'x':
+		h.Flash("only available in the session itself")
+	}
+	if err != nil {
+		h.Flash(err.Error())
+	}
+	return false
+}
+
+// attachAction restarts the selected tunnel or pauses or resumes it.
+func attachAction(ctx context.Context, key byte, selected string) error {
+	if selected == "" {
+		return nil
+	}
+	if key == 'R' {
+		return ControlTunnel(ctx, selected, "restart")
+	}
+	snapshot, err := ControlSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range snapshot.Tunnels {
+		if t := &snapshot.Tunnels[i]; t.Name == selected {
+			action := "stop"
+			if t.Status == Paused {
+				action = "start"
+			}
+			return ControlTunnel(ctx, selected, action)
+		}
+	}
+	return errors.Errorf("unknown tunnel %q", selected)
+}
+
+// attachAdd adds the tunnel of the form to the session and tells how it went.
+// Saving it to a config file is left to the session itself.
+func attachAdd(ctx context.Context, c TunnelConfig, readOnly bool) string {
+	if readOnly {
+		return "read-only: attach without --read-only to add tunnels"
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "not added: " + err.Error()
+	}
+	names, err := ControlAdd(ctx, string(b))
+	if err != nil {
+		return "not added: " + err.Error()
+	}
+	return fmt.Sprintf("added %s", strings.Join(names, ", "))
+}
@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AuditEntry records a command spawned by a tunnel, once when it starts and
+// once when it exits.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// Exit is the exit status of the command, -1 if it was killed by a
+	// signal. It is only set when the command exited.
+	Exit *int `json:"exit,omitempty"`
+	// Event is "start" or "exit".
+	Event  string `json:"event"`
+	Tunnel string `json:"tunnel"`
+	// Field is the config field the command comes from, "command" for the
+	// tunnel process itself.
+	Field string `json:"field"`
+	// Trigger tells why the tunnel process was (re)started.
+	Trigger string `json:"trigger,omitempty"`
+	User    string `json:"user"`
+	// Error is why the command could not start or was killed.
+	Error string   `json:"error,omitempty"`
+	Argv  []string `json:"argv"`
+	Pid   int      `json:"pid,omitempty"`
+	// Session is the pid of the session the tunnel belongs to.
+	Session int `json:"session"`
+}
+
+// AuditLog appends every command spawned by the tunnels to a file, for
+// compliance to know where the processes on the machine come from. Unlike
+// the history, it is never pruned.
+type AuditLog struct {
+	f    *os.File
+	user string
+	m    sync.Mutex
+}
+
+// OpenAuditLog opens the audit log at the given path for appending. A
+// leading ~ stands for the user's home.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	if rest := strings.TrimPrefix(path, "~/"); rest != path {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.Wrap(err, "getting home directory")
+		}
+		path = filepath.Join(home, rest)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, errors.Wrap(err, "creating audit log directory")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening audit log %s", path)
+	}
+	name := ""
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	return &AuditLog{f: f, user: name}, nil
+}
+
+// Close closes the audit log file.
+func (l *AuditLog) Close() {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.f.Close()
+}
+
+func (l *AuditLog) record(e *AuditEntry) {
+	e.User = l.user
+	e.Session = os.Getpid()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	// A single write so that concurrent sessions do not mix their lines.
+	l.f.Write(append(b, '\n')) //nolint:errcheck // Nothing to do about it.
+}
+
+// SetAuditLog makes the tunnel record the commands it spawns to the given
+// audit log. Call this before Start.
+func (t *Tunnel) SetAuditLog(l *AuditLog) {
+	t.config.audit = l
+}
+
+// commandAudit records a command of a tunnel to the audit log, it does
+// nothing if nil.
+type commandAudit struct {
+	log *AuditLog
+	// secrets are the values to hide from the arguments.
+	secrets map[string]string
+	tunnel  string
+	field   string
+	trigger string
+}
+
+// auditFor returns the audit of a command coming from the given field of the
+// config, nil if there is no audit log.
+func (c *TunnelConfig) auditFor(field, trigger string) *commandAudit {
+	if c.audit == nil {
+		return nil
+	}
+	return &commandAudit{log: c.audit, tunnel: c.Name, field: field, trigger: trigger, secrets: c.secrets}
+}
+
+// hideSecrets returns a copy of args where the given secret values are
+// replaced.
+func hideSecrets(args []string, secrets map[string]string) []string {
+	hidden := append([]string(nil), args...)
+	for i := range hidden {
+		for _, v := range secrets {
+			if v != "" {
+				hidden[i] = strings.ReplaceAll(hidden[i], v, "***")
+			}
+		}
+	}
+	return hidden
+}
+
+func (a *commandAudit) entry(event string, cmd *exec.Cmd) *AuditEntry {
+	argv := hideSecrets(cmd.Args, a.secrets)
+	e := &AuditEntry{Time: time.Now(), Event: event, Tunnel: a.tunnel, Field: a.field, Trigger: a.trigger, Argv: argv}
+	if cmd.Process != nil {
+		e.Pid = cmd.Process.Pid
+	}
+	return e
+}
+
+// started records that cmd started.
+func (a *commandAudit) started(cmd *exec.Cmd) {
+	if a != nil {
+		a.log.record(a.entry("start", cmd))
+	}
+}
+
+// exited records that cmd exited, or could not start, with the error
+// returned by Start or Wait.
+func (a *commandAudit) exited(cmd *exec.Cmd, err error) {
+	if a == nil {
+		return
+	}
+	e := a.entry("exit", cmd)
+	if cmd.ProcessState != nil {
+		code := cmd.ProcessState.ExitCode()
+		e.Exit = &code
+	}
+	var exitErr *exec.ExitError
+	if err != nil && (!errors.As(err, &exitErr) || !exitErr.Exited()) {
+		e.Error = errors.Cause(err).Error()
+	}
+	a.log.record(e)
+}
+
+// run runs cmd like its Run method, recording it.
+func (a *commandAudit) run(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		a.exited(cmd, err)
+		return err
+	}
+	a.started(cmd)
+	err := cmd.Wait()
+	a.exited(cmd, err)
+	return err
+}
+
+// output runs cmd like its Output method, recording it.
+func (a *commandAudit) output(cmd *exec.Cmd) ([]byte, error) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	err := a.run(cmd)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), err
+}
+
+// combinedOutput runs cmd like its CombinedOutput method, recording it.
+func (a *commandAudit) combinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	b := &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = b, b
+	err := a.run(cmd)
+	return b.Bytes(), err
+}
+
+// startTrigger tells why the tunnel process is about to be (re)started. The
+// caller must hold the tunnel lock.
+func (t *Tunnel) startTrigger() string {
+	switch {
+	case t.woken:
+		return "connection"
+	case t.status == Close:
+		return "session start"
+	case t.err != nil:
+		return t.status.String() + ": " + strings.SplitN(errors.Cause(t.err).Error(), "\n", 2)[0]
+	}
+	return t.status.String()
+}
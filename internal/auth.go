@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"context"
+	"os/exec"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// authRefreshDebounce is the minimum time between two runs of the
+	// auth_refresh command of a tunnel, so that a tunnel failing for other
+	// reasons right after a refresh does not trigger a storm of logins.
+	authRefreshDebounce = time.Minute
+	// authRefreshTimeout caps the refresh command, it is generous because most
+	// sso logins wait for the user to go through the browser.
+	authRefreshTimeout = 5 * time.Minute
+)
+
+// authErrorRegex matches the messages kubectl, its exec credential plugins and
+// ssh print when credentials are missing or expired.
+var authErrorRegex = regexp.MustCompile(`(?i)(unauthorized|you must be logged in|token (has )?expired|expiredtoken|` +
+	`sso session|refresh token|invalid_grant|permission denied \(publickey)`)
+
+func isAuthError(err error) bool {
+	return err != nil && authErrorRegex.MatchString(err.Error())
+}
+
+// shouldRefreshAuth tells whether the auth_refresh command must be run before
+// reopening the tunnel.
+func (t *Tunnel) shouldRefreshAuth() bool {
+	return t.config.AuthRefresh != "" && isAuthError(t.err) && time.Since(t.authRefreshedAt) > authRefreshDebounce
+}
+
+//nolint:gosec // I'm happy for now.
+func (t *Tunnel) refreshAuth(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, authRefreshTimeout)
+	defer cancel()
+	parts, err := splitCommand(t.config.AuthRefresh)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, parts[0], parts[1:]...)
+	cmd.Dir = t.config.Dir
+	b, err := t.config.auditFor("auth_refresh", "").combinedOutput(cmd)
+	return errors.Wrap(err, string(b))
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// defaultBind is the address tunnels listen on when they do not set one.
+const defaultBind = "127.0.0.1"
+
+// bindPlaceholder can be used in custom commands to refer to the address the
+// tunnel should listen on.
+const bindPlaceholder = "{{bind}}"
+
+// IP families a tunnel can listen on, see TunnelConfig.IPFamily.
+const (
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+	familyDual = "dual"
+)
+
+// ipFamily returns the IP family of the local port of the tunnel, which
+// follows the bind address unless set explicitly.
+func (c *TunnelConfig) ipFamily() string {
+	if c.IPFamily != "" {
+		return c.IPFamily
+	}
+	if c.Bind == "localhost" {
+		return familyDual
+	}
+	if ip := net.ParseIP(c.Bind); ip != nil && ip.To4() == nil {
+		return familyIPv6
+	}
+	return familyIPv4
+}
+
+// network returns the Go network of the local port of the tunnel.
+func (c *TunnelConfig) network() string {
+	switch c.ipFamily() {
+	case familyIPv6:
+		return "tcp6"
+	case familyDual:
+		return "tcp"
+	default:
+		return "tcp4"
+	}
+}
+
+// loopback returns the loopback address of the IP family of the tunnel.
+func (c *TunnelConfig) loopback() string {
+	switch c.ipFamily() {
+	case familyIPv6:
+		return "::1"
+	case familyDual:
+		return "localhost"
+	default:
+		return defaultBind
+	}
+}
+
+// processNetwork returns the Go network the tunnel process listens on. The
+// processes of proxied tunnels always listen on the IPv4 loopback.
+func (c *TunnelConfig) processNetwork() string {
+	if c.isProxied() {
+		return "tcp4"
+	}
+	return c.network()
+}
+
+// processBind returns the address the tunnel process listens on. The
+// processes of proxied tunnels always listen on the loopback, behind the
+// balancer which listens on the bind address.
+func (c *TunnelConfig) processBind() string {
+	if c.isProxied() {
+		return defaultBind
+	}
+	return c.listenBind()
+}
+
+// listenBind returns the address the local port of the tunnel is bound to.
+func (c *TunnelConfig) listenBind() string {
+	if c.Bind == "" {
+		return c.loopback()
+	}
+	return c.Bind
+}
+
+// listenHosts returns the addresses the local port of the tunnel is bound to,
+// which are both loopbacks for dual stack tunnels.
+func (c *TunnelConfig) listenHosts() []string {
+	if bind := c.listenBind(); bind != "localhost" {
+		return []string{bind}
+	}
+	return []string{"127.0.0.1", "::1"}
+}
+
+// dialHost returns the host the local port of the tunnel can be reached at,
+// which is the loopback for tunnels listening on all interfaces.
+func (c *TunnelConfig) dialHost() string {
+	if ip := net.ParseIP(c.Bind); c.Bind == "" || (ip != nil && ip.IsUnspecified()) {
+		return c.loopback()
+	}
+	return c.Bind
+}
+
+// bindsOverlap tells whether two tunnels listening on the same port would
+// conflict given their bind addresses.
+func bindsOverlap(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if (ipA != nil && ipA.IsUnspecified()) || (ipB != nil && ipB.IsUnspecified()) {
+		return true
+	}
+	if (a == "localhost" && ipB != nil && ipB.IsLoopback()) || (b == "localhost" && ipA != nil && ipA.IsLoopback()) {
+		return true
+	}
+	return a == b
+}
+
+// expandAddress replaces the {{host}}, {{port}} and {{name}} placeholders of
+// a connection string or URL template. IPv6 hosts are enclosed in brackets so
+// that URLs stay valid.
+func (c *TunnelConfig) expandAddress(template string) string {
+	host := c.dialHost()
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return strings.NewReplacer(
+		"{{host}}", host,
+		"{{port}}", strconv.Itoa(c.LocalPort),
+		"{{name}}", c.Name,
+	).Replace(template)
+}
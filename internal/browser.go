@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"os/exec"
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// GetURL returns the URL of the tunnel with its placeholders replaced, empty
+// if it has none.
+func (c *TunnelConfig) GetURL() string {
+	if c.URL == "" {
+		return ""
+	}
+	return c.expandAddress(c.URL)
+}
+
+// openBrowser opens the URL in the default browser, without waiting for it.
+func openBrowser(url string) error {
+	opener, args := "xdg-open", []string{url}
+	switch runtime.GOOS {
+	case "darwin":
+		opener = "open"
+	case "windows":
+		// Unlike cmd /c start, this leaves the & of query strings alone.
+		opener, args = "rundll32", []string{"url.dll,FileProtocolHandler", url}
+	}
+	cmd := exec.Command(opener, args...) //nolint:gosec // The URL comes from the config.
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "running %s", opener)
+	}
+	go cmd.Wait() //nolint:errcheck // Browsers report their own errors.
+	return nil
+}
+
+// ControlOpen opens the URL of the tunnel of the running session with the
+// given name in the default browser.
+func ControlOpen(ctx context.Context, name string) error {
+	js := jsonSnapshot{}
+	if err := controlRequest(ctx, http.MethodGet, "/tunnels", &js); err != nil {
+		return err
+	}
+	for i := range js.Tunnels {
+		if t := &js.Tunnels[i]; t.Name == name {
+			if t.URL == "" {
+				return errors.Errorf("tunnel %s has no url", name)
+			}
+			return openBrowser(t.URL)
+		}
+	}
+	return errors.Errorf("no tunnel named %s", name)
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRetryBudget is how many tunnels may be reopened per second
+	// across a session.
+	defaultRetryBudget = 4
+	// retryJitter is the fraction by which retry delays are randomly spread,
+	// both ways.
+	retryJitter = 0.2
+)
+
+// jitterRand spreads retries, it is not seeded the same in every session so
+// that sessions sharing a VPN do not retry in lockstep either.
+var jitterRand = struct {
+	*rand.Rand
+	m sync.Mutex
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))} //nolint:gosec // Not for security.
+
+// jitter returns d spread randomly by up to retryJitter of it, so that
+// tunnels which failed together do not retry together.
+func jitter(d time.Duration) time.Duration {
+	jitterRand.m.Lock()
+	f := jitterRand.Float64()
+	jitterRand.m.Unlock()
+	return d + time.Duration((2*f-1)*retryJitter*float64(d))
+}
+
+// RetryBudget caps how many tunnels are reopened per second across a
+// session. When the VPN blips every tunnel fails at once, reopening them all
+// at once as well makes the next blip, or the rate limit of the API server,
+// more likely. Tunnels over the budget try again on their next check.
+type RetryBudget struct {
+	last time.Time
+	// tokens is the number of reopenings allowed right now, refilled by rate
+	// per second up to rate.
+	tokens float64
+	rate   float64
+	m      sync.Mutex
+}
+
+// NewRetryBudget instantiates a RetryBudget allowing perSecond reopenings
+// per second, the default if 0.
+func NewRetryBudget(perSecond int) *RetryBudget {
+	if perSecond <= 0 {
+		perSecond = defaultRetryBudget
+	}
+	return &RetryBudget{rate: float64(perSecond), tokens: float64(perSecond)}
+}
+
+// take tells whether a tunnel may be reopened now, spending from the budget
+// if so.
+func (b *RetryBudget) take(now time.Time) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
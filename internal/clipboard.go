@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// defaultConnectionString is copied when a tunnel does not set
+// ConnectionString.
+const defaultConnectionString = "{{host}}:{{port}}"
+
+// clipboardCommands are the commands tried in turn to write to the clipboard.
+var clipboardCommands = [][]string{
+	{"pbcopy"},
+	{"wl-copy"},
+	{"xclip", "-selection", "clipboard"},
+	{"xsel", "--clipboard", "--input"},
+	{"clip"},
+}
+
+// GetConnectionString returns the connection string of the tunnel with its
+// placeholders replaced, see expandAddress.
+func (c *TunnelConfig) GetConnectionString() string {
+	if c.ConnectionString == "" {
+		return c.expandAddress(defaultConnectionString)
+	}
+	return c.expandAddress(c.ConnectionString)
+}
+
+// copyToClipboard writes text to the clipboard using the first clipboard
+// command available. Without any, e.g. over SSH, it falls back to the OSC 52
+// escape sequence which most terminals turn into a clipboard write.
+func copyToClipboard(text string, f *os.File) error {
+	for _, args := range clipboardCommands {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(args[0], args[1:]...) //nolint:gosec // Fixed commands.
+		cmd.Stdin = strings.NewReader(text)
+		if err := cmd.Run(); err != nil {
+			return errors.Wrapf(err, "running %s", args[0])
+		}
+		return nil
+	}
+	_, err := fmt.Fprintf(f, "\x1b]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(text)))
+	return errors.Wrap(err, "writing to the terminal")
+}
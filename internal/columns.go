@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Columns of the table.
+const (
+	ColumnName     = "name"
+	ColumnType     = "type"
+	ColumnPort     = "port"
+	ColumnPid      = "pid"
+	ColumnAge      = "age"
+	ColumnRestarts = "restarts"
+	ColumnStatus   = "status"
+	// ColumnTarget is the namespace, service and port of k8s tunnels, the
+	// target host or redacted command of custom ones.
+	ColumnTarget = "target"
+	// ColumnContext is the kubectl context of k8s tunnels.
+	ColumnContext = "context"
+	// ColumnDetails is the error, warning or connections of the tunnel.
+	ColumnDetails = "details"
+	// ColumnTraffic is the bytes received and sent through proxied tunnels.
+	ColumnTraffic = "traffic"
+	// ColumnRate is the recent transfer rate of proxied tunnels.
+	ColumnRate = "rate"
+	// ColumnLatency is the average round trip of the latest health probes.
+	ColumnLatency = "latency"
+	// ColumnCPU is the recent CPU usage of the tunnel process, as a share of
+	// a core.
+	ColumnCPU = "cpu"
+	// ColumnRSS is the resident memory of the tunnel process.
+	ColumnRSS = "rss"
+	// ColumnUptime is the time the tunnel has been open since the session
+	// started, across reopens.
+	ColumnUptime = "uptime"
+	// ColumnDowntime is the time the tunnel has been failing since the session
+	// started.
+	ColumnDowntime = "downtime"
+)
+
+// columnWidths are the default widths of the columns, 0 for no limit.
+var columnWidths = map[string]int{
+	ColumnName:     16,
+	ColumnType:     10,
+	ColumnPort:     12,
+	ColumnPid:      10,
+	ColumnAge:      10,
+	ColumnRestarts: 10,
+	ColumnStatus:   10,
+	ColumnTarget:   30,
+	ColumnContext:  16,
+	ColumnDetails:  0,
+	ColumnTraffic:  18,
+	ColumnRate:     10,
+	ColumnLatency:  10,
+	ColumnCPU:      8,
+	ColumnRSS:      10,
+	ColumnUptime:   10,
+	ColumnDowntime: 10,
+}
+
+// defaultColumns are the columns of the table when none are configured.
+var defaultColumns = []string{
+	ColumnName, ColumnType, ColumnPort, ColumnPid, ColumnAge, ColumnRestarts, ColumnStatus, ColumnDetails,
+}
+
+// column is a column of the table.
+type column struct {
+	name string
+	// width of the column, values are cut to fit. 0 for no limit.
+	width int
+}
+
+// parseColumns parses columns such as "name:24", the width being optional.
+// It returns the default columns if there are none.
+func parseColumns(specs []string) ([]column, error) {
+	if len(specs) == 0 {
+		specs = defaultColumns
+	}
+	columns := make([]column, 0, len(specs))
+	for _, spec := range specs {
+		name, widthSpec := spec, ""
+		if i := strings.Index(spec, ":"); i >= 0 {
+			name, widthSpec = spec[:i], spec[i+1:]
+		}
+		width, ok := columnWidths[name]
+		if !ok {
+			return nil, errors.Errorf("unknown column %q", name)
+		}
+		if widthSpec != "" {
+			var err error
+			if width, err = strconv.Atoi(widthSpec); err != nil || width < 0 {
+				return nil, errors.Errorf("invalid width of column %q", spec)
+			}
+		}
+		columns = append(columns, column{name: name, width: width})
+	}
+	return columns, nil
+}
+
+// cell pads value to the width of the column, cutting it if needed so that
+// there is always a space before the next column.
+func (c column) cell(value string) string {
+	if c.width == 0 {
+		return value
+	}
+	switch {
+	case c.width == 1:
+		value = ""
+	case utf8.RuneCountInString(value) >= c.width:
+		value = clip(value, c.width-1)
+	}
+	return fmt.Sprintf("%-*s", c.width, value)
+}
+
+// GetTarget returns a short description of where the tunnel goes.
+func (c *TunnelConfig) GetTarget() string {
+	switch {
+	case c.K8s != nil:
+		return fmt.Sprintf("%s/%s:%d", c.K8s.Namespace, c.K8s.Service, c.K8s.Port)
+	case c.TargetHost != "" && c.TargetPort > 0:
+		return net.JoinHostPort(c.TargetHost, strconv.Itoa(c.TargetPort))
+	case c.TargetHost != "":
+		return c.TargetHost
+	case c.HTTPProxy != nil:
+		return c.httpProxyTarget()
+	case c.Custom != "":
+		args, err := splitCommand(c.Custom)
+		if err != nil {
+			args = strings.Fields(c.Custom)
+		}
+		return strings.Join(redactArgs(args), " ")
+	case c.Provider != "":
+		return c.paramsTarget()
+	case c.dynamicCommand != "":
+		command := strings.NewReplacer(
+			localPortPlaceholder, strconv.Itoa(c.LocalPort),
+			bindPlaceholder, c.processBind(),
+		).Replace(c.dynamicCommand)
+		args, err := splitCommand(command)
+		if err != nil {
+			args = strings.Fields(command)
+		}
+		return strings.Join(redactArgs(args), " ")
+	}
+	return notAvailable
+}
+
+// GetContext returns the kubectl context of the tunnel, N/A if it is not a
+// k8s tunnel or uses the current context.
+func (c *TunnelConfig) GetContext() string {
+	if c.K8s == nil || c.K8s.Context == "" {
+		return notAvailable
+	}
+	return c.K8s.Context
+}
@@ -0,0 +1,342 @@
+package internal
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRetryInterval   = 2 * time.Second
+	defaultRefreshInterval = 5 * time.Second
+)
+
+// Config is the content of a config file. For backward compatibility a config
+// file can also be just an array of tunnel configs.
+type Config struct {
+	// Vars can be referenced as {{vars.name}} in any string of the tunnel
+	// configs and of the defaults.
+	Vars map[string]string `json:"vars"`
+	// Defaults is a partial tunnel config applied to every tunnel, which can
+	// override any of it.
+	Defaults map[string]interface{} `json:"defaults"`
+	// Profiles are partial configs, merged over the rest when selected with
+	// --profile. Tunnels listing profiles are only started with one of them.
+	Profiles map[string]interface{} `json:"profiles"`
+	// Include lists config files merged before this one, relative to it.
+	Include []string       `json:"include"`
+	Tunnels []TunnelConfig `json:"tunnels"`
+	// namespaces are the k8s_namespace entries, see WatchNamespaces.
+	namespaces []TunnelConfig
+	// dirs are the config directories the config was loaded from, see
+	// WatchConfigDirs.
+	dirs     []string
+	Settings Settings `json:"settings"`
+}
+
+// Settings apply to the whole session. Some of them act as defaults for the
+// tunnel configs which can override them.
+type Settings struct {
+	// Logs enables writing the output of the tunnel processes to files.
+	Logs *LogSettings `json:"logs"`
+	// Hints overrides the suggested commands shown when tunnels fail for a
+	// known reason, by failure kind. Can be overridden per tunnel.
+	Hints map[string]string `json:"hints"`
+	// Schedule, if set, holds back notifications during quiet hours and
+	// pauses the tunnels outside of work hours.
+	Schedule *Schedule `json:"schedule"`
+	// Notifications, if set, tells who to notify when tunnels fail and
+	// recover.
+	Notifications *Notifications `json:"notifications"`
+	// NetworkWatch tells how network changes and wake ups from sleep are
+	// noticed, see WatchNetwork.
+	NetworkWatch *NetworkWatch `json:"network_watch"`
+	// MetricsExport, if set, pushes the metrics of the tunnels to StatsD or
+	// an OpenTelemetry collector.
+	MetricsExport *MetricsExport `json:"metrics_export"`
+	// Formats tells how durations and timestamps are displayed.
+	Formats Formats `json:"formats"`
+	// Renderer is how the session is displayed, see the Renderer constants.
+	// It can be overridden with the --renderer flag.
+	Renderer string `json:"renderer"`
+	// LogFormat is the format of the lines renderer, see the LogFormat
+	// constants. It can be overridden with the --log-format flag.
+	LogFormat string `json:"log_format"`
+	// DNSAddr, if set, is the UDP address on which to serve "<name>.tunnel"
+	// DNS queries, e.g. "127.0.0.1:5354".
+	DNSAddr string `json:"dns_addr"`
+	// SecretReader reads the {{secret "<ref>"}} references of the tunnel
+	// commands, with the {{ref}} placeholder. Defaults to "op read {{ref}}".
+	SecretReader string `json:"secret_reader"`
+	// Providers are the tunnel types added by the config, by name.
+	Providers map[string]*ExecProvider `json:"providers"`
+	// HTTPAddr, if set, is the TCP address on which to serve the http api,
+	// /metrics and /healthz, e.g. "127.0.0.1:9464". It can be overridden
+	// with the --http-addr flag.
+	HTTPAddr string `json:"http_addr"`
+	// MetricsAddr is the former name of HTTPAddr, used if HTTPAddr is not set.
+	//
+	// Deprecated: use HTTPAddr.
+	MetricsAddr string `json:"metrics_addr"`
+	// EnvFile, if set, is the dotenv file the host and port of every tunnel
+	// are written to, e.g. "~/.tmancer/current.env". It can be overridden with
+	// the --env-file flag.
+	EnvFile string `json:"env_file"`
+	// HostsFile is the hosts file the aliases of the tunnels are added to,
+	// defaults to /etc/hosts.
+	HostsFile string `json:"hosts_file"`
+	// Sort is the order of the table rows, see the Sort constants. It can be
+	// overridden with the --sort flag.
+	Sort string `json:"sort"`
+	// Columns of the table, optionally with their width such as "name:24",
+	// see the Column constants. It can be overridden with the --columns flag.
+	Columns []string `json:"columns"`
+	// RetryInterval is how often tunnels check their process and move through
+	// their statuses, defaults to 2s. Can be overridden per tunnel.
+	RetryInterval Duration `json:"retry_interval"`
+	// RetryBudget is how many failed tunnels may be reopened per second
+	// across the session, defaults to 4.
+	RetryBudget int `json:"retry_budget"`
+	// MaxOpening is how many tunnels may be opening at once, the others
+	// waiting for their turn, 0 for no limit.
+	MaxOpening int `json:"max_opening"`
+	// StartDelay is how long to wait between two tunnels starting to open.
+	StartDelay Duration `json:"start_delay"`
+	// RefreshInterval is how often the status table is refreshed, defaults
+	// to 5s.
+	RefreshInterval Duration `json:"refresh_interval"`
+	// KillGrace is how long tunnel processes are given to terminate before
+	// being killed, defaults to 5s. Can be overridden per tunnel.
+	KillGrace Duration `json:"kill_grace"`
+	// PortOffset shifts every local port, so that several sessions of the
+	// same config can run on one machine. It can be overridden with the
+	// --port-offset flag.
+	PortOffset int `json:"port_offset"`
+	// ProblemsOnly hides the tunnels which do not need attention from the
+	// table. It can be enabled with the --problems-only flag.
+	ProblemsOnly bool `json:"problems_only"`
+	// TerminalTitle keeps the title of the terminal window to a summary of
+	// the session while the table is displayed, e.g. "tmancer: 11/12 open".
+	// It can be enabled with the --title flag.
+	TerminalTitle bool `json:"terminal_title"`
+	// CountConnections proxies the connections of every tunnel which can be,
+	// see TunnelConfig.CountConnections.
+	CountConnections bool `json:"count_connections"`
+}
+
+// GetRefreshInterval returns the table refresh interval.
+func (s *Settings) GetRefreshInterval() time.Duration {
+	return s.RefreshInterval.Or(defaultRefreshInterval)
+}
+
+// LoadConfig reads the config contained in the given json files. Later files
+// override the settings of earlier ones and replace their tunnels with the
+// same name. The profile, if any, is applied last.
+func LoadConfig(profile string, paths ...string) (*Config, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no config file")
+	}
+	doc := map[string]interface{}{}
+	var dirs []string
+	for _, path := range paths {
+		fileDoc, err := loadDocument(path, map[string]bool{}, &dirs)
+		if err != nil {
+			return nil, err
+		}
+		doc = mergeDocuments(doc, fileDoc)
+	}
+	doc, err := applyProfile(doc, profile)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshaling configs")
+	}
+	config := &Config{}
+	if err = json.Unmarshal(b, config); err == nil {
+		err = config.applyTemplates(b)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshaling configs")
+	}
+	config.selectProfile(profile)
+	config.dirs = dirs
+	if err = config.prepare(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// NewConfig returns the config of the given tunnels and settings, checked and
+// ready to be started as if it was loaded from a file.
+func NewConfig(settings Settings, tunnels []TunnelConfig) (*Config, error) {
+	config := &Config{Settings: settings, Tunnels: append([]TunnelConfig(nil), tunnels...)}
+	if err := config.prepare(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// prepare checks the config, expands its port ranges, sets its k8s_namespace
+// entries aside and applies the settings to the tunnels.
+func (c *Config) prepare() error {
+	if c.Settings.HTTPAddr == "" {
+		c.Settings.HTTPAddr = c.Settings.MetricsAddr
+	}
+	c.extractNamespaces()
+	if err := c.expandPortRanges(); err != nil {
+		return err
+	}
+	if err := c.Settings.Formats.validate(); err != nil {
+		return err
+	}
+	if _, err := parseColumns(c.Settings.Columns); err != nil {
+		return err
+	}
+	if err := checkSort(c.Settings.Sort); err != nil {
+		return err
+	}
+	if err := c.Settings.Schedule.validate(); err != nil {
+		return err
+	}
+	if err := c.Settings.Notifications.validate(); err != nil {
+		return err
+	}
+	if err := c.Settings.MetricsExport.validate(); err != nil {
+		return err
+	}
+	if err := checkHints(c.Settings.Hints); err != nil {
+		return err
+	}
+	if err := checkLocalPorts(c.Tunnels); err != nil {
+		return err
+	}
+	if err := c.linkUpstreams(); err != nil {
+		return err
+	}
+	if err := checkDependencies(c.Tunnels); err != nil {
+		return err
+	}
+	if err := checkAliases(c.Tunnels); err != nil {
+		return err
+	}
+	if err := c.resolveProviders(); err != nil {
+		return err
+	}
+	c.applySettings()
+	for i := range c.Tunnels {
+		if err := checkHints(c.Tunnels[i].Hints); err != nil {
+			return errors.Wrap(err, c.Tunnels[i].Name)
+		}
+		for j := range c.Tunnels[i].ActiveHours {
+			if err := c.Tunnels[i].ActiveHours[j].validate(c.Tunnels[i].Name + ": active_hours"); err != nil {
+				return err
+			}
+		}
+		if _, err := c.Tunnels[i].readyRegex(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandPortRanges replaces the tunnels using local_ports with their
+// sub-forwards.
+func (c *Config) expandPortRanges() error {
+	tunnels := make([]TunnelConfig, 0, len(c.Tunnels))
+	for i := range c.Tunnels {
+		if c.Tunnels[i].LocalPorts == "" {
+			tunnels = append(tunnels, c.Tunnels[i])
+			continue
+		}
+		subs, err := expandPortRange(&c.Tunnels[i])
+		if err != nil {
+			return err
+		}
+		tunnels = append(tunnels, subs...)
+	}
+	c.Tunnels = tunnels
+	return nil
+}
+
+// checkLocalPorts makes sure that no two tunnels share a local port on the
+// same address, in which case the second one would be PortBusy forever.
+func checkLocalPorts(configs []TunnelConfig) error {
+	owners := map[int][]*TunnelConfig{}
+	for i := range configs {
+		c := &configs[i]
+		if c.LocalPort == 0 {
+			continue
+		}
+		for _, owner := range owners[c.LocalPort] {
+			if bindsOverlap(owner.listenBind(), c.listenBind()) {
+				return errors.Errorf("%s and %s both use local port %d", owner.Name, c.Name, c.LocalPort)
+			}
+		}
+		owners[c.LocalPort] = append(owners[c.LocalPort], c)
+	}
+	return nil
+}
+
+// ShiftPorts adds offset to the local port of every tunnel, the ones picking a
+// free port aside.
+func (c *Config) ShiftPorts(offset int) error {
+	for i := range c.Tunnels {
+		if c.Tunnels[i].LocalPort == 0 {
+			continue
+		}
+		port := c.Tunnels[i].LocalPort + offset
+		if port <= 0 || port > 65535 {
+			return errors.Errorf("%s: local port %d is out of range once shifted by %d", c.Tunnels[i].Name, port, offset)
+		}
+		c.Tunnels[i].LocalPort = port
+	}
+	return nil
+}
+
+// AssignFreePorts gives a free ephemeral port to the tunnels which do not set
+// their local port, for when any port will do.
+func (c *Config) AssignFreePorts() error {
+	for i := range c.Tunnels {
+		if c.Tunnels[i].LocalPort != 0 {
+			continue
+		}
+		port, err := freePort(c.Tunnels[i].network(), c.Tunnels[i].listenHosts()[0])
+		if err != nil {
+			return errors.Wrap(err, c.Tunnels[i].Name)
+		}
+		c.Tunnels[i].LocalPort = port
+	}
+	return nil
+}
+
+// applySettings sets the tunnel configs defaults from the settings.
+func (c *Config) applySettings() {
+	for i := range c.Tunnels {
+		if c.Tunnels[i].RetryInterval.Duration == 0 {
+			c.Tunnels[i].RetryInterval = c.Settings.RetryInterval
+		}
+		if c.Tunnels[i].KillGrace.Duration == 0 {
+			c.Tunnels[i].KillGrace = c.Settings.KillGrace
+		}
+		c.Tunnels[i].formats = c.Settings.Formats
+		c.Tunnels[i].logSettings = c.Settings.Logs
+		c.Tunnels[i].schedule = c.Settings.Schedule
+		c.Tunnels[i].notifications = c.Settings.Notifications
+		c.Tunnels[i].secretReader = c.Settings.GetSecretReader()
+		if c.Settings.CountConnections && c.Tunnels[i].canProxy() {
+			c.Tunnels[i].CountConnections = true
+		}
+		for kind, hint := range c.Settings.Hints {
+			if _, ok := c.Tunnels[i].Hints[kind]; ok {
+				continue
+			}
+			if c.Tunnels[i].Hints == nil {
+				c.Tunnels[i].Hints = map[string]string{}
+			}
+			c.Tunnels[i].Hints[kind] = hint
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// controlSocket is where the running session listens for tmancer ctl,
+// relative to the user's home.
+const controlSocket = ".tmancer/tmancer.sock"
+
+const controlTimeout = 10 * time.Second
+
+func controlSocketPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "getting home directory")
+	}
+	return filepath.Join(home, controlSocket), nil
+}
+
+// StartControlSocket serves the http api on ~/.tmancer/tmancer.sock, so that
+// tmancer ctl can drive the session from other shells, and on a socket of its
+// own in ~/.tmancer/instances for tmancer ps. It fails to listen on the former
+// if another session already does. It stops once ctx is done.
+func StartControlSocket(ctx context.Context, s *Session, formats Formats, shutdown func()) error {
+	h := newHTTPHandler(s, formats, shutdown, true)
+	dir, err := instancesPath()
+	if err != nil {
+		return err
+	}
+	l, err := listenUnix(instanceSocketPath(dir, os.Getpid()))
+	if err != nil {
+		return err
+	}
+	serveHTTP(ctx, l, h)
+	path, err := controlSocketPath()
+	if err != nil {
+		return err
+	}
+	if isSocketUp(path) {
+		return errors.Errorf("another session is listening on %s", path)
+	}
+	if l, err = listenUnix(path); err != nil {
+		return err
+	}
+	serveHTTP(ctx, l, h)
+	return nil
+}
+
+// instanceSocketPath returns the path of the socket of the session with the
+// given pid.
+func instanceSocketPath(dir string, pid int) string {
+	return filepath.Join(dir, strconv.Itoa(pid)+".sock")
+}
+
+// listenUnix listens on a unix socket only the user can connect to.
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, errors.Wrap(err, "creating control socket directory")
+	}
+	// Left behind by a session which did not shut down cleanly.
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "removing stale control socket")
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listening on %s", path)
+	}
+	if err = os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, errors.Wrap(err, "restricting control socket permissions")
+	}
+	return l, nil
+}
+
+// controlRequest sends a request to the running session over the control
+// socket and decodes the json response into v, if not nil.
+func controlRequest(ctx context.Context, method, path string, v interface{}) error {
+	socket, err := controlSocketPath()
+	if err != nil {
+		return err
+	}
+	return socketRequest(ctx, socket, method, path, nil, v)
+}
+
+// socketDo sends a request to the session listening on the given socket, with
+// body as its json body if not nil.
+func socketDo(ctx context.Context, socket, method, path string, body []byte) (*http.Response, error) {
+	client := &http.Client{
+		Timeout: controlTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	var reader io.Reader = http.NoBody
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://tmancer"+path, reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		// The socket is missing, or left behind by a session which is gone.
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return nil, errors.New("no running session")
+		}
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, errors.Wrap(err, "talking to the session")
+	}
+	return res, nil
+}
+
+// socketRequest sends a request to the session listening on the given socket
+// and decodes the json response into v, if not nil.
+func socketRequest(ctx context.Context, socket, method, path string, body []byte, v interface{}) error {
+	res, err := socketDo(ctx, socket, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		apiErr := apiError{}
+		if err = json.NewDecoder(res.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			return errors.New(res.Status)
+		}
+		return errors.New(apiErr.Error)
+	}
+	if v == nil {
+		return nil
+	}
+	return errors.Wrap(json.NewDecoder(res.Body).Decode(v), "decoding response")
+}
+
+// ControlStatus prints the status of the tunnels of the running session.
+func ControlStatus(ctx context.Context, w io.Writer) error {
+	js := jsonSnapshot{}
+	if err := controlRequest(ctx, http.MethodGet, "/tunnels", &js); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%-24s%-12s%-18s%-10s%-10s%-10s%s\n", "NAME", "PORT", "STATUS", "AGE", "UPTIME", "DOWNTIME", "DETAILS")
+	for i := range js.Tunnels {
+		t := &js.Tunnels[i]
+		age := t.Age
+		if age == "" {
+			age = notAvailable
+		}
+		details := strings.SplitN(strings.TrimSpace(t.Details), "\n", 2)[0]
+		fmt.Fprintf(w, "%-24s%-12s%-18s%-10s%-10s%-10s%s\n", t.Name, t.Ports, t.Status, age, t.Uptime, t.Downtime, details)
+	}
+	return nil
+}
+
+// ControlTunnel asks the running session to restart, stop or start the
+// tunnels with the given name or group.
+func ControlTunnel(ctx context.Context, name, action string) error {
+	return controlRequest(ctx, http.MethodPost, "/tunnels/"+url.PathEscape(name)+"/"+action, nil)
+}
+
+// ControlAdd asks the running session to add the tunnel described by the json
+// config and returns the names of the tunnels added, several for a port
+// range.
+func ControlAdd(ctx context.Context, config string) ([]string, error) {
+	c := TunnelConfig{}
+	if err := json.Unmarshal([]byte(config), &c); err != nil {
+		return nil, errors.Wrap(err, "unmarshaling tunnel")
+	}
+	socket, err := controlSocketPath()
+	if err != nil {
+		return nil, err
+	}
+	added := addedTunnels{}
+	if err = socketRequest(ctx, socket, http.MethodPost, "/tunnels", []byte(config), &added); err != nil {
+		return nil, err
+	}
+	return added.Tunnels, nil
+}
+
+// ControlRemove asks the running session to stop the tunnels with the given
+// name or group and to remove them.
+func ControlRemove(ctx context.Context, name string) error {
+	return ControlTunnel(ctx, name, "remove")
+}
+
+// ControlStop asks the running session to end and waits for it to be over.
+func ControlStop(ctx context.Context) error {
+	if err := controlRequest(ctx, http.MethodPost, "/shutdown", nil); err != nil {
+		return err
+	}
+	// The socket goes away once the tunnel processes are gone.
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "waiting for the session to end")
+		case <-time.After(200 * time.Millisecond):
+		}
+		if !isControlSocketUp() {
+			return nil
+		}
+	}
+}
+
+// isControlSocketUp tells whether a session listens on the control socket.
+func isControlSocketUp() bool {
+	path, err := controlSocketPath()
+	return err == nil && isSocketUp(path)
+}
+
+// isSocketUp tells whether a session listens on the given socket.
+func isSocketUp(path string) bool {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// ControlPs prints the tunnels of all the running sessions.
+func ControlPs(ctx context.Context, w io.Writer) error {
+	dir, err := instancesPath()
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(dir); os.IsNotExist(err) {
+		fmt.Fprintln(w, "No running session")
+		return nil
+	}
+	instances, _, err := readInstances(dir)
+	if err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		fmt.Fprintln(w, "No running session")
+		return nil
+	}
+	fmt.Fprintf(w, "%-10s%-24s%-12s%-18s%s\n", "SESSION", "NAME", "PORT", "STATUS", "CONFIG")
+	for _, i := range instances {
+		configs := strings.Join(i.Configs, ",")
+		js := jsonSnapshot{}
+		if err := socketRequest(ctx, instanceSocketPath(dir, i.Pid), http.MethodGet, "/tunnels", nil, &js); err != nil {
+			// Too old a session, or too busy to answer.
+			for _, t := range i.Tunnels {
+				fmt.Fprintf(w, "%-10d%-24s%-12d%-18s%s\n", i.Pid, t.Name, t.Port, notAvailable, configs)
+			}
+			continue
+		}
+		for _, t := range js.Tunnels {
+			fmt.Fprintf(w, "%-10d%-24s%-12s%-18s%s\n", i.Pid, t.Name, t.Ports, t.Status, configs)
+		}
+	}
+	return nil
+}
+
+// ControlWait waits for the running session to be ready, see IsReady, writing
+// the tunnels it waits for whenever they change. It fails once ctx is done.
+func ControlWait(ctx context.Context, w io.Writer) error {
+	socket, err := controlSocketPath()
+	if err != nil {
+		return err
+	}
+	last := ""
+	for {
+		res, err := socketDo(ctx, socket, http.MethodGet, "/healthz", nil)
+		if err != nil {
+			return err
+		}
+		h := healthz{}
+		err = json.NewDecoder(res.Body).Decode(&h)
+		res.Body.Close()
+		if err != nil {
+			return errors.Wrap(err, "decoding response")
+		}
+		if len(h.WaitingFor) == 0 {
+			return nil
+		}
+		statuses := make(map[string]string, len(h.Tunnels))
+		for _, t := range h.Tunnels {
+			statuses[t.Name] = t.Status
+		}
+		waiting := make([]string, 0, len(h.WaitingFor))
+		for _, name := range h.WaitingFor {
+			waiting = append(waiting, fmt.Sprintf("%s (%s)", name, statuses[name]))
+		}
+		if current := strings.Join(waiting, ", "); current != last {
+			fmt.Fprintf(w, "Waiting for %s\n", current)
+			last = current
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("not ready, still waiting for %s", last)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
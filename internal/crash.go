@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// crashDir is where crash reports are written, relative to the user's home.
+const crashDir = ".tmancer/crash"
+
+// WriteCrashReport writes a report about a recovered panic which happened in
+// the given part of tmancer, so that it can be attached to a bug report. The
+// tunnel config is optional and redacted. It returns the path of the report.
+func WriteCrashReport(where string, recovered interface{}, config *TunnelConfig) (string, error) {
+	stack := debug.Stack()
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "getting home directory")
+	}
+	dir := filepath.Join(home, crashDir)
+	if err = os.MkdirAll(dir, 0o700); err != nil {
+		return "", errors.Wrap(err, "creating crash directory")
+	}
+	now := time.Now()
+	name := strings.NewReplacer("/", "_", " ", "_", ":", "_").Replace(where)
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.txt", now.Format("20060102-150405"), name))
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "tmancer %s crashed in %s at %s\n", Version, where, now.Format(time.RFC3339))
+	fmt.Fprintf(b, "%s %s/%s\n\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(b, "panic: %v\n\n%s\n", recovered, stack)
+	if config != nil {
+		c, err := json.MarshalIndent(redactConfig(*config), "", "  ")
+		if err != nil {
+			return "", errors.Wrap(err, "marshaling config")
+		}
+		fmt.Fprintf(b, "config:\n%s\n", c)
+	}
+	if err = os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		return "", errors.Wrap(err, "writing crash report")
+	}
+	return path, nil
+}
+
+// redactConfig returns a copy of c where the commands and urls which could
+// carry secrets are redacted.
+func redactConfig(c TunnelConfig) TunnelConfig {
+	redact := func(s string) string {
+		if s == "" {
+			return s
+		}
+		args, err := splitCommand(s)
+		if err != nil {
+			args = strings.Fields(s)
+		}
+		return strings.Join(redactArgs(args), " ")
+	}
+	c.Custom = redact(c.Custom)
+	c.AuthRefresh = redact(c.AuthRefresh)
+	c.Preflight = redact(c.Preflight)
+	if c.Hooks != nil {
+		h := *c.Hooks
+		h.PreStart, h.PostStart = redact(h.PreStart), redact(h.PostStart)
+		h.PreStop, h.PostStop = redact(h.PreStop), redact(h.PostStop)
+		c.Hooks = &h
+	}
+	if c.HealthCheck != nil {
+		hc := *c.HealthCheck
+		hc.Cmd = redact(hc.Cmd)
+		c.HealthCheck = &hc
+	}
+	dependents := make([]Dependent, len(c.Dependents))
+	for i, d := range c.Dependents {
+		d.URL = redact(d.URL)
+		dependents[i] = d
+	}
+	c.Dependents = dependents
+	return c
+}
+
+// heldLocker remembers whether it is held, so that the lock can be released
+// when recovering from a panic. It must only be used by one goroutine.
+type heldLocker struct {
+	sync.Locker
+	held bool
+}
+
+func (l *heldLocker) Lock() {
+	l.Locker.Lock()
+	l.held = true
+}
+
+func (l *heldLocker) Unlock() {
+	l.held = false
+	l.Locker.Unlock()
+}
+
+// crash marks the tunnel as Crashed after a panic in its goroutine and stops
+// its process, leaving the rest of the session alive.
+func (t *Tunnel) crash(recovered interface{}, lock *heldLocker) {
+	path, err := WriteCrashReport("tunnel "+t.config.Name, recovered, &t.config)
+	if !lock.held {
+		lock.Lock()
+	}
+	t.status = Crashed
+	t.err = errors.Errorf("crash report in %s", path)
+	if err != nil {
+		t.err = errors.Wrapf(err, "crashed (%v)", recovered)
+	}
+	balancer := t.balancer
+	lock.Unlock()
+	t.stop()
+	if balancer != nil {
+		balancer.stop()
+	}
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// daemonLog is where detached sessions write their output, relative to the
+// user's home.
+const daemonLog = ".tmancer/daemon.log"
+
+// detachTimeout is how long a detached session is given to start listening
+// on the control socket.
+const detachTimeout = 10 * time.Second
+
+// Detach runs tmancer again in the background with the given arguments, minus
+// --detach, and waits for the session to listen on the control socket. It
+// returns the pid of the session and the path of its log.
+func Detach(args []string) (int, string, error) {
+	if isControlSocketUp() {
+		return 0, "", errors.New("a session is already running, see tmancer status")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, "", errors.Wrap(err, "finding the tmancer executable")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return 0, "", errors.Wrap(err, "getting home directory")
+	}
+	logPath := filepath.Join(home, daemonLog)
+	if err = os.MkdirAll(filepath.Dir(logPath), 0o700); err != nil {
+		return 0, "", errors.Wrap(err, "creating log directory")
+	}
+	log, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "opening %s", logPath)
+	}
+	defer log.Close()
+	var childArgs []string
+	for _, arg := range args {
+		name := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+		if strings.HasPrefix(arg, "-") && name == "detach" {
+			continue
+		}
+		childArgs = append(childArgs, arg)
+	}
+	cmd := exec.Command(exe, childArgs...)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	setDetached(cmd)
+	if err = cmd.Start(); err != nil {
+		return 0, "", errors.Wrap(err, "starting the session")
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait() //nolint:errcheck // Reported through the log.
+		close(exited)
+	}()
+	deadline := time.After(detachTimeout)
+	for !isControlSocketUp() {
+		select {
+		case <-exited:
+			return 0, logPath, errors.Errorf("the session exited, see %s", logPath)
+		case <-deadline:
+			return cmd.Process.Pid, logPath, errors.Errorf("the session did not start listening in %s, see %s", detachTimeout, logPath)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return cmd.Process.Pid, logPath, nil
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	_ "embed" // The dashboard page.
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+//go:embed dashboard.html
+var dashboardPage string
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(dashboardPage))
+
+// dashboardData fills the dashboard page in.
+type dashboardData struct {
+	// Colours maps the statuses to their colour class, see statusColour.
+	Colours       map[string]string
+	RefreshMillis int64
+}
+
+// serveDashboard serves the web page showing the tunnels of the session, with
+// their output and errors and buttons to restart, stop and start them through
+// the HTTP endpoints.
+func serveDashboard(w http.ResponseWriter, r *http.Request, s *Session) {
+	if r.URL.Path != "/" {
+		writeJSON(w, http.StatusNotFound, apiError{Error: "not found"})
+		return
+	}
+	data := dashboardData{
+		Colours:       map[string]string{},
+		RefreshMillis: s.settings.GetRefreshInterval().Milliseconds(),
+	}
+	names := map[string]string{green: "green", red: "red", yellow: "yellow"}
+	for status := Undefined; status <= Scheduled; status++ {
+		if colour := statusColour(status); colour != "" {
+			data.Colours[status.String()] = names[colour]
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	dashboardTemplate.Execute(w, data) //nolint:errcheck // The client went away.
+}
+
+// isDashboardOrigin tells whether the request comes from the dashboard served
+// by the session itself, on a loopback address. Checking the host as well
+// keeps pages using DNS rebinding out.
+func isDashboardOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != r.Host {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
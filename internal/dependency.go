@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"github.com/pkg/errors"
+)
+
+// dependencyIndex maps the names tunnels can be referred to by in depends_on
+// to their indexes. Port ranges can be referred to by their original name, in
+// which case all their sub-forwards are dependencies.
+func dependencyIndex(names []string, groups []string) map[string][]int {
+	index := map[string][]int{}
+	for i := range names {
+		index[names[i]] = append(index[names[i]], i)
+		if groups[i] != "" {
+			index[groups[i]] = append(index[groups[i]], i)
+		}
+	}
+	return index
+}
+
+// checkDependencies makes sure that depends_on only refers to existing tunnels
+// and that there are no cycles.
+func checkDependencies(configs []TunnelConfig) error {
+	names, groups := make([]string, len(configs)), make([]string, len(configs))
+	for i := range configs {
+		names[i], groups[i] = configs[i].Name, configs[i].Group
+	}
+	index := dependencyIndex(names, groups)
+	edges := make([][]int, len(configs))
+	for i := range configs {
+		for _, name := range configs[i].DependsOn {
+			deps, ok := index[name]
+			if !ok {
+				return errors.Errorf("%s: depends on unknown tunnel %s", configs[i].Name, name)
+			}
+			edges[i] = append(edges[i], deps...)
+		}
+	}
+	// Depth first search, a tunnel being visited again before being done
+	// means there is a cycle.
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make([]int, len(configs))
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			return errors.Errorf("%s: circular depends_on", configs[i].Name)
+		case done:
+			return nil
+		}
+		state[i] = visiting
+		for _, j := range edges[i] {
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+		state[i] = done
+		return nil
+	}
+	for i := range configs {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LinkDependencies lets each tunnel know about the tunnels it depends on. Call
+// this before starting them, with the tunnels of a config which passed
+// LoadConfig.
+func LinkDependencies(tunnels []*Tunnel) {
+	index := dependencyIndex(tunnelNames(tunnels))
+	for _, t := range tunnels {
+		t.linkDependencies(tunnels, index)
+	}
+}
+
+// waitingFor returns the first dependency of the tunnel which is not open, nil
+// if there is none. The caller must hold the tunnel lock.
+func (t *Tunnel) waitingFor() *Tunnel {
+	for _, d := range t.dependencies {
+		if s := d.published(); s.status != Open && s.status != Degraded {
+			return d
+		}
+	}
+	return nil
+}
+
+// dependencyReopened returns the first dependency which opened again since the
+// tunnel process was spawned, nil if there is none. The caller must hold the
+// tunnel lock.
+func (t *Tunnel) dependencyReopened() *Tunnel {
+	for _, d := range t.dependencies {
+		if d.published().startedAt.After(t.openingAt) {
+			return d
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const dependentTimeout = 5 * time.Second
+
+// Dependent is a local application relying on a tunnel. Once the tunnel opens
+// again after some downtime the dependent is woken up either with an HTTP
+// request or with a signal sent to the process found in PidFile.
+type Dependent struct {
+	// URL to ping, e.g. "http://localhost:3000/admin/reset-pool".
+	URL string `json:"url"`
+	// Method used for the HTTP ping, defaults to POST.
+	Method string `json:"method"`
+	// PidFile containing the pid of the process to signal.
+	PidFile string `json:"pid_file"`
+	// Signal to send, defaults to HUP.
+	Signal string `json:"signal"`
+}
+
+func (d *Dependent) notify(ctx context.Context) error {
+	if d.URL != "" {
+		return d.ping(ctx)
+	}
+	if d.PidFile != "" {
+		return d.signal()
+	}
+	return errors.New("dependent is missing url or pid_file")
+}
+
+func (d *Dependent) ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, dependentTimeout)
+	defer cancel()
+	method := d.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, method, d.URL, http.NoBody)
+	if err != nil {
+		return errors.Wrapf(err, "creating request for %s", d.URL)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "pinging %s", d.URL)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		return errors.Errorf("pinging %s: unexpected status %d", d.URL, res.StatusCode)
+	}
+	return nil
+}
+
+func (d *Dependent) signal() error {
+	name := strings.TrimPrefix(strings.ToUpper(d.Signal), "SIG")
+	if name == "" {
+		name = "HUP"
+	}
+	sig, ok := signals[name]
+	if !ok {
+		return errors.Errorf("unsupported signal %q", d.Signal)
+	}
+	b, err := os.ReadFile(d.PidFile)
+	if err != nil {
+		return errors.Wrapf(err, "reading pid file %s", d.PidFile)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return errors.Wrapf(err, "parsing pid file %s", d.PidFile)
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return errors.Wrapf(err, "finding process %d", pid)
+	}
+	return errors.Wrapf(p.Signal(sig), "signalling process %d", pid)
+}
+
+// notifyDependents wakes up all the dependents of a tunnel, returning the
+// first error encountered. Every dependent is notified regardless.
+func notifyDependents(ctx context.Context, dependents []Dependent) error {
+	var firstErr error
+	for i := range dependents {
+		if err := dependents[i].notify(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
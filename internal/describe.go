@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	describeDialTimeout = 500 * time.Millisecond
+	toolVersionTimeout  = 5 * time.Second
+)
+
+// toolVersionArgs are the arguments printing the version of the tools tunnels
+// commonly rely on. Other tools are not run, as there is no telling what they
+// would do with a version flag.
+var toolVersionArgs = map[string][]string{
+	"kubectl":     {"version", "--client", "-o", "json"},
+	"ssh":         {"-V"},
+	"aws":         {"--version"},
+	"gcloud":      {"--version"},
+	"cloudflared": {"--version"},
+}
+
+// Description is a normalized and secret-free description of a session, meant
+// to be diffed against the one of a teammate: it is sorted and carries no
+// timestamps nor pids.
+type Description struct {
+	// Tools maps the tools used by the tunnels to their version.
+	Tools    map[string]string   `json:"tools"`
+	Version  string              `json:"version"`
+	Platform string              `json:"platform"`
+	Tunnels  []TunnelDescription `json:"tunnels"`
+}
+
+// TunnelDescription describes a tunnel of a session.
+type TunnelDescription struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Target is where the tunnel goes: the k8s context, namespace, service and
+	// port, or the redacted command of custom tunnels.
+	Target string `json:"target"`
+	// Status tells whether the local port accepts connections.
+	Status string `json:"status"`
+	// Hint is the suggested command to fix a tunnel which cannot work, e.g.
+	// because of a missing binary or context.
+	Hint      string `json:"hint,omitempty"`
+	LocalPort int    `json:"local_port"`
+}
+
+// Describe describes the session of the given config, as seen from the local
+// ports.
+func Describe(ctx context.Context, config *Config) *Description {
+	d := &Description{
+		Version:  Version,
+		Platform: runtime.GOOS + "/" + runtime.GOARCH,
+		Tools:    map[string]string{},
+		Tunnels:  make([]TunnelDescription, 0, len(config.Tunnels)),
+	}
+	var currentContext string
+	var contexts map[string]bool
+	for i := range config.Tunnels {
+		c := &config.Tunnels[i]
+		td := TunnelDescription{
+			Name:      c.Name,
+			Type:      c.GetType(),
+			LocalPort: c.LocalPort,
+			Status:    Close.String(),
+		}
+		if conn, err := net.DialTimeout(c.network(), net.JoinHostPort(c.dialHost(), strconv.Itoa(c.LocalPort)), describeDialTimeout); err == nil {
+			_ = conn.Close()
+			td.Status = Open.String()
+		}
+		switch {
+		case c.K8s != nil:
+			k8sContext := c.K8s.Context
+			if k8sContext == "" {
+				if currentContext == "" {
+					currentContext = kubectlCurrentContext(ctx)
+				}
+				k8sContext = currentContext
+			}
+			td.Target = fmt.Sprintf("%s/%s/%s:%d", k8sContext, c.K8s.Namespace, c.K8s.Service, c.K8s.Port)
+			d.addTool(ctx, "kubectl")
+			if c.K8s.Context != "" {
+				if contexts == nil {
+					contexts = kubectlContexts(ctx)
+				}
+				if len(contexts) > 0 && !contexts[c.K8s.Context] {
+					err := errors.Errorf("context %q does not exist", c.K8s.Context)
+					td.Hint = c.hint(FailureContextNotFound, err)
+				}
+			}
+		case c.Custom != "":
+			args, err := splitCommand(c.Custom)
+			if err != nil {
+				args = strings.Fields(c.Custom)
+			}
+			td.Target = strings.Join(redactArgs(args), " ")
+			if len(args) > 0 && !c.Shell {
+				d.addTool(ctx, filepath.Base(args[0]))
+			}
+		}
+		if args, err := c.getArgs(c.LocalPort); err == nil && td.Hint == "" {
+			if _, err = exec.LookPath(args[0]); err != nil {
+				td.Hint = c.hint(FailureMissingBinary, err)
+			}
+		}
+		d.Tunnels = append(d.Tunnels, td)
+	}
+	sort.Slice(d.Tunnels, func(i, j int) bool {
+		if d.Tunnels[i].Name != d.Tunnels[j].Name {
+			return d.Tunnels[i].Name < d.Tunnels[j].Name
+		}
+		return d.Tunnels[i].LocalPort < d.Tunnels[j].LocalPort
+	})
+	return d
+}
+
+// kubectlContexts returns the names of the contexts kubectl knows about, empty
+// if they cannot be listed.
+func kubectlContexts(ctx context.Context) map[string]bool {
+	ctx, cancel := context.WithTimeout(ctx, toolVersionTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "kubectl", "config", "get-contexts", "-o", "name").Output()
+	contexts := map[string]bool{}
+	if err != nil {
+		return contexts
+	}
+	for _, name := range strings.Fields(string(out)) {
+		contexts[name] = true
+	}
+	return contexts
+}
+
+// addTool records the version of the given tool, if it is a known one.
+//
+//nolint:gosec // I'm happy for now.
+func (d *Description) addTool(ctx context.Context, tool string) {
+	args, ok := toolVersionArgs[tool]
+	if _, done := d.Tools[tool]; !ok || done {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, toolVersionTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, tool, args...).CombinedOutput()
+	if err != nil {
+		d.Tools[tool] = notAvailable
+		return
+	}
+	if tool == "kubectl" {
+		v := struct {
+			ClientVersion struct {
+				GitVersion string `json:"gitVersion"`
+			} `json:"clientVersion"`
+		}{}
+		if json.Unmarshal(out, &v) == nil {
+			d.Tools[tool] = v.ClientVersion.GitVersion
+			return
+		}
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	d.Tools[tool] = strings.TrimSpace(line)
+}
+
+// kubectlCurrentContext returns the current kubectl context, which is what k8s
+// tunnels without a context use.
+func kubectlCurrentContext(ctx context.Context) string {
+	ctx, cancel := context.WithTimeout(ctx, toolVersionTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "kubectl", "config", "current-context").Output()
+	if err != nil {
+		return notAvailable
+	}
+	return strings.TrimSpace(string(out))
+}
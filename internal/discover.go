@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Annotations platform teams can set on services to publish recommended
+// forwards, read by Discover.
+const (
+	// portForwardAnnotation is either "<local_port>" or
+	// "<local_port>:<remote_port>", the remote port defaulting to the first
+	// port of the service.
+	portForwardAnnotation = "tmancer.io/port-forward"
+	// nameAnnotation overrides the tunnel name, which defaults to the service
+	// name.
+	nameAnnotation = "tmancer.io/name"
+)
+
+// DiscoverOptions tells where to look for annotated services.
+type DiscoverOptions struct {
+	// Context is the kubectl context, defaults to the current one.
+	Context string
+	// Namespace restricts the lookup, all namespaces are scanned by default.
+	Namespace string
+}
+
+type serviceList struct {
+	Items []struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+			Name        string            `json:"name"`
+			Namespace   string            `json:"namespace"`
+		} `json:"metadata"`
+		Spec struct {
+			Selector map[string]string `json:"selector"`
+			Type     string            `json:"type"`
+			Ports    []struct {
+				Name     string `json:"name"`
+				Protocol string `json:"protocol"`
+				Port     int    `json:"port"`
+			} `json:"ports"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// listServices returns the services of the namespace, or of all of them if
+// unset.
+//
+//nolint:gosec // I'm happy for now.
+func listServices(ctx context.Context, opts DiscoverOptions) (*serviceList, error) {
+	args := []string{"get", "services", "-o", "json"}
+	if opts.Namespace != "" {
+		args = append(args, "-n", opts.Namespace)
+	} else {
+		args = append(args, "--all-namespaces")
+	}
+	if opts.Context != "" {
+		args = append(args, "--context", opts.Context)
+	}
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, "kubectl", args...)
+	cmd.Stderr = stderr
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing services: %s", strings.TrimSpace(stderr.String()))
+	}
+	list := &serviceList{}
+	if err = json.Unmarshal(b, list); err != nil {
+		return nil, errors.Wrap(err, "unmarshaling services")
+	}
+	return list, nil
+}
+
+// Discover lists the services carrying the port forward annotation and returns
+// the matching k8s tunnel configs, in their json form.
+func Discover(ctx context.Context, opts DiscoverOptions) ([]map[string]interface{}, error) {
+	list, err := listServices(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	tunnels := []map[string]interface{}{}
+	for _, svc := range list.Items {
+		value, ok := svc.Metadata.Annotations[portForwardAnnotation]
+		if !ok {
+			continue
+		}
+		local, remote, hasRemote := strings.Cut(value, ":")
+		localPort, err := strconv.Atoi(strings.TrimSpace(local))
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s/%s: parsing %s", svc.Metadata.Namespace, svc.Metadata.Name, portForwardAnnotation)
+		}
+		var remotePort int
+		switch {
+		case hasRemote:
+			if remotePort, err = strconv.Atoi(strings.TrimSpace(remote)); err != nil {
+				return nil, errors.Wrapf(err, "%s/%s: parsing %s", svc.Metadata.Namespace, svc.Metadata.Name, portForwardAnnotation)
+			}
+		case len(svc.Spec.Ports) > 0:
+			remotePort = svc.Spec.Ports[0].Port
+		default:
+			return nil, errors.Errorf("%s/%s: no remote port", svc.Metadata.Namespace, svc.Metadata.Name)
+		}
+		name := svc.Metadata.Name
+		if n := svc.Metadata.Annotations[nameAnnotation]; n != "" {
+			name = n
+		}
+		k8s := map[string]interface{}{
+			"namespace": svc.Metadata.Namespace,
+			"service":   "svc/" + svc.Metadata.Name,
+			"port":      remotePort,
+		}
+		if opts.Context != "" {
+			k8s["context"] = opts.Context
+		}
+		tunnels = append(tunnels, map[string]interface{}{
+			"name":       name,
+			"local_port": localPort,
+			"k8s":        k8s,
+		})
+	}
+	return tunnels, nil
+}
+
+// UpdateConfig merges discovered tunnels into the config file at path: the
+// fields they set, such as the local port and k8s block, are replaced in the
+// tunnels with the same name, the others are appended. Everything else in the file is kept, formatting
+// aside.
+func UpdateConfig(path string, discovered []map[string]interface{}) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "reading file %s", path)
+	}
+	if err = refuseEncrypted(path, b); err != nil {
+		return err
+	}
+	isArray := bytes.HasPrefix(bytes.TrimSpace(b), []byte("["))
+	doc := map[string]interface{}{}
+	tunnels := []map[string]interface{}{}
+	if isArray {
+		err = json.Unmarshal(b, &tunnels)
+	} else if err = json.Unmarshal(b, &doc); err == nil {
+		if raw, ok := doc["tunnels"]; ok {
+			// Go through json again to get typed tunnels.
+			tb, _ := json.Marshal(raw)
+			err = json.Unmarshal(tb, &tunnels)
+		}
+	}
+	if err != nil {
+		return errors.Wrap(err, "unmarshaling configs")
+	}
+	for _, d := range discovered {
+		found := false
+		for _, t := range tunnels {
+			if t["name"] == d["name"] {
+				for k, v := range d {
+					t[k] = v
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			tunnels = append(tunnels, d)
+		}
+	}
+	var out interface{} = tunnels
+	if !isArray {
+		doc["tunnels"] = tunnels
+		out = doc
+	}
+	if b, err = json.MarshalIndent(out, "", "  "); err != nil {
+		return errors.Wrap(err, "marshaling configs")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrapf(err, "reading file %s", path)
+	}
+	return errors.Wrapf(os.WriteFile(path, append(b, '\n'), info.Mode()), "writing file %s", path)
+}
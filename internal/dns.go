@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DNS wire format constants, see RFC 1035.
+const (
+	dnsHeaderLen   = 12
+	dnsTypeA       = 1
+	dnsTypeTXT     = 16
+	dnsTypeANY     = 255
+	dnsClassIN     = 1
+	dnsRcodeNX     = 3
+	dnsRcodeFormat = 1
+	dnsTTL         = 5
+	dnsSuffix      = ".tunnel."
+	dnsMaxPacket   = 512
+)
+
+// StartDNS starts a tiny DNS stub listening on the given UDP address. It
+// answers "<name>.tunnel" queries with an A record pointing to the address the
+// tunnel listens on (127.0.0.1 by default) and a TXT record
+// "port=<local_port>", so that scripts can discover tunnel endpoints without
+// editing the hosts file. The aliases of the tunnels are answered too. It
+// stops once ctx is done.
+func StartDNS(ctx context.Context, addr string, configs []TunnelConfig) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "listening for dns on %s", addr)
+	}
+	endpoints := map[string]dnsEndpoint{}
+	for i := range configs {
+		e := dnsEndpoint{ip: net.IPv4(127, 0, 0, 1).To4(), port: configs[i].LocalPort}
+		if ip := net.ParseIP(configs[i].dialHost()).To4(); ip != nil {
+			e.ip = ip
+		}
+		endpoints[strings.ToLower(configs[i].Name)+dnsSuffix] = e
+		if configs[i].Alias != "" {
+			endpoints[strings.ToLower(configs[i].Alias)+"."] = e
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go func() {
+		buf := make([]byte, dnsMaxPacket)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				// Closed.
+				return
+			}
+			if res := answerDNS(buf[:n], endpoints); res != nil {
+				conn.WriteTo(res, from) //nolint:errcheck // Best effort, clients retry.
+			}
+		}
+	}()
+	return nil
+}
+
+// dnsEndpoint is what a tunnel name resolves to.
+type dnsEndpoint struct {
+	ip   net.IP
+	port int
+}
+
+// answerDNS builds the response to a DNS query, nil if the query is too
+// malformed to be answered at all.
+func answerDNS(query []byte, endpoints map[string]dnsEndpoint) []byte {
+	if len(query) < dnsHeaderLen {
+		return nil
+	}
+	res := make([]byte, dnsHeaderLen, dnsMaxPacket)
+	copy(res, query[:2]) // Id.
+	// QR and AA set, RD copied from the query.
+	res[2] = 0x84 | query[2]&0x01
+	qdcount := binary.BigEndian.Uint16(query[4:6])
+	name, end, ok := parseDNSName(query, dnsHeaderLen)
+	if qdcount != 1 || !ok || end+4 > len(query) {
+		res[3] = dnsRcodeFormat
+		return res
+	}
+	qtype := binary.BigEndian.Uint16(query[end : end+2])
+	// Echo the question.
+	binary.BigEndian.PutUint16(res[4:6], 1)
+	res = append(res, query[dnsHeaderLen:end+4]...)
+	e, found := endpoints[strings.ToLower(name)]
+	if !found {
+		res[3] = dnsRcodeNX
+		return res
+	}
+	answers := uint16(0)
+	if qtype == dnsTypeA || qtype == dnsTypeANY {
+		res = appendDNSRecord(res, dnsTypeA, e.ip)
+		answers++
+	}
+	if qtype == dnsTypeTXT || qtype == dnsTypeANY {
+		txt := "port=" + strconv.Itoa(e.port)
+		res = appendDNSRecord(res, dnsTypeTXT, append([]byte{byte(len(txt))}, txt...))
+		answers++
+	}
+	binary.BigEndian.PutUint16(res[6:8], answers)
+	return res
+}
+
+// appendDNSRecord appends a resource record for the question name.
+func appendDNSRecord(b []byte, rtype uint16, data []byte) []byte {
+	// Pointer to the question name, right after the header.
+	rr := make([]byte, 12)
+	rr[0], rr[1] = 0xc0, dnsHeaderLen
+	binary.BigEndian.PutUint16(rr[2:4], rtype)
+	binary.BigEndian.PutUint16(rr[4:6], dnsClassIN)
+	binary.BigEndian.PutUint32(rr[6:10], dnsTTL)
+	binary.BigEndian.PutUint16(rr[10:12], uint16(len(data)))
+	return append(append(b, rr...), data...)
+}
+
+// parseDNSName reads an uncompressed name starting at off, returning it in its
+// fully qualified form along with the offset right after it.
+func parseDNSName(b []byte, off int) (name string, end int, ok bool) {
+	labels := []string{}
+	for off < len(b) {
+		l := int(b[off])
+		off++
+		if l == 0 {
+			return strings.Join(labels, ".") + ".", off, true
+		}
+		// Compression is not expected in questions.
+		if l > 63 || off+l > len(b) {
+			return "", 0, false
+		}
+		labels = append(labels, string(b[off:off+l]))
+		off += l
+	}
+	return "", 0, false
+}
@@ -0,0 +1,299 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	doctorTimeout = 10 * time.Second
+	// doctorParallelism is how many checks run at once, most of them being
+	// kubectl calls.
+	doctorParallelism = 8
+	// doctorTunnels is how many tunnels relying on a check are named in the
+	// text report.
+	doctorTunnels = 3
+)
+
+// Phases of the doctor checks, a check only running once the one it depends
+// on, from an earlier phase, passed.
+const (
+	phaseLocal = iota
+	phaseNamespace
+	phaseService
+)
+
+// DoctorCheck is the outcome of checking a prerequisite of a config.
+type DoctorCheck struct {
+	// Check is what was checked, e.g. "binary kubectl" or "port 5432".
+	Check string `json:"check"`
+	// Error tells why the check failed, empty if it passed.
+	Error string `json:"error,omitempty"`
+	// Hint is the suggested command to fix the failure, if any.
+	Hint string `json:"hint,omitempty"`
+	// Tunnels are the tunnels relying on what was checked.
+	Tunnels []string `json:"tunnels"`
+	OK      bool     `json:"ok"`
+}
+
+// DoctorReport is the result of checking that a config can be started: the
+// binaries the tunnels run exist, the k8s contexts are reachable, the
+// namespaces and services exist and the local ports are free. Checks which
+// depend on a failed one, e.g. the services of an unreachable context, are
+// left out.
+type DoctorReport struct {
+	Checks []DoctorCheck `json:"checks"`
+	OK     bool          `json:"ok"`
+}
+
+// doctorCheck is a check to run, shared by the tunnels relying on the same
+// prerequisite.
+type doctorCheck struct {
+	// run returns why the check failed and a hint to fix it.
+	run       func(ctx context.Context) (string, error)
+	dependsOn *doctorCheck
+	result    DoctorCheck
+	phase     int
+	skipped   bool
+}
+
+// doctor collects the checks of a config, in the order they are reported.
+type doctor struct {
+	byName map[string]*doctorCheck
+	checks []*doctorCheck
+}
+
+// Doctor checks the prerequisites of the tunnels of the config, see
+// DoctorReport.
+func Doctor(ctx context.Context, config *Config) *DoctorReport {
+	d := &doctor{byName: map[string]*doctorCheck{}}
+	configs := append(append([]TunnelConfig(nil), config.Tunnels...), config.namespaces...)
+	for i := range configs {
+		d.addBinaries(&configs[i])
+	}
+	for i := range configs {
+		d.addK8s(&configs[i])
+	}
+	for i := range configs {
+		c := &configs[i]
+		if c.LocalPort == 0 {
+			continue
+		}
+		name := fmt.Sprintf("port %d", c.LocalPort)
+		if c.Bind != "" {
+			name = "port " + net.JoinHostPort(c.Bind, strconv.Itoa(c.LocalPort))
+		}
+		d.add(name, c.Name, phaseLocal, nil, c.checkPort)
+	}
+	for phase := phaseLocal; phase <= phaseService; phase++ {
+		d.run(ctx, phase)
+	}
+	r := &DoctorReport{Checks: []DoctorCheck{}, OK: true}
+	for _, c := range d.checks {
+		if c.skipped {
+			continue
+		}
+		r.Checks = append(r.Checks, c.result)
+		r.OK = r.OK && c.result.OK
+	}
+	return r
+}
+
+// add adds a check unless it was already added, in which case the tunnel is
+// added to the ones relying on it.
+func (d *doctor) add(name, tunnel string, phase int, dependsOn *doctorCheck, run func(context.Context) (string, error)) *doctorCheck {
+	if c, ok := d.byName[name]; ok {
+		c.result.Tunnels = append(c.result.Tunnels, tunnel)
+		return c
+	}
+	c := &doctorCheck{
+		run:       run,
+		dependsOn: dependsOn,
+		phase:     phase,
+		result:    DoctorCheck{Check: name, Tunnels: []string{tunnel}},
+	}
+	d.byName[name] = c
+	d.checks = append(d.checks, c)
+	return c
+}
+
+// run runs the checks of the given phase, a few at a time.
+func (d *doctor) run(ctx context.Context, phase int) {
+	wg := sync.WaitGroup{}
+	slots := make(chan struct{}, doctorParallelism)
+	for _, c := range d.checks {
+		if c.phase != phase {
+			continue
+		}
+		if dep := c.dependsOn; dep != nil && (dep.skipped || !dep.result.OK) {
+			c.skipped = true
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(c *doctorCheck) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+			defer cancel()
+			hint, err := c.run(ctx)
+			c.result.OK = err == nil
+			if err != nil {
+				c.result.Error, c.result.Hint = err.Error(), hint
+			}
+		}(c)
+	}
+	wg.Wait()
+}
+
+// addBinaries adds the checks of the executables the tunnel runs, its own
+// command as well as its hooks, health check and the like.
+func (d *doctor) addBinaries(c *TunnelConfig) {
+	var executables []string
+	switch {
+	case c.K8sNamespace != nil:
+		executables = append(executables, "kubectl")
+	case c.Dynamic != "":
+		// The command is only known once the dynamic command runs, whose
+		// executable is checked with the other commands below.
+	default:
+		cmd, err := c.getCommand(c.LocalPort)
+		if err != nil {
+			d.add("command of "+c.Name, c.Name, phaseLocal, nil, func(context.Context) (string, error) {
+				return "", err
+			})
+			return
+		}
+		executables = append(executables, cmd.Args[0])
+	}
+	commands := c.commands()
+	fields := make([]string, 0, len(commands))
+	for field := range commands {
+		if field != "custom" {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if args, err := splitCommand(commands[field]); err == nil {
+			executables = append(executables, args[0])
+		}
+	}
+	for _, executable := range executables {
+		path := executable
+		if strings.Contains(path, "/") && !filepath.IsAbs(path) {
+			// Relative to the directory the command runs in.
+			path = filepath.Join(c.Dir, path)
+		}
+		d.add("binary "+executable, c.Name, phaseLocal, nil, func(context.Context) (string, error) {
+			if _, err := exec.LookPath(path); err != nil {
+				return c.hint(FailureMissingBinary, err), errors.New("not found in PATH")
+			}
+			return "", nil
+		})
+	}
+}
+
+// addK8s adds the checks of the context, namespace and service k8s tunnels
+// forward, each one only running if the previous one passed.
+func (d *doctor) addK8s(c *TunnelConfig) {
+	var k8sContext, namespace, service string
+	switch {
+	case c.K8s != nil:
+		k8sContext, namespace, service = c.K8s.Context, c.K8s.Namespace, c.K8s.Service
+	case c.K8sNamespace != nil:
+		k8sContext, namespace = c.K8sNamespace.Context, c.K8sNamespace.Namespace
+	default:
+		return
+	}
+	name := k8sContext
+	if name == "" {
+		name = "(current)"
+	}
+	contextCheck := d.add("context "+name, c.Name, phaseLocal, nil, func(ctx context.Context) (string, error) {
+		return c.kubectlCheck(ctx, k8sContext, "version", "-o", "json")
+	})
+	if namespace == "" {
+		return
+	}
+	namespaceCheck := d.add(fmt.Sprintf("namespace %s/%s", name, namespace), c.Name, phaseNamespace, contextCheck, func(ctx context.Context) (string, error) {
+		return c.kubectlCheck(ctx, k8sContext, "get", "namespace", namespace, "-o", "name")
+	})
+	if service == "" {
+		return
+	}
+	d.add(fmt.Sprintf("service %s/%s/%s", name, namespace, service), c.Name, phaseService, namespaceCheck, func(ctx context.Context) (string, error) {
+		return c.kubectlCheck(ctx, k8sContext, "get", "-n", namespace, service, "-o", "name")
+	})
+}
+
+// kubectlCheck runs kubectl with the given arguments, on the given context if
+// set, and returns its error message and a hint if it fails.
+//
+//nolint:gosec // I'm happy for now.
+func (c *TunnelConfig) kubectlCheck(ctx context.Context, k8sContext string, args ...string) (string, error) {
+	if k8sContext != "" {
+		args = append(args, "--context", k8sContext)
+	}
+	args = append(args, "--request-timeout", "5s")
+	out, err := exec.CommandContext(ctx, "kubectl", args...).CombinedOutput()
+	if err == nil {
+		return "", nil
+	}
+	// The last line is the most telling one, e.g. after the client version.
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if msg := strings.TrimSpace(lines[len(lines)-1]); msg != "" {
+		err = errors.New(msg)
+	}
+	return c.hint(classifyFailure(Error, err), err), err
+}
+
+// checkPort returns why the local port of the tunnel cannot be listened on,
+// telling which process holds it.
+func (c *TunnelConfig) checkPort(context.Context) (string, error) {
+	if canListen(c.network(), c.listenHosts(), c.LocalPort) {
+		return "", nil
+	}
+	err := errors.New("in use")
+	if holder := portHolder(c.network(), c.listenBind(), c.LocalPort); holder != "" {
+		err = errors.Errorf("in use, %s", holder)
+	}
+	return c.hint(FailurePortBusy, err), err
+}
+
+// WriteText prints the report for humans, one line per check.
+func (r *DoctorReport) WriteText(w io.Writer) {
+	failed := 0
+	for i := range r.Checks {
+		c := &r.Checks[i]
+		tunnels := c.Tunnels
+		if len(tunnels) > doctorTunnels {
+			tunnels = append(tunnels[:doctorTunnels:doctorTunnels], fmt.Sprintf("+%d", len(c.Tunnels)-doctorTunnels))
+		}
+		if c.OK {
+			fmt.Fprintf(w, "ok    %s (%s)\n", c.Check, strings.Join(tunnels, ", "))
+			continue
+		}
+		failed++
+		fmt.Fprintf(w, "FAIL  %s (%s): %s\n", c.Check, strings.Join(tunnels, ", "), c.Error)
+		if c.Hint != "" {
+			fmt.Fprintf(w, "      try: %s\n", c.Hint)
+		}
+	}
+	if failed == 0 {
+		fmt.Fprintf(w, "All %d checks passed\n", len(r.Checks))
+		return
+	}
+	fmt.Fprintf(w, "%d of %d checks failed\n", failed, len(r.Checks))
+}
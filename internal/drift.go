@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// driftPollInterval is how often the config files tunnels rely on are checked.
+const driftPollInterval = 5 * time.Second
+
+// kubeconfigPaths returns the kubeconfig files kubectl reads.
+func kubeconfigPaths() []string {
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		return filepath.SplitList(env)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	return []string{filepath.Join(home, ".kube", "config")}
+}
+
+// configFiles returns the kubeconfig and ssh config files the tunnel command
+// reads, whose changes only apply once it is restarted.
+func (c *TunnelConfig) configFiles() []string {
+	if c.K8s != nil {
+		return kubeconfigPaths()
+	}
+	if c.Custom == "" || c.Shell {
+		return nil
+	}
+	args, err := splitCommand(c.Custom)
+	if err != nil || len(args) == 0 {
+		return nil
+	}
+	// flagValue returns the value of the given flag, if set.
+	flagValue := func(name string) string {
+		for i, a := range args {
+			if a == name && i+1 < len(args) {
+				return args[i+1]
+			}
+			if strings.HasPrefix(a, name+"=") {
+				return strings.TrimPrefix(a, name+"=")
+			}
+		}
+		return ""
+	}
+	switch filepath.Base(args[0]) {
+	case "kubectl":
+		if path := flagValue("--kubeconfig"); path != "" {
+			return []string{path}
+		}
+		return kubeconfigPaths()
+	case "ssh":
+		if path := flagValue("-F"); path != "" {
+			return []string{path}
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		return []string{filepath.Join(home, ".ssh", "config")}
+	}
+	return nil
+}
+
+// fileStamp tells whether a file changed, without reading it.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampFile(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// WatchConfigFiles polls the config files the tunnels of the session rely on
+// and flags the running tunnels whose files changed as ConfigDrift. If
+// interactive, the warning tells that pressing r restarts them, see
+// RestartDrifted.
+func WatchConfigFiles(ctx context.Context, s *Session, interactive bool) {
+	stamps := map[string]fileStamp{}
+	hint := "restart it to apply"
+	if interactive {
+		hint = "press r to restart"
+	}
+	ticker := time.NewTicker(driftPollInterval)
+	defer ticker.Stop()
+	for {
+		// Tunnels come and go with tmancer ctl add and remove.
+		watched := map[string][]*Tunnel{}
+		for _, t := range s.Tunnels() {
+			for _, path := range t.published().config.configFiles() {
+				watched[path] = append(watched[path], t)
+			}
+		}
+		for path, tunnels := range watched {
+			current := stampFile(path)
+			stamp, ok := stamps[path]
+			stamps[path] = current
+			if !ok || current == stamp {
+				continue
+			}
+			for _, t := range tunnels {
+				t.Lock()
+				switch t.status {
+				case Open, Opening, Degraded:
+					t.drift = fmt.Sprintf("ConfigDrift: %s changed, %s", path, hint)
+				}
+				t.Unlock()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetDirs returns the config directories the config was loaded from, see
+// WatchConfigDirs.
+func (c *Config) GetDirs() []string {
+	return c.dirs
+}
+
+// dirFiles returns the stamps of the json files of the config directories, by
+// path.
+func dirFiles(dirs []string) (map[string]fileStamp, error) {
+	stamps := map[string]fileStamp{}
+	for _, dir := range dirs {
+		files, err := tunnelFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range files {
+			stamps[path] = stampFile(path)
+		}
+	}
+	return stamps, nil
+}
+
+// dirFileNames returns the names of the tunnels defined by the files of the
+// config directories, by path.
+func dirFileNames(stamps map[string]fileStamp) map[string]string {
+	names := make(map[string]string, len(stamps))
+	for path := range stamps {
+		tunnel := map[string]interface{}{}
+		if b, err := readConfigFile(path); err == nil {
+			unmarshalConfig(path, b, &tunnel) //nolint:errcheck // Named after the file then.
+		}
+		names[path] = dirTunnelName(path, tunnel)
+	}
+	return names
+}
+
+// WatchConfigDirs polls the config directories, see Config.GetDirs, and
+// removes the tunnels of the files removed from them and adds the ones of
+// the files added, through the session. The tunnels of the files which
+// changed are replaced. The config is read again with load, the changes
+// being left for the next poll if it fails, e.g. while a file is half
+// written. Added tunnels are not reviewed, see Session.Add. It returns when
+// ctx is done.
+func WatchConfigDirs(ctx context.Context, s *Session, dirs []string, load func() (*Config, error)) {
+	if len(dirs) == 0 {
+		return
+	}
+	stamps, err := dirFiles(dirs)
+	if err != nil {
+		return
+	}
+	names := dirFileNames(stamps)
+	ticker := time.NewTicker(driftPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current, err := dirFiles(dirs)
+		if err != nil {
+			continue
+		}
+		var removed, added []string
+		for path, stamp := range stamps {
+			if now, ok := current[path]; !ok || now != stamp {
+				removed = append(removed, path)
+			}
+		}
+		for path, stamp := range current {
+			if before, ok := stamps[path]; !ok || before != stamp {
+				added = append(added, path)
+			}
+		}
+		if len(removed) == 0 && len(added) == 0 {
+			continue
+		}
+		config, err := load()
+		if err != nil {
+			continue
+		}
+		for _, path := range removed {
+			s.Remove(names[path]) //nolint:errcheck // Left running if others depend on it.
+		}
+		currentNames := dirFileNames(current)
+		for _, path := range added {
+			name := currentNames[path]
+			// The sub-forwards of a port range share the name as group.
+			for _, c := range config.Tunnels {
+				if c.Name == name || c.Group == name {
+					s.Add(c, false) //nolint:errcheck // Tried again once the file changes.
+				}
+			}
+		}
+		stamps, names = current, currentNames
+	}
+}
+
+// RestartDrifted restarts the tunnels flagged as ConfigDrift, so that they
+// pick up the new config. It takes the tunnel locks.
+func RestartDrifted(tunnels []*Tunnel) {
+	for _, t := range tunnels {
+		t.Lock()
+		if t.drift != "" {
+			t.drift = ""
+			t.killFor(errors.New("restarted after config change"))
+		}
+		t.Unlock()
+	}
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DryRun prints the command each tunnel of the config would run, with its
+// local port, directory and the other commands it relies on, without running
+// anything. Secrets are left as placeholders since reading them may need
+// running commands, and the tunnels picking a free port show port 0 since it
+// is only picked when starting. It fails if a command cannot be built.
+func (c *Config) DryRun(w io.Writer) error {
+	failed := 0
+	for i := range c.Tunnels {
+		if !c.Tunnels[i].dryRun(w) {
+			failed++
+		}
+	}
+	for i := range c.namespaces {
+		t := &c.namespaces[i]
+		fmt.Fprintf(w, "%s (k8s_namespace)\n", t.Name)
+		fmt.Fprintf(w, "  forwards every service of namespace %s, listed when the session starts\n", t.K8sNamespace.Namespace)
+	}
+	if failed > 0 {
+		return errors.Errorf("%d command(s) could not be built", failed)
+	}
+	return nil
+}
+
+// dryRun prints what the tunnel would run and tells whether its command could
+// be built.
+func (c *TunnelConfig) dryRun(w io.Writer) bool {
+	if c.LocalPort == 0 {
+		fmt.Fprintf(w, "%s (%s, free port picked when starting)\n", c.Name, c.GetType())
+	} else {
+		fmt.Fprintf(w, "%s (%s, port %d)\n", c.Name, c.GetType(), c.LocalPort)
+	}
+	ok := true
+	if c.Dynamic != "" {
+		fmt.Fprintf(w, "  command printed by: %s\n", c.Dynamic)
+	} else if cmd, err := c.getCommand(c.LocalPort); err != nil {
+		fmt.Fprintf(w, "  error: %s\n", err)
+		ok = false
+	} else {
+		fmt.Fprintf(w, "  %s\n", joinCommand(cmd.Args))
+		if cmd.Dir != "" {
+			fmt.Fprintf(w, "  in %s\n", cmd.Dir)
+		}
+		if c.Sandbox != nil {
+			names := make([]string, 0, len(cmd.Env))
+			for _, kv := range cmd.Env {
+				name, _, _ := strings.Cut(kv, "=")
+				names = append(names, name)
+			}
+			fmt.Fprintf(w, "  environment: %s\n", strings.Join(names, " "))
+		}
+	}
+	commands := c.commands()
+	fields := make([]string, 0, len(commands))
+	for field := range commands {
+		if field != "custom" && field != "dynamic" {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		fmt.Fprintf(w, "  %s: %s\n", field, commands[field])
+	}
+	return ok
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// dynamicTimeout caps the dynamic command of a tunnel, which usually queries
+// some service discovery.
+const dynamicTimeout = 30 * time.Second
+
+// dynamicOutput is what dynamic commands can print instead of a plain command
+// line, when the port is only known at runtime too.
+type dynamicOutput struct {
+	Command string `json:"command"`
+	// Port replaces {{remote_port}} in the command.
+	Port int `json:"port"`
+}
+
+// resolveDynamic runs the dynamic command of the tunnel and returns the tunnel
+// command it printed, either as a plain command line or as a dynamicOutput.
+//
+//nolint:gosec // The command comes from the config.
+func (c *TunnelConfig) resolveDynamic(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dynamicTimeout)
+	defer cancel()
+	parts, err := splitCommand(c.Dynamic)
+	if err != nil {
+		return "", errors.Wrap(err, "dynamic")
+	}
+	cmd := exec.CommandContext(ctx, parts[0], parts[1:]...)
+	cmd.Dir = c.Dir
+	cmd.Env = append(os.Environ(),
+		"TMANCER_TUNNEL="+c.Name,
+		"TMANCER_LOCAL_PORT="+strconv.Itoa(c.LocalPort),
+	)
+	b, err := c.auditFor("dynamic", "").output(cmd)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			err = errors.Wrap(err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", errors.Wrap(err, "running dynamic command")
+	}
+	out := strings.TrimSpace(string(b))
+	if strings.HasPrefix(out, "{") {
+		o := dynamicOutput{}
+		if err = json.Unmarshal([]byte(out), &o); err != nil {
+			return "", errors.Wrap(err, "parsing dynamic command output")
+		}
+		out = o.Command
+		if o.Port != 0 {
+			out = strings.ReplaceAll(out, remotePortPlaceholder, strconv.Itoa(o.Port))
+		}
+	}
+	if out == "" {
+		return "", errors.New("the dynamic command printed no command")
+	}
+	return out, nil
+}
@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ageHeaders start the files encrypted with age, binary or armored.
+var ageHeaders = [][]byte{
+	[]byte("age-encryption.org/v1"),
+	[]byte("-----BEGIN AGE ENCRYPTED FILE-----"),
+}
+
+// readPlainFile reads the file at path, decrypted in memory if it was
+// encrypted with sops or age: the plain text never goes to disk.
+func readPlainFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading file %s", path)
+	}
+	switch {
+	case isAgeEncrypted(b):
+		identity, err := ageIdentity()
+		if err != nil {
+			return nil, err
+		}
+		b, err = decrypt(path, "age", "--decrypt", "--identity", identity, path)
+		if err != nil {
+			return nil, err
+		}
+	case isSopsEncrypted(b):
+		if b, err = decrypt(path, "sops", "--decrypt", "--input-type", "json", "--output-type", "json", path); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// isEncrypted tells whether the content of a config file is encrypted.
+func isEncrypted(b []byte) bool {
+	return isAgeEncrypted(b) || isSopsEncrypted(b)
+}
+
+func isAgeEncrypted(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	for _, header := range ageHeaders {
+		if bytes.HasPrefix(b, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSopsEncrypted tells whether b is a json document encrypted by sops, which
+// keeps its metadata under a top-level "sops" key.
+func isSopsEncrypted(b []byte) bool {
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		return false
+	}
+	var doc struct {
+		Sops *struct {
+			Mac string `json:"mac"`
+		} `json:"sops"`
+	}
+	return json.Unmarshal(b, &doc) == nil && doc.Sops != nil && doc.Sops.Mac != ""
+}
+
+// ageIdentity returns the age identity file: TMANCER_AGE_IDENTITY, else the
+// one of sops, SOPS_AGE_KEY_FILE or ~/.config/sops/age/keys.txt.
+func ageIdentity() (string, error) {
+	for _, env := range []string{"TMANCER_AGE_IDENTITY", "SOPS_AGE_KEY_FILE"} {
+		if path := os.Getenv(env); path != "" {
+			return path, nil
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "getting home directory")
+	}
+	return filepath.Join(home, ".config", "sops", "age", "keys.txt"), nil
+}
+
+// decrypt returns the output of the decryption command, telling its error
+// output if it fails.
+func decrypt(path string, args ...string) ([]byte, error) {
+	cmd := exec.Command(args[0], args[1:]...) //nolint:gosec // Fixed commands.
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	b, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = errors.Wrap(err, msg)
+		}
+		return nil, errors.Wrapf(err, "decrypting %s with %s", path, args[0])
+	}
+	return b, nil
+}
+
+// refuseEncrypted returns an error if the config file content b is
+// encrypted, tmancer only ever reading those.
+func refuseEncrypted(path string, b []byte) error {
+	if isEncrypted(b) {
+		return errors.Errorf("%s is encrypted, edit it with sops or age instead", path)
+	}
+	return nil
+}
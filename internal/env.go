@@ -2,3 +2,7 @@ package internal
 
 // Version of the program, set at linking time if makefile is used.
 var Version = "n/a"
+
+// ReleasePublicKey is the minisign public key the releases are signed with,
+// set at linking time if makefile is used. Self-update is refused without it.
+var ReleasePublicKey = ""
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// envFilePollInterval is how often the env file is brought up to date with
+// the tunnels of the session.
+const envFilePollInterval = 2 * time.Second
+
+// WriteEnvFile writes the PortEnv variables of the tunnels to a dotenv file,
+// for direnv and other processes to find the free ports tmancer picked. A
+// leading ~ stands for the user's home. The returned function removes the
+// file, the ports being meaningless once the session is over.
+func WriteEnvFile(path string, configs []TunnelConfig) (func(), error) {
+	path, err := envFilePath(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, errors.Wrap(err, "creating env file directory")
+	}
+	if err = writeEnvFile(path, PortEnv(configs)); err != nil {
+		return nil, err
+	}
+	return func() {
+		os.Remove(path) //nolint:errcheck // Nothing to do about it.
+	}, nil
+}
+
+// envFilePath expands the leading ~ of path, if any.
+func envFilePath(path string) (string, error) {
+	if rest := strings.TrimPrefix(path, "~/"); rest != path {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", errors.Wrap(err, "getting home directory")
+		}
+		path = filepath.Join(home, rest)
+	}
+	return path, nil
+}
+
+// writeEnvFile replaces the env file at path with the given variables.
+func writeEnvFile(path string, env []string) error {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "# Written by tmancer (pid %d), removed once the session is over.\n", os.Getpid())
+	for _, v := range env {
+		fmt.Fprintln(b, v)
+	}
+	// Readers must never see a half written file.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o600); err != nil {
+		return errors.Wrap(err, "writing env file")
+	}
+	return errors.Wrap(os.Rename(tmp, path), "writing env file")
+}
+
+// WatchEnvFile keeps the env file written by WriteEnvFile up to date as
+// tunnels are added, removed or rebound to another port. It returns when ctx
+// is done.
+func WatchEnvFile(ctx context.Context, path string, s *Session) {
+	path, err := envFilePath(path)
+	if err != nil {
+		return
+	}
+	var last string
+	ticker := time.NewTicker(envFilePollInterval)
+	defer ticker.Stop()
+	for {
+		env := TunnelEnv(s.Tunnels())
+		if current := strings.Join(env, "\n"); current != last && writeEnvFile(path, env) == nil {
+			last = current
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
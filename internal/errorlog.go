@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errorLogSize is the number of errors kept per tunnel.
+const errorLogSize = 20
+
+// TunnelError is an error a tunnel failed with. It is kept in full, the table
+// only having room for the start of its first line.
+type TunnelError struct {
+	Time   time.Time `json:"time"`
+	Status string    `json:"status"`
+	Error  string    `json:"error"`
+}
+
+// recordError adds the error of the tunnel to its latest errors, unless it
+// was already added, e.g. when the tunnel reopens. The caller must hold the
+// tunnel lock.
+func (t *Tunnel) recordError(now time.Time) {
+	if t.err == nil || t.err == t.recordedErr || t.status == Open {
+		return
+	}
+	t.recordedErr = t.err
+	t.errorLog = append(t.errorLog, TunnelError{Time: now, Status: t.status.String(), Error: t.err.Error()})
+	if len(t.errorLog) > errorLogSize {
+		t.errorLog = t.errorLog[len(t.errorLog)-errorLogSize:]
+	}
+}
+
+// GetErrors returns the latest errors of the tunnel, oldest first.
+func (t *Tunnel) GetErrors() []TunnelError {
+	return t.published().errorLog
+}
+
+// mergeErrors returns the latest errors of the forwards of a port range,
+// oldest first.
+func mergeErrors(forwards []TunnelSnapshot) []TunnelError {
+	var merged []TunnelError
+	for i := range forwards {
+		merged = append(merged, forwards[i].Errors...)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Time.Before(merged[j].Time)
+	})
+	if len(merged) > errorLogSize {
+		merged = merged[len(merged)-errorLogSize:]
+	}
+	return merged
+}
+
+// errorLines describes the errors in full, each one under the time it
+// happened at, e.g.:
+//
+//	14:32:05  Error
+//	  error: unable to forward port because pod is not running. Current status=Pending
+func errorLines(errs []TunnelError, formats Formats, width int) []string {
+	var lines []string
+	for _, e := range errs {
+		lines = append(lines, fmt.Sprintf("%s  %s", formats.FormatTime(e.Time), e.Status))
+		for _, line := range strings.Split(strings.TrimSpace(e.Error), "\n") {
+			lines = append(lines, wrapLine("  "+line, "  ", width)...)
+		}
+	}
+	return lines
+}
+
+// wrapLine splits the line into lines of at most width characters, the
+// continuation lines starting with indent. 0 means no limit.
+func wrapLine(line, indent string, width int) []string {
+	runes := []rune(line)
+	if width <= len(indent) || len(runes) <= width {
+		return []string{line}
+	}
+	lines := []string{string(runes[:width])}
+	step := width - len(indent)
+	for runes = runes[width:]; len(runes) > 0; {
+		n := step
+		if n > len(runes) {
+			n = len(runes)
+		}
+		lines = append(lines, indent+string(runes[:n]))
+		runes = runes[n:]
+	}
+	return lines
+}
+
+// ControlErrors prints the latest errors of a tunnel of the running session
+// in full.
+func ControlErrors(ctx context.Context, w io.Writer, name string) error {
+	var errs []TunnelError
+	if err := controlRequest(ctx, http.MethodGet, "/tunnels/"+url.PathEscape(name)+"/errors", &errs); err != nil {
+		return err
+	}
+	if len(errs) == 0 {
+		fmt.Fprintf(w, "No error for %s yet\n", name)
+		return nil
+	}
+	formats := Formats{Timestamp: "2006-01-02 15:04:05"}
+	for i := range errs {
+		errs[i].Time = errs[i].Time.Local()
+	}
+	for _, line := range errorLines(errs, formats, 0) {
+		fmt.Fprintln(w, line)
+	}
+	return nil
+}
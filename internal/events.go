@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// eventLogSize is the number of status changes kept in memory.
+const eventLogSize = 500
+
+// EventLog keeps the latest status changes of the tunnels of a session, so
+// that what happened can be looked at after the table has moved on.
+type EventLog struct {
+	events []HistoryEvent
+	m      sync.Mutex
+}
+
+// SetEventLog makes the tunnel add its status changes to the given log, shared
+// by all the tunnels of a session. Call this before Start.
+func (t *Tunnel) SetEventLog(l *EventLog) {
+	t.events = l
+}
+
+func (l *EventLog) add(e *HistoryEvent) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.events = append(l.events, *e)
+	if len(l.events) > eventLogSize {
+		l.events = l.events[len(l.events)-eventLogSize:]
+	}
+}
+
+// list returns the status changes, oldest first.
+func (l *EventLog) list() []HistoryEvent {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return append([]HistoryEvent(nil), l.events...)
+}
+
+// getEvents returns the status changes of the session the tunnels belong to.
+func getEvents(tunnels []*Tunnel) []HistoryEvent {
+	for _, t := range tunnels {
+		if t.events != nil {
+			return t.events.list()
+		}
+	}
+	return nil
+}
+
+// eventLine describes a status change on a single line, e.g.
+// "14:32:05  db  Error: connection reset".
+func eventLine(e *HistoryEvent, formats Formats) string {
+	line := fmt.Sprintf("%s  %s  %s", formats.FormatTime(e.Time), e.Tunnel, e.Status)
+	if e.Error != "" {
+		line += ": " + strings.SplitN(strings.TrimSpace(e.Error), "\n", 2)[0]
+	}
+	return line
+}
+
+// ControlEvents prints the last n status changes of the running session.
+func ControlEvents(ctx context.Context, w io.Writer, n int) error {
+	var events []HistoryEvent
+	if err := controlRequest(ctx, http.MethodGet, "/events", &events); err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		fmt.Fprintln(w, "No status change yet")
+		return nil
+	}
+	if n > 0 && len(events) > n {
+		events = events[len(events)-n:]
+	}
+	formats := Formats{Timestamp: "2006-01-02 15:04:05"}
+	for i := range events {
+		events[i].Time = events[i].Time.Local()
+		fmt.Fprintln(w, eventLine(&events[i], formats))
+	}
+	return nil
+}
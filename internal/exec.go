@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// Exec runs args inside the target of the k8s tunnel with the given name,
+// using kubectl exec with the same context and namespace as the tunnel. The
+// command is wired to the standard streams and its exit code is returned.
+//
+//nolint:gosec // I'm happy for now.
+func Exec(config *Config, name string, args []string) (int, error) {
+	var c *TunnelConfig
+	for i := range config.Tunnels {
+		// Port ranges can be referred to by their original name.
+		if config.Tunnels[i].Name == name || config.Tunnels[i].Group == name {
+			c = &config.Tunnels[i]
+			break
+		}
+	}
+	if c == nil {
+		return 1, errors.Errorf("no tunnel named %s", name)
+	}
+	if c.K8s == nil {
+		return 1, errors.Errorf("%s: exec is only supported for k8s tunnels", name)
+	}
+	kargs := []string{"exec", "-n", c.K8s.Namespace}
+	if c.K8s.Context != "" {
+		kargs = append(kargs, "--context", c.K8s.Context)
+	}
+	kargs = append(kargs, "-i")
+	if isTerminal(os.Stdin) {
+		kargs = append(kargs, "-t")
+	}
+	kargs = append(append(kargs, c.K8s.Service, "--"), args...)
+	cmd := exec.Command("kubectl", kargs...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 1, errors.Wrap(err, "running kubectl exec")
+	}
+	return 0, nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
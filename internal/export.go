@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// exportConfig returns the config of the tunnels as they run, with the local
+// ports they ended up on, in the json form LoadConfig reads back. The
+// sub-forwards of port ranges are exported one by one, the tunnels depending
+// on a range depending on each of them instead, and the session wide settings
+// the tunnels do not carry, such as the http address, are lost.
+func exportConfig(tunnels []*Tunnel) map[string]interface{} {
+	members := map[string][]string{}
+	for _, t := range tunnels {
+		if c := &t.published().config; c.Group != "" {
+			members[c.Group] = append(members[c.Group], c.Name)
+		}
+	}
+	config := &Config{Tunnels: make([]TunnelConfig, 0, len(tunnels))}
+	for i, t := range tunnels {
+		c := t.published().config
+		c.Group = ""
+		dependsOn := make([]string, 0, len(c.DependsOn))
+		for _, name := range c.DependsOn {
+			if names, ok := members[name]; ok {
+				dependsOn = append(dependsOn, names...)
+			} else {
+				dependsOn = append(dependsOn, name)
+			}
+		}
+		c.DependsOn = dependsOn
+		config.Tunnels = append(config.Tunnels, c)
+		if i == 0 {
+			config.Settings.Logs = c.logSettings
+			config.Settings.Schedule = c.schedule
+			config.Settings.Notifications = c.notifications
+			config.Settings.Formats = c.formats
+			if c.secretReader != defaultSecretReader {
+				config.Settings.SecretReader = c.secretReader
+			}
+		}
+		if p, ok := c.provider.(*ExecProvider); ok {
+			if config.Settings.Providers == nil {
+				config.Settings.Providers = map[string]*ExecProvider{}
+			}
+			config.Settings.Providers[c.Provider] = p
+		}
+	}
+	// Go through json to drop the unset fields, which would make the config
+	// unreadable.
+	b, _ := json.Marshal(config)
+	doc := map[string]interface{}{}
+	json.Unmarshal(b, &doc) //nolint:errcheck // Just marshaled.
+	pruneUnset(doc)
+	return doc
+}
+
+// pruneUnset removes the fields set to their zero value from a json document.
+// Objects are kept even if left empty, as a set pointer may mean something,
+// e.g. a default health check.
+func pruneUnset(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if isUnset(e) {
+				delete(v, k)
+			} else {
+				pruneUnset(e)
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			pruneUnset(e)
+		}
+	}
+}
+
+// isUnset tells whether the json value is the zero value of its field.
+func isUnset(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case []interface{}:
+		return len(v) == 0
+	case string:
+		return v == "" || v == (Duration{}).String() || v == (Rate{}).String()
+	case float64:
+		return v == 0
+	case bool:
+		return !v
+	}
+	return false
+}
+
+// ExportSession writes the config of the tunnels as they run to a file of the
+// working directory named after the time, and returns its path.
+func ExportSession(tunnels []*Tunnel) (string, error) {
+	b, err := json.MarshalIndent(exportConfig(tunnels), "", "  ")
+	if err != nil {
+		return "", errors.Wrap(err, "marshaling config")
+	}
+	path := "tmancer-session-" + time.Now().Format("20060102-150405") + ".json"
+	return path, errors.Wrapf(os.WriteFile(path, append(b, '\n'), 0o600), "writing %s", path)
+}
+
+// ControlExport writes the config of the tunnels of the running session as
+// they run to w.
+func ControlExport(ctx context.Context, w io.Writer) error {
+	var config interface{}
+	if err := controlRequest(ctx, http.MethodGet, "/config", &config); err != nil {
+		return err
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return errors.Wrap(e.Encode(config), "writing config")
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+)
+
+const defaultFailoverAfter = 3
+
+// Failover lists the endpoints a tunnel switches to, in order, when its
+// current endpoint keeps failing, such as the replicas of a database in other
+// regions. All the endpoints share the local port of the tunnel, whose own
+// k8s or custom config is the primary endpoint.
+type Failover struct {
+	Endpoints []Endpoint `json:"endpoints"`
+	// After is the number of consecutive failures after which the next
+	// endpoint is used, defaults to 3. Failures are forgotten once the
+	// tunnel stayed open for a minute.
+	After int `json:"after"`
+}
+
+// Endpoint is an alternative target of a tunnel.
+type Endpoint struct {
+	K8s *K8sInfo `json:"k8s"`
+	// Name identifies the endpoint, e.g. its region. Defaults to its
+	// position.
+	Name   string `json:"name"`
+	Custom string `json:"custom"`
+}
+
+// endpoints returns all the endpoints of the tunnel, the primary one first.
+func (c *TunnelConfig) endpoints() []Endpoint {
+	if c.Failover == nil {
+		return nil
+	}
+	endpoints := make([]Endpoint, 0, len(c.Failover.Endpoints)+1)
+	endpoints = append(endpoints, Endpoint{Name: "primary", K8s: c.K8s, Custom: c.Custom})
+	for i, e := range c.Failover.Endpoints {
+		if e.Name == "" {
+			e.Name = fmt.Sprintf("failover #%d", i+1)
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints
+}
+
+// recordEndpointFailure counts a failure of the current endpoint and fails
+// over to the next one if it keeps failing. wasOpenFor is how long the tunnel
+// had been open before failing. The caller must hold the tunnel lock.
+func (t *Tunnel) recordEndpointFailure(wasOpenFor time.Duration) {
+	if len(t.endpoints) < 2 || t.status.IsTerminal() {
+		return
+	}
+	if wasOpenFor > restartResetAfter {
+		t.endpointFailures = 0
+	}
+	t.endpointFailures++
+	after := t.config.Failover.After
+	if after <= 0 {
+		after = defaultFailoverAfter
+	}
+	if t.endpointFailures < after {
+		return
+	}
+	from := t.endpoints[t.endpoint]
+	// The hint is about the failing endpoint.
+	hint := t.config.hint(classifyFailure(t.status, t.err), t.err)
+	t.endpoint = (t.endpoint + 1) % len(t.endpoints)
+	to := t.endpoints[t.endpoint]
+	t.config.K8s, t.config.Custom = to.K8s, to.Custom
+	// ready_regex is checked when loading the config.
+	t.readyRegex, _ = t.config.readyRegex()
+	t.endpointFailures = 0
+	t.retries = 0
+	t.warning = fmt.Sprintf("Failover: %s kept failing, switched to %s", from.Name, to.Name)
+	t.sendNotification(&notification{
+		event:          EventFailedOver,
+		title:          "tmancer: " + t.config.Name + " failed over",
+		message:        fmt.Sprintf("%s kept failing, switched to %s", from.Name, to.Name),
+		name:           t.config.Name,
+		status:         t.status.String(),
+		previousStatus: t.notifiedStatus.String(),
+		hint:           hint,
+		port:           t.config.LocalPort,
+		critical:       t.config.Critical,
+	})
+}
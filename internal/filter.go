@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FilterTags keeps the tunnels carrying any of the given tags, along with the
+// tunnels they depend on, so that a subset of a big config can be started.
+func (c *Config) FilterTags(tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	if !c.keep(func(t *TunnelConfig) bool { return t.hasAnyTag(tags) }) {
+		return errors.Errorf("no tunnel tagged %s", strings.Join(tags, " or "))
+	}
+	return nil
+}
+
+// FilterNames keeps the tunnels with the given names, along with the tunnels
+// they depend on, and then drops the excluded ones. Port ranges can be referred
+// to by their original name.
+func (c *Config) FilterNames(only, exclude []string) error {
+	known := map[string]bool{}
+	for i := range c.Tunnels {
+		known[c.Tunnels[i].Name] = true
+		known[c.Tunnels[i].Group] = true
+	}
+	for _, name := range append(append([]string{}, only...), exclude...) {
+		if name == "" {
+			// Ungrouped tunnels have an empty group, which is no selector.
+			return errors.New("empty tunnel name")
+		}
+		if !known[name] {
+			return errors.Errorf("unknown tunnel %s", name)
+		}
+	}
+	if len(only) > 0 {
+		c.keep(func(t *TunnelConfig) bool { return t.hasAnyName(only) })
+	}
+	if len(exclude) == 0 {
+		return nil
+	}
+	tunnels := make([]TunnelConfig, 0, len(c.Tunnels))
+	for i := range c.Tunnels {
+		if !c.Tunnels[i].hasAnyName(exclude) {
+			tunnels = append(tunnels, c.Tunnels[i])
+		}
+	}
+	for i := range tunnels {
+		for _, name := range tunnels[i].DependsOn {
+			for _, excluded := range exclude {
+				if name == excluded {
+					return errors.Errorf("%s depends on excluded tunnel %s", tunnels[i].Name, name)
+				}
+			}
+		}
+	}
+	if len(tunnels) == 0 {
+		return errors.New("every tunnel is excluded")
+	}
+	c.Tunnels = tunnels
+	return nil
+}
+
+// keep keeps the tunnels matching, along with the tunnels they depend on. It
+// tells whether any tunnel matched, leaving the tunnels untouched otherwise.
+func (c *Config) keep(match func(t *TunnelConfig) bool) bool {
+	names, groups := make([]string, len(c.Tunnels)), make([]string, len(c.Tunnels))
+	for i := range c.Tunnels {
+		names[i], groups[i] = c.Tunnels[i].Name, c.Tunnels[i].Group
+	}
+	index := dependencyIndex(names, groups)
+	kept := make([]bool, len(c.Tunnels))
+	var add func(i int)
+	add = func(i int) {
+		if kept[i] {
+			return
+		}
+		kept[i] = true
+		for _, name := range c.Tunnels[i].DependsOn {
+			for _, j := range index[name] {
+				add(j)
+			}
+		}
+	}
+	for i := range c.Tunnels {
+		if match(&c.Tunnels[i]) {
+			add(i)
+		}
+	}
+	tunnels := make([]TunnelConfig, 0, len(c.Tunnels))
+	for i := range c.Tunnels {
+		if kept[i] {
+			tunnels = append(tunnels, c.Tunnels[i])
+		}
+	}
+	if len(tunnels) == 0 {
+		return false
+	}
+	c.Tunnels = tunnels
+	return true
+}
+
+// hasAnyName tells whether the tunnel, or the port range it comes from, has
+// any of the given names.
+func (c *TunnelConfig) hasAnyName(names []string) bool {
+	for _, name := range names {
+		if c.Name == name || (c.Group != "" && c.Group == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAnyTag tells whether the tunnel carries any of the given tags.
+func (c *TunnelConfig) hasAnyTag(tags []string) bool {
+	for _, tag := range tags {
+		for _, t := range c.Tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
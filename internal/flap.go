@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultFlapRestarts = 10
+	defaultFlapWindow   = 5 * time.Minute
+	defaultFlapCoolOff  = 5 * time.Minute
+)
+
+// Reasons of the restarts, which the restart counter of the metrics is broken
+// down by.
+const (
+	restartExited = iota
+	restartSignal
+	restartKilled
+	restartPortBusy
+	restartError
+	restartReasons
+)
+
+var restartReasonNames = [restartReasons]string{"exited", "signal", "killed", "port_busy", "error"}
+
+// FlapDetection acts as a circuit breaker for tunnels which keep restarting:
+// once a tunnel restarts more than Restarts times within Window, it is put in
+// the Flapping status and left alone for CoolOff. It is enabled by default.
+type FlapDetection struct {
+	// Restarts allowed within Window, defaults to 10.
+	Restarts int `json:"restarts"`
+	// Window defaults to 5m.
+	Window Duration `json:"window"`
+	// CoolOff defaults to 5m.
+	CoolOff Duration `json:"cool_off"`
+	// Disabled turns flap detection off for the tunnel.
+	Disabled bool `json:"disabled"`
+}
+
+func (f *FlapDetection) restarts() int {
+	if f == nil || f.Restarts <= 0 {
+		return defaultFlapRestarts
+	}
+	return f.Restarts
+}
+
+func (f *FlapDetection) window() time.Duration {
+	if f == nil {
+		return defaultFlapWindow
+	}
+	return f.Window.Or(defaultFlapWindow)
+}
+
+func (f *FlapDetection) coolOff() time.Duration {
+	if f == nil {
+		return defaultFlapCoolOff
+	}
+	return f.CoolOff.Or(defaultFlapCoolOff)
+}
+
+// recordRestart registers a restart of the tunnel process and tells whether
+// the tunnel is now flapping, in which case the restart must not happen. The
+// caller must hold the tunnel lock.
+func (t *Tunnel) recordRestart(now time.Time) bool {
+	f := t.config.Flapping
+	t.pruneRestarts(now)
+	if f != nil && f.Disabled {
+		t.restarts = append(t.restarts, now)
+		t.countRestart()
+		return false
+	}
+	if len(t.restarts) >= f.restarts() {
+		t.status = Flapping
+		t.flappingUntil = now.Add(f.coolOff())
+		t.err = errors.Errorf("restarted %d times in %s, cooling off until %s",
+			len(t.restarts), t.config.formats.FormatDuration(f.window()), t.config.formats.FormatTime(t.flappingUntil))
+		t.restarts = t.restarts[:0]
+		return true
+	}
+	t.restarts = append(t.restarts, now)
+	t.countRestart()
+	return false
+}
+
+// countRestart counts a restart of the tunnel process, along with its reason
+// as told by how the previous attempt ended. The caller must hold the tunnel
+// lock.
+func (t *Tunnel) countRestart() {
+	reason := restartError
+	switch {
+	case t.killed:
+		reason = restartKilled
+	case t.status == Cooper:
+		reason = restartExited
+	case t.status == Signal:
+		reason = restartSignal
+	case t.status == PortBusy:
+		reason = restartPortBusy
+	}
+	t.restartsTotal++
+	t.restartsByReason[reason]++
+	t.killed = false
+}
+
+// pruneRestarts forgets the restarts which happened before the flap window.
+func (t *Tunnel) pruneRestarts(now time.Time) {
+	window := t.config.Flapping.window()
+	recent := t.restarts[:0]
+	for _, r := range t.restarts {
+		if now.Sub(r) < window {
+			recent = append(recent, r)
+		}
+	}
+	t.restarts = recent
+}
+
+// GetRestartRate returns the number of restarts of the tunnel process within
+// the flap detection window, along with the window itself.
+func (t *Tunnel) GetRestartRate() (restarts int, window time.Duration) {
+	return t.published().restartRate(time.Now())
+}
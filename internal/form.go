@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// formHelp is the help bar of the new tunnel form.
+const formHelp = "↑/↓/tab field  space change option  enter add  esc cancel"
+
+// keyEscape is a lone escape key press, see ReadKeys.
+const keyEscape = '\x1b'
+
+// formField is a field of the new tunnel form.
+type formField struct {
+	label string
+	value string
+	// kind is the tunnel type the field belongs to, empty for all.
+	kind string
+	// options are the values the field cycles through, nil for free text.
+	options []string
+}
+
+// Indexes of the fields of the new tunnel form.
+const (
+	fieldType = iota
+	fieldName
+	fieldLocalPort
+	fieldContext
+	fieldNamespace
+	fieldService
+	fieldPort
+	fieldCommand
+	fieldSave
+)
+
+// tunnelForm is the form of the interactive table adding a tunnel to the
+// session.
+type tunnelForm struct {
+	// message tells why the form could not be submitted.
+	message string
+	fields  []formField
+	// current is the index of the field being edited.
+	current int
+}
+
+func newTunnelForm() *tunnelForm {
+	return &tunnelForm{fields: []formField{
+		fieldType:      {label: "Type", value: "k8s", options: []string{"k8s", "custom"}},
+		fieldName:      {label: "Name"},
+		fieldLocalPort: {label: "Local port (empty for any)"},
+		fieldContext:   {label: "Context (empty for current)", kind: "k8s"},
+		fieldNamespace: {label: "Namespace", kind: "k8s"},
+		fieldService:   {label: "Service", kind: "k8s"},
+		fieldPort:      {label: "Service port", kind: "k8s"},
+		fieldCommand:   {label: "Command", kind: "custom"},
+		fieldSave:      {label: "Save to the config file", value: "no", options: []string{"no", "yes"}},
+	}}
+}
+
+// shown tells whether the field applies to the selected tunnel type.
+func (f *tunnelForm) shown(i int) bool {
+	kind := f.fields[i].kind
+	return kind == "" || kind == f.fields[fieldType].value
+}
+
+// move selects the next field shown in the given direction.
+func (f *tunnelForm) move(step int) {
+	for i := f.current + step; i >= 0 && i < len(f.fields); i += step {
+		if f.shown(i) {
+			f.current = i
+			return
+		}
+	}
+}
+
+// handleKey handles a key press, arrow being set for the up and down arrow
+// keys, and tells whether the form was submitted.
+func (f *tunnelForm) handleKey(key byte, arrow bool) bool {
+	field := &f.fields[f.current]
+	switch {
+	case arrow && key == 'k':
+		f.move(-1)
+	case arrow && key == 'j', key == '\t':
+		f.move(1)
+	case key == '\n' || key == '\r':
+		_, err := f.config()
+		if err == nil {
+			return true
+		}
+		f.message = err.Error()
+	case field.options != nil:
+		if key == ' ' {
+			for i, o := range field.options {
+				if o == field.value {
+					field.value = field.options[(i+1)%len(field.options)]
+					break
+				}
+			}
+		}
+	case key == 127 || key == '\b':
+		if field.value != "" {
+			_, size := utf8.DecodeLastRuneInString(field.value)
+			field.value = field.value[:len(field.value)-size]
+		}
+	case key >= ' ':
+		field.value += string([]byte{key})
+	}
+	return false
+}
+
+// config returns the tunnel config described by the form.
+func (f *tunnelForm) config() (TunnelConfig, error) {
+	value := func(i int) string {
+		return strings.TrimSpace(f.fields[i].value)
+	}
+	port := func(i int, required bool) (int, error) {
+		if value(i) == "" && !required {
+			return 0, nil
+		}
+		p, err := strconv.Atoi(value(i))
+		if err != nil || p <= 0 || p > 65535 {
+			return 0, errors.Errorf("%s is not a port number", strings.ToLower(f.fields[i].label))
+		}
+		return p, nil
+	}
+	c := TunnelConfig{Name: value(fieldName)}
+	if c.Name == "" {
+		return c, errors.New("the tunnel needs a name")
+	}
+	var err error
+	if c.LocalPort, err = port(fieldLocalPort, false); err != nil {
+		return c, err
+	}
+	if value(fieldType) == "custom" {
+		if c.Custom = value(fieldCommand); c.Custom == "" {
+			return c, errors.New("the tunnel needs a command")
+		}
+		return c, nil
+	}
+	k8s := &K8sInfo{Context: value(fieldContext), Namespace: value(fieldNamespace), Service: value(fieldService)}
+	if k8s.Namespace == "" || k8s.Service == "" {
+		return c, errors.New("the tunnel needs a namespace and a service")
+	}
+	if !strings.Contains(k8s.Service, "/") {
+		k8s.Service = "svc/" + k8s.Service
+	}
+	if k8s.Port, err = port(fieldPort, true); err != nil {
+		return c, err
+	}
+	c.K8s = k8s
+	return c, nil
+}
+
+// persist tells whether the tunnel is to be saved to the config file.
+func (f *tunnelForm) persist() bool {
+	return f.fields[fieldSave].value == "yes"
+}
+
+// render writes the form, title and help bar aside.
+func (f *tunnelForm) render(frame *bytes.Buffer, cols int) {
+	for i := range f.fields {
+		if !f.shown(i) {
+			continue
+		}
+		value := f.fields[i].value
+		if f.fields[i].options != nil {
+			options := make([]string, len(f.fields[i].options))
+			for j, o := range f.fields[i].options {
+				if o == value {
+					o = "[" + o + "]"
+				}
+				options[j] = o
+			}
+			value = strings.Join(options, " ")
+		}
+		line := clip(fmt.Sprintf("  %-28s %s", f.fields[i].label+":", value), cols)
+		if i == f.current {
+			line = reverseVideo + line + resetVideo
+		}
+		frame.WriteString(line + clearLine + "\n")
+	}
+	if f.message != "" {
+		frame.WriteString(clearLine + "\n" + clip(f.message, cols) + clearLine + "\n")
+	}
+}
+
+// SaveTunnel appends the tunnel to the config file at path, keeping the rest
+// of the file. It fails if the file already has a tunnel with the same name,
+// e.g. one left out of the session.
+func SaveTunnel(path string, c TunnelConfig) error {
+	taken, err := LocalPorts(path)
+	if err != nil {
+		return err
+	}
+	if nameTaken(taken, c.Name) {
+		return errors.Errorf("%s already has a tunnel named %s", path, c.Name)
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return errors.Wrap(err, "marshaling tunnel")
+	}
+	doc := map[string]interface{}{}
+	json.Unmarshal(b, &doc) //nolint:errcheck // Just marshaled.
+	pruneUnset(doc)
+	return UpdateConfig(path, []map[string]interface{}{doc})
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Duration formats.
+const (
+	// DurationShort is Go's format dropping zero trailing units, e.g. "5m"
+	// instead of "5m0s". This is the default.
+	DurationShort = "short"
+	// DurationGo is Go's format, e.g. "1h2m3s".
+	DurationGo = "go"
+	// DurationISO8601 is the ISO 8601 format, e.g. "PT1H2M3S".
+	DurationISO8601 = "iso8601"
+	// DurationSeconds is the number of seconds, e.g. "3723".
+	DurationSeconds = "seconds"
+)
+
+// Timestamp formats. Any other value is used as a Go time layout, e.g.
+// "2006-01-02 15:04".
+const (
+	// TimestampClock is the local time of the day, e.g. "15:04:05". This is
+	// the default.
+	TimestampClock = "clock"
+	// TimestampRFC3339 is the RFC 3339 (ISO 8601) format.
+	TimestampRFC3339 = "rfc3339"
+	// TimestampRelative is relative to now, e.g. "in 3m" or "3m ago".
+	TimestampRelative = "relative"
+	// TimestampUnix is the number of seconds since the epoch.
+	TimestampUnix = "unix"
+)
+
+// Formats tells how durations and timestamps are formatted in the outputs of
+// tmancer, so that downstream tooling does not have to parse Go's default
+// formats.
+type Formats struct {
+	Duration  string `json:"duration"`
+	Timestamp string `json:"timestamp"`
+}
+
+// validate checks that the duration format is known. Any timestamp format is
+// valid since it falls back to being a time layout.
+func (f Formats) validate() error {
+	switch f.Duration {
+	case "", DurationShort, DurationGo, DurationISO8601, DurationSeconds:
+		return nil
+	}
+	return errors.Errorf("unknown duration format %q", f.Duration)
+}
+
+// FormatDuration formats d according to the duration format.
+func (f Formats) FormatDuration(d time.Duration) string {
+	switch f.Duration {
+	case DurationGo:
+		return d.String()
+	case DurationISO8601:
+		return iso8601Duration(d)
+	case DurationSeconds:
+		return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+	}
+	return shortDuration(d)
+}
+
+// FormatTime formats t according to the timestamp format.
+func (f Formats) FormatTime(t time.Time) string {
+	switch f.Timestamp {
+	case "", TimestampClock:
+		return t.Format("15:04:05")
+	case TimestampRFC3339:
+		return t.Format(time.RFC3339)
+	case TimestampRelative:
+		d := time.Until(t).Round(time.Second)
+		if d < 0 {
+			return shortDuration(-d) + " ago"
+		}
+		return "in " + shortDuration(d)
+	case TimestampUnix:
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	return t.Format(f.Timestamp)
+}
+
+// shortDuration formats d dropping zero trailing units, e.g. "5m" instead of
+// "5m0s".
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// iso8601Duration formats d as an ISO 8601 duration, using hours as the
+// largest unit since days are ambiguous.
+func iso8601Duration(d time.Duration) string {
+	if d == 0 {
+		return "PT0S"
+	}
+	b := strings.Builder{}
+	if d < 0 {
+		b.WriteString("-")
+		d = -d
+	}
+	b.WriteString("PT")
+	if h := d / time.Hour; h > 0 {
+		b.WriteString(strconv.FormatInt(int64(h), 10) + "H")
+		d -= h * time.Hour
+	}
+	if m := d / time.Minute; m > 0 {
+		b.WriteString(strconv.FormatInt(int64(m), 10) + "M")
+		d -= m * time.Minute
+	}
+	if d > 0 {
+		b.WriteString(strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "S")
+	}
+	return b.String()
+}
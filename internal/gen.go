@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// privilegedPortShift is added to the privileged remote ports to get their
+// local port, e.g. 10443 for 443, so that no root is needed.
+const privilegedPortShift = 10000
+
+// GenerateK8s returns k8s tunnel configs, in their json form, for every TCP
+// port of every service of the namespace which can be forwarded to. Tunnels
+// are named after their service, suffixed with the port name or number for
+// services with several ports. Local ports are the remote ones, shifted if
+// privileged, and moved to the next free one if already taken by another
+// tunnel, either generated or in taken, which maps ports to tunnel names.
+func GenerateK8s(ctx context.Context, opts DiscoverOptions, taken map[int]string) ([]map[string]interface{}, error) {
+	if opts.Namespace == "" {
+		return nil, errors.New("no namespace")
+	}
+	list, err := listServices(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[int]string, len(taken))
+	for port, name := range taken {
+		used[port] = name
+	}
+	tunnels := []map[string]interface{}{}
+	for _, f := range serviceForwards(list) {
+		local, err := pickLocalPort(used, f.name, defaultLocalPort(f.port))
+		if err != nil {
+			return nil, err
+		}
+		k8s := map[string]interface{}{
+			"namespace": f.namespace,
+			"service":   "svc/" + f.service,
+			"port":      f.port,
+		}
+		if opts.Context != "" {
+			k8s["context"] = opts.Context
+		}
+		tunnels = append(tunnels, map[string]interface{}{
+			"name":       f.name,
+			"local_port": local,
+			"k8s":        k8s,
+		})
+	}
+	return tunnels, nil
+}
+
+// serviceForward is a port of a service which can be forwarded to.
+type serviceForward struct {
+	// name is the service name, suffixed with the port name or number for
+	// services with several ports.
+	name      string
+	namespace string
+	service   string
+	port      int
+}
+
+// serviceForwards returns the TCP ports of the services which can be
+// forwarded to, sorted by service.
+func serviceForwards(list *serviceList) []serviceForward {
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Metadata.Name < list.Items[j].Metadata.Name })
+	var forwards []serviceForward
+	for _, svc := range list.Items {
+		// Without pods behind them there is nothing to forward to.
+		if len(svc.Spec.Selector) == 0 || svc.Spec.Type == "ExternalName" {
+			continue
+		}
+		for _, p := range svc.Spec.Ports {
+			if p.Protocol != "" && p.Protocol != "TCP" {
+				continue
+			}
+			name := svc.Metadata.Name
+			if len(svc.Spec.Ports) > 1 {
+				suffix := p.Name
+				if suffix == "" {
+					suffix = strconv.Itoa(p.Port)
+				}
+				name += "-" + suffix
+			}
+			forwards = append(forwards, serviceForward{
+				name:      name,
+				namespace: svc.Metadata.Namespace,
+				service:   svc.Metadata.Name,
+				port:      p.Port,
+			})
+		}
+	}
+	return forwards
+}
+
+// defaultLocalPort returns the local port of the given remote one, shifted if
+// privileged.
+func defaultLocalPort(remote int) int {
+	if remote < 1024 {
+		return remote + privilegedPortShift
+	}
+	return remote
+}
+
+// pickLocalPort returns the first port from the given one which is not used
+// by another tunnel than name, and marks it as used by name.
+func pickLocalPort(used map[int]string, name string, port int) (int, error) {
+	for ; port <= 65535; port++ {
+		if owner, ok := used[port]; !ok || owner == name {
+			used[port] = name
+			return port, nil
+		}
+	}
+	return 0, errors.Errorf("%s: no free local port", name)
+}
+
+// LocalPorts returns the tunnel names of the config at path by local port.
+func LocalPorts(path string) (map[int]string, error) {
+	ports := map[int]string{}
+	config, err := LoadConfig("", path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range config.Tunnels {
+		ports[config.Tunnels[i].LocalPort] = config.Tunnels[i].Name
+	}
+	return ports, nil
+}
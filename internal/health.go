@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+	defaultHealthFailures = 3
+)
+
+// HTTPCheck configures an HTTP request to perform through the tunnel local
+// port instead of just dialing it.
+type HTTPCheck struct {
+	// Path to request, e.g. "/healthz".
+	Path string `json:"path"`
+	// Status is the expected response status code, defaults to 200.
+	Status int `json:"status"`
+}
+
+// probe requests the path, over TLS if secure is set. The certificate is not
+// verified, it is often self-signed.
+func (h *HTTPCheck) probe(ctx context.Context, network, host string, port int, secure bool) error {
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+	url := fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, strconv.Itoa(port)), h.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	// Stick to the IP family of the tunnel, rather than whichever the host
+	// resolves to first.
+	d := net.Dialer{}
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, network, addr)
+		},
+		DisableKeepAlives: true,
+		//nolint:gosec // Checking the health, not the identity.
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	res, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "requesting %s", h.Path)
+	}
+	defer res.Body.Close()
+	expected := h.Status
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+	if res.StatusCode != expected {
+		return errors.Errorf("GET %s: expected status %d, got %d", h.Path, expected, res.StatusCode)
+	}
+	return nil
+}
+
+// HealthCheck configures the periodic probe of an open tunnel. By default it
+// just dials the local port to make sure that something accepts connections.
+type HealthCheck struct {
+	// HTTP, if set, performs an HTTP request instead of a plain dial.
+	HTTP *HTTPCheck `json:"http"`
+	// Cmd, if set, is run instead of dialing the local port and must exit
+	// with 0, e.g. "pg_isready -h localhost -p 4646". This is useful for
+	// protocols where dialing always succeeds but the session is dead.
+	Cmd string `json:"cmd"`
+	// Interval between two probes, defaults to 10s.
+	Interval Duration `json:"interval"`
+	// Timeout of a single probe, defaults to 2s.
+	Timeout Duration `json:"timeout"`
+	// Failures is the number of consecutive failed probes after which the
+	// tunnel is marked as Degraded, defaults to 3.
+	Failures int `json:"failures"`
+	// MaxLatency, if set, makes probes slower than that count as failed,
+	// so that tunnels which are open but crawling become Degraded.
+	MaxLatency Duration `json:"max_latency"`
+	// Restart the tunnel process once it becomes Degraded.
+	Restart bool `json:"restart"`
+}
+
+func (h *HealthCheck) failures() int {
+	if h.Failures <= 0 {
+		return defaultHealthFailures
+	}
+	return h.Failures
+}
+
+// probe runs a single health check against the local port of the given
+// tunnel config.
+func (h *HealthCheck) probe(ctx context.Context, c *TunnelConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout.Or(defaultHealthTimeout))
+	defer cancel()
+	if h.Cmd != "" {
+		parts, err := splitCommand(h.Cmd)
+		if err != nil {
+			return err
+		}
+		cmd := exec.CommandContext(ctx, parts[0], parts[1:]...) //nolint:gosec // I'm happy for now.
+		cmd.Dir = c.Dir
+		b, err := c.auditFor("health_check.cmd", "").combinedOutput(cmd)
+		return errors.Wrap(err, strings.TrimSpace(string(b)))
+	}
+	if h.HTTP != nil {
+		return h.HTTP.probe(ctx, c.network(), c.dialHost(), c.LocalPort, c.TLS != nil && c.TLS.Terminate)
+	}
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, c.network(), net.JoinHostPort(c.dialHost(), strconv.Itoa(c.LocalPort)))
+	if err != nil {
+		return errors.Wrap(err, "dialing local port")
+	}
+	return conn.Close()
+}
+
+// watchHealth periodically probes the tunnel while it is Open or Degraded.
+// Run this in a separate goroutine.
+func (t *Tunnel) watchHealth(ctx context.Context) {
+	hc := t.config.HealthCheck
+	ticker := time.NewTicker(hc.Interval.Or(defaultHealthInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s := t.published()
+		if s.status != Open && s.status != Degraded {
+			continue
+		}
+		start := time.Now()
+		err := hc.probe(ctx, &s.config)
+		// Failed probes are mostly timeouts, which say nothing about the
+		// latency.
+		var latency time.Duration
+		if err == nil {
+			latency = time.Since(start)
+			if max := hc.MaxLatency.Duration; max > 0 && latency > max {
+				err = errors.Errorf("took %s, more than %s", formatLatency(latency), max)
+			}
+		}
+		t.Lock()
+		t.recordHealth(err, latency)
+		t.Unlock()
+	}
+}
+
+// recordHealth updates the tunnel status and latency according to the result
+// of a probe, latency being 0 if it failed. The caller must hold the tunnel
+// lock.
+func (t *Tunnel) recordHealth(err error, latency time.Duration) {
+	// The tunnel may have changed status while the probe was running.
+	if t.status != Open && t.status != Degraded {
+		t.healthFailures = 0
+		return
+	}
+	if latency > 0 {
+		t.recordLatency(latency)
+	}
+	if err == nil {
+		t.healthFailures = 0
+		if t.status == Degraded {
+			t.status = Open
+			t.err = nil
+		}
+		return
+	}
+	t.healthFailures++
+	if t.healthFailures >= t.config.HealthCheck.failures() {
+		t.status = Degraded
+		t.err = errors.Wrap(err, "health check")
+		if t.config.HealthCheck.Restart {
+			// The process exit is picked up by Start which reopens the tunnel.
+			t.killFor(t.err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Failure kinds a recovery hint can be given for, which are also the keys of
+// the hints settings.
+const (
+	FailureAuthExpired     = "auth_expired"
+	FailureMissingBinary   = "missing_binary"
+	FailurePortBusy        = "port_busy"
+	FailureContextNotFound = "context_not_found"
+)
+
+const portOwnerTimeout = 2 * time.Second
+
+var (
+	// missingBinaryRegex matches the messages of Go and of shells when the
+	// executable to run cannot be found, capturing its name.
+	missingBinaryRegex = regexp.MustCompile(`exec: "([^"]+)": executable file not found|` +
+		`(?:^|\s)([^\s:]+): (?:command )?not found`)
+	// contextNotFoundRegex matches the messages of kubectl when the context
+	// does not exist, capturing its name.
+	contextNotFoundRegex = regexp.MustCompile(`context "([^"]+)" does not exist|` +
+		`context was not found for specified context: (\S+)|no context exists with the name: "?([^"\s]+)`)
+	awsAuthRegex    = regexp.MustCompile(`(?i)(\baws\b|sso)`)
+	gcloudAuthRegex = regexp.MustCompile(`(?i)(gcloud|gke-gcloud-auth-plugin)`)
+	azureAuthRegex  = regexp.MustCompile(`(?i)(kubelogin|azure)`)
+)
+
+// classifyFailure returns the failure kind of a tunnel given its status and
+// error, empty if there is no hint to give about it.
+func classifyFailure(status Status, err error) string {
+	switch {
+	case status == PortBusy:
+		return FailurePortBusy
+	case err == nil:
+		return ""
+	case missingBinaryRegex.MatchString(err.Error()):
+		return FailureMissingBinary
+	case contextNotFoundRegex.MatchString(err.Error()):
+		return FailureContextNotFound
+	case isAuthError(err):
+		return FailureAuthExpired
+	}
+	return ""
+}
+
+// firstSubmatch returns the first non empty group matched by re in s.
+func firstSubmatch(re *regexp.Regexp, s string) string {
+	for i, group := range re.FindStringSubmatch(s) {
+		if i > 0 && group != "" {
+			return group
+		}
+	}
+	return ""
+}
+
+// portOwner returns the pid and command of the process listening on the
+// given port, if any, from procfs when lsof is missing.
+func portOwner(network, host string, port int) (int, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), portOwnerTimeout)
+	defer cancel()
+	//nolint:gosec // I'm happy for now.
+	out, err := exec.CommandContext(ctx, "lsof", "-n", "-F", "pc", "-sTCP:LISTEN", "-i", lsofAddress(network, host, port)).Output()
+	var notFound *exec.Error
+	if errors.As(err, &notFound) {
+		return procPortOwner(network, port)
+	}
+	if err != nil {
+		return 0, ""
+	}
+	var pid int
+	for _, line := range strings.Split(string(out), "\n") {
+		switch {
+		case strings.HasPrefix(line, "p") && pid == 0:
+			pid, _ = strconv.Atoi(line[1:])
+		case strings.HasPrefix(line, "c") && pid != 0:
+			return pid, line[1:]
+		}
+	}
+	return pid, ""
+}
+
+// defaultHint returns the built-in hint for the given failure, with
+// placeholders.
+func (c *TunnelConfig) defaultHint(kind string, err error, ownerPid int) string {
+	switch kind {
+	case FailureMissingBinary:
+		return "install {{binary}} or add it to PATH"
+	case FailureContextNotFound:
+		return "kubectl config get-contexts"
+	case FailurePortBusy:
+		if ownerPid != 0 {
+			return "kill {{owner_pid}} ({{owner}} holds the port)"
+		}
+		return "lsof -n -i :{{port}}"
+	case FailureAuthExpired:
+		switch {
+		case c.AuthRefresh != "":
+			return c.AuthRefresh
+		case awsAuthRegex.MatchString(err.Error()) && os.Getenv("AWS_PROFILE") != "":
+			return "aws sso login --profile {{aws_profile}}"
+		case awsAuthRegex.MatchString(err.Error()):
+			return "aws sso login"
+		case gcloudAuthRegex.MatchString(err.Error()):
+			return "gcloud auth login"
+		case azureAuthRegex.MatchString(err.Error()):
+			return "az login"
+		}
+	}
+	return ""
+}
+
+// hint returns the suggested command to recover from the given failure kind,
+// from the hints of the tunnel or the built-in ones. An empty hint in the
+// config disables the built-in one.
+func (c *TunnelConfig) hint(kind string, err error) string {
+	if kind == "" {
+		return ""
+	}
+	var ownerPid int
+	var owner string
+	if kind == FailurePortBusy {
+		ownerPid, owner = portOwner(c.network(), c.listenBind(), c.LocalPort)
+	}
+	hint, ok := c.Hints[kind]
+	if !ok {
+		hint = c.defaultHint(kind, err, ownerPid)
+	}
+	if hint == "" {
+		return ""
+	}
+	var binary, k8sContext string
+	if err != nil {
+		binary = firstSubmatch(missingBinaryRegex, err.Error())
+		k8sContext = firstSubmatch(contextNotFoundRegex, err.Error())
+	}
+	if binary == "" {
+		if args, argsErr := c.getArgs(c.LocalPort); argsErr == nil && len(args) > 0 {
+			binary = args[0]
+		}
+	}
+	if k8sContext == "" && c.K8s != nil {
+		k8sContext = c.K8s.Context
+	}
+	return strings.NewReplacer(
+		"{{name}}", c.Name,
+		"{{port}}", strconv.Itoa(c.LocalPort),
+		"{{binary}}", binary,
+		"{{context}}", k8sContext,
+		"{{owner}}", owner,
+		"{{owner_pid}}", strconv.Itoa(ownerPid),
+		"{{aws_profile}}", os.Getenv("AWS_PROFILE"),
+	).Replace(hint)
+}
+
+// checkHints makes sure that hints are only given for known failure kinds.
+func checkHints(hints map[string]string) error {
+	for kind := range hints {
+		switch kind {
+		case FailureAuthExpired, FailureMissingBinary, FailurePortBusy, FailureContextNotFound:
+		default:
+			return errors.Errorf("unknown hint %q", kind)
+		}
+	}
+	return nil
+}
+
+// updateHint computes the recovery hint of the tunnel again if its status or
+// error changed. The caller must hold the tunnel lock through lock, which is
+// released while computing the hint as it may look up the holder of the
+// port.
+func (t *Tunnel) updateHint(lock sync.Locker) {
+	if t.err == t.hintErr && t.status == t.hintStatus {
+		return
+	}
+	config, err, status := t.config, t.err, t.status
+	t.hintErr, t.hintStatus = err, status
+	lock.Unlock()
+	hint := config.hint(classifyFailure(status, err), err)
+	lock.Lock()
+	t.hint = hint
+}
+
+// GetHint returns the suggested command to recover from the current failure
+// of the tunnel, empty if none.
+func (t *Tunnel) GetHint() string {
+	return t.published().hint
+}
@@ -0,0 +1,349 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// historyFile is where the status changes of the tunnels are recorded,
+	// relative to the user's home.
+	historyFile = ".tmancer/history.jsonl"
+	// historyRetention is how long the status changes are kept for.
+	historyRetention = 30 * 24 * time.Hour
+)
+
+// HistoryEvent is a status change of a tunnel, as recorded in the history.
+type HistoryEvent struct {
+	Time   time.Time `json:"time"`
+	Tunnel string    `json:"tunnel"`
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	// Session is the pid of the session the tunnel belongs to.
+	Session int `json:"session"`
+}
+
+// History appends the status changes of the tunnels of a session to the
+// history file, shared by all the sessions.
+type History struct {
+	f *os.File
+	// lock is the lock file next to the history, held by the sessions while
+	// they write to it.
+	lock *os.File
+	m    sync.Mutex
+}
+
+func historyPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "getting home directory")
+	}
+	return filepath.Join(home, historyFile), nil
+}
+
+// OpenHistory opens the history file for appending, forgetting the status
+// changes older than the retention on the way.
+func OpenHistory() (*History, error) {
+	path, err := historyPath()
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, errors.Wrap(err, "creating history directory")
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDONLY, 0o600) //nolint:gosec // Only ever locked.
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening the lock of %s", path)
+	}
+	if err = pruneHistory(path, lock, time.Now().Add(-historyRetention)); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		lock.Close()
+		return nil, errors.Wrapf(err, "opening %s", path)
+	}
+	return &History{f: f, lock: lock}, nil
+}
+
+// pruneHistory rewrites the history without the status changes before the
+// given time, if there are any. The file is rewritten in place holding the
+// lock of the history, since the other sessions keep appending to it. The
+// history file itself is never locked, as Windows would then refuse to read
+// it through any other handle.
+func pruneHistory(path string, lock *os.File, before time.Time) error {
+	if err := lockFile(lock); err != nil {
+		return errors.Wrap(err, "locking history")
+	}
+	defer unlockFile(lock) //nolint:errcheck // Released on close anyway.
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", path)
+	}
+	defer f.Close()
+	events, err := readHistory(path)
+	if err != nil || len(events) == 0 || !events[0].Time.Before(before) {
+		return err
+	}
+	b := &strings.Builder{}
+	e := json.NewEncoder(b)
+	for i := range events {
+		if !events[i].Time.Before(before) {
+			e.Encode(&events[i]) //nolint:errcheck // Writing to a builder.
+		}
+	}
+	if err = f.Truncate(0); err != nil {
+		return errors.Wrap(err, "pruning history")
+	}
+	_, err = f.WriteAt([]byte(b.String()), 0)
+	return errors.Wrap(err, "pruning history")
+}
+
+// record appends a status change to the history.
+func (h *History) record(e *HistoryEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	// Not while another session prunes the history.
+	if lockFile(h.lock) != nil {
+		return
+	}
+	defer unlockFile(h.lock) //nolint:errcheck // Released on close anyway.
+	// A single write so that concurrent sessions do not mix their lines.
+	h.f.Write(append(b, '\n')) //nolint:errcheck // The history is best effort.
+}
+
+// Close closes the history file.
+func (h *History) Close() {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.f.Close()
+	h.lock.Close()
+}
+
+// SetHistory makes the tunnel record its status changes to the given history.
+// Call this before Start.
+func (t *Tunnel) SetHistory(h *History) {
+	t.history = h
+}
+
+// recordEnd records that the tunnel is stopped as the session ends.
+func (t *Tunnel) recordEnd() {
+	if t.history != nil {
+		t.history.record(&HistoryEvent{Time: time.Now(), Tunnel: t.config.Name, Status: Close.String(), Session: os.Getpid()})
+	}
+}
+
+// recordStatus records the status of the tunnel to the history and the event
+// log if it changed, accounting for the time spent in the previous one. The caller must hold the tunnel lock.
+func (t *Tunnel) recordStatus() {
+	if t.status == t.recordedStatus {
+		return
+	}
+	now := time.Now()
+	t.accountStatus(t.recordedStatus, now)
+	t.recordedStatus = t.status
+	e := &HistoryEvent{Time: now, Tunnel: t.config.Name, Status: t.status.String(), Session: os.Getpid()}
+	if t.err != nil && t.status != Open {
+		e.Error = errors.Cause(t.err).Error()
+	}
+	t.recordError(now)
+	if t.history != nil {
+		t.history.record(e)
+	}
+	if t.events != nil {
+		t.events.add(e)
+	}
+}
+
+// readHistory returns the status changes recorded in the history file, oldest
+// first. Malformed lines, e.g. cut by a crash, are skipped.
+func readHistory(path string) ([]HistoryEvent, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", path)
+	}
+	defer f.Close()
+	var events []HistoryEvent
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		e := HistoryEvent{}
+		if json.Unmarshal(s.Bytes(), &e) == nil {
+			events = append(events, e)
+		}
+	}
+	if err = s.Err(); err != nil {
+		return nil, errors.Wrapf(err, "reading %s", path)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events, nil
+}
+
+// TunnelReliability sums up the history of a tunnel.
+type TunnelReliability struct {
+	// LastDrop is when the tunnel last stopped being open because of a
+	// failure.
+	LastDrop time.Time
+	Name     string
+	// Up and Down are the time spent open and failing.
+	Up   time.Duration
+	Down time.Duration
+	// OpenBeforeDrop is the total time the tunnel was open before each
+	// drop, divided by Drops it tells how long the tunnel usually lasts.
+	OpenBeforeDrop time.Duration
+	// Drops counts the times the tunnel stopped being open because of a
+	// failure.
+	Drops int
+	// Restarts counts the times the tunnel process was started again.
+	Restarts int
+}
+
+// Uptime returns the share of time the tunnel was open rather than failing,
+// from 0 to 1.
+func (r *TunnelReliability) Uptime() float64 {
+	if r.Up+r.Down == 0 {
+		return 0
+	}
+	return float64(r.Up) / float64(r.Up+r.Down)
+}
+
+// isUp tells whether a tunnel in the status is usable.
+func isUp(status string) bool {
+	return status == Open.String() || status == Degraded.String()
+}
+
+// isDown tells whether a tunnel in the status is failing.
+func isDown(status string) bool {
+	s, ok := ParseStatus(status)
+	return ok && s.IsProblem()
+}
+
+// summarize computes the reliability of each tunnel from the events, sorted by
+// tunnel name. The time after the last event of a session counts until now if
+// the session still runs, not at all otherwise.
+func summarize(events []HistoryEvent, now time.Time) []TunnelReliability {
+	type key struct {
+		tunnel  string
+		session int
+	}
+	last := map[key]*HistoryEvent{}
+	byName := map[string]*TunnelReliability{}
+	// opened is when the tunnels last opened.
+	opened := map[key]time.Time{}
+	account := func(r *TunnelReliability, e *HistoryEvent, until time.Time) {
+		switch d := until.Sub(e.Time); {
+		case isUp(e.Status):
+			r.Up += d
+		case isDown(e.Status):
+			r.Down += d
+		}
+	}
+	for i := range events {
+		e := &events[i]
+		k := key{tunnel: e.Tunnel, session: e.Session}
+		r, found := byName[e.Tunnel]
+		if !found {
+			r = &TunnelReliability{Name: e.Tunnel}
+			byName[e.Tunnel] = r
+		}
+		if prev, ok := last[k]; ok {
+			account(r, prev, e.Time)
+			if isUp(prev.Status) && isDown(e.Status) {
+				r.Drops++
+				r.LastDrop = e.Time
+				r.OpenBeforeDrop += e.Time.Sub(opened[k])
+			}
+			if e.Status == Opening.String() && prev.Status != Close.String() &&
+				prev.Status != Paused.String() && prev.Status != Idle.String() && prev.Status != Waiting.String() &&
+				prev.Status != Scheduled.String() {
+				r.Restarts++
+			}
+		}
+		if prev, ok := last[k]; isUp(e.Status) && (!ok || !isUp(prev.Status)) {
+			opened[k] = e.Time
+		}
+		last[k] = e
+	}
+	for k, e := range last {
+		if k.session == os.Getpid() || isAlive(k.session) {
+			account(byName[k.tunnel], e, now)
+		}
+	}
+	res := make([]TunnelReliability, 0, len(byName))
+	for _, r := range byName {
+		res = append(res, *r)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// ShowHistory prints the reliability of the tunnels over the given period,
+// and the status changes of the tunnel if name is set.
+func ShowHistory(w io.Writer, name string, since time.Duration) error {
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+	events, err := readHistory(path)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	from := now.Add(-since)
+	var selected []HistoryEvent
+	for i := range events {
+		if events[i].Time.After(from) && (name == "" || events[i].Tunnel == name) {
+			selected = append(selected, events[i])
+		}
+	}
+	if len(selected) == 0 {
+		if name != "" {
+			return errors.Errorf("no history for %s in the last %s", name, shortDuration(since))
+		}
+		return errors.Errorf("no history in the last %s", shortDuration(since))
+	}
+	round := func(d time.Duration) string {
+		return shortDuration(d.Round(time.Minute))
+	}
+	fmt.Fprintf(w, "%-24s%-9s%-12s%-8s%-10s%-12s%s\n", "NAME", "UPTIME", "DOWNTIME", "DROPS", "RESTARTS", "AVG OPEN", "LAST DROP")
+	for _, r := range summarize(selected, now) {
+		avg, lastDrop := notAvailable, notAvailable
+		if r.Drops > 0 {
+			avg = round(r.OpenBeforeDrop / time.Duration(r.Drops))
+			lastDrop = r.LastDrop.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%-24s%-9s%-12s%-8d%-10d%-12s%s\n", r.Name, fmt.Sprintf("%.1f%%", 100*r.Uptime()),
+			round(r.Down), r.Drops, r.Restarts, avg, lastDrop)
+	}
+	if name == "" {
+		return nil
+	}
+	fmt.Fprintln(w)
+	for i := range selected {
+		e := &selected[i]
+		line := e.Time.Local().Format("2006-01-02 15:04:05") + "  " + e.Status
+		if e.Error != "" {
+			line += ": " + strings.SplitN(e.Error, "\n", 2)[0]
+		}
+		fmt.Fprintln(w, line)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// hookTimeout caps the run time of hook commands.
+const hookTimeout = 30 * time.Second
+
+// Hooks are commands run around the lifecycle of a tunnel process. They get
+// the TMANCER_TUNNEL and TMANCER_LOCAL_PORT environment variables.
+type Hooks struct {
+	// PreStart runs before every start of the tunnel process, which is not
+	// started if the hook fails.
+	PreStart string `json:"pre_start"`
+	// PostStart runs every time the tunnel opens.
+	PostStart string `json:"post_start"`
+	// PreStop runs before the tunnel process is stopped at the end of the
+	// session.
+	PreStop string `json:"pre_stop"`
+	// PostStop runs once the tunnel process exited at the end of the session.
+	PostStop string `json:"post_stop"`
+}
+
+// runHook runs the given hook command, if any.
+func (c *TunnelConfig) runHook(ctx context.Context, name, command string) error {
+	if command == "" {
+		return nil
+	}
+	return errors.Wrapf(c.runShortCommand(ctx, "hooks."+name, command), "%s hook", name)
+}
+
+// runShortCommand runs a command of the config field, such as a hook, for at
+// most hookTimeout. Its output is part of the error if it fails.
+//
+//nolint:gosec // I'm happy for now.
+func (c *TunnelConfig) runShortCommand(ctx context.Context, field, command string) error {
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	parts, err := splitCommand(command)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, parts[0], parts[1:]...)
+	cmd.Dir = c.Dir
+	cmd.Env = append(os.Environ(),
+		"TMANCER_TUNNEL="+c.Name,
+		"TMANCER_LOCAL_PORT="+strconv.Itoa(c.LocalPort),
+	)
+	b, err := c.auditFor(field, "").combinedOutput(cmd)
+	if err == nil {
+		return nil
+	}
+	if out := strings.TrimSpace(string(b)); out != "" {
+		err = errors.Wrap(err, out)
+	}
+	return err
+}
+
+// runPostStart runs the post_start hook of c, the config of the tunnel as it
+// opened. Failures are reported as the tunnel error.
+func (t *Tunnel) runPostStart(ctx context.Context, c TunnelConfig) {
+	err := c.runHook(ctx, "post_start", c.Hooks.PostStart)
+	if err == nil {
+		return
+	}
+	t.Lock()
+	t.err = err
+	t.Unlock()
+}
+
+// shutdown stops the tunnel process at the end of the session, running the
+// stop hooks around it. Failures are printed since the table is gone by then.
+func (t *Tunnel) shutdown() {
+	hooks := t.config.Hooks
+	if hooks == nil || t.exited == nil {
+		t.stop()
+		return
+	}
+	// The session context is done already.
+	ctx := context.Background()
+	if err := t.config.runHook(ctx, "pre_stop", hooks.PreStop); err != nil {
+		fmt.Printf("Error while stopping %s: %v\n", t.config.Name, err)
+	}
+	t.stop()
+	if err := t.config.runHook(ctx, "post_stop", hooks.PostStop); err != nil {
+		fmt.Printf("Error while stopping %s: %v\n", t.config.Name, err)
+	}
+}
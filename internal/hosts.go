@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// defaultHostsFile is where the aliases of the tunnels are added when the
+// settings do not say otherwise.
+const defaultHostsFile = "/etc/hosts"
+
+// hostsMarker starts the lines delimiting the block of aliases of a session,
+// followed by the pid of the session and "begin" or "end".
+const hostsMarker = "# tmancer "
+
+// aliasRegex matches valid host names.
+var aliasRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+// checkAliases makes sure that the aliases are valid host names and that no
+// alias points to two different addresses. The sub-forwards of a port range
+// share theirs.
+func checkAliases(configs []TunnelConfig) error {
+	hosts := map[string]string{}
+	for i := range configs {
+		c := &configs[i]
+		if c.Alias == "" {
+			continue
+		}
+		if !aliasRegex.MatchString(c.Alias) {
+			return errors.Errorf("%s: alias %q is not a valid host name", c.Name, c.Alias)
+		}
+		alias := strings.ToLower(c.Alias)
+		if host, ok := hosts[alias]; ok && host != c.dialHost() {
+			return errors.Errorf("%s: alias %s already points to %s", c.Name, c.Alias, host)
+		}
+		hosts[alias] = c.dialHost()
+	}
+	return nil
+}
+
+// AddHostAliases adds the aliases of the tunnels to the hosts file, pointing
+// to the addresses they listen on, for the client tools which want host names
+// rather than ports. The blocks left behind by the sessions which did not
+// shut down are removed on the way. The returned function removes the
+// aliases, it is nil if there are none.
+func AddHostAliases(path string, configs []TunnelConfig) (func(), error) {
+	if path == "" {
+		path = defaultHostsFile
+	}
+	block := &strings.Builder{}
+	seen := map[string]bool{}
+	for i := range configs {
+		alias := strings.ToLower(configs[i].Alias)
+		if alias == "" || seen[alias] {
+			continue
+		}
+		seen[alias] = true
+		fmt.Fprintf(block, "%s\t%s\n", configs[i].dialHost(), alias)
+	}
+	if block.Len() == 0 {
+		return nil, nil
+	}
+	pid := os.Getpid()
+	err := updateHostsFile(path, func(lines []string) []string {
+		lines = append(lines, fmt.Sprintf("%s%d begin", hostsMarker, pid))
+		lines = append(lines, strings.Split(strings.TrimSuffix(block.String(), "\n"), "\n")...)
+		return append(lines, fmt.Sprintf("%s%d end", hostsMarker, pid))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		updateHostsFile(path, func(lines []string) []string { return lines }) //nolint:errcheck // Cleaned up by the next session.
+	}, nil
+}
+
+// hostsLock is the lock file next to the hosts file, held by the sessions
+// while they update it.
+const hostsLock = ".tmancer-hosts.lock"
+
+// updateHostsFile rewrites the hosts file without the blocks of the current
+// session and of the dead ones, letting edit append to the remaining lines.
+// Sessions take turns through a lock file, so that none of them loses the
+// blocks of the others.
+func updateHostsFile(path string, edit func(lines []string) []string) error {
+	lock, err := os.OpenFile(filepath.Join(filepath.Dir(path), hostsLock), os.O_CREATE|os.O_RDONLY, 0o644) //nolint:gosec // Only ever locked.
+	if err != nil {
+		return errors.Wrapf(err, "opening the lock of %s", path)
+	}
+	defer lock.Close()
+	if err = lockFile(lock); err != nil {
+		return errors.Wrapf(err, "locking %s", path)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "reading %s", path)
+	}
+	var lines []string
+	skipping := false
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		if rest := strings.TrimPrefix(line, hostsMarker); rest != line {
+			fields := strings.Fields(rest)
+			if len(fields) == 2 {
+				pid, err := strconv.Atoi(fields[0])
+				if err == nil && (pid == os.Getpid() || !isAlive(pid)) {
+					skipping = fields[1] == "begin"
+					continue
+				}
+			}
+		}
+		if !skipping {
+			lines = append(lines, line)
+		}
+	}
+	content := strings.Join(edit(lines), "\n") + "\n"
+	if content == string(b) {
+		return nil
+	}
+	return errors.Wrapf(writeHostsFile(path, []byte(content)), "writing %s", path)
+}
+
+// writeHostsFile replaces the hosts file with a temporary file written next
+// to it, keeping its mode, so that a crash never leaves it half written. It
+// is written in place if it cannot be replaced, as it is often a mount point
+// in containers.
+func writeHostsFile(path string, content []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmancer-hosts-*")
+	if err == nil {
+		_, err = tmp.Write(content)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Chmod(tmp.Name(), info.Mode().Perm())
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err == nil {
+			return nil
+		}
+		os.Remove(tmp.Name()) //nolint:errcheck // Best effort.
+	}
+	return os.WriteFile(path, content, info.Mode().Perm())
+}
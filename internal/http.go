@@ -0,0 +1,299 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StartHTTP serves the local HTTP endpoints of the session on the given TCP
+// address. It stops once ctx is done.
+//
+//   - /: a web dashboard of the session.
+//   - /metrics: Prometheus metrics about the tunnels.
+//   - /healthz: 200 if all the required tunnels are open, 503 otherwise.
+//   - GET /tunnels: the state of the tunnels, as the json renderer prints it.
+//   - GET /tunnels/<name>/output and errors: the latest output lines and
+//     errors of a tunnel.
+//   - GET /snapshot: the raw state of the session, for tmancer attach.
+//   - POST /tunnels/<name>/restart, stop and start: act on a tunnel or a port
+//     range. Stopping pauses it until it is started again.
+//   - POST /shutdown: calls shutdown, which ends the session.
+//
+// Adding and removing tunnels, which amounts to running commands, is only
+// served on the control socket, see StartControlSocket.
+func StartHTTP(ctx context.Context, addr string, s *Session, formats Formats, shutdown func()) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "listening for http on %s", addr)
+	}
+	serveHTTP(ctx, l, newHTTPHandler(s, formats, shutdown, false))
+	return nil
+}
+
+// serveHTTP serves h on l until ctx is done.
+func serveHTTP(ctx context.Context, l net.Listener, h http.Handler) {
+	server := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go server.Serve(l) //nolint:errcheck // Closed.
+}
+
+// newHTTPHandler returns the handler of the endpoints StartHTTP serves, and
+// of the ones adding and removing tunnels if control is set, which is only
+// the case for the control socket only the user can connect to.
+func newHTTPHandler(s *Session, formats Formats, shutdown func(), control bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		serveDashboard(w, r, s)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		body := writeMetrics(s.Tunnels())
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(body) //nolint:errcheck // The client went away.
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		h := getHealthz(s.Tunnels())
+		code := http.StatusOK
+		if !h.Healthy {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, h)
+	})
+	mux.HandleFunc("/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			code, v := addTunnel(r, s, control)
+			writeJSON(w, code, v)
+			return
+		}
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "use GET or POST"})
+			return
+		}
+		snapshot := TakeSnapshot(s.Tunnels())
+		writeJSON(w, http.StatusOK, newJSONSnapshot(snapshot, formats))
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "use GET"})
+			return
+		}
+		config := exportConfig(s.Tunnels())
+		writeJSON(w, http.StatusOK, config)
+	})
+	mux.HandleFunc("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "use GET"})
+			return
+		}
+		snapshot := TakeSnapshot(s.Tunnels())
+		snapshot.Started = s.started
+		writeJSON(w, http.StatusOK, snapshot)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "use GET"})
+			return
+		}
+		events := getEvents(s.Tunnels())
+		if events == nil {
+			events = []HistoryEvent{}
+		}
+		writeJSON(w, http.StatusOK, events)
+	})
+	mux.HandleFunc("/tunnels/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			code, v := getTunnelDetails(r, s)
+			writeJSON(w, code, v)
+			return
+		}
+		code, err := controlTunnel(r, s, control)
+		if err != nil {
+			writeJSON(w, code, apiError{Error: err.Error()})
+			return
+		}
+		w.WriteHeader(code)
+	})
+	mux.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
+		if code, err := checkControl(r); err != nil {
+			writeJSON(w, code, apiError{Error: err.Error()})
+			return
+		}
+		shutdown()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	return mux
+}
+
+// writeJSON writes v as the json body of the response.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v) //nolint:errcheck // The client went away.
+}
+
+// apiError is the body of failed API calls.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// checkControl makes sure that the request may act on the session.
+func checkControl(r *http.Request) (int, error) {
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, errors.New("use POST")
+	}
+	// Browsers send an Origin with cross-site requests, do not let any web
+	// page but the dashboard drive the tunnels.
+	if origin := r.Header.Get("Origin"); origin != "" && !isDashboardOrigin(r, origin) {
+		return http.StatusForbidden, errors.New("cross-origin requests are not allowed")
+	}
+	return 0, nil
+}
+
+// errControlOnly is returned when adding or removing tunnels over TCP.
+var errControlOnly = errors.New("only available on the control socket, see tmancer ctl")
+
+// controlTunnel handles POST /tunnels/<name>/<action> and returns the status
+// code of the response. Tunnels are only removed if control is set.
+func controlTunnel(r *http.Request, s *Session, control bool) (int, error) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/tunnels/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		return http.StatusNotFound, errors.New("not found")
+	}
+	if code, err := checkControl(r); err != nil {
+		return code, err
+	}
+	if parts[1] == "remove" {
+		if !control {
+			return http.StatusForbidden, errControlOnly
+		}
+		found, err := s.Remove(parts[0])
+		switch {
+		case !found:
+			return http.StatusNotFound, errors.Errorf("unknown tunnel %q", parts[0])
+		case err != nil:
+			return http.StatusConflict, err
+		}
+		return http.StatusNoContent, nil
+	}
+	var act func([]*Tunnel, string) bool
+	switch parts[1] {
+	case "restart":
+		act = RestartTunnels
+	case "stop":
+		act = PauseTunnels
+	case "start":
+		act = ResumeTunnels
+	default:
+		return http.StatusNotFound, errors.Errorf("unknown action %q", parts[1])
+	}
+	found := act(s.Tunnels(), parts[0])
+	if !found {
+		return http.StatusNotFound, errors.Errorf("unknown tunnel %q", parts[0])
+	}
+	return http.StatusNoContent, nil
+}
+
+// getTunnelDetails handles GET /tunnels/<name>/errors and output, and returns
+// the status code and body of the response. Port ranges have no output of
+// their own.
+func getTunnelDetails(r *http.Request, s *Session) (int, interface{}) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/tunnels/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		return http.StatusNotFound, apiError{Error: "not found"}
+	}
+	snapshot := TakeSnapshot(s.Tunnels())
+	for i := range snapshot.Tunnels {
+		t := &snapshot.Tunnels[i]
+		if t.Name != parts[0] {
+			continue
+		}
+		switch parts[1] {
+		case "errors":
+			if t.Errors == nil {
+				return http.StatusOK, []TunnelError{}
+			}
+			return http.StatusOK, t.Errors
+		case "output":
+			if t.Output == nil {
+				return http.StatusOK, []string{}
+			}
+			return http.StatusOK, t.Output
+		}
+		return http.StatusNotFound, apiError{Error: "not found"}
+	}
+	return http.StatusNotFound, apiError{Error: errors.Errorf("unknown tunnel %q", parts[0]).Error()}
+}
+
+// addedTunnels is the body of the response to POST /tunnels.
+type addedTunnels struct {
+	Tunnels []string `json:"tunnels"`
+}
+
+// addTunnel handles POST /tunnels and returns the status code and body of
+// the response. Tunnels are only added if control is set.
+func addTunnel(r *http.Request, s *Session, control bool) (int, interface{}) {
+	if code, err := checkControl(r); err != nil {
+		return code, apiError{Error: err.Error()}
+	}
+	if !control {
+		return http.StatusForbidden, apiError{Error: errControlOnly.Error()}
+	}
+	c := TunnelConfig{}
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		return http.StatusBadRequest, apiError{Error: "decoding tunnel: " + err.Error()}
+	}
+	names, err := s.Add(c, false)
+	if err != nil {
+		return http.StatusBadRequest, apiError{Error: err.Error()}
+	}
+	return http.StatusCreated, addedTunnels{Tunnels: names}
+}
+
+// healthz is the body of the /healthz endpoint.
+type healthz struct {
+	Tunnels []healthzTunnel `json:"tunnels"`
+	// WaitingFor lists the tunnels keeping the session from being ready.
+	WaitingFor []string `json:"waiting_for"`
+	Healthy    bool     `json:"healthy"`
+}
+
+type healthzTunnel struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Required bool   `json:"required"`
+}
+
+// getHealthz tells whether all the required tunnels are open. Critical
+// tunnels are the required ones, or all of them if none is critical. It also
+// lists the tunnels the session waits for to be ready, see IsReady.
+func getHealthz(tunnels []*Tunnel) healthz {
+	anyCritical := false
+	for _, t := range tunnels {
+		anyCritical = anyCritical || t.config.Critical
+	}
+	h := healthz{Healthy: true, Tunnels: make([]healthzTunnel, 0, len(tunnels)), WaitingFor: waitingFor(tunnels)}
+	if h.WaitingFor == nil {
+		h.WaitingFor = []string{}
+	}
+	for _, t := range tunnels {
+		status := t.GetStatus()
+		required := t.config.Critical || !anyCritical
+		if required && status != Open {
+			h.Healthy = false
+		}
+		h.Tunnels = append(h.Tunnels, healthzTunnel{
+			Name:     t.config.Name,
+			Status:   status.String(),
+			Required: required,
+		})
+	}
+	return h
+}
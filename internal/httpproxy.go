@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// socksTimeout caps the SOCKS5 handshake.
+const socksTimeout = 10 * time.Second
+
+// httpProxyReadyRegex matches the line printed by the http-proxy subcommand
+// once it listens.
+var httpProxyReadyRegex = regexp.MustCompile(`^proxying on `)
+
+// socksReplies are the failures a SOCKS5 proxy reports, by reply code.
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// HTTPProxy makes the tunnel a local HTTP proxy, for the browsers and tools
+// which only speak HTTP_PROXY. Connections are routed through a SOCKS5
+// proxy, such as "ssh -D", which is the upstream tunnel unless Socks is set.
+type HTTPProxy struct {
+	// Socks is the address of the SOCKS5 proxy, e.g. "127.0.0.1:1080".
+	Socks string `json:"socks"`
+}
+
+// httpProxyArgs returns the command serving the HTTP proxy on port, which is
+// tmancer itself.
+func (c *TunnelConfig) httpProxyArgs(port int) ([]string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, errors.Wrap(err, "finding the tmancer executable")
+	}
+	socks := c.HTTPProxy.Socks
+	if socks == "" {
+		if c.Upstream == "" {
+			return nil, errors.New("http_proxy needs socks or an upstream")
+		}
+		socks = net.JoinHostPort(defaultBind, strconv.Itoa(c.upstreamPort))
+	}
+	listen := net.JoinHostPort(c.processBind(), strconv.Itoa(port))
+	return []string{exe, "http-proxy", "--listen", listen, "--socks", socks}, nil
+}
+
+// ServeHTTPProxy serves an HTTP proxy on the listen address, routing the
+// connections through the SOCKS5 proxy at socks, until ctx is done. Both
+// CONNECT requests and plain HTTP ones are supported. It writes a line to w
+// once listening.
+func ServeHTTPProxy(ctx context.Context, listen, socks string, w io.Writer) error {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return errors.Wrapf(err, "listening on %s", listen)
+	}
+	p := &httpProxy{socks: socks}
+	p.transport = &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialSOCKS5(ctx, socks, addr)
+		},
+		IdleConnTimeout: time.Minute,
+	}
+	srv := &http.Server{Handler: p, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	fmt.Fprintf(w, "proxying on %s through %s\n", l.Addr(), socks)
+	if err = srv.Serve(l); errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return errors.Wrap(err, "serving the http proxy")
+}
+
+// httpProxyTarget describes where the connections of the HTTP proxy go.
+func (c *TunnelConfig) httpProxyTarget() string {
+	if c.HTTPProxy.Socks != "" {
+		return "http proxy via " + c.HTTPProxy.Socks
+	}
+	return "http proxy via " + c.Upstream
+}
+
+// httpProxy is the handler of the HTTP proxy.
+type httpProxy struct {
+	transport *http.Transport
+	socks     string
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "this is a proxy, requests must have an absolute url", http.StatusBadRequest)
+		return
+	}
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Header.Del("Proxy-Connection")
+	out.Header.Del("Proxy-Authorization")
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body) //nolint:errcheck // Either side going away is fine.
+}
+
+// connect handles a CONNECT request, piping the client connection to the
+// target.
+func (p *httpProxy) connect(w http.ResponseWriter, r *http.Request) {
+	up, err := dialSOCKS5(r.Context(), p.socks, r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer up.Close()
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+	done := make(chan struct{}, 2)
+	pipe := func(dst net.Conn, src io.Reader) {
+		io.Copy(dst, src) //nolint:errcheck // Either side going away is fine.
+		if hc, ok := dst.(interface{ CloseWrite() error }); ok {
+			hc.CloseWrite() //nolint:errcheck // Best effort.
+		}
+		done <- struct{}{}
+	}
+	// The client may have sent more than the request already.
+	go pipe(up, buf.Reader)
+	go pipe(conn, up)
+	<-done
+	<-done
+}
+
+// dialSOCKS5 connects to target, a host and port, through the SOCKS5 proxy
+// at proxy, without authentication.
+func dialSOCKS5(ctx context.Context, proxy, target string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", target)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, errors.Errorf("%s is not a valid port", portString)
+	}
+	d := &net.Dialer{Timeout: socksTimeout}
+	conn, err := d.DialContext(ctx, "tcp", proxy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "connecting to socks proxy %s", proxy)
+	}
+	conn.SetDeadline(time.Now().Add(socksTimeout)) //nolint:errcheck // Then the handshake fails.
+	if err = socksHandshake(conn, host, port); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "connecting to %s through %s", target, proxy)
+	}
+	conn.SetDeadline(time.Time{}) //nolint:errcheck // Then the connection fails.
+	return conn, nil
+}
+
+// socksHandshake asks the SOCKS5 proxy at the other end of conn to connect
+// to host and port.
+func socksHandshake(conn net.Conn, host string, port int) error {
+	// Version 5, a single method: no authentication.
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return errors.Wrap(err, "greeting socks proxy")
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return errors.Wrap(err, "reading socks greeting")
+	}
+	if reply[0] != 5 || reply[1] != 0 {
+		return errors.New("the socks proxy requires authentication")
+	}
+	// Version 5, CONNECT, reserved, then the address.
+	req := []byte{5, 1, 0}
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		req = append(append(req, 1), ip.To4()...)
+	case ip != nil:
+		req = append(append(req, 4), ip.To16()...)
+	case len(host) > 255:
+		return errors.Errorf("host name %s is too long", host)
+	default:
+		req = append(append(req, 3, byte(len(host))), host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return errors.Wrap(err, "sending socks request")
+	}
+	// Version, reply, reserved and address type, then the bound address.
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return errors.Wrap(err, "reading socks reply")
+	}
+	if header[1] != 0 {
+		if reason, ok := socksReplies[header[1]]; ok {
+			return errors.New(reason)
+		}
+		return errors.Errorf("socks reply %d", header[1])
+	}
+	var skip int
+	switch header[3] {
+	case 1:
+		skip = net.IPv4len + 2
+	case 4:
+		skip = net.IPv6len + 2
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return errors.Wrap(err, "reading socks reply")
+		}
+		skip = int(length[0]) + 2
+	default:
+		return errors.Errorf("unknown socks address type %d", header[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip))
+	return errors.Wrap(err, "reading socks reply")
+}
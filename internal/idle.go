@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errIdle is the reason tunnel processes are stopped for when nobody used
+// them for their idle timeout.
+var errIdle = errors.New("idle")
+
+// applyIdleTimeout stops the tunnel once no connection went through it for its
+// idle timeout. The caller must hold the tunnel lock.
+func (t *Tunnel) applyIdleTimeout(now time.Time) {
+	timeout := t.config.IdleTimeout.Duration
+	if timeout <= 0 || t.balancer == nil || t.killReason != nil || (t.status != Open && t.status != Degraded) {
+		return
+	}
+	last, active := t.balancer.lastActivity()
+	if active {
+		return
+	}
+	if last.Before(t.startedAt) {
+		last = t.startedAt
+	}
+	if now.Sub(last) >= timeout {
+		t.killFor(errIdle)
+	}
+}
+
+// enterIdle marks the tunnel as Idle once its process is gone, releasing its
+// local port unless the tunnel is on demand, in which case it waits for the
+// next connection. The caller must hold the tunnel lock.
+func (t *Tunnel) enterIdle() {
+	if t.config.OnDemand && t.balancer != nil {
+		t.sleepOnDemand()
+		return
+	}
+	t.enterPaused()
+	t.status = Idle
+}
+
+// lastActivity returns when the last connection went through the balancer,
+// and whether some are going through right now.
+func (b *balancer) lastActivity() (time.Time, bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	var last time.Time
+	for _, f := range b.forwards {
+		if f.conns > 0 {
+			return time.Time{}, true
+		}
+		if f.lastUsed.After(last) {
+			last = f.lastUsed
+		}
+	}
+	return last, false
+}
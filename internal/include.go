@@ -0,0 +1,267 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// configDirVar is replaced by the directory of the config file it appears in.
+const configDirVar = "${CONFIG_DIR}"
+
+// loadDocument reads a config file into its generic json form, with the files
+// it includes merged in first. Legacy array configs become a document with
+// just tunnels, and so do config directories, which are added to dirs. The
+// including set holds the files being loaded, to catch include cycles.
+func loadDocument(path string, including map[string]bool, dirs *[]string) (map[string]interface{}, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving %s", path)
+	}
+	if including[abs] {
+		return nil, errors.Errorf("include cycle through %s", path)
+	}
+	including[abs] = true
+	defer delete(including, abs)
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		*dirs = append(*dirs, abs)
+		return loadTunnelDir(abs)
+	}
+	b, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(abs)
+	doc := map[string]interface{}{}
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		tunnels := []interface{}{}
+		err = unmarshalConfig(path, b, &tunnels)
+		doc["tunnels"] = tunnels
+	} else {
+		err = unmarshalConfig(path, b, &doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	setTunnelDirs(doc, dir)
+	if settings, ok := doc["settings"].(map[string]interface{}); ok {
+		if logs, ok := settings["logs"].(map[string]interface{}); ok {
+			if logDir, ok := logs["dir"].(string); ok && logDir != "" && !filepath.IsAbs(logDir) {
+				logs["dir"] = filepath.Join(dir, logDir)
+			}
+		}
+	}
+	if profiles, ok := doc["profiles"].(map[string]interface{}); ok {
+		for _, profile := range profiles {
+			if obj, ok := profile.(map[string]interface{}); ok {
+				setTunnelDirs(obj, dir)
+			}
+		}
+	}
+	includes, _ := doc["include"].([]interface{})
+	delete(doc, "include")
+	res := map[string]interface{}{}
+	for _, include := range includes {
+		name, ok := include.(string)
+		if !ok {
+			return nil, errors.Errorf("%s: include must be a list of paths", path)
+		}
+		// Includes are relative to the including file.
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(path), name)
+		}
+		included, err := loadDocument(name, including, dirs)
+		if err != nil {
+			return nil, err
+		}
+		res = mergeDocuments(res, included)
+	}
+	return mergeDocuments(res, doc), nil
+}
+
+// readConfigFile reads a config file, with the config dir variable replaced.
+func readConfigFile(path string) ([]byte, error) {
+	b, err := readPlainFile(path)
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving %s", path)
+	}
+	// Escape the directory as a json string, without the quotes.
+	escaped, _ := json.Marshal(filepath.Dir(abs))
+	return bytes.ReplaceAll(b, []byte(configDirVar), escaped[1:len(escaped)-1]), nil
+}
+
+// unmarshalConfig unmarshals the content b of a config file into v, telling
+// the line of syntax errors.
+func unmarshalConfig(path string, b []byte, v interface{}) error {
+	err := json.Unmarshal(b, v)
+	if err == nil {
+		return nil
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line := bytes.Count(b[:syntaxErr.Offset], []byte("\n")) + 1
+		return errors.Wrapf(err, "unmarshaling configs of %s:%d", path, line)
+	}
+	return errors.Wrapf(err, "unmarshaling configs of %s", path)
+}
+
+// tunnelFiles returns the json files of a config directory, sorted.
+func tunnelFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading directory %s", dir)
+	}
+	// ReadDir sorts by name already.
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		files = append(files, filepath.Join(dir, e.Name()))
+	}
+	return files, nil
+}
+
+// loadTunnelDir reads a config directory into a document, each of its json
+// files defining one tunnel named after the file unless it sets its name.
+func loadTunnelDir(dir string) (map[string]interface{}, error) {
+	files, err := tunnelFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	tunnels := make([]interface{}, 0, len(files))
+	for _, path := range files {
+		b, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		tunnel := map[string]interface{}{}
+		if err = unmarshalConfig(path, b, &tunnel); err != nil {
+			return nil, err
+		}
+		tunnel["name"] = dirTunnelName(path, tunnel)
+		tunnels = append(tunnels, tunnel)
+	}
+	doc := map[string]interface{}{"tunnels": tunnels}
+	setTunnelDirs(doc, dir)
+	return doc, nil
+}
+
+// dirTunnelName returns the name of the tunnel defined by a file of a config
+// directory, the name of the file unless it sets one.
+func dirTunnelName(path string, tunnel map[string]interface{}) string {
+	if name, _ := tunnel["name"].(string); name != "" {
+		return name
+	}
+	return strings.TrimSuffix(filepath.Base(path), ".json")
+}
+
+// setTunnelDirs makes the paths of the tunnels of the config document, and
+// of its defaults, relative to the directory of its file rather than to where
+// tmancer runs: their dir if set, then their pid files and certificates
+// relative to that dir.
+func setTunnelDirs(doc map[string]interface{}, dir string) {
+	objs := []map[string]interface{}{}
+	if defaults, ok := doc["defaults"].(map[string]interface{}); ok {
+		objs = append(objs, defaults)
+	}
+	tunnels, _ := doc["tunnels"].([]interface{})
+	for _, t := range tunnels {
+		if obj, ok := t.(map[string]interface{}); ok {
+			objs = append(objs, obj)
+		}
+	}
+	for _, obj := range objs {
+		resolvePath(obj, "dir", dir)
+		tunnelDir := dir
+		if d, _ := obj["dir"].(string); d != "" {
+			tunnelDir = d
+		}
+		if tls, ok := obj["tls"].(map[string]interface{}); ok {
+			for _, key := range []string{"cert_file", "key_file", "ca_file", "client_cert_file", "client_key_file"} {
+				resolvePath(tls, key, tunnelDir)
+			}
+		}
+		dependents, _ := obj["dependents"].([]interface{})
+		for _, d := range dependents {
+			if dep, ok := d.(map[string]interface{}); ok {
+				resolvePath(dep, "pid_file", tunnelDir)
+			}
+		}
+	}
+}
+
+// resolvePath makes the path at key of obj relative to dir, unless it is
+// unset, absolute or starts with a template.
+func resolvePath(obj map[string]interface{}, key, dir string) {
+	path, _ := obj[key].(string)
+	if path == "" || filepath.IsAbs(path) || strings.HasPrefix(path, "{{") {
+		return
+	}
+	obj[key] = filepath.Join(dir, path)
+}
+
+// mergeDocuments merges the config document over into base. Tunnels of over
+// replace the tunnels of base with the same name, objects such as settings
+// are merged recursively and anything else is replaced.
+func mergeDocuments(base, over map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(base))
+	for k, v := range base {
+		res[k] = v
+	}
+	for k, v := range over {
+		if k == "tunnels" {
+			res[k] = mergeTunnels(res[k], v)
+			continue
+		}
+		baseObj, baseIsObj := res[k].(map[string]interface{})
+		obj, isObj := v.(map[string]interface{})
+		if baseIsObj && isObj {
+			res[k] = mergeDocuments(baseObj, obj)
+			continue
+		}
+		res[k] = v
+	}
+	return res
+}
+
+// mergeTunnels returns the base tunnels with the ones of over replacing those
+// with the same name, in place, and the new ones appended.
+func mergeTunnels(base, over interface{}) interface{} {
+	baseList, _ := base.([]interface{})
+	overList, ok := over.([]interface{})
+	if !ok {
+		// Let the typed unmarshaling report it.
+		return over
+	}
+	res := append([]interface{}{}, baseList...)
+	for _, t := range overList {
+		name := tunnelName(t)
+		replaced := false
+		for i := range res {
+			if name != "" && tunnelName(res[i]) == name {
+				res[i] = t
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+func tunnelName(t interface{}) string {
+	obj, _ := t.(map[string]interface{})
+	name, _ := obj["name"].(string)
+	return name
+}
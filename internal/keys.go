@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// stty runs stty on the terminal attached to stdin.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), errors.Wrap(err, "running stty")
+}
+
+// ReadKeys switches the terminal to reading single keys, without echo, and
+// sends the keys pressed, a lone escape key being sent as an escape and a
+// NUL. The returned function restores the terminal.
+func ReadKeys() (<-chan byte, func(), error) {
+	if !isTerminal(os.Stdin) {
+		return nil, nil, errors.New("stdin is not a terminal")
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = stty("-icanon", "-echo", "min", "1"); err != nil {
+		return nil, nil, err
+	}
+	keys := make(chan byte)
+	go func() {
+		defer close(keys)
+		b := make([]byte, 16)
+		for {
+			n, err := os.Stdin.Read(b)
+			if err != nil {
+				return
+			}
+			for _, k := range b[:n] {
+				keys <- k
+			}
+			// The sequences of the arrow keys come in a single read, a
+			// lone escape key is followed by a NUL to tell it apart.
+			if n == 1 && b[0] == '\x1b' {
+				keys <- 0
+			}
+		}
+	}()
+	restore := func() {
+		_, _ = stty(saved)
+	}
+	return keys, restore, nil
+}
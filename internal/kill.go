@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultKillGrace = 5 * time.Second
+
+// stopSignal returns the signal used to ask the tunnel process to terminate.
+// The flag is false if the configured signal is not supported, in which case
+// SIGTERM is returned.
+func (c *TunnelConfig) stopSignal() (syscall.Signal, bool) {
+	if c.StopSignal == "" {
+		return syscall.SIGTERM, true
+	}
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(c.StopSignal), "SIG")]
+	if !ok {
+		return syscall.SIGTERM, false
+	}
+	return sig, true
+}
+
+// terminate asks the tunnel process group to terminate, escalating to SIGKILL
+// if it is still alive after the grace period. It does not wait for the
+// process to exit, use the exited channel for that. The caller must hold the
+// tunnel lock.
+func (t *Tunnel) terminate() {
+	if t.cmd == nil || t.cmd.Process == nil || t.exited == nil {
+		return
+	}
+	sig, _ := t.config.stopSignal()
+	terminateGroup(t.cmd.Process.Pid, sig, t.config.KillGrace.Or(defaultKillGrace), t.exited, t.config.Name)
+}
+
+// terminateGroup sends sig to the process group led by pid, then SIGKILL if
+// exited is not closed within grace.
+func terminateGroup(pid int, sig syscall.Signal, grace time.Duration, exited <-chan struct{}, name string) {
+	if err := signalGroup(pid, sig); err != nil {
+		fmt.Printf("Error while terminating %s: %v\n", name, err)
+	}
+	go func() {
+		select {
+		case <-exited:
+		case <-time.After(grace):
+			if err := signalGroup(pid, syscall.SIGKILL); err != nil {
+				fmt.Printf("Error while killing %s: %v\n", name, err)
+			}
+		}
+	}()
+}
+
+// stop terminates the tunnel process and waits for it to exit. The caller
+// must not hold the tunnel lock.
+func (t *Tunnel) stop() {
+	t.Lock()
+	exited := t.exited
+	t.terminate()
+	t.Unlock()
+	if exited == nil {
+		return
+	}
+	select {
+	case <-exited:
+	case <-time.After(t.config.KillGrace.Or(defaultKillGrace) + time.Second):
+	}
+}
+
+// killFor terminates the tunnel process and records why.
+func (t *Tunnel) killFor(reason error) {
+	t.killReason = reason
+	t.terminate()
+}
+
+// stoppedOnPurpose handles the exit of a process tmancer stopped to pause or
+// restart the tunnel, e.g. after a network change, rather than because
+// something was wrong with it. It tells whether this was the case. The caller
+// must hold the tunnel lock.
+func (t *Tunnel) stoppedOnPurpose() bool {
+	switch errors.Cause(t.killReason) {
+	case errOutsideWorkHours, errPausedOnDemand:
+		t.enterPaused()
+	case errOutsideActiveHours:
+		t.enterScheduled()
+	case errRestartRequested, errNetworkChanged, errWokeUp:
+		t.reset()
+	case errIdle:
+		t.enterIdle()
+	case errPreconditionUnmet:
+		t.reset()
+		t.waitForPreconditions()
+	default:
+		return false
+	}
+	t.killReason = nil
+	return true
+}
@@ -0,0 +1,40 @@
+package internal
+
+import "time"
+
+// latencySamples is the number of health probes the latency of a tunnel is
+// averaged over.
+const latencySamples = 5
+
+// recordLatency adds the round trip of a successful health probe to the
+// latency of the tunnel. The caller must hold the tunnel lock.
+func (t *Tunnel) recordLatency(d time.Duration) {
+	t.latencies = append(t.latencies, d)
+	if len(t.latencies) > latencySamples {
+		t.latencies = t.latencies[1:]
+	}
+}
+
+// latency returns the average round trip of the latest health probes, 0 if
+// the tunnel is not open or was not probed since it opened.
+func (s *tunnelState) latency() time.Duration {
+	if (s.status != Open && s.status != Degraded) || len(s.latencies) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, d := range s.latencies {
+		total += d
+	}
+	return total / time.Duration(len(s.latencies))
+}
+
+// formatLatency returns a short latency such as "42ms".
+func formatLatency(d time.Duration) string {
+	if d < time.Millisecond {
+		return "<1ms"
+	}
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(10 * time.Millisecond).String()
+}
@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultLogMaxSizeMB  = 10
+	defaultLogMaxAge     = 7 * 24 * time.Hour
+	defaultLogMaxTotalMB = 100
+	// defaultLogDir is where logs are written by default, relative to the
+	// home directory.
+	defaultLogDir = ".tmancer/logs"
+	megabyte      = 1 << 20
+	// rotatedLogLayout is the timestamp added to the name of rotated logs.
+	rotatedLogLayout = "20060102-150405.000"
+)
+
+// LogSettings enables writing the output of the tunnel processes and their
+// status changes to files, one per tunnel, rotated so that long-lived
+// sessions with chatty processes do not fill the disk.
+type LogSettings struct {
+	// Dir is where the logs are written, relative to the config file.
+	// Defaults to ~/.tmancer/logs.
+	Dir string `json:"dir"`
+	// MaxAge is how long rotated logs are kept, defaults to 7 days. Can be
+	// overridden per tunnel.
+	MaxAge Duration `json:"max_age"`
+	// MaxSizeMB is the size at which a log is rotated, defaults to 10. Can be
+	// overridden per tunnel.
+	MaxSizeMB int `json:"max_size_mb"`
+	// MaxTotalMB caps the size of all the rotated logs in Dir, the oldest
+	// ones being removed first. Defaults to 100.
+	MaxTotalMB int `json:"max_total_mb"`
+	// Compress rotated logs with gzip.
+	Compress bool `json:"compress"`
+}
+
+// LogLimits overrides the log retention settings for a tunnel.
+type LogLimits struct {
+	// MaxAge is how long rotated logs are kept.
+	MaxAge Duration `json:"max_age"`
+	// MaxSizeMB is the size at which the log is rotated.
+	MaxSizeMB int `json:"max_size_mb"`
+}
+
+// rotatingLog writes the log of a tunnel, rotating it once it is too large.
+type rotatingLog struct {
+	file *os.File
+	// name of the tunnel, which prefixes the log files.
+	name     string
+	settings LogSettings
+	size     int64
+	m        sync.Mutex
+}
+
+// openLog opens the log of the given tunnel config, nil if logs are disabled.
+func openLog(c *TunnelConfig) (*rotatingLog, error) {
+	if c.logSettings == nil {
+		return nil, nil
+	}
+	settings := *c.logSettings
+	if settings.Dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.Wrap(err, "getting home directory")
+		}
+		settings.Dir = filepath.Join(home, defaultLogDir)
+	}
+	if c.Logs != nil {
+		if c.Logs.MaxAge.Duration != 0 {
+			settings.MaxAge = c.Logs.MaxAge
+		}
+		if c.Logs.MaxSizeMB != 0 {
+			settings.MaxSizeMB = c.Logs.MaxSizeMB
+		}
+	}
+	if err := os.MkdirAll(settings.Dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "creating log directory")
+	}
+	name := c.Name
+	if c.Group != "" {
+		name = c.Group + "-" + strings.TrimPrefix(c.Name, c.Group+":")
+	}
+	l := &rotatingLog{settings: settings, name: name}
+	return l, l.open()
+}
+
+func (l *rotatingLog) path() string {
+	return filepath.Join(l.settings.Dir, l.name+".log")
+}
+
+func (l *rotatingLog) open() error {
+	f, err := os.OpenFile(l.path(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "opening log")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "opening log")
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// WriteLine writes a timestamped line to the log, rotating it if needed.
+// Errors are dropped, logs being best effort.
+func (l *rotatingLog) WriteLine(line string) {
+	if l == nil {
+		return
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.file == nil {
+		return
+	}
+	n, _ := l.file.WriteString(time.Now().Format(time.RFC3339) + " " + line + "\n")
+	l.size += int64(n)
+	maxSize := l.settings.MaxSizeMB
+	if maxSize <= 0 {
+		maxSize = defaultLogMaxSizeMB
+	}
+	if l.size >= int64(maxSize)*megabyte {
+		l.rotate()
+	}
+}
+
+// rotate moves the current log aside, compressing it if needed, and removes
+// the rotated logs exceeding the retention limits. The caller must hold the
+// lock.
+func (l *rotatingLog) rotate() {
+	l.file.Close()
+	l.file = nil
+	rotated := filepath.Join(l.settings.Dir, l.name+"-"+time.Now().Format(rotatedLogLayout)+".log")
+	if err := os.Rename(l.path(), rotated); err == nil && l.settings.Compress {
+		if compressLog(rotated) == nil {
+			os.Remove(rotated)
+		}
+	}
+	l.prune()
+	_ = l.open()
+}
+
+// compressLog writes a gzipped copy of the file at path next to it.
+func compressLog(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "opening log")
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "creating compressed log")
+	}
+	defer out.Close()
+	w := gzip.NewWriter(out)
+	if _, err = io.Copy(w, in); err != nil {
+		return errors.Wrap(err, "compressing log")
+	}
+	return errors.Wrap(w.Close(), "compressing log")
+}
+
+// prune removes the rotated logs of this tunnel older than the max age, then
+// the oldest rotated logs of the directory until they fit in the total cap.
+func (l *rotatingLog) prune() {
+	maxAge := l.settings.MaxAge.Or(defaultLogMaxAge)
+	maxTotal := int64(l.settings.MaxTotalMB)
+	if maxTotal <= 0 {
+		maxTotal = defaultLogMaxTotalMB
+	}
+	maxTotal *= megabyte
+	entries, err := os.ReadDir(l.settings.Dir)
+	if err != nil {
+		return
+	}
+	type rotatedLog struct {
+		modTime time.Time
+		path    string
+		size    int64
+	}
+	var logs []rotatedLog
+	var total int64
+	for _, e := range entries {
+		name := e.Name()
+		// Current logs are named after the tunnel only.
+		if !strings.HasSuffix(name, ".log.gz") && !isRotatedLog(name) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(l.settings.Dir, name)
+		if strings.HasPrefix(name, l.name+"-") && time.Since(info.ModTime()) > maxAge {
+			os.Remove(path)
+			continue
+		}
+		logs = append(logs, rotatedLog{modTime: info.ModTime(), path: path, size: info.Size()})
+		total += info.Size()
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].modTime.Before(logs[j].modTime) })
+	for _, rl := range logs {
+		if total <= maxTotal {
+			break
+		}
+		if os.Remove(rl.path) == nil {
+			total -= rl.size
+		}
+	}
+}
+
+// isRotatedLog tells whether the file name is the one of an uncompressed
+// rotated log, which ends with its rotation timestamp.
+func isRotatedLog(name string) bool {
+	base := strings.TrimSuffix(name, ".log")
+	if base == name || len(base) <= len(rotatedLogLayout) {
+		return false
+	}
+	_, err := time.Parse(rotatedLogLayout, base[len(base)-len(rotatedLogLayout):])
+	return err == nil
+}
+
+// logStatus writes the status of the tunnel to its log when it changed, so
+// that disconnections can be investigated after the fact. The caller must hold
+// the tunnel lock.
+func (t *Tunnel) logStatus() {
+	if t.log == nil || t.status == t.loggedStatus {
+		return
+	}
+	t.loggedStatus = t.status
+	line := "--- status " + t.status.String()
+	if t.err != nil && t.status != Open {
+		line += ": " + errors.Cause(t.err).Error()
+	}
+	t.log.WriteLine(line)
+}
+
+// Close closes the log.
+func (l *rotatingLog) Close() {
+	if l == nil {
+		return
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
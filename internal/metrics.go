@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// metricLabel escapes a label value of the Prometheus text format.
+func metricLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// metricLabels returns the labels identifying the tunnel in its series.
+func metricLabels(c *TunnelConfig) string {
+	return fmt.Sprintf("tunnel=\"%s\",type=\"%s\",target=\"%s\",tags=\"%s\"",
+		metricLabel(c.Name), metricLabel(c.GetType()), metricLabel(c.GetTarget()), metricLabel(strings.Join(c.Tags, ",")))
+}
+
+// writeMetrics renders the metrics of the tunnels in the Prometheus text
+// format.
+func writeMetrics(tunnels []*Tunnel) []byte {
+	// The same state of each tunnel goes through all the metrics.
+	now := time.Now()
+	states := make([]*tunnelState, len(tunnels))
+	labels := make([]string, len(tunnels))
+	for i, t := range tunnels {
+		states[i] = t.published()
+		labels[i] = metricLabels(&states[i].config)
+	}
+	b := &bytes.Buffer{}
+	family := func(name, kind, help string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	family("tmancer_tunnel_status", "gauge", "Whether the tunnel is in the given status.")
+	for i := range tunnels {
+		for s := Close; s <= Scheduled; s++ {
+			fmt.Fprintf(b, "tmancer_tunnel_status{%s,status=\"%s\"} %d\n",
+				labels[i], s, bool01(states[i].status == s))
+		}
+	}
+	family("tmancer_tunnel_up", "gauge", "Whether the tunnel is open.")
+	for i := range tunnels {
+		fmt.Fprintf(b, "tmancer_tunnel_up{%s} %d\n",
+			labels[i], bool01(states[i].isUp()))
+	}
+	family("tmancer_tunnel_age_seconds", "gauge", "How long the tunnel has been open, 0 if it is not.")
+	for i := range tunnels {
+		age, _ := states[i].age(now)
+		fmt.Fprintf(b, "tmancer_tunnel_age_seconds{%s} %g\n",
+			labels[i], age.Seconds())
+	}
+	family("tmancer_tunnel_open_seconds_total", "counter", "Time the tunnel has been open since the session started.")
+	for i := range tunnels {
+		up, _ := states[i].uptime(now)
+		fmt.Fprintf(b, "tmancer_tunnel_open_seconds_total{%s} %g\n", labels[i], up.Seconds())
+	}
+	family("tmancer_tunnel_down_seconds_total", "counter", "Time the tunnel has been failing since the session started.")
+	for i := range tunnels {
+		_, down := states[i].uptime(now)
+		fmt.Fprintf(b, "tmancer_tunnel_down_seconds_total{%s} %g\n", labels[i], down.Seconds())
+	}
+	family("tmancer_tunnel_recent_restarts", "gauge", "Restarts of the tunnel within its flap detection window.")
+	for i := range tunnels {
+		restarts, _ := states[i].restartRate(now)
+		fmt.Fprintf(b, "tmancer_tunnel_recent_restarts{%s} %d\n", labels[i], restarts)
+	}
+	family("tmancer_tunnel_restarts_total", "counter", "Restarts of the tunnel process since the session started, by reason.")
+	for i := range tunnels {
+		for reason, n := range states[i].restartsByReason {
+			fmt.Fprintf(b, "tmancer_tunnel_restarts_total{%s,reason=\"%s\"} %d\n", labels[i], restartReasonNames[reason], n)
+		}
+	}
+	family("tmancer_tunnel_errors_total", "counter", "Failures of the tunnel process since the session started.")
+	for i := range tunnels {
+		fmt.Fprintf(b, "tmancer_tunnel_errors_total{%s} %d\n", labels[i], states[i].errorsTotal)
+	}
+	family("tmancer_tunnel_latency_seconds", "gauge", "Average round trip of the latest health probes, only for probed open tunnels.")
+	for i := range tunnels {
+		if latency := states[i].latency(); latency > 0 {
+			fmt.Fprintf(b, "tmancer_tunnel_latency_seconds{%s} %g\n", labels[i], latency.Seconds())
+		}
+	}
+	family("tmancer_tunnel_connections", "gauge", "Connections going through the tunnel, only for proxied tunnels.")
+	for i := range tunnels {
+		if stats, ok := states[i].connStats(); ok {
+			fmt.Fprintf(b, "tmancer_tunnel_connections{%s} %d\n", labels[i], stats.Conns)
+		}
+	}
+	family("tmancer_tunnel_connections_total", "counter", "Connections proxied through the tunnel since the session started.")
+	for i := range tunnels {
+		if stats, ok := states[i].connStats(); ok {
+			fmt.Fprintf(b, "tmancer_tunnel_connections_total{%s} %d\n", labels[i], stats.Total)
+		}
+	}
+	family("tmancer_tunnel_received_bytes_total", "counter", "Bytes received from the remote end of the proxied tunnel.")
+	for i := range tunnels {
+		if stats, ok := states[i].connStats(); ok {
+			fmt.Fprintf(b, "tmancer_tunnel_received_bytes_total{%s} %d\n", labels[i], stats.BytesIn)
+		}
+	}
+	family("tmancer_tunnel_sent_bytes_total", "counter", "Bytes sent to the remote end of the proxied tunnel.")
+	for i := range tunnels {
+		if stats, ok := states[i].connStats(); ok {
+			fmt.Fprintf(b, "tmancer_tunnel_sent_bytes_total{%s} %d\n", labels[i], stats.BytesOut)
+		}
+	}
+	family("tmancer_session_health", "gauge", "Health score of the session, from 0 to 100.")
+	fmt.Fprintf(b, "tmancer_session_health %d\n", GetSessionHealth(tunnels).Score)
+	return b.Bytes()
+}
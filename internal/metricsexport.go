@@ -0,0 +1,352 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMetricsPrefix   = "tmancer"
+	defaultMetricsInterval = 10 * time.Second
+	metricsExportTimeout   = 10 * time.Second
+	// statsdPacketSize keeps the StatsD datagrams below the usual MTU.
+	statsdPacketSize = 1400
+)
+
+// MetricsExport pushes the metrics of the tunnels to a StatsD daemon or an
+// OpenTelemetry collector, for those whose telemetry does not scrape
+// Prometheus endpoints.
+type MetricsExport struct {
+	// Headers are added to the OTLP requests, e.g. for authentication.
+	Headers map[string]string `json:"headers"`
+	// StatsD is the address of a StatsD daemon, e.g. "127.0.0.1:8125". The
+	// metrics are sent over UDP with DogStatsD tags.
+	StatsD string `json:"statsd"`
+	// OTLP is the URL of an OpenTelemetry collector receiving OTLP over HTTP,
+	// e.g. "http://127.0.0.1:4318".
+	OTLP string `json:"otlp"`
+	// Prefix of the metric names, defaults to "tmancer".
+	Prefix string `json:"prefix"`
+	// Interval between two pushes of the metrics, defaults to 10s. Status
+	// changes are sent to StatsD right away.
+	Interval Duration `json:"interval"`
+}
+
+func (m *MetricsExport) validate() error {
+	if m == nil {
+		return nil
+	}
+	if m.StatsD == "" && m.OTLP == "" {
+		return errors.New("metrics_export needs statsd or otlp")
+	}
+	if m.StatsD != "" {
+		if _, _, err := net.SplitHostPort(m.StatsD); err != nil {
+			return errors.Wrapf(err, "invalid statsd address %q", m.StatsD)
+		}
+	}
+	if m.OTLP != "" {
+		u, err := url.Parse(m.OTLP)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("invalid otlp url %q", m.OTLP)
+		}
+	}
+	return nil
+}
+
+// statusKey counts the status changes of a tunnel to a status.
+type statusKey struct {
+	tunnel string
+	status Status
+}
+
+// MetricsExporter pushes the metrics configured by a MetricsExport.
+type MetricsExporter struct {
+	start time.Time
+	// changes are the status changes waiting to be sent to StatsD.
+	changes chan StatusChange
+	config  *MetricsExport
+	// statusChanges counts the status changes since the session started.
+	statusChanges map[statusKey]int64
+	// sent are the counters as of the last push to StatsD, which only takes
+	// increments.
+	sent map[string]int64
+	m    sync.Mutex
+}
+
+// NewMetricsExporter returns the exporter of the settings, nil if none.
+func NewMetricsExporter(config *MetricsExport) *MetricsExporter {
+	if config == nil {
+		return nil
+	}
+	return &MetricsExporter{
+		start:         time.Now(),
+		changes:       make(chan StatusChange, 100),
+		config:        config,
+		statusChanges: map[statusKey]int64{},
+		sent:          map[string]int64{},
+	}
+}
+
+// StatusChanged counts a status change of a tunnel, see Tunnel.Subscribe.
+func (e *MetricsExporter) StatusChanged(c StatusChange) {
+	e.m.Lock()
+	e.statusChanges[statusKey{tunnel: c.Tunnel, status: c.Status}]++
+	e.m.Unlock()
+	if e.config.StatsD == "" {
+		return
+	}
+	select {
+	case e.changes <- c:
+	default:
+		// The daemon is not keeping up, the next push has the counts.
+	}
+}
+
+// Run pushes the metrics of the tunnels of the session every interval until
+// ctx is done. Failed pushes are dropped, the next ones carrying the totals.
+func (e *MetricsExporter) Run(ctx context.Context, s *Session) {
+	var statsd net.Conn
+	if e.config.StatsD != "" {
+		// UDP, nothing is sent yet.
+		statsd, _ = net.Dial("udp", e.config.StatsD)
+	}
+	if statsd != nil {
+		defer statsd.Close()
+	}
+	ticker := time.NewTicker(e.config.Interval.Or(defaultMetricsInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c := <-e.changes:
+			if statsd != nil {
+				tags := statsdTags("tunnel", c.Tunnel, "status", c.Status.String(), "previous_status", c.Previous.String())
+				sendStatsD(statsd, []string{e.name("tunnel.status_changes") + ":1|c|" + tags})
+			}
+		case <-ticker.C:
+			tunnels := s.Tunnels()
+			if statsd != nil {
+				sendStatsD(statsd, e.statsdLines(tunnels))
+			}
+			if e.config.OTLP != "" {
+				e.pushOTLP(ctx, tunnels) //nolint:errcheck // Best effort, the next push has the totals.
+			}
+		}
+	}
+}
+
+// name returns the name of a metric with the prefix.
+func (e *MetricsExporter) name(name string) string {
+	prefix := e.config.Prefix
+	if prefix == "" {
+		prefix = defaultMetricsPrefix
+	}
+	return prefix + "." + name
+}
+
+// statsdTags returns the DogStatsD tags of the key value pairs.
+func statsdTags(kv ...string) string {
+	escape := strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", " ")
+	tags := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		tags = append(tags, kv[i]+":"+escape.Replace(kv[i+1]))
+	}
+	return "#" + strings.Join(tags, ",")
+}
+
+// sendStatsD sends the lines in as few datagrams as possible.
+func sendStatsD(conn net.Conn, lines []string) {
+	packet := &bytes.Buffer{}
+	flush := func() {
+		if packet.Len() > 0 {
+			conn.Write(packet.Bytes()) //nolint:errcheck // Best effort.
+			packet.Reset()
+		}
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+			flush()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	flush()
+}
+
+// statsdLines returns the gauges of the tunnels and the increments of their
+// counters since the last push.
+func (e *MetricsExporter) statsdLines(tunnels []*Tunnel) []string {
+	lines := make([]string, 0, 3*len(tunnels)+1)
+	increment := func(name string, tags string, total int64) {
+		key := name + tags
+		if delta := total - e.sent[key]; delta > 0 {
+			lines = append(lines, fmt.Sprintf("%s:%d|c|%s", name, delta, tags))
+		}
+		e.sent[key] = total
+	}
+	for _, t := range tunnels {
+		state := t.published()
+		tags := statsdTags("tunnel", state.config.Name)
+		lines = append(lines, fmt.Sprintf("%s:%d|g|%s", e.name("tunnel.up"), bool01(state.isUp()), tags))
+		increment(e.name("tunnel.restarts"), tags, int64(state.restartsTotal))
+		increment(e.name("tunnel.errors"), tags, int64(state.errorsTotal))
+	}
+	return append(lines, fmt.Sprintf("%s:%d|g", e.name("session.health"), GetSessionHealth(tunnels).Score))
+}
+
+// isUp tells whether the tunnel can be used.
+func (s *tunnelState) isUp() bool {
+	return s.status == Open || s.status == Degraded
+}
+
+func bool01(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// OTLP metrics as json, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto.
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	otlpMetric struct {
+		Gauge *otlpData `json:"gauge,omitempty"`
+		Sum   *otlpData `json:"sum,omitempty"`
+		Name  string    `json:"name"`
+	}
+	otlpData struct {
+		DataPoints []otlpDataPoint `json:"dataPoints"`
+		// AggregationTemporality 2 is cumulative.
+		AggregationTemporality int  `json:"aggregationTemporality,omitempty"`
+		IsMonotonic            bool `json:"isMonotonic,omitempty"`
+	}
+	otlpDataPoint struct {
+		StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		AsInt             string          `json:"asInt"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+// otlpMetrics returns the metrics of the tunnels: gauges, and counters since
+// the session started.
+func (e *MetricsExporter) otlpMetrics(tunnels []*Tunnel) []otlpMetric {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	start := strconv.FormatInt(e.start.UnixNano(), 10)
+	attributes := func(kv ...string) []otlpAttribute {
+		attrs := make([]otlpAttribute, 0, len(kv)/2)
+		for i := 0; i+1 < len(kv); i += 2 {
+			attrs = append(attrs, otlpAttribute{Key: kv[i], Value: otlpValue{StringValue: kv[i+1]}})
+		}
+		return attrs
+	}
+	gauge := func(name string) *otlpMetric {
+		return &otlpMetric{Name: e.name(name), Gauge: &otlpData{}}
+	}
+	counter := func(name string) *otlpMetric {
+		return &otlpMetric{Name: e.name(name), Sum: &otlpData{AggregationTemporality: 2, IsMonotonic: true}}
+	}
+	point := func(data *otlpData, cumulative bool, v int64, attrs []otlpAttribute) {
+		p := otlpDataPoint{TimeUnixNano: now, AsInt: strconv.FormatInt(v, 10), Attributes: attrs}
+		if cumulative {
+			p.StartTimeUnixNano = start
+		}
+		data.DataPoints = append(data.DataPoints, p)
+	}
+	up, restarts, errs := gauge("tunnel.up"), counter("tunnel.restarts"), counter("tunnel.errors")
+	for _, t := range tunnels {
+		state := t.published()
+		attrs := attributes("tunnel", state.config.Name)
+		point(up.Gauge, false, int64(bool01(state.isUp())), attrs)
+		point(restarts.Sum, true, int64(state.restartsTotal), attrs)
+		point(errs.Sum, true, int64(state.errorsTotal), attrs)
+	}
+	changes := counter("tunnel.status_changes")
+	e.m.Lock()
+	for key, n := range e.statusChanges {
+		point(changes.Sum, true, n, attributes("tunnel", key.tunnel, "status", key.status.String()))
+	}
+	e.m.Unlock()
+	health := gauge("session.health")
+	point(health.Gauge, false, int64(GetSessionHealth(tunnels).Score), nil)
+	metrics := []otlpMetric{*up, *restarts, *errs, *health}
+	// Collectors refuse sums without data points.
+	if len(changes.Sum.DataPoints) > 0 {
+		metrics = append(metrics, *changes)
+	}
+	return metrics
+}
+
+// pushOTLP posts the metrics of the tunnels to the OTLP collector.
+func (e *MetricsExporter) pushOTLP(ctx context.Context, tunnels []*Tunnel) error {
+	body, err := json.Marshal(otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpValue{StringValue: "tmancer"}},
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "tmancer", Version: Version},
+			Metrics: e.otlpMetrics(tunnels),
+		}},
+	}}})
+	if err != nil {
+		return errors.Wrap(err, "marshaling metrics")
+	}
+	ctx, cancel := context.WithTimeout(ctx, metricsExportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(e.config.OTLP, "/")+"/v1/metrics", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.config.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "pushing metrics")
+	}
+	res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		return errors.Errorf("pushing metrics: %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMTUInterval = 10 * time.Minute
+	// IPv4 and ICMP headers, added to the ping payload size.
+	icmpOverhead = 28
+	// IPv4 and TCP headers, removed from the MTU to get the MSS.
+	tcpOverhead = 40
+	// Ethernet MTU, which is what the payloads are expected to fit in.
+	maxPingPayload = 1500 - icmpOverhead
+	// Minimum MTU every IPv4 host must accept.
+	minPingPayload = 576 - icmpOverhead
+	pingTimeout    = 3 * time.Second
+)
+
+// VPN marks a tunnel going through a VPN, whose path MTU is probed so that
+// fragmentation issues (large payloads hanging while small ones go through)
+// are reported instead of showing up as mysterious stalls.
+type VPN struct {
+	// ProbeHost is a host on the other side of the VPN which answers pings,
+	// typically the remote end of the tunnel.
+	ProbeHost string `json:"probe_host"`
+	// Interval between probes, defaults to 10m.
+	Interval Duration `json:"interval"`
+}
+
+// ping sends a single ping with the given payload size forbidding
+// fragmentation, and tells whether it got an answer.
+//
+//nolint:gosec // I'm happy for now.
+func ping(ctx context.Context, host string, size int) bool {
+	s := strconv.Itoa(size)
+	var args []string
+	switch runtime.GOOS {
+	case "darwin":
+		args = []string{"-D", "-s", s, "-c", "1", "-t", "2", host}
+	case "windows":
+		args = []string{"-f", "-l", s, "-n", "1", "-w", "2000", host}
+	default:
+		args = []string{"-M", "do", "-s", s, "-c", "1", "-W", "2", host}
+	}
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	return exec.CommandContext(ctx, "ping", args...).Run() == nil
+}
+
+// probePathMTU looks for the largest unfragmented payload which reaches host.
+// The flag is false if there is no MTU issue, either because full size
+// payloads go through or because the host cannot be reached at all.
+func probePathMTU(ctx context.Context, host string) (mtu int, issue bool) {
+	if ping(ctx, host, maxPingPayload) || !ping(ctx, host, minPingPayload) {
+		return 0, false
+	}
+	// Binary search, lo always goes through and hi never does.
+	lo, hi := minPingPayload, maxPingPayload
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if ping(ctx, host, mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo + icmpOverhead, true
+}
+
+// watchMTU periodically probes the path MTU of a VPN-backed tunnel and keeps
+// its warning up to date.
+func (t *Tunnel) watchMTU(ctx context.Context) {
+	vpn := t.config.VPN
+	for {
+		var warning string
+		if mtu, issue := probePathMTU(ctx, vpn.ProbeHost); issue {
+			warning = fmt.Sprintf("MTUIssue: path MTU to %s is %d, clamp the VPN MTU to %d or the TCP MSS to %d",
+				vpn.ProbeHost, mtu, mtu, mtu-tcpOverhead)
+		}
+		t.Lock()
+		t.warning = warning
+		t.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(vpn.Interval.Or(defaultMTUInterval)):
+		}
+	}
+}
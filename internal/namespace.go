@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultNamespaceInterval = 30 * time.Second
+
+// K8sNamespace makes a config entry forward every service of a namespace,
+// kubefwd style, instead of listing them one by one. The entry is a template:
+// each service gets a k8s tunnel named "<service>.<entry name>" with the rest
+// of the entry config, which is kept in sync as services come and go.
+type K8sNamespace struct {
+	// Context is the kubectl context, defaults to the current one.
+	Context   string `json:"context"`
+	Namespace string `json:"namespace"`
+	// Ports is the range local ports are picked from, e.g. "20000-20099". By
+	// default services are forwarded on their own port, shifted if
+	// privileged, or on the next free one.
+	Ports string `json:"ports"`
+	// Interval between two lookups of the services, defaults to 30s.
+	Interval Duration `json:"interval"`
+}
+
+// extractNamespaces moves the k8s_namespace entries out of the tunnels, their
+// tunnels are only known once the services are listed, see WatchNamespaces.
+func (c *Config) extractNamespaces() {
+	tunnels := make([]TunnelConfig, 0, len(c.Tunnels))
+	for i := range c.Tunnels {
+		if c.Tunnels[i].K8sNamespace == nil {
+			tunnels = append(tunnels, c.Tunnels[i])
+			continue
+		}
+		c.namespaces = append(c.namespaces, c.Tunnels[i])
+	}
+	c.Tunnels = tunnels
+}
+
+// namespaceTunnels returns the configs of the tunnels forwarding the services
+// of list, used mapping the local ports taken to the tunnel names. Tunnels
+// which already exist keep their port.
+func (c *TunnelConfig) namespaceTunnels(list *serviceList, used map[int]string) ([]TunnelConfig, error) {
+	var ports []int
+	if c.K8sNamespace.Ports != "" {
+		var err error
+		if ports, err = parsePortRange(c.K8sNamespace.Ports); err != nil {
+			return nil, errors.Wrap(err, c.Name)
+		}
+	}
+	var tunnels []TunnelConfig
+	for _, f := range serviceForwards(list) {
+		t := *c
+		t.Name = f.name + "." + c.Name
+		t.K8sNamespace = nil
+		t.namespace = c.Name
+		t.K8s = &K8sInfo{
+			Context:   c.K8sNamespace.Context,
+			Namespace: f.namespace,
+			Service:   "svc/" + f.service,
+			Port:      f.port,
+		}
+		var err error
+		if ports == nil {
+			t.LocalPort, err = pickLocalPort(used, t.Name, defaultLocalPort(f.port))
+		} else {
+			t.LocalPort, err = pickRangePort(used, t.Name, ports)
+		}
+		if err != nil {
+			return nil, err
+		}
+		tunnels = append(tunnels, t)
+	}
+	return tunnels, nil
+}
+
+// pickRangePort returns the first port of the range which is not used by
+// another tunnel than name, and marks it as used by name.
+func pickRangePort(used map[int]string, name string, ports []int) (int, error) {
+	for _, port := range ports {
+		if owner, ok := used[port]; ok && owner == name {
+			return port, nil
+		}
+	}
+	for _, port := range ports {
+		if _, ok := used[port]; !ok {
+			used[port] = name
+			return port, nil
+		}
+	}
+	return 0, errors.Errorf("%s: no free local port in the range", name)
+}
+
+// WatchNamespaces keeps the tunnels of the k8s_namespace entries of the config
+// in sync with the services of their namespace: new services are forwarded,
+// the tunnels of the services which went away are removed. Tunnels are left as
+// they are when the services cannot be listed. It returns when ctx is done.
+func WatchNamespaces(ctx context.Context, s *Session, c *Config) {
+	var wg sync.WaitGroup
+	for i := range c.namespaces {
+		wg.Add(1)
+		go func(entry *TunnelConfig) {
+			defer wg.Done()
+			interval := entry.K8sNamespace.Interval.Or(defaultNamespaceInterval)
+			for {
+				syncNamespace(ctx, s, entry) //nolint:errcheck // Tried again at the next interval.
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(interval):
+				}
+			}
+		}(&c.namespaces[i])
+	}
+	wg.Wait()
+}
+
+// syncNamespace lists the services of the namespace of the entry, and adds
+// and removes tunnels to the session to match them.
+func syncNamespace(ctx context.Context, s *Session, entry *TunnelConfig) error {
+	list, err := listServices(ctx, DiscoverOptions{Context: entry.K8sNamespace.Context, Namespace: entry.K8sNamespace.Namespace})
+	if err != nil {
+		return err
+	}
+	used := map[int]string{}
+	current := map[string]*K8sInfo{}
+	for _, t := range s.Tunnels() {
+		c := t.published().config
+		used[c.LocalPort] = c.Name
+		if c.namespace == entry.Name {
+			current[c.Name] = c.K8s
+		}
+	}
+	tunnels, err := entry.namespaceTunnels(list, used)
+	if err != nil {
+		return err
+	}
+	// Carry on past failures, e.g. a port taken meanwhile, so that one
+	// service does not hold the others up. The first one is returned.
+	var first error
+	keep := func(err error) {
+		if first == nil {
+			first = err
+		}
+	}
+	for i := range tunnels {
+		k8s, ok := current[tunnels[i].Name]
+		delete(current, tunnels[i].Name)
+		if ok && *k8s == *tunnels[i].K8s {
+			continue
+		}
+		// The port of the service changed.
+		if ok {
+			if _, err = s.Remove(tunnels[i].Name); err != nil {
+				keep(err)
+				continue
+			}
+		}
+		if _, err = s.Add(tunnels[i], true); err != nil {
+			keep(err)
+		}
+	}
+	for name := range current {
+		if _, err = s.Remove(name); err != nil {
+			keep(err)
+		}
+	}
+	return errors.Wrapf(first, "syncing %s", entry.Name)
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultNetworkInterval = 5 * time.Second
+
+// NetworkWatch tells how the session notices that the network changed under
+// its tunnels, e.g. after switching Wi-Fi or waking up from sleep.
+type NetworkWatch struct {
+	// Interval between checks, defaults to 5s.
+	Interval Duration `json:"interval"`
+	// Disabled leaves the tunnels to notice by themselves.
+	Disabled bool `json:"disabled"`
+}
+
+// Reasons tunnel processes are stopped for when the network changed under
+// them.
+var (
+	errNetworkChanged = errors.New("network changed")
+	errWokeUp         = errors.New("woke up from sleep")
+)
+
+// networkAddrs returns the addresses of the network interfaces which are up,
+// loopback and link-local ones aside.
+func networkAddrs() (map[string]bool, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing network interfaces")
+	}
+	addrs := map[string]bool{}
+	for i := range interfaces {
+		if interfaces[i].Flags&net.FlagUp == 0 || interfaces[i].Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifAddrs, err := interfaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range ifAddrs {
+			// Link-local addresses come and go with virtual interfaces, e.g.
+			// those of containers, tunnels do not go through them.
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			addrs[interfaces[i].Name+" "+a.String()] = true
+		}
+	}
+	return addrs, nil
+}
+
+// missingAddrs returns the addresses of from which are not in to, sorted.
+func missingAddrs(from, to map[string]bool) []string {
+	var missing []string
+	for a := range from {
+		if !to[a] {
+			missing = append(missing, a)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// WatchNetwork reconnects the tunnels of the session when the network changes
+// under them, rather than leaving them broken until their processes notice,
+// which can take minutes. Running tunnels are reopened when the system wakes
+// up from sleep and when an address they may go through goes away, failing
+// tunnels are retried right away when the system wakes up or gets a new
+// address. It returns when ctx is done.
+func WatchNetwork(ctx context.Context, s *Session, c *NetworkWatch) {
+	if c != nil && c.Disabled {
+		return
+	}
+	interval := defaultNetworkInterval
+	if c != nil {
+		interval = c.Interval.Or(defaultNetworkInterval)
+	}
+	addrs, _ := networkAddrs()
+	last := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		// The monotonic clock stands still while the system sleeps, the wall
+		// clock does not.
+		slept := now.Round(0).Sub(last.Round(0))-now.Sub(last) > interval
+		last = now
+		current, err := networkAddrs()
+		if err != nil {
+			continue
+		}
+		lost, gained := missingAddrs(addrs, current), missingAddrs(current, addrs)
+		addrs = current
+		var reason error
+		switch {
+		case slept:
+			reason = errWokeUp
+		case len(lost) > 0:
+			reason = errors.Wrapf(errNetworkChanged, "lost %s", strings.Join(lost, ", "))
+		case len(gained) == 0:
+			continue
+		}
+		for _, t := range s.Tunnels() {
+			t.Lock()
+			t.reconnect(reason)
+			t.Unlock()
+		}
+	}
+}
+
+// reconnect reopens the tunnel if it is running and reason is not nil, as it
+// is likely broken, or retries it right away if it is failing. This does not
+// count towards the restart policy nor flapping. The caller must hold the
+// tunnel lock.
+func (t *Tunnel) reconnect(reason error) {
+	switch t.status {
+	case Opening, Open, Degraded:
+		if reason != nil && t.killReason == nil {
+			t.killFor(reason)
+		}
+	case Close, Reopening, Error, Signal, Cooper, PortBusy, Throttled:
+		t.retryAt = time.Time{}
+	}
+}
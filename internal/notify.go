@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const notifyTimeout = 5 * time.Second
+
+// notify shows a desktop notification, on a best-effort basis: nothing
+// happens if the platform has no way of showing one.
+//
+//nolint:gosec // I'm happy for now.
+func notify(title, message string) {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		script := "display notification " + strconv.Quote(message) + " with title " + strconv.Quote(title)
+		cmd = exec.CommandContext(ctx, "osascript", "-e", script)
+	default:
+		cmd = exec.CommandContext(ctx, "notify-send", title, message)
+	}
+	_ = cmd.Run()
+}
+
+// Events tmancer notifies about.
+const (
+	// EventFailed is when a tunnel fails or its port is busy, once until it
+	// recovers.
+	EventFailed = "failed"
+	// EventFlapping is when a tunnel starts cooling off after restarting too
+	// often.
+	EventFlapping = "flapping"
+	// EventGaveUp is when a tunnel fails for good.
+	EventGaveUp = "gave_up"
+	// EventRecovered is when a tunnel is open again after a failure.
+	EventRecovered = "recovered"
+	// EventFailedOver is when a tunnel switches to its next endpoint.
+	EventFailedOver = "failed_over"
+)
+
+// Notifications tells who to notify when tunnels fail and recover.
+type Notifications struct {
+	// Webhooks are posted to on every event.
+	Webhooks []Webhook `json:"webhooks"`
+	// Desktop shows a desktop notification on every event.
+	Desktop bool `json:"desktop"`
+}
+
+// validate checks the webhooks.
+func (n *Notifications) validate() error {
+	if n == nil {
+		return nil
+	}
+	for i := range n.Webhooks {
+		if err := n.Webhooks[i].validate(); err != nil {
+			return errors.Wrapf(err, "notifications.webhooks[%d]", i)
+		}
+	}
+	return nil
+}
+
+// notification is an event about a tunnel.
+type notification struct {
+	event          string
+	title          string
+	message        string
+	name           string
+	status         string
+	previousStatus string
+	hint           string
+	port           int
+	critical       bool
+}
+
+// notifyStatus notifies about the tunnel failing or recovering, once per
+// failure rather than on every retry. The caller must hold the tunnel lock.
+func (t *Tunnel) notifyStatus() {
+	n := t.config.notifications
+	if n == nil || t.status == t.notifiedStatus {
+		return
+	}
+	previous := t.notifiedStatus
+	t.notifiedStatus = t.status
+	e := notification{
+		name:           t.config.Name,
+		status:         t.status.String(),
+		previousStatus: previous.String(),
+		port:           t.config.LocalPort,
+		critical:       t.config.Critical,
+	}
+	switch t.status {
+	case Error, PortBusy:
+		if t.alerted {
+			return
+		}
+		e.event = EventFailed
+		e.title = fmt.Sprintf("tmancer: %s failed", t.config.Name)
+		if t.status == PortBusy {
+			e.title = fmt.Sprintf("tmancer: %s port %d is busy", t.config.Name, t.config.LocalPort)
+		}
+		if t.err != nil {
+			e.message = errors.Cause(t.err).Error()
+		}
+	case Flapping:
+		e.event = EventFlapping
+		e.title = fmt.Sprintf("tmancer: %s is flapping", t.config.Name)
+		if t.err != nil {
+			e.message = t.err.Error()
+		}
+	case Failed:
+		e.event = EventGaveUp
+		e.title = fmt.Sprintf("tmancer: %s gave up", t.config.Name)
+		if t.err != nil {
+			e.message = t.err.Error()
+		}
+	case Open:
+		if !t.alerted {
+			return
+		}
+		t.alerted = false
+		e.event = EventRecovered
+		e.title = fmt.Sprintf("tmancer: %s recovered", t.config.Name)
+		e.message = fmt.Sprintf("open again on port %d", t.config.LocalPort)
+	default:
+		return
+	}
+	if t.status != Open {
+		t.alerted = true
+		e.hint = t.hint
+	}
+	t.sendNotification(&e)
+}
+
+// sendNotification shows the notification on the desktop, if enabled and not
+// during quiet hours, and posts it to the webhooks which want it, during quiet
+// hours only to those ignoring them. The caller must hold the tunnel lock.
+func (t *Tunnel) sendNotification(e *notification) {
+	n := t.config.notifications
+	if n == nil {
+		return
+	}
+	if n.Desktop {
+		message := e.message
+		if e.hint != "" {
+			message += " (try: " + e.hint + ")"
+		}
+		t.notify(e.title, message)
+	}
+	quiet := t.config.schedule.IsQuiet(time.Now())
+	for i := range n.Webhooks {
+		if w := &n.Webhooks[i]; w.wants(e) && (!quiet || w.IgnoreQuietHours) {
+			go w.post(e, t.log)
+		}
+	}
+}
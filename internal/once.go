@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// onceRenderer displays the first snapshot and ignores the others, for the
+// tools capturing the output of tmancer which only want to know how the
+// session started.
+type onceRenderer struct {
+	r    Renderer
+	done bool
+}
+
+// NewOnceRenderer returns a renderer displaying a single snapshot with the
+// renderer backend of the settings. The table is printed as plain lines, as
+// there is nothing to refresh in place.
+func NewOnceRenderer(s *Settings, w io.Writer) (Renderer, error) {
+	if s.Renderer != "" && s.Renderer != RendererTable {
+		r, err := NewRenderer(s, w)
+		if err != nil {
+			return nil, err
+		}
+		return &onceRenderer{r: r}, nil
+	}
+	columns, err := parseColumns(s.Columns)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkSort(s.Sort); err != nil {
+		return nil, err
+	}
+	return &onceRenderer{r: &plainTableRenderer{
+		w:            w,
+		table:        tableRenderer{formats: s.Formats, columns: columns},
+		order:        s.Sort,
+		problemsOnly: s.ProblemsOnly,
+	}}, nil
+}
+
+func (r *onceRenderer) Render(s *Snapshot) {
+	if r.done {
+		return
+	}
+	r.done = true
+	r.r.Render(s)
+}
+
+func (r *onceRenderer) Close() {
+	r.r.Close()
+}
+
+// plainTableRenderer prints the table without moving the cursor around.
+type plainTableRenderer struct {
+	w            io.Writer
+	order        string
+	table        tableRenderer
+	problemsOnly bool
+}
+
+func (r *plainTableRenderer) Render(s *Snapshot) {
+	arranged := *s
+	arranged.Tunnels = arrange(s.Tunnels, r.order, r.problemsOnly)
+	for _, line := range r.table.format(&arranged) {
+		fmt.Fprintln(r.w, strings.TrimRight(line, " "))
+	}
+}
+
+func (r *plainTableRenderer) Close() {}
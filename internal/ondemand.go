@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"time"
+)
+
+// sleep makes the balancer hold the new connections until wakeUp is called,
+// asking the tunnel to open through wake. This is how on demand tunnels listen
+// on their local port without running their process.
+func (b *balancer) sleep() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.asleep {
+		return
+	}
+	b.asleep = true
+	b.awake = make(chan struct{})
+}
+
+// wakeUp lets the connections held while asleep go through.
+func (b *balancer) wakeUp() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if !b.asleep {
+		return
+	}
+	b.asleep = false
+	close(b.awake)
+}
+
+// waitAwake holds a new connection until the tunnel is open, asking for it to
+// be opened if the balancer is asleep. It tells whether the balancer was
+// asleep and whether the connection can go through.
+func (b *balancer) waitAwake() (woke, ok bool) {
+	b.m.Lock()
+	awake, asleep := b.awake, b.asleep
+	b.m.Unlock()
+	if !asleep {
+		return false, true
+	}
+	select {
+	case b.wake <- struct{}{}:
+	default:
+		// Already asked.
+	}
+	timer := time.NewTimer(b.getConfig().StartupTimeout.Or(defaultStartupTimeout))
+	defer timer.Stop()
+	select {
+	case <-awake:
+		return true, true
+	case <-timer.C:
+		return true, false
+	}
+}
+
+// idleWake returns the channel on which an idle on demand tunnel is asked to
+// open, nil if the tunnel is not waiting for connections. The caller must hold
+// the tunnel lock.
+func (t *Tunnel) idleWake() <-chan struct{} {
+	if t.status != Idle || t.balancer == nil {
+		return nil
+	}
+	return t.balancer.wake
+}
+
+// wakeOnDemand opens an idle on demand tunnel as a connection came in. The
+// caller must hold the tunnel lock.
+func (t *Tunnel) wakeOnDemand() {
+	if t.status != Idle {
+		return
+	}
+	t.woken = true
+	t.reset()
+}
+
+// sleepOnDemand makes an on demand tunnel wait for connections on its local
+// port, without running its process. It tells whether it did. The caller must
+// hold the tunnel lock.
+func (t *Tunnel) sleepOnDemand() bool {
+	if !t.config.OnDemand || t.balancer == nil || t.woken {
+		return false
+	}
+	t.balancer.sleep()
+	t.status = Idle
+	t.err = nil
+	return true
+}
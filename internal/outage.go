@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// outageWindow is the time window in which tunnel failures are considered
+	// correlated.
+	outageWindow = 10 * time.Second
+	// outageMinFailures is the minimum number of correlated failures which
+	// make an outage, regardless of the number of tunnels.
+	outageMinFailures = 3
+	// outageHold is how long leaf tunnels wait before reopening after an
+	// outage, giving time to infra tunnels to come back first.
+	outageHold = 10 * time.Second
+)
+
+// OutageDetector spots global outages, i.e. many tunnels failing within a few
+// seconds, which typically happens when the VPN or a bastion goes down. During
+// an outage infra tunnels are reopened first while leaf tunnels are held for a
+// little while, instead of all racing and half of them failing again.
+type OutageDetector struct {
+	holdUntil time.Time
+	failures  []time.Time
+	threshold int
+	hasInfra  bool
+	m         sync.Mutex
+}
+
+// NewOutageDetector instantiates an OutageDetector for the given tunnels. An
+// outage is declared when at least half of them fail within a few seconds.
+func NewOutageDetector(configs []TunnelConfig) *OutageDetector {
+	d := &OutageDetector{
+		threshold: (len(configs) + 1) / 2,
+	}
+	if d.threshold < outageMinFailures {
+		d.threshold = outageMinFailures
+	}
+	for i := range configs {
+		d.hasInfra = d.hasInfra || configs[i].Infra
+	}
+	return d
+}
+
+// recordFailure registers the failure of a tunnel and starts holding leaf
+// tunnels if this makes an outage.
+func (d *OutageDetector) recordFailure(now time.Time) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	recent := d.failures[:0]
+	for _, f := range d.failures {
+		if now.Sub(f) < outageWindow {
+			recent = append(recent, f)
+		}
+	}
+	d.failures = append(recent, now)
+	if d.hasInfra && len(d.failures) >= d.threshold {
+		d.holdUntil = now.Add(outageHold)
+	}
+}
+
+// holds tells whether leaf tunnels must wait before reopening.
+func (d *OutageDetector) holds(now time.Time) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return now.Before(d.holdUntil)
+}
@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"github.com/pkg/errors"
+)
+
+// errPausedOnDemand is the reason tunnel processes are stopped for when
+// paused on demand.
+var errPausedOnDemand = errors.New("paused on demand")
+
+// Pause stops the tunnel process, if any, and keeps the tunnel Paused until
+// Resume is called, freeing its local port for another tool. Crashed tunnels
+// and tunnels refreshing their auth are left alone. The caller must hold the
+// tunnel lock.
+func (t *Tunnel) Pause() {
+	if t.status == Crashed || t.status == Refreshing {
+		return
+	}
+	t.paused = true
+	switch t.status {
+	case Opening, Open, Degraded:
+		// The process exit is picked up by Start which pauses the tunnel.
+		if t.killReason == nil {
+			t.killFor(errPausedOnDemand)
+		}
+	case Paused:
+	default:
+		t.enterPaused()
+	}
+}
+
+// Resume reopens a tunnel paused on demand or idle. The caller must hold the
+// tunnel lock.
+func (t *Tunnel) Resume() {
+	if t.status == Idle {
+		t.woken = true
+		t.reset()
+		return
+	}
+	if t.killReason == errIdle {
+		// Reopened as soon as the process is gone.
+		t.killReason = errRestartRequested
+		return
+	}
+	if !t.paused {
+		return
+	}
+	t.paused = false
+	if t.status == Paused {
+		t.reset()
+	}
+}
+
+// IsPaused tells whether the tunnel was paused on demand.
+func (t *Tunnel) IsPaused() bool {
+	return t.published().paused
+}
+
+// enterPaused marks the tunnel as Paused once its process is gone, releasing
+// its local port. The caller must hold the tunnel lock.
+func (t *Tunnel) enterPaused() {
+	t.status = Paused
+	t.err = nil
+	if t.balancer != nil {
+		t.balancer.close()
+		t.balancer = nil
+	}
+}
+
+// TogglePause resumes the tunnels with the given name or group if they are
+// paused on demand or idle, pauses them otherwise. It takes the tunnel locks.
+func TogglePause(tunnels []*Tunnel, name string) {
+	matching := matchTunnels(tunnels, name)
+	paused := false
+	for _, t := range matching {
+		s := t.published()
+		paused = paused || s.paused || s.status == Idle
+	}
+	for _, t := range matching {
+		t.Lock()
+		if paused {
+			t.Resume()
+		} else {
+			t.Pause()
+		}
+		t.Unlock()
+	}
+}
+
+// PauseTunnels pauses the tunnels with the given name or group and tells
+// whether there were any. It takes the tunnel locks.
+func PauseTunnels(tunnels []*Tunnel, name string) bool {
+	matching := matchTunnels(tunnels, name)
+	for _, t := range matching {
+		t.Lock()
+		t.Pause()
+		t.Unlock()
+	}
+	return len(matching) > 0
+}
+
+// ResumeTunnels resumes the tunnels with the given name or group and tells
+// whether there were any. It takes the tunnel locks.
+func ResumeTunnels(tunnels []*Tunnel, name string) bool {
+	matching := matchTunnels(tunnels, name)
+	for _, t := range matching {
+		t.Lock()
+		t.Resume()
+		t.Unlock()
+	}
+	return len(matching) > 0
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// policyFile is where the policy is read from by default, relative to the
+// user's home.
+const policyFile = ".tmancer/policy.json"
+
+// Policy restricts what configs may do, for teams distributing shared configs
+// who want to be protected against a malicious or mistyped command. Unlike
+// configs, it belongs to the machine.
+type Policy struct {
+	// AuditLog, if set, is the file every command spawned by the tunnels is
+	// appended to, e.g. "~/.tmancer/audit.jsonl".
+	AuditLog string `json:"audit_log"`
+	// AllowedCommands lists the executables the tunnel commands (custom,
+	// hooks, health checks and auth refresh) may run: names looked up in
+	// PATH or absolute paths. Shell tunnels run sh.
+	AllowedCommands []string `json:"allowed_commands"`
+	// ConfirmCommands makes tmancer show the commands of a config and ask
+	// for confirmation before running them the first time, and whenever
+	// they change.
+	ConfirmCommands bool `json:"confirm_commands"`
+}
+
+// LoadPolicy reads the policy at the given path. If path is empty, the one
+// pointed at by TMANCER_POLICY is used, or ~/.tmancer/policy.json if it
+// exists. A nil policy allows everything.
+func LoadPolicy(path string) (*Policy, error) {
+	if path == "" {
+		path = os.Getenv("TMANCER_POLICY")
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(home, policyFile)
+		if _, err = os.Stat(path); err != nil {
+			return nil, nil
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading policy %s", path)
+	}
+	p := &Policy{}
+	if err = json.Unmarshal(b, p); err != nil {
+		return nil, errors.Wrapf(err, "unmarshaling policy %s", path)
+	}
+	return p, nil
+}
+
+// Check returns an error listing the tunnel commands the policy does not
+// allow. Without allowed commands, the policy allows everything.
+func (p *Policy) Check(config *Config) error {
+	if p == nil || p.AllowedCommands == nil {
+		return nil
+	}
+	allowed := make(map[string]bool, len(p.AllowedCommands))
+	for _, c := range p.AllowedCommands {
+		allowed[c] = true
+	}
+	var violations []string
+	for i := range config.Tunnels {
+		c := &config.Tunnels[i]
+		for field, command := range c.commands() {
+			executable := shell[0]
+			if !strings.HasSuffix(field, "custom") || !c.Shell {
+				args, err := splitCommand(command)
+				if err != nil || len(args) == 0 {
+					continue
+				}
+				executable = args[0]
+			}
+			if !allowed[executable] {
+				violations = append(violations, c.Name+": "+field+" runs "+executable)
+			}
+		}
+	}
+	if len(violations) > 0 {
+		sort.Strings(violations)
+		return errors.Errorf("not allowed by the policy: %s", strings.Join(violations, ", "))
+	}
+	return nil
+}
+
+// commands returns the commands of the tunnel config by field name.
+func (c *TunnelConfig) commands() map[string]string {
+	commands := map[string]string{}
+	add := func(field, command string) {
+		if command != "" {
+			commands[field] = command
+		}
+	}
+	add("custom", c.Custom)
+	add("dynamic", c.Dynamic)
+	add("secret_cmd", c.SecretCmd)
+	if secretRefRegex.MatchString(c.Custom) {
+		add("secret_reader", c.secretReader)
+	}
+	if p, ok := c.provider.(*ExecProvider); ok {
+		add("provider", p.Command)
+	}
+	add("auth_refresh", c.AuthRefresh)
+	add("preflight", c.Preflight)
+	if c.HealthCheck != nil {
+		add("health_check.cmd", c.HealthCheck.Cmd)
+	}
+	if c.Hooks != nil {
+		add("hooks.pre_start", c.Hooks.PreStart)
+		add("hooks.post_start", c.Hooks.PostStart)
+		add("hooks.pre_stop", c.Hooks.PreStop)
+		add("hooks.post_stop", c.Hooks.PostStop)
+	}
+	if c.Failover != nil {
+		for i, e := range c.Failover.Endpoints {
+			add(fmt.Sprintf("failover.endpoints[%d].custom", i), e.Custom)
+		}
+	}
+	return commands
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// maxHolderCommand is the most characters of the command line of the process
+// holding a port shown in errors.
+const maxHolderCommand = 60
+
+// procPortOwner returns the pid and command of the process listening on the
+// given port according to procfs, for when lsof is not installed. Only the
+// processes of the user can be told on most systems.
+func procPortOwner(network string, port int) (int, string) {
+	var tables []string
+	if network != "tcp6" {
+		tables = append(tables, "/proc/net/tcp")
+	}
+	if network != "tcp4" {
+		tables = append(tables, "/proc/net/tcp6")
+	}
+	for _, table := range tables {
+		if inode := listeningInode(table, port); inode != "" {
+			return socketOwner(inode)
+		}
+	}
+	return 0, ""
+}
+
+// listeningInode returns the inode of the socket listening on the port in the
+// given procfs table, empty if none.
+func listeningInode(table string, port int) string {
+	b, err := os.ReadFile(table)
+	if err != nil {
+		return ""
+	}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		// e.g. "0: 0100007F:1F40 00000000:0000 0A 00000000:00000000 00:00000000
+		// 00000000 1000 0 123456 1 ..." where 0A means listening.
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 || fields[3] != "0A" {
+			continue
+		}
+		i := strings.LastIndexByte(fields[1], ':')
+		if p, err := strconv.ParseUint(fields[1][i+1:], 16, 16); err == nil && int(p) == port {
+			return fields[9]
+		}
+	}
+	return ""
+}
+
+// socketOwner returns the pid and command of the process having the socket
+// with the given inode open.
+func socketOwner(inode string) (int, string) {
+	target := "socket:[" + inode + "]"
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		if link, err := os.Readlink(fd); err != nil || link != target {
+			continue
+		}
+		pid, _ := strconv.Atoi(strings.Split(fd, "/")[2])
+		comm, _ := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm"))
+		return pid, strings.TrimSpace(string(comm))
+	}
+	return 0, ""
+}
+
+// portHolder describes the process listening on the given port, e.g.
+// "held by pid 4242 (ssh -N -L 8000:db:5432 bastion)", empty if it cannot be
+// told.
+func portHolder(network, host string, port int) string {
+	pid, command := portOwner(network, host, port)
+	if pid == 0 {
+		return ""
+	}
+	if full := strings.Fields(processCommand(pid)); len(full) > 0 {
+		// The path of the executable would take all the room.
+		full[0] = filepath.Base(full[0])
+		command = strings.Join(full, " ")
+	}
+	if runes := []rune(command); len(runes) > maxHolderCommand {
+		command = string(runes[:maxHolderCommand-3]) + "..."
+	}
+	if command == "" {
+		return fmt.Sprintf("held by pid %d", pid)
+	}
+	return fmt.Sprintf("held by pid %d (%s)", pid, command)
+}
+
+// setPortBusy makes the tunnel PortBusy because of err, telling which process
+// holds the port. The holder is only looked up again when err changes, and
+// the error is kept as is while it does not change, so that the hint and
+// notifications are not made again on every retry. The caller must hold the
+// tunnel lock through lock, which is released during the lookup.
+func (t *Tunnel) setPortBusy(lock sync.Locker, err error, network, host string, port int) {
+	if t.status == PortBusy && t.bindErr == err.Error() {
+		return
+	}
+	t.bindErr = err.Error()
+	lock.Unlock()
+	holder := portHolder(network, host, port)
+	lock.Lock()
+	if holder != "" {
+		err = errors.Errorf("%s, %s", err, holder)
+	}
+	t.status = PortBusy
+	if t.err == nil || t.err.Error() != err.Error() {
+		t.err = err
+	}
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Placeholders which can be used in the custom command of a tunnel using a
+// port range.
+const (
+	localPortPlaceholder  = "{{local_port}}"
+	remotePortPlaceholder = "{{remote_port}}"
+)
+
+// parsePortRange parses a "9000-9009" or "9000" string into the list of ports
+// it spans.
+func parsePortRange(s string) ([]int, error) {
+	from, to, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	start, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing port range %q", s)
+	}
+	end := start
+	if isRange {
+		if end, err = strconv.Atoi(strings.TrimSpace(to)); err != nil {
+			return nil, errors.Wrapf(err, "parsing port range %q", s)
+		}
+	}
+	if start <= 0 || end > 65535 || end < start {
+		return nil, errors.Errorf("invalid port range %q", s)
+	}
+	ports := make([]int, 0, end-start+1)
+	for p := start; p <= end; p++ {
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// expandPortRange turns a tunnel config using local_ports into one sub-forward
+// config per port. The sub-forwards share the original name as their group.
+func expandPortRange(c *TunnelConfig) ([]TunnelConfig, error) {
+	if c.LocalPort != 0 {
+		return nil, errors.Errorf("%s: local_port and local_ports are mutually exclusive", c.Name)
+	}
+	local, err := parsePortRange(c.LocalPorts)
+	if err != nil {
+		return nil, errors.Wrap(err, c.Name)
+	}
+	remote := local
+	if c.RemotePorts != "" {
+		if remote, err = parsePortRange(c.RemotePorts); err != nil {
+			return nil, errors.Wrap(err, c.Name)
+		}
+	}
+	if len(remote) != len(local) {
+		return nil, errors.Errorf("%s: local_ports and remote_ports must span the same number of ports", c.Name)
+	}
+	if c.Custom != "" && !strings.Contains(c.Custom, localPortPlaceholder) && !strings.Contains(c.Custom, remotePortPlaceholder) {
+		return nil, errors.Errorf("%s: custom command must use %s or %s with local_ports", c.Name, localPortPlaceholder, remotePortPlaceholder)
+	}
+	res := make([]TunnelConfig, len(local))
+	for i := range local {
+		sub := *c
+		sub.Name = fmt.Sprintf("%s:%d", c.Name, local[i])
+		sub.Group = c.Name
+		sub.LocalPort = local[i]
+		sub.LocalPorts = ""
+		sub.RemotePorts = ""
+		if c.K8s != nil {
+			k8s := *c.K8s
+			k8s.Port = remote[i]
+			sub.K8s = &k8s
+		}
+		sub.Custom = strings.NewReplacer(
+			localPortPlaceholder, strconv.Itoa(local[i]),
+			remotePortPlaceholder, strconv.Itoa(remote[i]),
+		).Replace(c.Custom)
+		res[i] = sub
+	}
+	return res, nil
+}
+
+// GroupStatus aggregates the statuses of the sub-forwards of a port range:
+// the group is only Open when all of them are, otherwise the first status
+// which is not Open is reported along with a summary.
+func GroupStatus(forwards []TunnelSnapshot) (status Status, summary string) {
+	open := 0
+	status = Open
+	for i := range forwards {
+		if forwards[i].Status == Open {
+			open++
+		} else if status == Open {
+			status = forwards[i].Status
+		}
+	}
+	if open == len(forwards) {
+		return status, ""
+	}
+	return status, fmt.Sprintf("%d/%d open", open, len(forwards))
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// preconditionPollInterval is how often the preconditions of a tunnel
+	// are checked again.
+	preconditionPollInterval = 5 * time.Second
+	preconditionTimeout      = 3 * time.Second
+	// pingPayload is the default payload size of ping.
+	pingPayload = 56
+)
+
+// errPreconditionUnmet is the reason tunnel processes are stopped for when
+// one of their preconditions no longer holds.
+var errPreconditionUnmet = errors.New("precondition no longer met")
+
+// Precondition is something which must hold for a tunnel to make sense, such
+// as the corporate VPN being connected. Exactly one of Host and Interface is
+// set.
+type Precondition struct {
+	// Host must answer pings, or accept TCP connections on Port if set.
+	Host string `json:"host"`
+	// Interface must be up, e.g. "utun3".
+	Interface string `json:"interface"`
+	Port      int    `json:"port"`
+}
+
+// String describes the precondition, e.g. "interface utun3 up".
+func (p *Precondition) String() string {
+	switch {
+	case p.Interface != "":
+		return fmt.Sprintf("interface %s up", p.Interface)
+	case p.Port > 0:
+		return fmt.Sprintf("%s reachable", net.JoinHostPort(p.Host, strconv.Itoa(p.Port)))
+	}
+	return fmt.Sprintf("host %s reachable", p.Host)
+}
+
+// holds tells whether the precondition holds right now.
+func (p *Precondition) holds(ctx context.Context) bool {
+	if p.Interface != "" {
+		i, err := net.InterfaceByName(p.Interface)
+		return err == nil && i.Flags&net.FlagUp != 0
+	}
+	if p.Port > 0 {
+		d := &net.Dialer{Timeout: preconditionTimeout}
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(p.Host, strconv.Itoa(p.Port)))
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	return ping(ctx, p.Host, pingPayload)
+}
+
+// unmetPrecondition returns the first precondition of the tunnel which does
+// not hold, nil if they all do.
+func (c *TunnelConfig) unmetPrecondition(ctx context.Context) *Precondition {
+	for i := range c.Preconditions {
+		if !c.Preconditions[i].holds(ctx) {
+			return &c.Preconditions[i]
+		}
+	}
+	return nil
+}
+
+// checkPreconditions checks the preconditions of the tunnel in the
+// background, at most every preconditionPollInterval, and sends the first
+// unmet one on unmet. The caller must hold the tunnel lock.
+func (t *Tunnel) checkPreconditions(ctx context.Context, unmet chan<- *Precondition) {
+	if len(t.config.Preconditions) == 0 || t.checkingPreconditions || time.Since(t.preconditionsCheckedAt) < preconditionPollInterval {
+		return
+	}
+	t.checkingPreconditions = true
+	c := t.config
+	go func() {
+		unmet <- c.unmetPrecondition(ctx)
+	}()
+}
+
+// waitForPreconditions tells whether the tunnel must wait for its
+// preconditions before being opened, in which case it moves to Waiting.
+// Waiting does not count towards the restart policy nor flapping. The caller
+// must hold the tunnel lock.
+func (t *Tunnel) waitForPreconditions() bool {
+	if len(t.config.Preconditions) == 0 {
+		return false
+	}
+	switch {
+	case t.preconditionsCheckedAt.IsZero():
+		t.err = errors.New("checking preconditions")
+	case t.unmet != nil:
+		t.err = errors.Errorf("waiting for %s", t.unmet)
+	case t.status == Waiting:
+		// Open right away rather than after the backoff of the last failure.
+		t.status = Close
+		if t.openedOnce {
+			t.status = Reopening
+		}
+		t.err = nil
+		t.retryAt = time.Time{}
+		return false
+	default:
+		return false
+	}
+	t.status = Waiting
+	return true
+}
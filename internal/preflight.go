@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// preflightRetryInterval is how long a tunnel which failed its preflight
+// waits before running it again.
+const preflightRetryInterval = 30 * time.Second
+
+// preflight runs the preflight command of the tunnel in the background
+// before its first open attempt, and tells whether the tunnel must wait for
+// it, either because it is running or because it failed. Failures move the
+// tunnel to PreflightFailed, which does not count towards the restart policy
+// nor flapping. The caller must hold the tunnel lock.
+func (t *Tunnel) preflight(ctx context.Context, done chan<- error) bool {
+	switch {
+	case t.config.Preflight == "" || t.preflightPassed:
+		return false
+	case t.preflighting:
+		return true
+	case t.status == PreflightFailed && time.Now().Before(t.retryAt):
+		return true
+	}
+	t.preflighting = true
+	c := t.config
+	go func() {
+		done <- errors.Wrap(c.runShortCommand(ctx, "preflight", c.Preflight), "preflight")
+	}()
+	return true
+}
+
+// preflightDone records the outcome of the preflight command. The caller must
+// hold the tunnel lock.
+func (t *Tunnel) preflightDone(err error) {
+	t.preflighting = false
+	if err != nil {
+		t.status = PreflightFailed
+		t.err = err
+		t.retryAt = time.Now().Add(preflightRetryInterval)
+		return
+	}
+	t.preflightPassed = true
+	if t.status == PreflightFailed {
+		t.status = Close
+		t.err = nil
+		t.retryAt = time.Time{}
+	}
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// outputTailLines is how many of the last output lines of a process are kept
+// to explain why it exited.
+const outputTailLines = 10
+
+// outputHistoryLines is how many of the last output lines of a tunnel are kept
+// for the output view, across its processes.
+const outputHistoryLines = 500
+
+// outputDrainTimeout is how long to wait for the remaining output once a
+// process exited.
+const outputDrainTimeout = time.Second
+
+// forwardingRegex matches the line kubectl prints once a port forward is
+// actually listening.
+var forwardingRegex = regexp.MustCompile(`^Forwarding from `)
+
+// outputTail keeps the last lines written by a process, long running tunnels
+// can be quite chatty (e.g. kubectl logs every handled connection).
+type outputTail struct {
+	lines []string
+	// size is the number of lines kept, outputTailLines if 0.
+	size int
+	m    sync.Mutex
+}
+
+// add keeps line, doing nothing if o is nil.
+func (o *outputTail) add(line string) {
+	if o == nil {
+		return
+	}
+	o.m.Lock()
+	defer o.m.Unlock()
+	size := o.size
+	if size == 0 {
+		size = outputTailLines
+	}
+	if len(o.lines) == size {
+		o.lines = o.lines[1:]
+	}
+	o.lines = append(o.lines, line)
+}
+
+// get returns a copy of the lines kept.
+func (o *outputTail) get() []string {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return append([]string(nil), o.lines...)
+}
+
+func (o *outputTail) String() string {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return strings.Join(o.lines, "\n")
+}
+
+// runCommand starts cmd and waits for it to exit, streaming its combined
+// output line by line. The command is started with lock held, so that
+// cmd.Process can be read under it. If readyRegex is not nil, ready is
+// notified once as soon as a line matches it. The output is also written to
+// log and kept in history, if not nil, and the command recorded to audit. The
+// returned error contains the last output lines.
+func runCommand(cmd *exec.Cmd, lock sync.Locker, readyRegex *regexp.Regexp, ready chan<- struct{}, log *rotatingLog, history *outputTail, audit *commandAudit) error {
+	// Use a real pipe rather than an io.Writer, otherwise Wait would also wait
+	// for any grandchild still holding the output open.
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "creating output pipe")
+	}
+	defer pr.Close()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	lock.Lock()
+	err = cmd.Start()
+	lock.Unlock()
+	pw.Close()
+	if err != nil {
+		audit.exited(cmd, err)
+		return errors.Wrap(err, "starting command")
+	}
+	trackProcessGroup(cmd)
+	audit.started(cmd)
+	tail := &outputTail{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		notified := false
+		s := bufio.NewScanner(pr)
+		for s.Scan() {
+			tail.add(s.Text())
+			log.WriteLine(s.Text())
+			history.add(s.Text())
+			if !notified && readyRegex != nil && readyRegex.MatchString(s.Text()) {
+				notified = true
+				ready <- struct{}{}
+			}
+		}
+		// Keep draining so that the process never blocks on a full pipe, e.g.
+		// after an overly long line.
+		io.Copy(io.Discard, pr) //nolint:errcheck // Nothing to do about it.
+	}()
+	err = cmd.Wait()
+	releaseProcessGroup(cmd.Process.Pid)
+	audit.exited(cmd, err)
+	select {
+	case <-done:
+	case <-time.After(outputDrainTimeout):
+	}
+	if out := tail.String(); out != "" {
+		return errors.Wrap(err, out)
+	}
+	return err
+}
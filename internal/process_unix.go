@@ -0,0 +1,95 @@
+//go:build !windows
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// signals are the signals which can be sent to tunnel processes and
+// dependents, by name.
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// shell runs the custom commands of the tunnels with "shell" set.
+var shell = []string{"sh", "-c"}
+
+// setProcessGroup makes cmd lead a new process group.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// trackProcessGroup is a no-op, the process group of a started command is
+// known from its pid.
+func trackProcessGroup(*exec.Cmd) {}
+
+// releaseProcessGroup is a no-op, see trackProcessGroup.
+func releaseProcessGroup(int) {}
+
+// setDetached makes cmd run in a new session, so that closing the terminal
+// does not hang it up.
+func setDetached(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// signalGroup sends sig to the whole process group led by pid, so that
+// whatever the tunnel command spawned is terminated too, or to pid alone if
+// it does not lead a group.
+func signalGroup(pid int, sig syscall.Signal) error {
+	err := syscall.Kill(-pid, sig)
+	if errors.Is(err, syscall.ESRCH) {
+		// Not a group leader, e.g. an adopted process, or already gone.
+		err = syscall.Kill(pid, sig)
+	}
+	if errors.Is(err, syscall.ESRCH) {
+		// Already gone.
+		return nil
+	}
+	return err
+}
+
+// isAlive tells whether the process with the given pid is still running.
+func isAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// lockFile takes an exclusive lock on f, released when f is closed.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+// unlockFile releases the lock taken on f by lockFile.
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+//nolint:gosec // I'm happy for now.
+func isPortBusy(ctx context.Context, network, host string, port int) bool {
+	// Calling lsof alone is not enough to know if a TCP file means that a
+	// connection is established or not. This is because it returns any state as
+	// long as there is avalid one for the provided port:
+	//   https://en.wikipedia.org/wiki/Transmission_Control_Protocol#Protocol_operation
+	// To do that we must grep the results.
+	cmdStr := fmt.Sprintf(`lsof -n -i %s | grep "(ESTABLISHED)"`, lsofAddress(network, host, port))
+	cmd := exec.CommandContext(ctx, "sh", "-c", cmdStr)
+	cmd.Run() // nolint:errcheck // lsof returns error if nothing is found.
+	// If the process state is nil it means that the command could not be
+	// completed.
+	// In this case we simply treat this as busy (for now, not the best).
+	if cmd.ProcessState == nil {
+		return true
+	}
+	return cmd.ProcessState.Success()
+}
@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// signals are the signals which can be sent to tunnel processes and
+// dependents, by name. Windows has no signals, tunnel processes are
+// terminated right away whatever their stop signal.
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"TERM": syscall.SIGTERM,
+}
+
+// shell runs the custom commands of the tunnels with "shell" set.
+var shell = []string{"cmd", "/C"}
+
+// Windows API values missing from the syscall package.
+const (
+	detachedProcess       = 0x00000008
+	processSetQuota       = 0x0100
+	lockfileExclusiveLock = 0x00000002
+	stillActive           = 259
+	errorInvalidParameter = syscall.Errno(87)
+)
+
+var (
+	kernel32                     = syscall.NewLazyDLL("kernel32.dll")
+	procCreateJobObjectW         = kernel32.NewProc("CreateJobObjectW")
+	procAssignProcessToJobObject = kernel32.NewProc("AssignProcessToJobObject")
+	procTerminateJobObject       = kernel32.NewProc("TerminateJobObject")
+	procLockFileEx               = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx             = kernel32.NewProc("UnlockFileEx")
+)
+
+// jobs are the job objects holding the processes started by the tunnels and
+// their children, by pid of the started process. Job objects stand for the
+// process groups of the other platforms.
+var jobs = struct {
+	byPid map[int]syscall.Handle
+	m     sync.Mutex
+}{byPid: map[int]syscall.Handle{}}
+
+// setProcessGroup makes cmd lead a new process group, so that Ctrl-C in the
+// console is not forwarded to it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// trackProcessGroup puts the started cmd in a new job object, which its
+// children then inherit, so that signalGroup can terminate all of them. The
+// process is left alone if that fails, signalGroup then only terminates it.
+func trackProcessGroup(cmd *exec.Cmd) {
+	job, _, _ := procCreateJobObjectW.Call(0, 0)
+	if job == 0 {
+		return
+	}
+	pid := cmd.Process.Pid
+	p, err := syscall.OpenProcess(processSetQuota|syscall.PROCESS_TERMINATE, false, uint32(pid))
+	if err != nil {
+		syscall.CloseHandle(syscall.Handle(job)) //nolint:errcheck // Nothing to do about it.
+		return
+	}
+	defer syscall.CloseHandle(p) //nolint:errcheck // Nothing to do about it.
+	if ok, _, _ := procAssignProcessToJobObject.Call(job, uintptr(p)); ok == 0 {
+		syscall.CloseHandle(syscall.Handle(job)) //nolint:errcheck // Nothing to do about it.
+		return
+	}
+	jobs.m.Lock()
+	jobs.byPid[pid] = syscall.Handle(job)
+	jobs.m.Unlock()
+}
+
+// releaseProcessGroup closes the job object of the process started with pid
+// once it exited, its children being left alone as on the other platforms.
+func releaseProcessGroup(pid int) {
+	jobs.m.Lock()
+	job, ok := jobs.byPid[pid]
+	delete(jobs.byPid, pid)
+	jobs.m.Unlock()
+	if ok {
+		syscall.CloseHandle(job) //nolint:errcheck // Nothing to do about it.
+	}
+}
+
+// setDetached makes cmd run without a console, so that closing the terminal
+// does not end it.
+func setDetached(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: detachedProcess | syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// signalGroup terminates the job object of the process started with pid,
+// along with whatever it spawned, or the process alone if it has none, e.g.
+// an adopted process. The signal is ignored as Windows processes cannot be
+// asked to terminate.
+func signalGroup(pid int, _ syscall.Signal) error {
+	jobs.m.Lock()
+	job, ok := jobs.byPid[pid]
+	delete(jobs.byPid, pid)
+	jobs.m.Unlock()
+	if ok {
+		defer syscall.CloseHandle(job) //nolint:errcheck // Nothing to do about it.
+		if r, _, err := procTerminateJobObject.Call(uintptr(job), 1); r == 0 {
+			return err
+		}
+		return nil
+	}
+	p, err := syscall.OpenProcess(syscall.PROCESS_TERMINATE, false, uint32(pid))
+	if errors.Is(err, errorInvalidParameter) {
+		// Already gone.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(p) //nolint:errcheck // Nothing to do about it.
+	if err = syscall.TerminateProcess(p, 1); err != nil && isAlive(pid) {
+		return err
+	}
+	return nil
+}
+
+// isAlive tells whether the process with the given pid is still running.
+func isAlive(pid int) bool {
+	p, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// Running as another user if access is denied.
+		return !errors.Is(err, errorInvalidParameter)
+	}
+	defer syscall.CloseHandle(p) //nolint:errcheck // Nothing to do about it.
+	var code uint32
+	return syscall.GetExitCodeProcess(p, &code) == nil && code == stillActive
+}
+
+// lockFile takes an exclusive lock on f, released when f is closed.
+func lockFile(f *os.File) error {
+	overlapped := &syscall.Overlapped{}
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock, 0, 1, 0, uintptr(unsafe.Pointer(overlapped)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// unlockFile releases the lock taken on f by lockFile.
+func unlockFile(f *os.File) error {
+	overlapped := &syscall.Overlapped{}
+	r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(overlapped)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// isPortBusy tells whether connections are established on the local port, as
+// listed by netstat. Like with lsof, the port is considered busy if netstat
+// cannot tell.
+func isPortBusy(ctx context.Context, _, host string, port int) bool {
+	out, err := exec.CommandContext(ctx, "netstat", "-n", "-p", "TCP").Output()
+	if err != nil {
+		return true
+	}
+	if v6, err := exec.CommandContext(ctx, "netstat", "-n", "-p", "TCPv6").Output(); err == nil {
+		out = append(out, v6...)
+	}
+	ip := net.ParseIP(host)
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		// e.g. "  TCP    127.0.0.1:5432    127.0.0.1:51234    ESTABLISHED"
+		fields := strings.Fields(s.Text())
+		if len(fields) != 4 || fields[0] != "TCP" || fields[3] != "ESTABLISHED" {
+			continue
+		}
+		localHost, localPort, err := net.SplitHostPort(fields[1])
+		if err != nil || localPort != strconv.Itoa(port) {
+			continue
+		}
+		if ip == nil || ip.IsUnspecified() || ip.Equal(net.ParseIP(localHost)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// procStatsInterval is how often the CPU and memory usage of the tunnel
+// processes is sampled.
+const procStatsInterval = 5 * time.Second
+
+// ProcStats is the resource usage of a tunnel process.
+type ProcStats struct {
+	// RSS is the resident memory, in bytes.
+	RSS int64
+	// CPU is the share of a core used lately, in percent.
+	CPU float64
+	// pid is the process the usage is about, the tunnel may have restarted
+	// since.
+	pid int
+}
+
+// formatCPU returns a CPU share such as "2.5%".
+func formatCPU(cpu float64) string {
+	return fmt.Sprintf("%.1f%%", cpu)
+}
+
+// WatchProcesses samples the CPU and memory usage of the tunnel processes of
+// the session every few seconds, for the cpu and rss columns, until ctx is
+// done. Nothing is sampled on Windows.
+func WatchProcesses(ctx context.Context, s *Session) {
+	sampler := newProcSampler()
+	ticker := time.NewTicker(procStatsInterval)
+	defer ticker.Stop()
+	for {
+		pids := map[*Tunnel]int{}
+		list := []int{}
+		for _, t := range s.Tunnels() {
+			if pid := t.published().pid; pid != 0 {
+				pids[t] = pid
+				list = append(list, pid)
+			}
+		}
+		stats := sampler.sample(list)
+		for t, pid := range pids {
+			if st, ok := stats[pid]; ok {
+				st.pid = pid
+				t.Lock()
+				t.procStats = &st
+				t.Unlock()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// procStats returns the usage of the current process of the tunnel, nil if
+// unknown.
+func (s *tunnelState) procStats() *ProcStats {
+	if s.proc == nil || s.proc.pid != s.pid {
+		return nil
+	}
+	return s.proc
+}
@@ -0,0 +1,109 @@
+//go:build !windows
+
+package internal
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is the unit of the CPU times of procfs, USER_HZ, which is 100 on
+// all the Linux architectures.
+const clockTicks = 100
+
+// cpuTime is the CPU time a process used as of some time.
+type cpuTime struct {
+	at    time.Time
+	ticks int64
+}
+
+// procSampler samples the usage of processes, from procfs when available,
+// with ps otherwise.
+type procSampler struct {
+	// previous are the CPU times of the last sample by pid, procfs only
+	// telling the CPU time used since the process started.
+	previous map[int]cpuTime
+	procfs   bool
+}
+
+func newProcSampler() *procSampler {
+	_, err := os.Stat("/proc/self/stat")
+	return &procSampler{previous: map[int]cpuTime{}, procfs: err == nil}
+}
+
+// sample returns the usage of the processes which could be sampled, by pid.
+func (p *procSampler) sample(pids []int) map[int]ProcStats {
+	if !p.procfs {
+		return psSample(pids)
+	}
+	now := time.Now()
+	stats := map[int]ProcStats{}
+	current := map[int]cpuTime{}
+	for _, pid := range pids {
+		dir := filepath.Join("/proc", strconv.Itoa(pid))
+		stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+		if err != nil {
+			continue
+		}
+		statm, err := os.ReadFile(filepath.Join(dir, "statm"))
+		if err != nil {
+			continue
+		}
+		// The command name, in parentheses, may contain spaces. utime and
+		// stime are the 14th and 15th fields.
+		fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+		mem := strings.Fields(string(statm))
+		if len(fields) < 13 || len(mem) < 2 {
+			continue
+		}
+		utime, _ := strconv.ParseInt(fields[11], 10, 64)
+		stime, _ := strconv.ParseInt(fields[12], 10, 64)
+		pages, _ := strconv.ParseInt(mem[1], 10, 64)
+		st := ProcStats{RSS: pages * int64(os.Getpagesize())}
+		current[pid] = cpuTime{at: now, ticks: utime + stime}
+		if previous, ok := p.previous[pid]; ok && now.After(previous.at) {
+			used := float64(utime+stime-previous.ticks) / clockTicks
+			st.CPU = 100 * used / now.Sub(previous.at).Seconds()
+		}
+		stats[pid] = st
+	}
+	p.previous = current
+	return stats
+}
+
+// psSample returns the usage of the processes according to ps, whose CPU
+// share is a decaying average on macOS and BSDs.
+func psSample(pids []int) map[int]ProcStats {
+	stats := map[int]ProcStats{}
+	if len(pids) == 0 {
+		return stats
+	}
+	list := make([]string, len(pids))
+	for i, pid := range pids {
+		list[i] = strconv.Itoa(pid)
+	}
+	//nolint:gosec // Only pids.
+	out, err := exec.Command("ps", "-o", "pid=,rss=,%cpu=", "-p", strings.Join(list, ",")).Output()
+	if err != nil && len(out) == 0 {
+		return stats
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		rss, _ := strconv.ParseInt(fields[1], 10, 64)
+		cpu, _ := strconv.ParseFloat(strings.Replace(fields[2], ",", ".", 1), 64)
+		// rss is in kilobytes.
+		stats[pid] = ProcStats{RSS: rss * 1024, CPU: cpu}
+	}
+	return stats
+}
@@ -0,0 +1,13 @@
+package internal
+
+// procSampler does not sample anything on Windows, the cpu and rss columns
+// staying N/A.
+type procSampler struct{}
+
+func newProcSampler() *procSampler {
+	return &procSampler{}
+}
+
+func (p *procSampler) sample([]int) map[int]ProcStats {
+	return nil
+}
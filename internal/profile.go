@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"github.com/pkg/errors"
+)
+
+// applyProfile merges the overlay of the given profile over the config
+// document, as if it came from a later config file.
+func applyProfile(doc map[string]interface{}, profile string) (map[string]interface{}, error) {
+	if profile == "" {
+		return doc, nil
+	}
+	profiles, _ := doc["profiles"].(map[string]interface{})
+	overlay, ok := profiles[profile]
+	if !ok {
+		// Tunnels can be tagged with a profile which has no overlay.
+		if !hasProfileTunnel(doc, profile) {
+			return nil, errors.Errorf("unknown profile %s", profile)
+		}
+		return doc, nil
+	}
+	obj, ok := overlay.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("profile %s must be an object", profile)
+	}
+	return mergeDocuments(doc, obj), nil
+}
+
+// hasProfileTunnel tells whether some tunnel of the config document lists the
+// given profile.
+func hasProfileTunnel(doc map[string]interface{}, profile string) bool {
+	tunnels, _ := doc["tunnels"].([]interface{})
+	for _, t := range tunnels {
+		obj, _ := t.(map[string]interface{})
+		profiles, _ := obj["profiles"].([]interface{})
+		for _, p := range profiles {
+			if p == profile {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectProfile drops the tunnels which are restricted to other profiles.
+func (c *Config) selectProfile(profile string) {
+	tunnels := make([]TunnelConfig, 0, len(c.Tunnels))
+	for i := range c.Tunnels {
+		if c.Tunnels[i].inProfile(profile) {
+			tunnels = append(tunnels, c.Tunnels[i])
+		}
+	}
+	c.Tunnels = tunnels
+}
+
+// inProfile tells whether the tunnel belongs to the given profile, tunnels
+// listing no profile belonging to all of them.
+func (c *TunnelConfig) inProfile(profile string) bool {
+	if len(c.Profiles) == 0 {
+		return true
+	}
+	for _, p := range c.Profiles {
+		if p == profile {
+			return true
+		}
+	}
+	return false
+}
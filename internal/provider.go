@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// paramRegex matches the placeholders of the params of a tunnel in the command
+// of an exec provider, e.g. "{{params.host}}".
+var paramRegex = regexp.MustCompile(`{{params\.([a-zA-Z0-9_-]+)}}`)
+
+// TunnelProvider builds the tunnels of a custom type, e.g. for an in-house
+// bastion CLI, so that they can be configured with "provider" and "params"
+// rather than a raw command.
+type TunnelProvider interface {
+	// BuildCommand returns the command opening the tunnel on the given local
+	// address, including the executable.
+	BuildCommand(c *TunnelConfig, bind string, port int) ([]string, error)
+	// Health returns the health check of the tunnels which have none, nil
+	// for the default one.
+	Health(c *TunnelConfig) *HealthCheck
+	// Readiness returns the ready_regex of the tunnels which have none, empty
+	// to consider them open as soon as their process runs.
+	Readiness(c *TunnelConfig) string
+}
+
+// providers are the providers registered by the programs embedding tmancer.
+var providers = struct {
+	byName map[string]TunnelProvider
+	m      sync.Mutex
+}{byName: map[string]TunnelProvider{}}
+
+// RegisterProvider makes the provider available to the tunnels under the given
+// name. Providers declared in the settings take precedence. Call this before
+// loading the config.
+func RegisterProvider(name string, p TunnelProvider) {
+	providers.m.Lock()
+	defer providers.m.Unlock()
+	providers.byName[name] = p
+}
+
+// ExecProvider is a provider declared in the settings, running a command
+// template filled with the params of the tunnels.
+type ExecProvider struct {
+	HealthCheck *HealthCheck `json:"health_check"`
+	// Command opens the tunnel, with the {{local_port}}, {{bind}} and
+	// {{params.<name>}} placeholders, e.g.
+	// "bastion connect {{params.host}} --listen {{bind}}:{{local_port}}".
+	Command string `json:"command"`
+	// ReadyRegex is the default ready_regex of the tunnels.
+	ReadyRegex string `json:"ready_regex"`
+}
+
+// BuildCommand implements TunnelProvider. The template is split into
+// arguments first, so that params with spaces or quotes stay within theirs.
+func (p *ExecProvider) BuildCommand(c *TunnelConfig, bind string, port int) ([]string, error) {
+	args, err := splitCommand(p.Command)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	ports := strings.NewReplacer(localPortPlaceholder, strconv.Itoa(port), bindPlaceholder, bind)
+	for i := range args {
+		args[i] = paramRegex.ReplaceAllStringFunc(ports.Replace(args[i]), func(placeholder string) string {
+			name := paramRegex.FindStringSubmatch(placeholder)[1]
+			v, ok := c.Params[name]
+			if !ok {
+				missing = append(missing, name)
+			}
+			return v
+		})
+	}
+	if len(missing) > 0 {
+		return nil, errors.Errorf("missing params %s", strings.Join(missing, ", "))
+	}
+	return args, nil
+}
+
+// Health implements TunnelProvider.
+func (p *ExecProvider) Health(*TunnelConfig) *HealthCheck {
+	return p.HealthCheck
+}
+
+// Readiness implements TunnelProvider.
+func (p *ExecProvider) Readiness(*TunnelConfig) string {
+	return p.ReadyRegex
+}
+
+// resolveProviders sets the provider of the tunnels using one, with its
+// health check and ready regex unless the tunnels have their own, and makes
+// sure that their commands can be built.
+func (c *Config) resolveProviders() error {
+	for i := range c.Tunnels {
+		t := &c.Tunnels[i]
+		if t.Provider == "" {
+			continue
+		}
+		var p TunnelProvider
+		if e, ok := c.Settings.Providers[t.Provider]; ok && e != nil {
+			p = e
+		} else {
+			providers.m.Lock()
+			p = providers.byName[t.Provider]
+			providers.m.Unlock()
+		}
+		if p == nil {
+			return errors.Errorf("%s: unknown provider %q", t.Name, t.Provider)
+		}
+		t.provider = p
+		if _, err := p.BuildCommand(t, t.processBind(), t.LocalPort); err != nil {
+			return errors.Wrapf(err, "%s: provider %s", t.Name, t.Provider)
+		}
+		if t.HealthCheck == nil {
+			t.HealthCheck = p.Health(t)
+		}
+		if t.ReadyRegex == "" {
+			t.ReadyRegex = p.Readiness(t)
+		}
+	}
+	return nil
+}
+
+// paramsTarget describes the params of a provider tunnel, e.g.
+// "host=db1 region=eu".
+func (c *TunnelConfig) paramsTarget() string {
+	names := make([]string, 0, len(c.Params))
+	for name := range c.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + c.Params[name]
+	}
+	return strings.Join(names, " ")
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rateRegex matches rates such as "2MBps", "500 KB/s" or "10Mbps".
+var rateRegex = regexp.MustCompile(`^\s*([0-9]+(?:\.[0-9]+)?)\s*([kKMG]i?)?([Bb])(?:ps|/s)\s*$`)
+
+// rateUnits are the multipliers of the rate prefixes.
+var rateUnits = map[string]float64{
+	"":   1,
+	"k":  1e3,
+	"K":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+}
+
+// Rate is a transfer rate which can be unmarshaled from a human readable json
+// string such as "2MBps", "500KB/s" or "10Mbps", in bits per second with a
+// lowercase b. An empty or zero rate is unlimited.
+type Rate struct {
+	// BytesPerSecond is 0 when unlimited.
+	BytesPerSecond int64
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *Rate) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.Wrap(err, "rate must be a string such as \"2MBps\"")
+	}
+	if s == "" {
+		r.BytesPerSecond = 0
+		return nil
+	}
+	m := rateRegex.FindStringSubmatch(s)
+	if m == nil {
+		return errors.Errorf("parsing rate %q, expected e.g. \"2MBps\" or \"10Mbps\"", s)
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return errors.Wrapf(err, "parsing rate %q", s)
+	}
+	v *= rateUnits[m[2]]
+	if m[3] == "b" {
+		v /= 8
+	}
+	if v > 0 && v < 1 {
+		return errors.Errorf("rate %q is below one byte per second", s)
+	}
+	r.BytesPerSecond = int64(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, unlimited rates being empty.
+func (r Rate) MarshalJSON() ([]byte, error) {
+	if r.BytesPerSecond <= 0 {
+		return json.Marshal("")
+	}
+	return json.Marshal(r.String())
+}
+
+// String returns the rate such as "2.0MB/s".
+func (r Rate) String() string {
+	return formatBytes(r.BytesPerSecond) + "/s"
+}
+
+// rateLimiter is a token bucket shared by all the connections going one way
+// through a tunnel, so that they are limited together.
+type rateLimiter struct {
+	// next is when the bytes handed out so far will have been sent at the
+	// limited rate.
+	next time.Time
+	rate int64
+	m    sync.Mutex
+}
+
+// newRateLimiter returns a limiter to rate, nil if unlimited.
+func newRateLimiter(rate Rate) *rateLimiter {
+	if rate.BytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate.BytesPerSecond}
+}
+
+// chunk returns the most bytes to send at once, a tenth of a second worth,
+// which keeps the bursts small.
+func (l *rateLimiter) chunk() int {
+	if c := l.rate / 10; c > 1 {
+		return int(c)
+	}
+	return 1
+}
+
+// wait blocks until n bytes can be sent.
+func (l *rateLimiter) wait(n int) {
+	l.m.Lock()
+	now := time.Now()
+	// Unused time is not saved up, beyond the burst of a chunk.
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.m.Unlock()
+	time.Sleep(time.Until(at))
+}
+
+// limitedWriter writes through a rate limiter, nil meaning unlimited.
+type limitedWriter struct {
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+func (w limitedWriter) Write(p []byte) (int, error) {
+	if w.limiter == nil {
+		return w.w.Write(p)
+	}
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		if c := w.limiter.chunk(); n > c {
+			n = c
+		}
+		w.limiter.wait(n)
+		m, err := w.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// readyPollInterval is how often WaitReady checks the tunnels.
+const readyPollInterval = 200 * time.Millisecond
+
+// anyRequired tells whether some of the tunnels are marked as required.
+func anyRequired(tunnels []*Tunnel) bool {
+	for _, t := range tunnels {
+		if t.config.Required {
+			return true
+		}
+	}
+	return false
+}
+
+// waitingFor returns the names of the tunnels keeping the session from being
+// ready, see IsReady.
+func waitingFor(tunnels []*Tunnel) []string {
+	all := !anyRequired(tunnels)
+	var names []string
+	for _, t := range tunnels {
+		if s := t.published(); (all || t.config.Required) && s.status != Open && !s.waiting {
+			names = append(names, t.config.Name)
+		}
+	}
+	return names
+}
+
+// IsReady tells whether the session is usable, that is whether all the
+// required tunnels are open, or all of them if none is required. On demand
+// tunnels waiting for connections count as open.
+func IsReady(tunnels []*Tunnel) bool {
+	return len(waitingFor(tunnels)) == 0
+}
+
+// WaitReady waits for the session to be ready, see IsReady. It fails as soon
+// as one of the tunnels it waits for will never open, e.g. it failed for
+// good, or once ctx is done.
+func WaitReady(ctx context.Context, tunnels []*Tunnel) error {
+	all := !anyRequired(tunnels)
+	for {
+		if IsReady(tunnels) {
+			return nil
+		}
+		for _, t := range tunnels {
+			if s := t.published(); (all || t.config.Required) && s.status.IsTerminal() {
+				return errors.Errorf("tunnel %s is %s", t.config.Name, s.status)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "not ready")
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+// envName turns a tunnel name into an environment variable prefix, e.g.
+// "payments-db" into "PAYMENTS_DB".
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return '_'
+		}
+		return unicode.ToUpper(r)
+	}, name)
+}
+
+// PortEnv returns the environment variables telling where the tunnels listen,
+// e.g. PAYMENTS_DB_HOST=127.0.0.1 and PAYMENTS_DB_PORT=4646.
+func PortEnv(configs []TunnelConfig) []string {
+	env := make([]string, 0, 2*len(configs))
+	for i := range configs {
+		prefix := envName(configs[i].Name)
+		env = append(env,
+			prefix+"_HOST="+configs[i].dialHost(),
+			prefix+"_PORT="+strconv.Itoa(configs[i].LocalPort))
+	}
+	return env
+}
+
+// TunnelEnv returns the PortEnv variables of the tunnels as they run, that is
+// with the ports they were rebound to if any.
+func TunnelEnv(tunnels []*Tunnel) []string {
+	configs := make([]TunnelConfig, len(tunnels))
+	for i, t := range tunnels {
+		configs[i] = t.published().config
+	}
+	return PortEnv(configs)
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// portConflictRebind is the port_conflict value moving tunnels to the next
+// free port when their local port is taken.
+const portConflictRebind = "rebind"
+
+// reboundWarning prefixes the warning of the tunnels which were moved to
+// another port.
+const reboundWarning = "Rebound: "
+
+// canListen tells whether the port is free on all the given hosts.
+func canListen(network string, hosts []string, port int) bool {
+	for _, host := range hosts {
+		l, err := net.Listen(network, net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			return false
+		}
+		l.Close()
+	}
+	return true
+}
+
+// rebind moves the tunnel to another local port if its own is taken and it
+// sets port_conflict to rebind. The configured port is tried first, then the
+// current one, then the next ports or those of rebind_range. It tells
+// whether the tunnel has a free port, it is then PortBusy otherwise. The
+// caller must hold the tunnel lock through lock, see setPortBusy.
+func (t *Tunnel) rebind(lock sync.Locker) bool {
+	c := &t.config
+	if c.PortConflict != portConflictRebind {
+		return true
+	}
+	if t.preferredPort == 0 {
+		t.preferredPort = c.LocalPort
+	}
+	candidates := []int{t.preferredPort, c.LocalPort}
+	if c.RebindRange != "" {
+		// Checked by validate.
+		ports, _ := parsePortRange(c.RebindRange)
+		candidates = append(candidates, ports...)
+	} else {
+		for p := t.preferredPort + 1; p <= 65535; p++ {
+			candidates = append(candidates, p)
+		}
+	}
+	for _, port := range candidates {
+		if !canListen(c.network(), c.listenHosts(), port) {
+			continue
+		}
+		c.LocalPort = port
+		switch {
+		case port != t.preferredPort:
+			t.warning = fmt.Sprintf("%slocal port %d is taken, using %d", reboundWarning, t.preferredPort, port)
+		case strings.HasPrefix(t.warning, reboundWarning):
+			t.warning = ""
+		}
+		return true
+	}
+	t.setPortBusy(lock, errors.Errorf("local port %d is taken and no other port is free", t.preferredPort), c.network(), c.listenBind(), t.preferredPort)
+	return false
+}
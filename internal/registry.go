@@ -0,0 +1,323 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// instancesDir is where the running sessions record the ports they own,
+// relative to the user's home.
+const instancesDir = ".tmancer/instances"
+
+// registryInterval is how often the processes of the session are recorded.
+const registryInterval = 2 * time.Second
+
+// Instance is a running tmancer session, as recorded in the registry.
+type Instance struct {
+	StartedAt time.Time `json:"started_at"`
+	// Configs are the absolute paths of the config files of the session.
+	Configs []string         `json:"configs"`
+	Tunnels []InstanceTunnel `json:"tunnels"`
+	Pid     int              `json:"pid"`
+}
+
+// InstanceTunnel is a tunnel of a running session.
+type InstanceTunnel struct {
+	Name string `json:"name"`
+	// Command is the command line of the process of the tunnel, with its
+	// secrets hidden.
+	Command string `json:"command,omitempty"`
+	// Started is when the process started as ps tells it, to make sure that
+	// Pid still is that process once the session is gone.
+	Started string `json:"started,omitempty"`
+	// Bind is the address the local port is bound to, empty for sessions
+	// which predate it, whose ports then overlap any address.
+	Bind string `json:"bind,omitempty"`
+	Port int    `json:"port"`
+	Pid  int    `json:"pid,omitempty"`
+}
+
+// Orphan is a tunnel process left behind by a session which did not shut
+// down, e.g. because it was killed with SIGKILL.
+type Orphan struct {
+	Tunnel  string
+	Command string
+	Pid     int
+}
+
+// Registry is the record of the running session in ~/.tmancer/instances.
+type Registry struct {
+	path     string
+	instance Instance
+	m        sync.Mutex
+	closed   bool
+}
+
+func instancesPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "getting home directory")
+	}
+	return filepath.Join(home, instancesDir), nil
+}
+
+// lockInstances takes an exclusive lock on the registry, so that two sessions
+// starting together do not both claim the same ports. The returned function
+// releases it.
+func lockInstances(dir string) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening instances lock")
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "locking instances")
+	}
+	return func() { f.Close() }, nil
+}
+
+// readInstances returns the running sessions of the registry and the processes
+// left behind by the ones which are gone. The records of the sessions which
+// are gone are removed once they have no process left.
+func readInstances(dir string) ([]Instance, []Orphan, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "reading %s", dir)
+	}
+	var instances []Instance
+	var orphans []Orphan
+	for _, e := range entries {
+		pid, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".json"))
+		if err != nil || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		i := Instance{}
+		if json.Unmarshal(b, &i) != nil {
+			continue
+		}
+		if isAlive(pid) {
+			instances = append(instances, i)
+			continue
+		}
+		left := false
+		for _, t := range i.Tunnels {
+			if t.Pid != 0 && t.Started != "" && isAlive(t.Pid) && processStartTime(t.Pid) == t.Started {
+				orphans = append(orphans, Orphan{Tunnel: t.Name, Command: t.Command, Pid: t.Pid})
+				left = true
+			}
+		}
+		if !left {
+			os.Remove(path)                         //nolint:errcheck // Tried again next time.
+			os.Remove(instanceSocketPath(dir, pid)) //nolint:errcheck // Likewise.
+		}
+	}
+	sort.Slice(instances, func(a, b int) bool {
+		return instances[a].StartedAt.Before(instances[b].StartedAt)
+	})
+	return instances, orphans, nil
+}
+
+// processCommand returns the command line of the process, empty if it cannot
+// be found.
+func processCommand(pid int) string {
+	out, err := exec.Command("ps", "-o", "command=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// processStartTime returns when the process started, empty if it cannot be
+// found. Unlike the pid, it tells apart a process from the one which reuses its
+// pid.
+func processStartTime(pid int) string {
+	out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// redactedCommand returns the command line of the tunnel process, with the
+// secrets it was given and the values which look like ones hidden.
+func (c *TunnelConfig) redactedCommand() string {
+	args, err := c.getArgs(c.LocalPort)
+	if err != nil {
+		return ""
+	}
+	return strings.Join(redactArgs(hideSecrets(args, c.secrets)), " ")
+}
+
+// RegisterInstance records the local ports of the session in
+// ~/.tmancer/instances. It fails if another running session owns any of them,
+// as both would fight over the ports forever.
+func RegisterInstance(configPaths []string, configs []TunnelConfig) (*Registry, error) {
+	dir, err := instancesPath()
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "creating instances directory")
+	}
+	unlock, err := lockInstances(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	others, _, err := readInstances(dir)
+	if err != nil {
+		return nil, err
+	}
+	// The same port on other addresses does not overlap.
+	type owner struct {
+		bind, tunnel string
+	}
+	owners := map[int][]owner{}
+	for _, o := range others {
+		for _, t := range o.Tunnels {
+			owners[t.Port] = append(owners[t.Port], owner{
+				bind:   t.Bind,
+				tunnel: fmt.Sprintf("tunnel %s of the session %d (%s)", t.Name, o.Pid, strings.Join(o.Configs, ", ")),
+			})
+		}
+	}
+	i := Instance{StartedAt: time.Now(), Pid: os.Getpid()}
+	var overlaps []string
+	for c := range configs {
+		port, bind := configs[c].LocalPort, configs[c].listenBind()
+		for _, o := range owners[port] {
+			if o.bind == "" || bindsOverlap(o.bind, bind) {
+				overlaps = append(overlaps, fmt.Sprintf("port %d of %s is owned by %s", port, configs[c].Name, o.tunnel))
+				break
+			}
+		}
+		i.Tunnels = append(i.Tunnels, InstanceTunnel{Name: configs[c].Name, Bind: bind, Port: port})
+	}
+	if len(overlaps) > 0 {
+		return nil, errors.Errorf("another tmancer session is running:\n  %s", strings.Join(overlaps, "\n  "))
+	}
+	for _, p := range configPaths {
+		if abs, err := filepath.Abs(p); err == nil {
+			p = abs
+		}
+		i.Configs = append(i.Configs, p)
+	}
+	r := &Registry{instance: i, path: filepath.Join(dir, strconv.Itoa(i.Pid)+".json")}
+	if err = r.write(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// write saves the record. The caller must hold the registry lock, unless it
+// is not shared yet.
+func (r *Registry) write() error {
+	b, err := json.MarshalIndent(r.instance, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshaling instance")
+	}
+	return errors.Wrap(os.WriteFile(r.path, b, 0o600), "recording instance")
+}
+
+// Track records the tunnels of the session and their processes as they come
+// and go, so that the next session can find them if this one is killed. It
+// returns once ctx is done.
+func (r *Registry) Track(ctx context.Context, s *Session) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(registryInterval):
+		}
+		current := s.Tunnels()
+		tunnels := make([]InstanceTunnel, len(current))
+		for i, t := range current {
+			// The local port changes when the tunnel is rebound.
+			c := &t.published().config
+			tunnels[i] = InstanceTunnel{Name: c.Name, Bind: c.listenBind(), Port: c.LocalPort, Pid: t.GetPid()}
+		}
+		previous := r.instance.Tunnels
+		changed := len(tunnels) != len(previous)
+		for i := range tunnels {
+			rt := &tunnels[i]
+			if i < len(previous) && previous[i].Name == rt.Name && previous[i].Pid == rt.Pid {
+				rt.Command, rt.Started = previous[i].Command, previous[i].Started
+				continue
+			}
+			if rt.Pid != 0 {
+				rt.Command = current[i].published().config.redactedCommand()
+				rt.Started = processStartTime(rt.Pid)
+			}
+			changed = true
+		}
+		if changed {
+			r.m.Lock()
+			r.instance.Tunnels = tunnels
+			if !r.closed {
+				r.write() //nolint:errcheck // Tried again on the next change.
+			}
+			r.m.Unlock()
+		}
+	}
+}
+
+// Close removes the record, the session being over.
+func (r *Registry) Close() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.closed = true
+	os.Remove(r.path) //nolint:errcheck // Pruned by the next session anyway.
+}
+
+// FindOrphans returns the tunnel processes left behind by the previous
+// sessions which did not shut down.
+func FindOrphans() ([]Orphan, error) {
+	dir, err := instancesPath()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+	_, orphans, err := readInstances(dir)
+	return orphans, err
+}
+
+// ReapOrphans terminates the process groups of the orphans, escalating to
+// SIGKILL for the ones still alive after the grace period.
+func ReapOrphans(orphans []Orphan) error {
+	for _, o := range orphans {
+		if err := signalGroup(o.Pid, syscall.SIGTERM); err != nil {
+			return errors.Wrapf(err, "terminating %d", o.Pid)
+		}
+	}
+	deadline := time.Now().Add(defaultKillGrace)
+	for _, o := range orphans {
+		for isAlive(o.Pid) && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if isAlive(o.Pid) {
+			if err := signalGroup(o.Pid, syscall.SIGKILL); err != nil {
+				return errors.Wrapf(err, "killing %d", o.Pid)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,454 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Renderer backends.
+const (
+	// RendererTable is the table refreshed in place, full screen. It falls
+	// back to RendererLines when not writing to a terminal, where moving the
+	// cursor around only produces garbage. This is the default.
+	RendererTable = "table"
+	// RendererLines prints a line every time a tunnel changes status, which
+	// suits logs and daemons.
+	RendererLines = "lines"
+	// RendererJSON prints a json snapshot of the session on every refresh.
+	RendererJSON = "json"
+	// RendererAccessible announces the meaningful changes as plain
+	// sentences, for screen readers.
+	RendererAccessible = "accessible"
+	// RendererNone displays nothing.
+	RendererNone = "none"
+)
+
+// Log formats of the lines renderer.
+const (
+	// LogFormatText prints human readable lines. This is the default.
+	LogFormatText = "text"
+	// LogFormatJSON prints a json event per line, for jq and log
+	// aggregators.
+	LogFormatJSON = "json"
+)
+
+const notAvailable = "N/A"
+
+// TunnelSnapshot is the state of a tunnel, or of a port range as a whole, at
+// a given time.
+type TunnelSnapshot struct {
+	Name    string
+	Type    string
+	Ports   string
+	Target  string
+	Context string
+	Details string
+	// Hint is the suggested command to recover from the current failure.
+	Hint string
+	// Connection is the connection string of the tunnel, see
+	// TunnelConfig.ConnectionString.
+	Connection string
+	// URL is the web UI the tunnel fronts, empty if none.
+	URL string
+	// Conns are the connection stats of proxied tunnels, nil for the others.
+	Conns *ConnStats
+	// Proc is the CPU and memory usage of the tunnel process, nil if
+	// unknown.
+	Proc *ProcStats
+	// Output holds the last output lines of the tunnel processes, oldest
+	// first. It is empty for port ranges.
+	Output []string
+	// Errors are the latest errors of the tunnel, oldest first.
+	Errors []TunnelError
+	// Age is only meaningful if HasAge is true.
+	Age time.Duration
+	// Uptime and Downtime are the time spent open and failing since the
+	// session started.
+	Uptime        time.Duration
+	Downtime      time.Duration
+	RestartWindow time.Duration
+	// Latency is the average round trip of the latest health probes, 0 if
+	// unknown.
+	Latency  time.Duration
+	Pid      int
+	Restarts int
+	Status   Status
+	HasAge   bool
+}
+
+// Snapshot is the state of a session at a given time.
+type Snapshot struct {
+	Time time.Time
+	// Started is when the session started, zero if it is the one taking the
+	// snapshot.
+	Started time.Time
+	Tunnels []TunnelSnapshot
+	// Events are the latest status changes of the session, oldest first.
+	Events []HistoryEvent
+	Health SessionHealth
+}
+
+// TakeSnapshot captures the state of the given tunnels, see
+// Tunnel.GetSnapshot. The sub-forwards of port ranges are aggregated.
+func TakeSnapshot(tunnels []*Tunnel) *Snapshot {
+	s := &Snapshot{
+		Time:    time.Now(),
+		Health:  GetSessionHealth(tunnels),
+		Tunnels: make([]TunnelSnapshot, 0, len(tunnels)),
+		Events:  getEvents(tunnels),
+	}
+	for i := 0; i < len(tunnels); i++ {
+		ts := tunnels[i].GetSnapshot()
+		c := &tunnels[i].config
+		if c.Group == "" {
+			s.Tunnels = append(s.Tunnels, ts)
+			continue
+		}
+		forwards := []TunnelSnapshot{ts}
+		for i+1 < len(tunnels) && tunnels[i+1].config.Group == c.Group {
+			i++
+			forwards = append(forwards, tunnels[i].GetSnapshot())
+		}
+		status, summary := GroupStatus(forwards)
+		s.Tunnels = append(s.Tunnels, TunnelSnapshot{
+			Name:    c.Group,
+			Type:    ts.Type,
+			Target:  ts.Target,
+			Context: ts.Context,
+			Ports:   ts.Ports + "-" + forwards[len(forwards)-1].Ports,
+			Status:  status,
+			Details: summary,
+			Errors:  mergeErrors(forwards),
+			// Connecting to the first port of the range.
+			Connection: ts.Connection,
+			URL:        ts.URL,
+			// The uptime of the first port stands for the range.
+			Uptime:   ts.Uptime,
+			Downtime: ts.Downtime,
+		})
+	}
+	return s
+}
+
+// details returns the details followed by the hint, if any.
+func (t *TunnelSnapshot) details() string {
+	if t.Hint == "" {
+		return t.Details
+	}
+	return fmt.Sprintf("%s (try: %s)", t.Details, t.Hint)
+}
+
+// Renderer displays the state of a session.
+type Renderer interface {
+	// Render displays a snapshot, it is called on every refresh.
+	Render(s *Snapshot)
+	// Close is called once the session is over, before the final messages
+	// are printed.
+	Close()
+}
+
+// NewRenderer returns the renderer backend of the settings, writing to w. The
+// json log format is only supported by the lines renderer, which it defaults
+// to.
+func NewRenderer(s *Settings, w io.Writer) (Renderer, error) {
+	name, formats := s.Renderer, s.Formats
+	columns, err := parseColumns(s.Columns)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkSort(s.Sort); err != nil {
+		return nil, err
+	}
+	switch s.LogFormat {
+	case "", LogFormatText:
+	case LogFormatJSON:
+		if name != "" && name != RendererLines {
+			return nil, errors.Errorf("the json log format is not supported by the %s renderer", name)
+		}
+		return &linesRenderer{w: w, formats: formats, last: map[string]string{}, events: json.NewEncoder(w)}, nil
+	default:
+		return nil, errors.Errorf("unknown log format %q", s.LogFormat)
+	}
+	switch name {
+	case "", RendererTable:
+		if f, ok := w.(*os.File); ok && isTerminal(f) {
+			return newTUIRenderer(f, formats, columns, s.Sort, s.ProblemsOnly, s.TerminalTitle), nil
+		}
+		return &linesRenderer{w: w, formats: formats, last: map[string]string{}}, nil
+	case RendererLines:
+		return &linesRenderer{w: w, formats: formats, last: map[string]string{}}, nil
+	case RendererJSON:
+		return &jsonRenderer{e: json.NewEncoder(w), formats: formats}, nil
+	case RendererAccessible:
+		return &accessibleRenderer{w: w, last: map[string]Status{}}, nil
+	case RendererNone:
+		return noneRenderer{}, nil
+	}
+	return nil, errors.Errorf("unknown renderer %q", name)
+}
+
+// tableRenderer formats the table of the session.
+type tableRenderer struct {
+	formats Formats
+	columns []column
+}
+
+// format returns the lines of the table: the session health, the header and a
+// row per tunnel.
+func (r *tableRenderer) format(s *Snapshot) []string {
+	lines := make([]string, 0, len(s.Tunnels)+2)
+	header := &strings.Builder{}
+	for _, c := range r.columns {
+		if c.name != ColumnDetails {
+			header.WriteString(c.cell(strings.ToUpper(c.name)))
+		}
+	}
+	lines = append(lines, fmt.Sprintf("Session %s", s.Health), strings.TrimRight(header.String(), " "))
+	for i := range s.Tunnels {
+		row, _ := r.row(&s.Tunnels[i])
+		lines = append(lines, row)
+	}
+	return lines
+}
+
+// row formats the row of a tunnel, also returning the index of the rune its
+// status starts at, -1 if the status is not displayed.
+func (r *tableRenderer) row(t *TunnelSnapshot) (string, int) {
+	row := &strings.Builder{}
+	statusStart := -1
+	for _, c := range r.columns {
+		var value string
+		switch c.name {
+		case ColumnName:
+			value = t.Name
+		case ColumnType:
+			value = t.Type
+		case ColumnPort:
+			value = t.Ports
+		case ColumnPid:
+			value = notAvailable
+			if t.Pid != 0 {
+				value = strconv.Itoa(t.Pid)
+			}
+		case ColumnAge:
+			value = notAvailable
+			if t.HasAge {
+				value = r.formats.FormatDuration(t.Age)
+			}
+		case ColumnRestarts:
+			value = notAvailable
+			if t.RestartWindow != 0 {
+				value = fmt.Sprintf("%d/%s", t.Restarts, r.formats.FormatDuration(t.RestartWindow))
+			}
+		case ColumnStatus:
+			statusStart = utf8.RuneCountInString(row.String())
+			value = t.Status.String()
+		case ColumnTarget:
+			value = t.Target
+		case ColumnContext:
+			value = t.Context
+		case ColumnDetails:
+			value = t.details()
+		case ColumnTraffic:
+			value = notAvailable
+			if t.Conns != nil {
+				value = fmt.Sprintf("↓%s ↑%s", formatBytes(t.Conns.BytesIn), formatBytes(t.Conns.BytesOut))
+			}
+		case ColumnRate:
+			value = notAvailable
+			if t.Conns != nil {
+				value = formatBytes(int64(t.Conns.Rate)) + "/s"
+			}
+		case ColumnLatency:
+			value = notAvailable
+			if t.Latency > 0 {
+				value = formatLatency(t.Latency)
+			}
+		case ColumnCPU:
+			value = notAvailable
+			if t.Proc != nil {
+				value = formatCPU(t.Proc.CPU)
+			}
+		case ColumnRSS:
+			value = notAvailable
+			if t.Proc != nil {
+				value = formatBytes(t.Proc.RSS)
+			}
+		case ColumnUptime:
+			value = r.formats.FormatDuration(t.Uptime)
+		case ColumnDowntime:
+			value = r.formats.FormatDuration(t.Downtime)
+		}
+		row.WriteString(c.cell(value))
+	}
+	return row.String(), statusStart
+}
+
+// linesRenderer prints a line every time a tunnel changes status or details.
+type linesRenderer struct {
+	last map[string]string
+	w    io.Writer
+	// events, if set, encodes the lines as json events instead.
+	events *json.Encoder
+	// statuses are the latest statuses, for the events.
+	statuses map[string]Status
+	formats  Formats
+}
+
+// lineEvent is a line of the json log format.
+type lineEvent struct {
+	Time           string `json:"time"`
+	Tunnel         string `json:"tunnel"`
+	Status         string `json:"status"`
+	PreviousStatus string `json:"previous_status,omitempty"`
+	Details        string `json:"details,omitempty"`
+	Hint           string `json:"hint,omitempty"`
+	Pid            int    `json:"pid,omitempty"`
+	Restarts       int    `json:"restarts"`
+}
+
+func (r *linesRenderer) Render(s *Snapshot) {
+	for i := range s.Tunnels {
+		t := &s.Tunnels[i]
+		line := t.Status.String()
+		if details := t.details(); details != "" {
+			line += " " + details
+		}
+		if r.last[t.Name] == line {
+			continue
+		}
+		r.last[t.Name] = line
+		if r.events != nil {
+			r.writeEvent(s.Time, t)
+			continue
+		}
+		fmt.Fprintf(r.w, "%s %s %s\n", r.formats.FormatTime(s.Time), t.Name, line)
+	}
+}
+
+// writeEvent encodes the change of the given tunnel as a json event. Times are
+// always RFC 3339, which log aggregators understand.
+func (r *linesRenderer) writeEvent(at time.Time, t *TunnelSnapshot) {
+	if r.statuses == nil {
+		r.statuses = map[string]Status{}
+	}
+	e := lineEvent{
+		Time:     at.Format(time.RFC3339Nano),
+		Tunnel:   t.Name,
+		Status:   t.Status.String(),
+		Details:  t.Details,
+		Hint:     t.Hint,
+		Pid:      t.Pid,
+		Restarts: t.Restarts,
+	}
+	if previous, ok := r.statuses[t.Name]; ok {
+		e.PreviousStatus = previous.String()
+	}
+	r.statuses[t.Name] = t.Status
+	r.events.Encode(e) //nolint:errcheck // Nothing to do about stdout going away.
+}
+
+func (r *linesRenderer) Close() {}
+
+// jsonRenderer prints one json object per snapshot.
+type jsonRenderer struct {
+	e       *json.Encoder
+	formats Formats
+}
+
+type jsonTunnel struct {
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	Ports         string `json:"ports"`
+	Status        string `json:"status"`
+	Details       string `json:"details"`
+	Hint          string `json:"hint,omitempty"`
+	URL           string `json:"url,omitempty"`
+	Age           string `json:"age,omitempty"`
+	Uptime        string `json:"uptime"`
+	Downtime      string `json:"downtime"`
+	Latency       string `json:"latency,omitempty"`
+	CPU           string `json:"cpu,omitempty"`
+	RSS           string `json:"rss,omitempty"`
+	RestartWindow string `json:"restart_window,omitempty"`
+	// Output holds the last output lines, the full history is left to the
+	// interactive table.
+	Output   []string `json:"output,omitempty"`
+	Pid      int      `json:"pid,omitempty"`
+	Restarts int      `json:"restarts"`
+}
+
+type jsonSnapshot struct {
+	Time         string       `json:"time"`
+	CriticalDown []string     `json:"critical_down"`
+	Tunnels      []jsonTunnel `json:"tunnels"`
+	Score        int          `json:"score"`
+}
+
+// newJSONSnapshot converts the snapshot to its json representation.
+func newJSONSnapshot(s *Snapshot, formats Formats) *jsonSnapshot {
+	js := &jsonSnapshot{
+		Time:         formats.FormatTime(s.Time),
+		Score:        s.Health.Score,
+		CriticalDown: s.Health.CriticalDown,
+		Tunnels:      make([]jsonTunnel, len(s.Tunnels)),
+	}
+	if js.CriticalDown == nil {
+		js.CriticalDown = []string{}
+	}
+	for i := range s.Tunnels {
+		t := &s.Tunnels[i]
+		jt := jsonTunnel{
+			Name:     t.Name,
+			Type:     t.Type,
+			Ports:    t.Ports,
+			Status:   t.Status.String(),
+			Details:  t.Details,
+			Hint:     t.Hint,
+			URL:      t.URL,
+			Pid:      t.Pid,
+			Restarts: t.Restarts,
+			Uptime:   formats.FormatDuration(t.Uptime),
+			Downtime: formats.FormatDuration(t.Downtime),
+		}
+		if n := len(t.Output); n > outputTailLines {
+			jt.Output = t.Output[n-outputTailLines:]
+		} else {
+			jt.Output = t.Output
+		}
+		if t.HasAge {
+			jt.Age = formats.FormatDuration(t.Age)
+		}
+		if t.Latency > 0 {
+			jt.Latency = formatLatency(t.Latency)
+		}
+		if t.Proc != nil {
+			jt.CPU, jt.RSS = formatCPU(t.Proc.CPU), formatBytes(t.Proc.RSS)
+		}
+		if t.RestartWindow != 0 {
+			jt.RestartWindow = formats.FormatDuration(t.RestartWindow)
+		}
+		js.Tunnels[i] = jt
+	}
+	return js
+}
+
+func (r *jsonRenderer) Render(s *Snapshot) {
+	r.e.Encode(newJSONSnapshot(s, r.formats)) //nolint:errcheck // Nothing to do about stdout going away.
+}
+
+func (r *jsonRenderer) Close() {}
+
+type noneRenderer struct{}
+
+func (noneRenderer) Render(*Snapshot) {}
+
+func (noneRenderer) Close() {}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Restart policies.
+const (
+	// RestartAlways reopens the tunnel whatever the reason of its exit.
+	RestartAlways = "always"
+	// RestartOnFailure reopens the tunnel only if its process failed.
+	RestartOnFailure = "on-failure"
+	// RestartNever never reopens the tunnel.
+	RestartNever = "never"
+)
+
+const (
+	defaultBackoff    = 2 * time.Second
+	defaultMaxBackoff = time.Minute
+	// restartResetAfter is how long a tunnel must stay open for its retries
+	// to be forgotten.
+	restartResetAfter = time.Minute
+)
+
+// RestartPolicy controls how a tunnel is reopened after its process exits.
+// Without one a tunnel is reopened forever every couple of seconds.
+type RestartPolicy struct {
+	// Policy is one of "always" (default), "on-failure" and "never".
+	Policy string `json:"policy"`
+	// Backoff is the delay before the first retry, doubled at every
+	// consecutive retry. Defaults to 2s.
+	Backoff Duration `json:"backoff"`
+	// MaxBackoff caps the delay between retries, defaults to 1m.
+	MaxBackoff Duration `json:"max_backoff"`
+	// MaxRetries is the number of consecutive retries after which the tunnel
+	// is marked as Failed, 0 means unlimited.
+	MaxRetries int `json:"max_retries"`
+}
+
+func (p *RestartPolicy) isValid() bool {
+	switch p.Policy {
+	case "", RestartAlways, RestartOnFailure, RestartNever:
+		return true
+	}
+	return false
+}
+
+// delay returns how long to wait before the given retry, starting from 1.
+func (p *RestartPolicy) delay(retry int) time.Duration {
+	d := p.Backoff.Or(defaultBackoff)
+	maxDelay := p.MaxBackoff.Or(defaultMaxBackoff)
+	for i := 1; i < retry && d < maxDelay; i++ {
+		d *= 2
+	}
+	if d > maxDelay {
+		return maxDelay
+	}
+	return d
+}
+
+// applyRestartPolicy decides what happens after the tunnel process exited.
+// wasOpenFor is how long the tunnel had been open before exiting. The caller
+// must hold the tunnel lock.
+func (t *Tunnel) applyRestartPolicy(clean bool, wasOpenFor time.Duration) {
+	p := t.config.Restart
+	if p == nil {
+		return
+	}
+	if wasOpenFor > restartResetAfter {
+		t.retries = 0
+	}
+	switch {
+	case p.Policy == RestartNever && !clean:
+		t.status = Failed
+		return
+	case p.Policy == RestartNever, p.Policy == RestartOnFailure && clean:
+		t.status = Exited
+		return
+	}
+	t.retries++
+	if p.MaxRetries > 0 && t.retries > p.MaxRetries {
+		t.status = Failed
+		t.err = errors.Wrapf(t.err, "gave up after %d retries", p.MaxRetries)
+		return
+	}
+	t.retryAt = time.Now().Add(jitter(p.delay(t.retries)))
+}
+
+// errRestartRequested is the reason tunnel processes are stopped for when
+// restarted on demand.
+var errRestartRequested = errors.New("restarted on demand")
+
+// Restart kills the tunnel process, if any, and reopens the tunnel right
+// away, skipping any backoff and including when it gave up. This does not
+// count towards the restart policy nor flapping. Crashed tunnels, tunnels
+// refreshing their auth and paused or scheduled tunnels are left alone. The
+// caller must hold the tunnel lock.
+func (t *Tunnel) Restart() {
+	switch t.status {
+	case Crashed, Refreshing, Paused, Scheduled:
+		return
+	case Opening, Open, Degraded:
+		// The process exit is picked up by Start which reopens the tunnel.
+		if t.killReason == nil {
+			t.killFor(errRestartRequested)
+		}
+		return
+	}
+	t.reset()
+}
+
+// reset brings the tunnel back to Close, forgetting about its past failures,
+// so that it is opened again right away. The caller must hold the tunnel
+// lock.
+func (t *Tunnel) reset() {
+	t.status = Close
+	t.err = nil
+	t.retries = 0
+	t.retryAt = time.Time{}
+	t.flappingUntil = time.Time{}
+	t.healthFailures = 0
+}
+
+// RestartTunnels restarts the tunnels with the given name or group and tells
+// whether there were any. It takes the tunnel locks.
+func RestartTunnels(tunnels []*Tunnel, name string) bool {
+	matching := matchTunnels(tunnels, name)
+	for _, t := range matching {
+		t.Lock()
+		t.Restart()
+		t.Unlock()
+	}
+	return len(matching) > 0
+}
+
+// matchTunnels returns the tunnels with the given name, or all the tunnels of
+// the port range with the given group name.
+func matchTunnels(tunnels []*Tunnel, name string) []*Tunnel {
+	var matching []*Tunnel
+	for _, t := range tunnels {
+		if t.config.Name == name || (t.config.Group != "" && t.config.Group == name) {
+			matching = append(matching, t)
+		}
+	}
+	return matching
+}
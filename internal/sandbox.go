@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// defaultSandboxEnv is the environment passed to sandboxed commands when no
+// explicit list is configured.
+var defaultSandboxEnv = []string{"PATH", "HOME", "USER", "TMPDIR", "LANG"}
+
+// Sandbox restricts what a tunnel command can do, which is useful when running
+// semi-trusted custom commands coming from a shared config. It relies on
+// bubblewrap on linux and sandbox-exec on macOS. The network is always shared
+// with the host since tunnels cannot work without it.
+type Sandbox struct {
+	// Env lists the environment variables passed to the command, defaults to
+	// PATH, HOME, USER, TMPDIR and LANG.
+	Env []string `json:"env"`
+	// ReadOnlyHome prevents the command from writing to the user's home.
+	ReadOnlyHome bool `json:"read_only_home"`
+}
+
+// environ returns the filtered environment for the sandboxed command.
+func (s *Sandbox) environ() []string {
+	names := s.Env
+	if len(names) == 0 {
+		names = defaultSandboxEnv
+	}
+	env := []string{}
+	for _, name := range names {
+		if v, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	return env
+}
+
+// wrap prefixes the command arguments with the platform sandboxing tool.
+func (s *Sandbox) wrap(args []string) ([]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil && s.ReadOnlyHome {
+		return nil, errors.Wrap(err, "locating home for sandbox")
+	}
+	switch runtime.GOOS {
+	case "linux":
+		wrapper := []string{
+			"bwrap",
+			"--bind", "/", "/",
+			"--dev-bind", "/dev", "/dev",
+			"--proc", "/proc",
+			"--unshare-all", "--share-net",
+			"--die-with-parent",
+		}
+		if s.ReadOnlyHome {
+			wrapper = append(wrapper, "--ro-bind", home, home)
+		}
+		return append(append(wrapper, "--"), args...), nil
+	case "darwin":
+		profile := "(version 1)(allow default)"
+		if s.ReadOnlyHome {
+			profile += fmt.Sprintf("(deny file-write* (subpath %q))", home)
+		}
+		return append([]string{"sandbox-exec", "-p", profile}, args...), nil
+	default:
+		return nil, errors.Errorf("sandbox is not supported on %s", runtime.GOOS)
+	}
+}
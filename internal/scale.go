@@ -0,0 +1,551 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMaxForwards     = 4
+	defaultConnsPerForward = 8
+	// scaleDownAfter is how long an additional forward can stay idle before
+	// being stopped.
+	scaleDownAfter = time.Minute
+	dialTimeout    = 5 * time.Second
+)
+
+// Scale makes tmancer listen on the local port itself and spread connections
+// over parallel forwards to the same target, starting more of them as the
+// number of concurrent connections grows. A single kubectl forward
+// multiplexes all connections over one stream, which suffers from head of
+// line blocking under load. Only k8s tunnels and custom tunnels using the
+// {{local_port}} placeholder can be scaled.
+type Scale struct {
+	// MaxForwards is the maximum number of parallel forwards, defaults to 4.
+	MaxForwards int `json:"max_forwards"`
+	// ConnsPerForward is the number of concurrent connections per forward
+	// above which another forward is started, defaults to 8.
+	ConnsPerForward int `json:"conns_per_forward"`
+}
+
+func (s *Scale) maxForwards() int {
+	if s.MaxForwards <= 0 {
+		return defaultMaxForwards
+	}
+	return s.MaxForwards
+}
+
+func (s *Scale) connsPerForward() int {
+	if s.ConnsPerForward <= 0 {
+		return defaultConnsPerForward
+	}
+	return s.ConnsPerForward
+}
+
+// isProxied tells whether the tunnel runs behind a balancer, which is the case
+// when tmancer needs to see the connections and the tunnel command can be told
+// which port to forward on.
+func (c *TunnelConfig) isProxied() bool {
+	if c.Scale == nil && c.MaxConnections <= 0 && c.TLS == nil && !c.CountConnections && c.IdleTimeout.Duration <= 0 && !c.OnDemand && c.MaxRate.BytesPerSecond <= 0 {
+		return false
+	}
+	return c.canProxy()
+}
+
+// canProxy tells whether the tunnel command can be told which port to forward
+// on, so that tmancer can listen on the local port instead. Providers and
+// HTTP proxies are always given the port.
+func (c *TunnelConfig) canProxy() bool {
+	return c.K8s != nil || strings.Contains(c.Custom, localPortPlaceholder) || c.provider != nil || c.HTTPProxy != nil
+}
+
+// forward is a port forward the balancer spreads connections over.
+type forward struct {
+	lastUsed time.Time
+	// cmd is nil for the forward run by the tunnel itself.
+	cmd    *exec.Cmd
+	exited chan struct{}
+	port   int
+	conns  int
+	ready  bool
+}
+
+// ConnStats describes the connections going through a proxied tunnel.
+type ConnStats struct {
+	// Forwards is the number of ready parallel forwards.
+	Forwards int
+	// Conns is the number of connections being proxied.
+	Conns int
+	// Peak is the highest number of concurrent connections.
+	Peak int
+	// Max is the max_connections setting, 0 if unlimited.
+	Max int
+	// Queued is the number of connections waiting for a slot.
+	Queued int
+	// Rejected is the number of connections refused because of Max.
+	Rejected int
+	// Total is the number of connections proxied since the session started.
+	Total int
+	// BytesIn and BytesOut are the bytes received from and sent to the
+	// remote end since the session started.
+	BytesIn  int64
+	BytesOut int64
+	// Rate is the recent transfer rate in both directions, in bytes per
+	// second.
+	Rate float64
+}
+
+// String returns a short description such as "3/5 conns (peak 5, 120 total,
+// 2 queued, 1 rejected)".
+func (s ConnStats) String() string {
+	res := fmt.Sprintf("%d conns", s.Conns)
+	if s.Max > 0 {
+		res = fmt.Sprintf("%d/%d conns", s.Conns, s.Max)
+	}
+	if s.Forwards > 1 {
+		res = fmt.Sprintf("%d forwards, %s", s.Forwards, res)
+	}
+	res += fmt.Sprintf(" (peak %d, %d total", s.Peak, s.Total)
+	if s.Queued > 0 {
+		res += fmt.Sprintf(", %d queued", s.Queued)
+	}
+	if s.Rejected > 0 {
+		res += fmt.Sprintf(", %d rejected", s.Rejected)
+	}
+	return res + ")"
+}
+
+// balancer accepts connections on the local port of a proxied tunnel and
+// proxies them to the least busy forward. The first forward is the tunnel
+// process itself, the additional ones are managed by the balancer.
+type balancer struct {
+	// config is the config of the tunnel as last published, see setConfig.
+	config atomic.Value
+	// slots limits the number of concurrent connections, nil if unlimited.
+	slots chan struct{}
+	// cancel stops accepting connections.
+	cancel context.CancelFunc
+	// originate is the TLS config to reach the remote end with, nil for
+	// plaintext.
+	originate *tls.Config
+	// awake is closed once the tunnel of an on demand balancer is open, see
+	// sleep.
+	awake chan struct{}
+	// wake asks the tunnel to open when a connection comes in while asleep.
+	wake chan struct{}
+	// opened is closed once the tunnel process is open, see setOpen.
+	opened chan struct{}
+	// limitIn and limitOut cap the rate of the traffic received from and
+	// sent to the remote end, nil if unlimited.
+	limitIn, limitOut *rateLimiter
+	forwards          []*forward
+	// listeners are bound to each address of the local port.
+	listeners []net.Listener
+	traffic   traffic
+	stats     ConnStats
+	// port is the private port the tunnel process forwards on.
+	port     int
+	m        sync.Mutex
+	spawning bool
+	asleep   bool
+}
+
+// freePort returns a local port of the given network and host which is free at
+// the time of calling.
+func freePort(network, host string) (int, error) {
+	l, err := net.Listen(network, net.JoinHostPort(host, "0"))
+	if err != nil {
+		return 0, errors.Wrap(err, "finding a free port")
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// startBalancer starts listening on the local port of the tunnel. It stops
+// accepting connections once ctx is done, use stop to also stop the
+// additional forwards.
+func startBalancer(ctx context.Context, config TunnelConfig) (*balancer, error) {
+	port, err := freePort("tcp4", defaultBind)
+	if err != nil {
+		return nil, err
+	}
+	var terminate, originate *tls.Config
+	if s := config.TLS; s != nil && s.Terminate {
+		if terminate, err = s.serverConfig(config.listenHosts()); err != nil {
+			return nil, err
+		}
+	}
+	if s := config.TLS; s != nil && s.Originate {
+		if originate, err = s.clientConfig(); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	listeners := make([]net.Listener, 0, 2)
+	for _, host := range config.listenHosts() {
+		l, err := net.Listen(config.network(), net.JoinHostPort(host, strconv.Itoa(config.LocalPort)))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			cancel()
+			return nil, errors.Wrap(err, "listening for the balancer")
+		}
+		if terminate != nil {
+			l = tls.NewListener(l, terminate)
+		}
+		listeners = append(listeners, l)
+	}
+	b := &balancer{
+		listeners: listeners,
+		cancel:    cancel,
+		originate: originate,
+		port:      port,
+		forwards:  []*forward{{port: port}},
+		opened:    make(chan struct{}),
+		wake:      make(chan struct{}, 1),
+		limitIn:   newRateLimiter(config.MaxRate),
+		limitOut:  newRateLimiter(config.MaxRate),
+	}
+	b.setConfig(&config)
+	if config.MaxConnections > 0 {
+		b.slots = make(chan struct{}, config.MaxConnections)
+		b.stats.Max = config.MaxConnections
+	}
+	go func() {
+		<-ctx.Done()
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	for _, l := range listeners {
+		go b.serve(l)
+	}
+	go b.scaleDown(ctx)
+	go b.sampleTraffic(ctx)
+	return b, nil
+}
+
+// setConfig replaces the config of the tunnel read by the balancer, which
+// must not be modified afterwards. Tunnels call it whenever they publish their
+// state, so that the balancer follows failovers without taking the tunnel
+// lock.
+func (b *balancer) setConfig(c *TunnelConfig) {
+	b.config.Store(c)
+}
+
+// getConfig returns the config of the tunnel, see setConfig.
+func (b *balancer) getConfig() *TunnelConfig {
+	return b.config.Load().(*TunnelConfig)
+}
+
+func (b *balancer) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// Closed.
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+// handle proxies conn to the least busy forward.
+func (b *balancer) handle(conn net.Conn) {
+	defer conn.Close()
+	if b.slots != nil {
+		if !b.admit() {
+			return
+		}
+		defer func() { <-b.slots }()
+	}
+	woke, ok := b.waitAwake()
+	if !ok {
+		return
+	}
+	f := b.acquire()
+	if f == nil {
+		if !b.waitOpen() {
+			return
+		}
+		if f = b.acquire(); f == nil {
+			return
+		}
+	}
+	defer b.release(f)
+	addr := net.JoinHostPort(defaultBind, strconv.Itoa(f.port))
+	up, err := net.DialTimeout("tcp4", addr, dialTimeout)
+	// A tunnel process which just started may not listen yet.
+	for deadline := time.Now().Add(dialTimeout); err != nil && woke && time.Now().Before(deadline); {
+		time.Sleep(100 * time.Millisecond)
+		up, err = net.DialTimeout("tcp4", addr, dialTimeout)
+	}
+	if err != nil {
+		return
+	}
+	if b.originate != nil {
+		up = tls.Client(up, b.originate)
+	}
+	defer up.Close()
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn, count *int64, limiter *rateLimiter) {
+		io.Copy(limitedWriter{w: countingWriter{w: dst, count: count}, limiter: limiter}, src) //nolint:errcheck // Either side going away is fine.
+		// Let the other direction finish, both TCP and TLS connections can
+		// be half closed.
+		if hc, ok := dst.(interface{ CloseWrite() error }); ok {
+			hc.CloseWrite() //nolint:errcheck // Best effort.
+		}
+		done <- struct{}{}
+	}
+	go pipe(up, conn, &b.traffic.out, b.limitOut)
+	go pipe(conn, up, &b.traffic.in, b.limitIn)
+	<-done
+	<-done
+}
+
+// admit waits for a connection slot, up to the queue timeout. It tells whether
+// the connection can go through.
+func (b *balancer) admit() bool {
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	default:
+	}
+	timeout := b.getConfig().QueueTimeout.Duration
+	b.m.Lock()
+	if timeout <= 0 {
+		b.stats.Rejected++
+		b.m.Unlock()
+		return false
+	}
+	b.stats.Queued++
+	b.m.Unlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	admitted := false
+	select {
+	case b.slots <- struct{}{}:
+		admitted = true
+	case <-timer.C:
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.stats.Queued--
+	if !admitted {
+		b.stats.Rejected++
+	}
+	return admitted
+}
+
+// acquire picks the ready forward with the least connections, starting
+// another forward if all of them are saturated. It returns nil if no forward
+// is ready.
+func (b *balancer) acquire() *forward {
+	b.m.Lock()
+	defer b.m.Unlock()
+	var best *forward
+	conns, ready := 0, 0
+	for _, f := range b.forwards {
+		if !f.ready {
+			continue
+		}
+		ready++
+		conns += f.conns
+		if best == nil || f.conns < best.conns {
+			best = f
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	if scale := b.getConfig().Scale; scale != nil && !b.spawning &&
+		conns >= ready*scale.connsPerForward() && len(b.forwards) < scale.maxForwards() {
+		b.spawning = true
+		go b.spawn()
+	}
+	best.conns++
+	best.lastUsed = time.Now()
+	b.stats.Total++
+	if conns+1 > b.stats.Peak {
+		b.stats.Peak = conns + 1
+	}
+	return best
+}
+
+// setOpen tells whether the tunnel process, the first forward, is open and
+// can be sent connections.
+func (b *balancer) setOpen(open bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	f := b.forwards[0]
+	if f.ready == open {
+		return
+	}
+	f.ready = open
+	if open {
+		close(b.opened)
+		return
+	}
+	b.opened = make(chan struct{})
+}
+
+// waitOpen holds a new connection until the tunnel process is open, up to its
+// startup timeout. It tells whether the connection can go through.
+func (b *balancer) waitOpen() bool {
+	b.m.Lock()
+	opened := b.opened
+	b.m.Unlock()
+	timer := time.NewTimer(b.getConfig().StartupTimeout.Or(defaultStartupTimeout))
+	defer timer.Stop()
+	select {
+	case <-opened:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (b *balancer) release(f *forward) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	f.conns--
+	f.lastUsed = time.Now()
+}
+
+// spawn starts an additional forward, which joins the pool once it reports
+// that it is ready and leaves it once it exits.
+func (b *balancer) spawn() {
+	defer func() {
+		b.m.Lock()
+		b.spawning = false
+		b.m.Unlock()
+	}()
+	port, err := freePort("tcp4", defaultBind)
+	if err != nil {
+		return
+	}
+	config := b.getConfig()
+	cmd, err := config.getCommand(port)
+	if err != nil {
+		return
+	}
+	f := &forward{cmd: cmd, port: port, exited: make(chan struct{})}
+	// Already checked when loading the config.
+	readyRegex, _ := config.readyRegex()
+	ready := make(chan struct{}, 1)
+	if readyRegex == nil {
+		ready <- struct{}{}
+	}
+	b.m.Lock()
+	b.forwards = append(b.forwards, f)
+	b.m.Unlock()
+	go func() {
+		runCommand(cmd, &b.m, readyRegex, ready, nil, nil, config.auditFor("command", "scale up")) //nolint:errcheck // The forward is just dropped.
+		close(f.exited)
+		b.m.Lock()
+		defer b.m.Unlock()
+		for i := range b.forwards {
+			if b.forwards[i] == f {
+				b.forwards = append(b.forwards[:i], b.forwards[i+1:]...)
+				break
+			}
+		}
+	}()
+	select {
+	case <-ready:
+		b.m.Lock()
+		f.ready = true
+		f.lastUsed = time.Now()
+		b.m.Unlock()
+	case <-f.exited:
+	case <-time.After(config.StartupTimeout.Or(defaultStartupTimeout)):
+		b.terminate(f)
+	}
+}
+
+// scaleDown stops the additional forwards which have been idle for a while.
+func (b *balancer) scaleDown(ctx context.Context) {
+	ticker := time.NewTicker(scaleDownAfter / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		b.m.Lock()
+		for _, f := range b.forwards {
+			if f.cmd != nil && f.ready && f.conns == 0 && time.Since(f.lastUsed) > scaleDownAfter {
+				b.terminate(f)
+			}
+		}
+		b.m.Unlock()
+	}
+}
+
+// terminate stops an additional forward.
+func (b *balancer) terminate(f *forward) {
+	if f.cmd.Process == nil {
+		return
+	}
+	config := b.getConfig()
+	sig, _ := config.stopSignal()
+	terminateGroup(f.cmd.Process.Pid, sig, config.KillGrace.Or(defaultKillGrace), f.exited, config.Name)
+}
+
+// stop stops all the additional forwards and waits for them to exit. The
+// listener is closed as soon as the context passed to startBalancer is done.
+func (b *balancer) stop() {
+	b.m.Lock()
+	forwards := make([]*forward, 0, len(b.forwards))
+	for _, f := range b.forwards {
+		if f.cmd != nil {
+			b.terminate(f)
+			forwards = append(forwards, f)
+		}
+	}
+	b.m.Unlock()
+	timeout := time.After(b.getConfig().KillGrace.Or(defaultKillGrace) + time.Second)
+	for _, f := range forwards {
+		select {
+		case <-f.exited:
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// close stops listening on the local port and stops the additional forwards
+// in the background.
+func (b *balancer) close() {
+	b.cancel()
+	go b.stop()
+}
+
+// getStats returns the current connection stats.
+func (b *balancer) getStats() ConnStats {
+	b.m.Lock()
+	defer b.m.Unlock()
+	stats := b.stats
+	stats.BytesIn = atomic.LoadInt64(&b.traffic.in)
+	stats.BytesOut = atomic.LoadInt64(&b.traffic.out)
+	stats.Rate = b.traffic.rate()
+	for _, f := range b.forwards {
+		if f.ready {
+			stats.Forwards++
+			stats.Conns += f.conns
+		}
+	}
+	return stats
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// clockLayout is the layout of the times of a Window.
+const clockLayout = "15:04"
+
+// Reasons tunnel processes are stopped for at the end of the work hours and
+// of their active hours.
+var (
+	errOutsideWorkHours   = errors.New("outside work hours")
+	errOutsideActiveHours = errors.New("outside active hours")
+)
+
+// Window is a daily time window, e.g. from 22:00 to 08:00. A window ending
+// before it starts spans midnight.
+type Window struct {
+	// Start of the window, e.g. "09:00".
+	Start string `json:"start"`
+	// End of the window, e.g. "18:00".
+	End string `json:"end"`
+	// Days restricts the window to the given days, e.g. ["mon", "tue"].
+	// Defaults to every day. A window spanning midnight belongs to the day it
+	// starts.
+	Days []string `json:"days"`
+}
+
+func (w *Window) validate(field string) error {
+	for _, clock := range []string{w.Start, w.End} {
+		if _, err := time.Parse(clockLayout, clock); err != nil {
+			return errors.Errorf("%s: invalid time %q, expected HH:MM", field, clock)
+		}
+	}
+	for _, day := range w.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return errors.Errorf("%s: unknown day %q", field, day)
+		}
+	}
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// minutes returns the minutes since midnight of an already validated clock.
+func minutes(clock string) int {
+	t, _ := time.Parse(clockLayout, clock)
+	return t.Hour()*60 + t.Minute()
+}
+
+// onDay tells whether the window applies to the given day.
+func (w *Window) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// contains tells whether t falls within the window, in the location of t.
+func (w *Window) contains(t time.Time) bool {
+	now, start, end := t.Hour()*60+t.Minute(), minutes(w.Start), minutes(w.End)
+	if start <= end {
+		return now >= start && now < end && w.onDay(t.Weekday())
+	}
+	// Spanning midnight, the early hours belong to the previous day.
+	if now >= start {
+		return w.onDay(t.Weekday())
+	}
+	return now < end && w.onDay(t.AddDate(0, 0, -1).Weekday())
+}
+
+// Schedule tells when tmancer may disturb the user and keep the tunnels open,
+// which matters when working with clusters in other regions.
+type Schedule struct {
+	location *time.Location
+	// QuietHours, if set, is when no notification is shown.
+	QuietHours *Window `json:"quiet_hours"`
+	// WorkHours, if set, is when the tunnels are open. They are paused
+	// outside of it.
+	WorkHours *Window `json:"work_hours"`
+	// Timezone of the windows, e.g. "Europe/London". Defaults to the local
+	// timezone.
+	Timezone string `json:"timezone"`
+}
+
+// validate checks the windows and loads the timezone.
+func (s *Schedule) validate() error {
+	if s == nil {
+		return nil
+	}
+	var err error
+	if s.location, err = time.LoadLocation(s.Timezone); err != nil {
+		return errors.Wrap(err, "schedule.timezone")
+	}
+	if s.QuietHours != nil {
+		if err = s.QuietHours.validate("schedule.quiet_hours"); err != nil {
+			return err
+		}
+	}
+	if s.WorkHours != nil {
+		return s.WorkHours.validate("schedule.work_hours")
+	}
+	return nil
+}
+
+// IsQuiet tells whether notifications should be held back at t.
+func (s *Schedule) IsQuiet(t time.Time) bool {
+	return s != nil && s.QuietHours != nil && s.QuietHours.contains(t.In(s.location))
+}
+
+// IsWorking tells whether the tunnels should be open at t.
+func (s *Schedule) IsWorking(t time.Time) bool {
+	return s == nil || s.WorkHours == nil || s.WorkHours.contains(t.In(s.location))
+}
+
+// isActive tells whether t falls within the active hours of the tunnel, in the
+// timezone of the session schedule if any.
+func (c *TunnelConfig) isActive(t time.Time) bool {
+	if len(c.ActiveHours) == 0 {
+		return true
+	}
+	if c.schedule != nil {
+		t = t.In(c.schedule.location)
+	}
+	for i := range c.ActiveHours {
+		if c.ActiveHours[i].contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// applySchedule pauses the tunnel outside of the work hours, makes it
+// Scheduled outside of its active hours, and resumes it once they start
+// again. It tells whether the tunnel is paused or scheduled, in which case
+// its status must not change further. The caller must hold the tunnel lock.
+func (t *Tunnel) applySchedule(now time.Time) bool {
+	if t.paused {
+		// Paused on demand, whatever the schedule.
+		return true
+	}
+	working, active := t.config.schedule.IsWorking(now), t.config.isActive(now)
+	switch {
+	case t.status == Paused && !working, t.status == Scheduled && !active:
+		return true
+	case t.status == Paused, t.status == Scheduled:
+		// Resuming is a fresh start rather than a restart.
+		t.status = Close
+		t.retryAt = time.Time{}
+	}
+	if (working && active) || t.status.IsTerminal() || t.status == Refreshing {
+		return false
+	}
+	switch t.status {
+	case Opening, Open, Degraded:
+		// The process exit is picked up by Start which pauses the tunnel.
+		if t.killReason == nil {
+			reason := errOutsideWorkHours
+			if working {
+				reason = errOutsideActiveHours
+			}
+			t.killFor(reason)
+		}
+		return true
+	}
+	if working {
+		t.enterScheduled()
+	} else {
+		t.enterPaused()
+	}
+	return true
+}
+
+// enterScheduled marks the tunnel as Scheduled once its process is gone,
+// releasing its local port. The caller must hold the tunnel lock.
+func (t *Tunnel) enterScheduled() {
+	t.enterPaused()
+	t.status = Scheduled
+}
+
+// notify shows a desktop notification about the tunnel, unless it is quiet
+// hours.
+func (t *Tunnel) notify(title, message string) {
+	if t.config.schedule.IsQuiet(time.Now()) {
+		return
+	}
+	go notify(title, message)
+}
@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	configType       = reflect.TypeOf(Config{})
+	tunnelConfigType = reflect.TypeOf(TunnelConfig{})
+	unmarshalerType  = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// checkUnknownFields reports the fields of the config file at path, and of the
+// files it includes, which do not match anything tmancer knows of. These are
+// otherwise silently ignored, which makes typos hard to spot.
+func checkUnknownFields(path string) ([]string, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return checkTunnelDir(path)
+	}
+	b, err := readPlainFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &schemaChecker{b: b, path: path}
+	d := json.NewDecoder(bytes.NewReader(b))
+	typ := configType
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		typ = reflect.SliceOf(tunnelConfigType)
+	}
+	if err = s.walk(d, typ, ""); err != nil {
+		return nil, errors.Wrapf(err, "%s", path)
+	}
+	problems := s.problems
+	config := Config{}
+	if typ == configType && json.Unmarshal(b, &config) == nil {
+		for _, include := range config.Include {
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(filepath.Dir(path), include)
+			}
+			included, err := checkUnknownFields(include)
+			if err != nil {
+				return nil, err
+			}
+			problems = append(problems, included...)
+		}
+	}
+	return problems, nil
+}
+
+// checkTunnelDir checks each tunnel file of a config directory for unknown
+// fields.
+func checkTunnelDir(dir string) ([]string, error) {
+	files, err := tunnelFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	for _, path := range files {
+		b, err := readPlainFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s := &schemaChecker{b: b, path: path}
+		if err = s.walk(json.NewDecoder(bytes.NewReader(b)), tunnelConfigType, ""); err != nil {
+			return nil, errors.Wrapf(err, "%s", path)
+		}
+		problems = append(problems, s.problems...)
+	}
+	return problems, nil
+}
+
+// schemaChecker walks a json document along with the type it unmarshals to.
+type schemaChecker struct {
+	path     string
+	b        []byte
+	problems []string
+}
+
+// line returns the line of the given offset of the document.
+func (s *schemaChecker) line(offset int64) int {
+	return bytes.Count(s.b[:offset], []byte("\n")) + 1
+}
+
+// walk consumes the next value of d, typ being what it unmarshals to, nil if
+// anything goes.
+func (s *schemaChecker) walk(d *json.Decoder, typ reflect.Type, where string) error {
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ != nil && (reflect.PtrTo(typ).Implements(unmarshalerType) || typ.Kind() == reflect.Interface) {
+		typ = nil
+	}
+	token, err := d.Token()
+	if err != nil {
+		return errors.Wrap(err, "reading json")
+	}
+	switch token {
+	case json.Delim('['):
+		var elem reflect.Type
+		if typ != nil && typ.Kind() == reflect.Slice {
+			elem = typ.Elem()
+		}
+		for i := 0; d.More(); i++ {
+			if err = s.walk(d, elem, fmt.Sprintf("%s[%d]", where, i)); err != nil {
+				return err
+			}
+		}
+	case json.Delim('{'):
+		for d.More() {
+			token, err = d.Token()
+			if err != nil {
+				return errors.Wrap(err, "reading json")
+			}
+			key, _ := token.(string)
+			path := strings.TrimPrefix(where+"."+key, ".")
+			var field reflect.Type
+			switch {
+			case typ == nil:
+			case typ.Kind() == reflect.Map:
+				field = typ.Elem()
+			case typ.Kind() == reflect.Struct:
+				var ok bool
+				if field, ok = jsonField(typ, key); !ok {
+					s.problems = append(s.problems, fmt.Sprintf("%s:%d: unknown field %s", s.path, s.line(d.InputOffset()), path))
+				}
+			}
+			// Defaults and profiles are partial configs kept as json.
+			if typ == configType {
+				switch strings.ToLower(key) {
+				case "defaults":
+					field = tunnelConfigType
+				case "profiles":
+					field = reflect.MapOf(reflect.TypeOf(""), configType)
+				}
+			}
+			if err = s.walk(d, field, path); err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+	// Closing delimiter.
+	_, err = d.Token()
+	return errors.Wrap(err, "reading json")
+}
+
+// jsonField returns the type of the field of the struct typ which the json
+// key unmarshals to, matching names the way encoding/json does.
+func jsonField(typ reflect.Type, key string) (reflect.Type, bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if strings.EqualFold(name, key) {
+			return f.Type, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// statusScore tells how usable a tunnel is, from 0 to 1, given its status.
+func statusScore(s Status) float64 {
+	switch s {
+	case Open:
+		return 1
+	case Degraded:
+		return 0.5
+	default:
+		return 0
+	}
+}
+
+func (c *TunnelConfig) weight() float64 {
+	if c.Weight == nil {
+		return 1
+	}
+	return *c.Weight
+}
+
+// SessionHealth summarises how usable the whole session is.
+type SessionHealth struct {
+	// CriticalDown lists the critical tunnels which are not usable.
+	CriticalDown []string
+	// Score goes from 0 (nothing works) to 100 (everything is open), each
+	// tunnel contributing according to its weight.
+	Score int
+}
+
+// GetSessionHealth computes the health of a session made of the given
+// tunnels.
+func GetSessionHealth(tunnels []*Tunnel) SessionHealth {
+	h := SessionHealth{}
+	total, sum := 0.0, 0.0
+	for _, t := range tunnels {
+		w := t.config.weight()
+		s := statusScore(t.GetStatus())
+		total += w
+		sum += w * s
+		if t.config.Critical && s == 0 {
+			h.CriticalDown = append(h.CriticalDown, t.config.Name)
+		}
+	}
+	h.Score = 100
+	if total > 0 {
+		h.Score = int(math.Round(100 * sum / total))
+	}
+	return h
+}
+
+// String returns a one line description of the health, such as
+// "health 87%" or "health 40% (critical down: db, redis)".
+func (h SessionHealth) String() string {
+	if len(h.CriticalDown) == 0 {
+		return fmt.Sprintf("health %d%%", h.Score)
+	}
+	return fmt.Sprintf("health %d%% (critical down: %s)", h.Score, strings.Join(h.CriticalDown, ", "))
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// secretTimeout caps the commands reading secrets, which may wait for a
+	// biometric unlock.
+	secretTimeout = time.Minute
+	// defaultSecretReader reads the secret references, 1Password's by
+	// default.
+	defaultSecretReader = "op read {{ref}}"
+	// secretPlaceholder is replaced with the output of secret_cmd.
+	secretPlaceholder = "{{secret}}"
+	// secretEnv holds the output of secret_cmd in the tunnel process
+	// environment.
+	secretEnv = "TMANCER_SECRET"
+)
+
+// secretRefRegex matches the secret references of tunnel commands, e.g.
+// {{secret "op://vault/item/password"}}.
+var secretRefRegex = regexp.MustCompile(`{{secret "([^"]+)"}}`)
+
+// GetSecretReader returns the command reading secret references.
+func (s *Settings) GetSecretReader() string {
+	if s.SecretReader == "" {
+		return defaultSecretReader
+	}
+	return s.SecretReader
+}
+
+// needsSecrets tells whether secrets must be read before starting the tunnel.
+func (c *TunnelConfig) needsSecrets() bool {
+	return c.SecretCmd != "" || secretRefRegex.MatchString(c.Custom) || secretRefRegex.MatchString(c.dynamicCommand)
+}
+
+// readSecrets reads the secrets of the tunnel: the output of secret_cmd and the
+// references of its command, by placeholder. They are read before every start
+// so that rotated secrets are picked up.
+func (c *TunnelConfig) readSecrets(ctx context.Context) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, secretTimeout)
+	defer cancel()
+	secrets := map[string]string{}
+	if c.SecretCmd != "" {
+		parts, err := splitCommand(c.SecretCmd)
+		if err != nil {
+			return nil, errors.Wrap(err, "secret_cmd")
+		}
+		v, err := c.runSecretCommand(ctx, "secret_cmd", parts)
+		if err != nil {
+			return nil, errors.Wrap(err, "running secret_cmd")
+		}
+		secrets[secretPlaceholder] = v
+	}
+	reader, err := splitCommand(c.secretReader)
+	if err == nil && len(reader) == 0 {
+		err = errors.New("empty command")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "secret_reader")
+	}
+	for _, command := range []string{c.Custom, c.dynamicCommand} {
+		for _, m := range secretRefRegex.FindAllStringSubmatch(command, -1) {
+			if _, ok := secrets[m[0]]; ok {
+				continue
+			}
+			args := make([]string, len(reader))
+			for i, arg := range reader {
+				args[i] = strings.ReplaceAll(arg, "{{ref}}", m[1])
+			}
+			v, err := c.runSecretCommand(ctx, "secret_reader", args)
+			if err != nil {
+				return nil, errors.Wrapf(err, "reading secret %s", m[1])
+			}
+			secrets[m[0]] = v
+		}
+	}
+	return secrets, nil
+}
+
+// runSecretCommand returns the output of the command coming from the given
+// config field, without its trailing newline. Only the error output makes it
+// to the errors, the output may be the secret.
+//
+//nolint:gosec // The command comes from the config.
+func (c *TunnelConfig) runSecretCommand(ctx context.Context, field string, args []string) (string, error) {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = c.Dir
+	cmd.Env = append(os.Environ(), "TMANCER_TUNNEL="+c.Name, "TMANCER_LOCAL_PORT="+strconv.Itoa(c.LocalPort))
+	b, err := c.auditFor(field, "").output(cmd)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			err = errors.Wrap(err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// withSecrets replaces the secret placeholders of the command with the
+// secrets read for it, quoted so that each stays a single argument.
+func (c *TunnelConfig) withSecrets(command string) string {
+	if len(c.secrets) == 0 {
+		return command
+	}
+	pairs := make([]string, 0, 2*len(c.secrets))
+	for placeholder, v := range c.secrets {
+		pairs = append(pairs, placeholder, "'"+strings.ReplaceAll(v, "'", `'\''`)+"'")
+	}
+	return strings.NewReplacer(pairs...).Replace(command)
+}
+
+// addSecretEnv adds the output of secret_cmd to the environment of cmd.
+func (c *TunnelConfig) addSecretEnv(cmd *exec.Cmd) {
+	v, ok := c.secrets[secretPlaceholder]
+	if !ok {
+		return
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, secretEnv+"="+v)
+}
@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// serviceRestartDelay is how long the service manager waits before starting
+// a session which exited with an error again, in seconds.
+const serviceRestartDelay = 10
+
+// unsafeServiceName matches what cannot be part of a service name.
+var unsafeServiceName = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Service is a user service running a session from login, a systemd unit on
+// Linux and a launchd agent on macOS.
+type Service struct {
+	// Name is the name of the unit or the label of the agent.
+	Name string
+	// Path is where the unit or the agent is installed.
+	Path string
+	// Log is where the session writes its output.
+	Log     string
+	content []byte
+	// enable and disable are the commands making the service manager pick up
+	// the service, or drop it.
+	enable  [][]string
+	disable [][]string
+}
+
+// NewService returns the service running the configs at paths with the given
+// profile, named after the first config. It fails on the systems without a
+// supported service manager.
+func NewService(paths []string, profile string) (*Service, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no config")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, errors.Wrap(err, "finding the tmancer executable")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting home directory")
+	}
+	// The table needs a terminal, which services do not have.
+	args := []string{exe, "start", "--no-tui"}
+	if profile != "" {
+		args = append(args, "--profile", profile)
+	}
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolving %s", p)
+		}
+		args = append(args, abs)
+	}
+	base := filepath.Base(paths[0])
+	base = unsafeServiceName.ReplaceAllString(strings.TrimSuffix(base, filepath.Ext(base)), "-")
+	s := &Service{Name: "tmancer-" + base, Log: filepath.Join(home, ".tmancer", "tmancer-"+base+".log")}
+	// Service managers start with a bare environment, the tunnel commands
+	// need to be found all the same.
+	env := [][2]string{{"PATH", os.Getenv("PATH")}}
+	if kubeconfig := os.Getenv("KUBECONFIG"); kubeconfig != "" {
+		env = append(env, [2]string{"KUBECONFIG", kubeconfig})
+	}
+	switch runtime.GOOS {
+	case "linux":
+		s.Path = filepath.Join(home, ".config", "systemd", "user", s.Name+".service")
+		s.content = systemdUnit(args, env, s.Log, paths[0])
+		s.enable = [][]string{
+			{"systemctl", "--user", "daemon-reload"},
+			{"systemctl", "--user", "enable", "--now", s.Name + ".service"},
+		}
+		s.disable = [][]string{{"systemctl", "--user", "disable", "--now", s.Name + ".service"}}
+	case "darwin":
+		s.Name = "com.github.lzambarda." + s.Name
+		s.Path = filepath.Join(home, "Library", "LaunchAgents", s.Name+".plist")
+		s.content = launchdPlist(s.Name, args, env, s.Log)
+		s.enable = [][]string{{"launchctl", "load", "-w", s.Path}}
+		s.disable = [][]string{{"launchctl", "unload", "-w", s.Path}}
+	default:
+		return nil, errors.Errorf("services are not supported on %s", runtime.GOOS)
+	}
+	return s, nil
+}
+
+// systemdUnit returns a systemd user unit running the command.
+func systemdUnit(args []string, env [][2]string, log, config string) []byte {
+	// Specifiers start with % in unit files.
+	quote := func(s string) string {
+		s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%").Replace(s)
+		return `"` + s + `"`
+	}
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = quote(a)
+	}
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "[Unit]\nDescription=tmancer tunnels of %s\nAfter=network-online.target\n\n", strings.ReplaceAll(config, "%", "%%"))
+	fmt.Fprintf(b, "[Service]\nExecStart=%s\n", strings.Join(quoted, " "))
+	fmt.Fprintf(b, "Restart=on-failure\nRestartSec=%d\n", serviceRestartDelay)
+	for _, kv := range env {
+		fmt.Fprintf(b, "Environment=%s\n", quote(kv[0]+"="+kv[1]))
+	}
+	fmt.Fprintf(b, "StandardOutput=append:%s\nStandardError=append:%s\n\n", log, log)
+	b.WriteString("[Install]\nWantedBy=default.target\n")
+	return b.Bytes()
+}
+
+// launchdPlist returns a launchd agent running the command.
+func launchdPlist(label string, args []string, env [][2]string, log string) []byte {
+	escape := func(s string) string {
+		b := &bytes.Buffer{}
+		xml.EscapeText(b, []byte(s)) //nolint:errcheck // Writing to a buffer.
+		return b.String()
+	}
+	b := &bytes.Buffer{}
+	b.WriteString(xml.Header)
+	b.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	b.WriteString("<plist version=\"1.0\">\n<dict>\n")
+	fmt.Fprintf(b, "  <key>Label</key>\n  <string>%s</string>\n", escape(label))
+	b.WriteString("  <key>ProgramArguments</key>\n  <array>\n")
+	for _, a := range args {
+		fmt.Fprintf(b, "    <string>%s</string>\n", escape(a))
+	}
+	b.WriteString("  </array>\n  <key>EnvironmentVariables</key>\n  <dict>\n")
+	for _, kv := range env {
+		fmt.Fprintf(b, "    <key>%s</key>\n    <string>%s</string>\n", escape(kv[0]), escape(kv[1]))
+	}
+	b.WriteString("  </dict>\n  <key>RunAtLoad</key>\n  <true/>\n")
+	// Start the session again unless it exited cleanly, e.g. with tmancer
+	// stop.
+	b.WriteString("  <key>KeepAlive</key>\n  <dict>\n    <key>SuccessfulExit</key>\n    <false/>\n  </dict>\n")
+	fmt.Fprintf(b, "  <key>ThrottleInterval</key>\n  <integer>%d</integer>\n", serviceRestartDelay)
+	fmt.Fprintf(b, "  <key>StandardOutPath</key>\n  <string>%s</string>\n", escape(log))
+	fmt.Fprintf(b, "  <key>StandardErrorPath</key>\n  <string>%s</string>\n", escape(log))
+	b.WriteString("</dict>\n</plist>\n")
+	return b.Bytes()
+}
+
+// Install writes the service and has the service manager start it, now and
+// at every login.
+func (s *Service) Install() error {
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0o755); err != nil {
+		return errors.Wrapf(err, "creating %s", filepath.Dir(s.Path))
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Log), 0o700); err != nil {
+		return errors.Wrap(err, "creating log directory")
+	}
+	if err := os.WriteFile(s.Path, s.content, 0o644); err != nil { //nolint:gosec // Read by the service manager.
+		return errors.Wrapf(err, "writing %s", s.Path)
+	}
+	return errors.Wrapf(runServiceCommands(s.enable), "enabling %s", s.Path)
+}
+
+// Uninstall stops the service and removes it.
+func (s *Service) Uninstall() error {
+	if _, err := os.Stat(s.Path); os.IsNotExist(err) {
+		return errors.Errorf("%s is not installed", s.Name)
+	}
+	if err := runServiceCommands(s.disable); err != nil {
+		return err
+	}
+	return errors.Wrapf(os.Remove(s.Path), "removing %s", s.Path)
+}
+
+// runServiceCommands runs the commands driving the service manager in order.
+func runServiceCommands(commands [][]string) error {
+	for _, c := range commands {
+		out, err := exec.Command(c[0], c[1:]...).CombinedOutput() //nolint:gosec // Fixed commands.
+		if err != nil {
+			return errors.Wrapf(err, "running %s: %s", strings.Join(c, " "), strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Session owns the tunnels of a running session, which can be added and
+// removed while it runs. It is safe for concurrent use.
+type Session struct {
+	// started is when the session started, for the uptime of attached
+	// tables.
+	started time.Time
+	ctx     context.Context
+	policy  *Policy
+	// setup prepares a new tunnel before it starts, e.g. with the event log.
+	setup    func(t *Tunnel)
+	stops    map[*Tunnel]context.CancelFunc
+	wg       *sync.WaitGroup
+	tunnels  []*Tunnel
+	settings Settings
+	// m guards the list of tunnels, not the tunnels themselves.
+	m sync.RWMutex
+}
+
+// NewSession returns the session of the tunnels of a config which passed
+// LoadConfig and the policy. Tunnels are run until ctx is done, or until they
+// are removed, with wg counting them. The setup function is applied to every
+// tunnel added later on, as it was to the initial ones.
+func NewSession(ctx context.Context, wg *sync.WaitGroup, settings Settings, policy *Policy, tunnels []*Tunnel, setup func(t *Tunnel)) *Session {
+	return &Session{
+		started:  time.Now(),
+		ctx:      ctx,
+		policy:   policy,
+		setup:    setup,
+		stops:    map[*Tunnel]context.CancelFunc{},
+		wg:       wg,
+		tunnels:  tunnels,
+		settings: settings,
+	}
+}
+
+// Start starts the initial tunnels.
+func (s *Session) Start() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, t := range s.tunnels {
+		s.start(t)
+	}
+}
+
+func (s *Session) start(t *Tunnel) {
+	ctx, stop := context.WithCancel(s.ctx)
+	s.stops[t] = stop
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t.Start(ctx)
+	}()
+}
+
+// Tunnels returns the tunnels of the session, in order. The list is not
+// modified afterwards, tunnels added or removed make for a new one.
+func (s *Session) Tunnels() []*Tunnel {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.tunnels
+}
+
+// Add starts the tunnel, or the sub-forwards of its port range, once checked
+// against the tunnels of the session as LoadConfig would. Unless reviewed, e.g.
+// when coming from the config file or typed in the table, the commands it
+// runs must not need confirming, see Policy.Confirm. It returns the names of
+// the tunnels added.
+func (s *Session) Add(c TunnelConfig, reviewed bool) ([]string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	configs := make([]TunnelConfig, len(s.tunnels))
+	names := make(map[string]bool, len(s.tunnels))
+	for i, t := range s.tunnels {
+		configs[i] = t.published().config
+		names[t.config.Name] = true
+	}
+	if c.Name == "" {
+		return nil, errors.New("the tunnel has no name")
+	}
+	config, err := NewConfig(s.settings, append(configs, c))
+	if err != nil {
+		return nil, err
+	}
+	if len(config.namespaces) > 0 {
+		return nil, errors.New("k8s_namespace entries can only be set in the config file")
+	}
+	added := &Config{Settings: config.Settings, Tunnels: config.Tunnels[len(configs):]}
+	for i := range added.Tunnels {
+		if names[added.Tunnels[i].Name] {
+			return nil, errors.Errorf("there already is a tunnel named %s", added.Tunnels[i].Name)
+		}
+	}
+	if err = s.policy.Check(added); err != nil {
+		return nil, err
+	}
+	if !reviewed {
+		if err = s.policy.checkAdded(added); err != nil {
+			return nil, err
+		}
+	}
+	if err = added.AssignFreePorts(); err != nil {
+		return nil, err
+	}
+	tunnels := make([]*Tunnel, len(added.Tunnels))
+	for i := range added.Tunnels {
+		tunnels[i] = NewTunnel(added.Tunnels[i])
+		s.setup(tunnels[i])
+	}
+	all := append(append([]*Tunnel(nil), s.tunnels...), tunnels...)
+	index := dependencyIndex(tunnelNames(all))
+	result := make([]string, len(tunnels))
+	for i, t := range tunnels {
+		t.linkDependencies(all, index)
+		s.start(t)
+		result[i] = t.config.Name
+	}
+	s.tunnels = all
+	return result, nil
+}
+
+// Remove stops the tunnels with the given name or group and removes them from
+// the session. It fails if other tunnels depend on them. It returns false if
+// there is no such tunnel.
+func (s *Session) Remove(name string) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	removed := map[*Tunnel]bool{}
+	for _, t := range s.tunnels {
+		if t.config.Name == name || t.config.Group == name {
+			removed[t] = true
+		}
+	}
+	if len(removed) == 0 {
+		return false, nil
+	}
+	var dependents []string
+	for _, t := range s.tunnels {
+		if removed[t] {
+			continue
+		}
+		for _, d := range t.dependencies {
+			if removed[d] {
+				dependents = append(dependents, t.config.Name)
+				break
+			}
+		}
+	}
+	if len(dependents) > 0 {
+		return true, errors.Errorf("%s depend on %s", strings.Join(dependents, ", "), name)
+	}
+	tunnels := make([]*Tunnel, 0, len(s.tunnels)-len(removed))
+	for _, t := range s.tunnels {
+		if !removed[t] {
+			tunnels = append(tunnels, t)
+			continue
+		}
+		// The tunnel shuts its process down as it would at the end of the
+		// session.
+		s.stops[t]()
+		delete(s.stops, t)
+	}
+	s.tunnels = tunnels
+	return true, nil
+}
+
+// tunnelNames returns the names and groups of the tunnels, for
+// dependencyIndex.
+func tunnelNames(tunnels []*Tunnel) ([]string, []string) {
+	names, groups := make([]string, len(tunnels)), make([]string, len(tunnels))
+	for i, t := range tunnels {
+		names[i], groups[i] = t.config.Name, t.config.Group
+	}
+	return names, groups
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// splitCommand splits a command line into its arguments the way a POSIX shell
+// would, minus expansions: arguments are separated by blanks, single quotes
+// preserve everything, double quotes preserve everything but backslash escapes
+// of `"`, `\`, `$` and "`", and a backslash outside quotes escapes the next
+// character.
+func splitCommand(s string) ([]string, error) {
+	args := []string{}
+	b := strings.Builder{}
+	// inArg tells whether an argument has started, so that "" is kept as an
+	// empty argument.
+	inArg := false
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, b.String())
+				b.Reset()
+				inArg = false
+			}
+		case r == '\\':
+			inArg = true
+			if i+1 < len(runes) {
+				i++
+				b.WriteRune(runes[i])
+			}
+		case r == '\'':
+			inArg = true
+			end := i + 1
+			for end < len(runes) && runes[end] != '\'' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, errors.Errorf("unterminated single quote in %q", s)
+			}
+			b.WriteString(string(runes[i+1 : end]))
+			i = end
+		case r == '"':
+			inArg = true
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`", runes[i+1]) {
+					i++
+				}
+				b.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				return nil, errors.Errorf("unterminated double quote in %q", s)
+			}
+		default:
+			inArg = true
+			b.WriteRune(r)
+		}
+	}
+	if inArg {
+		args = append(args, b.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
+
+// joinCommand is the reverse of splitCommand, quoting the arguments which
+// need it so that the command line can be pasted in a shell.
+func joinCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if a != "" && strings.Trim(a, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=@%+,") == "" {
+			quoted[i] = a
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
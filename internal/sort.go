@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Orders of the table rows.
+const (
+	// SortConfig keeps the order of the config. This is the default.
+	SortConfig = "config"
+	// SortStatus bubbles the tunnels with problems to the top.
+	SortStatus = "status"
+	// SortAge puts the most recently (re)opened tunnels first.
+	SortAge  = "age"
+	SortPort = "port"
+	SortName = "name"
+)
+
+// sortOrders are the orders in the order the s key cycles through them.
+var sortOrders = []string{SortConfig, SortStatus, SortAge, SortPort, SortName}
+
+// checkSort makes sure that the order is known.
+func checkSort(order string) error {
+	if order == "" {
+		return nil
+	}
+	for _, o := range sortOrders {
+		if o == order {
+			return nil
+		}
+	}
+	return errors.Errorf("unknown sort order %q", order)
+}
+
+// nextSort returns the order following the given one.
+func nextSort(order string) string {
+	for i, o := range sortOrders {
+		if o == order {
+			return sortOrders[(i+1)%len(sortOrders)]
+		}
+	}
+	return sortOrders[1]
+}
+
+// statusRank ranks statuses from the most to the least worrying.
+func statusRank(s Status) int {
+	switch {
+	case s.IsProblem() && s.IsTerminal():
+		return 0
+	case s.IsProblem():
+		return 1
+	case s == Open:
+		return 4
+	case s == Paused || s == Idle || s == Scheduled || s == Exited:
+		return 3
+	}
+	return 2
+}
+
+// firstPort returns the local port of a tunnel, the first one of port ranges.
+func firstPort(ports string) int {
+	if i := strings.Index(ports, "-"); i >= 0 {
+		ports = ports[:i]
+	}
+	port, _ := strconv.Atoi(ports)
+	return port
+}
+
+// arrange returns the tunnels in the given order, only the ones with problems
+// if problemsOnly is set. Ties keep the order of the config.
+func arrange(tunnels []TunnelSnapshot, order string, problemsOnly bool) []TunnelSnapshot {
+	res := make([]TunnelSnapshot, 0, len(tunnels))
+	for i := range tunnels {
+		if !problemsOnly || tunnels[i].Status.IsProblem() {
+			res = append(res, tunnels[i])
+		}
+	}
+	var less func(a, b *TunnelSnapshot) bool
+	switch order {
+	case SortStatus:
+		less = func(a, b *TunnelSnapshot) bool { return statusRank(a.Status) < statusRank(b.Status) }
+	case SortAge:
+		less = func(a, b *TunnelSnapshot) bool {
+			if a.HasAge != b.HasAge {
+				return a.HasAge
+			}
+			return a.Age < b.Age
+		}
+	case SortPort:
+		less = func(a, b *TunnelSnapshot) bool { return firstPort(a.Ports) < firstPort(b.Ports) }
+	case SortName:
+		less = func(a, b *TunnelSnapshot) bool { return a.Name < b.Name }
+	default:
+		return res
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return less(&res[i], &res[j])
+	})
+	return res
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// sshForward is a LocalForward directive of an ssh_config Host block.
+type sshForward struct {
+	host       string
+	bind       string
+	remoteHost string
+	remotePort int
+	localPort  int
+}
+
+// parseSSHConfig returns the LocalForward directives of the Host blocks of
+// the ssh_config file, in order. Blocks matching only wildcard patterns are
+// skipped, as are the Match blocks and the forwards of unix sockets.
+func parseSSHConfig(path string) ([]sshForward, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", path)
+	}
+	defer f.Close()
+	var forwards []sshForward
+	host := ""
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		// Keywords are separated from their arguments by spaces or an
+		// equal sign.
+		keyword, rest, _ := strings.Cut(strings.Replace(text, "=", " ", 1), " ")
+		args := strings.Fields(rest)
+		switch strings.ToLower(keyword) {
+		case "host":
+			host = ""
+			for _, pattern := range args {
+				if !strings.ContainsAny(pattern, "*?!") {
+					host = pattern
+					break
+				}
+			}
+		case "match":
+			host = ""
+		case "localforward":
+			if host == "" {
+				continue
+			}
+			if len(args) != 2 {
+				return nil, errors.Errorf("%s:%d: LocalForward takes a listen address and a target", path, line)
+			}
+			fw, ok, err := parseLocalForward(args[0], args[1])
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s:%d", path, line)
+			}
+			if ok {
+				fw.host = host
+				forwards = append(forwards, fw)
+			}
+		}
+	}
+	return forwards, errors.Wrapf(s.Err(), "reading %s", path)
+}
+
+// parseLocalForward parses the "[bind_address:]port" and "host:hostport"
+// arguments of a LocalForward directive. It returns false for unix sockets.
+func parseLocalForward(listen, target string) (sshForward, bool, error) {
+	fw := sshForward{}
+	if strings.Contains(listen, "/") || strings.Contains(target, "/") {
+		return fw, false, nil
+	}
+	port := listen
+	if i := strings.LastIndex(listen, ":"); i >= 0 {
+		fw.bind = strings.Trim(listen[:i], "[]")
+		port = listen[i+1:]
+	}
+	var err error
+	if fw.localPort, err = strconv.Atoi(port); err != nil {
+		return fw, false, errors.Errorf("invalid local port %q", port)
+	}
+	host, remotePort, err := net.SplitHostPort(target)
+	if err != nil {
+		return fw, false, errors.Wrapf(err, "parsing target %q", target)
+	}
+	fw.remoteHost = host
+	if fw.remotePort, err = strconv.Atoi(remotePort); err != nil {
+		return fw, false, errors.Errorf("invalid remote port %q", remotePort)
+	}
+	return fw, true, nil
+}
+
+// GenerateSSH returns custom tunnel configs, in their json form, for the
+// LocalForward directives of the ssh_config file at path, ~/.ssh/config if
+// empty. The tunnels run ssh against the Host of the directive, so that the
+// rest of its config still applies, named after it and suffixed with the
+// local port for hosts with several forwards. Local ports which are already
+// taken by another tunnel, either generated or in taken, which maps ports to
+// tunnel names, are moved to the next free one.
+func GenerateSSH(path string, taken map[int]string) ([]map[string]interface{}, error) {
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.Wrap(err, "getting home directory")
+		}
+		path = filepath.Join(home, ".ssh", "config")
+	}
+	forwards, err := parseSSHConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	perHost := map[string]int{}
+	for _, fw := range forwards {
+		perHost[fw.host]++
+	}
+	used := make(map[int]string, len(taken))
+	for port, name := range taken {
+		used[port] = name
+	}
+	tunnels := []map[string]interface{}{}
+	for _, fw := range forwards {
+		name := fw.host
+		if perHost[fw.host] > 1 {
+			name += "-" + strconv.Itoa(fw.localPort)
+		}
+		local, err := pickLocalPort(used, name, fw.localPort)
+		if err != nil {
+			return nil, err
+		}
+		t := map[string]interface{}{
+			"name":       name,
+			"local_port": local,
+			"custom": "ssh -N -o ExitOnForwardFailure=yes -L " + bindPlaceholder + ":" + localPortPlaceholder + ":" +
+				net.JoinHostPort(fw.remoteHost, strconv.Itoa(fw.remotePort)) + " " + fw.host,
+		}
+		switch fw.bind {
+		case "", "localhost", defaultBind:
+		case "*":
+			t["bind"] = "0.0.0.0"
+		default:
+			t["bind"] = fw.bind
+		}
+		tunnels = append(tunnels, t)
+	}
+	return tunnels, nil
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StartQueue limits how many tunnels of a session open at once, and how
+// quickly they start one after the other, so that starting a big config does
+// not hammer the API server. Tunnels over the limit wait for their turn in
+// the order they asked for it.
+type StartQueue struct {
+	// next is when the next tunnel may start opening.
+	next    time.Time
+	waiting []*Tunnel
+	delay   time.Duration
+	// limit is the maximum number of tunnels opening at once, 0 for no limit.
+	limit   int
+	opening int
+	m       sync.Mutex
+}
+
+// NewStartQueue instantiates a StartQueue letting at most limit tunnels open
+// at once, 0 for no limit, and waiting for delay between two of them.
+func NewStartQueue(limit int, delay time.Duration) *StartQueue {
+	return &StartQueue{limit: limit, delay: delay}
+}
+
+// acquire tells whether the tunnel may start opening now, queuing it if not.
+func (q *StartQueue) acquire(t *Tunnel, now time.Time) bool {
+	q.m.Lock()
+	defer q.m.Unlock()
+	i := q.index(t)
+	if i < 0 {
+		q.waiting = append(q.waiting, t)
+		i = len(q.waiting) - 1
+	}
+	free := len(q.waiting)
+	if q.limit > 0 {
+		free = q.limit - q.opening
+	}
+	if q.delay > 0 && free > 1 {
+		// Only one tunnel starts per delay.
+		free = 1
+	}
+	if i >= free || now.Before(q.next) {
+		return false
+	}
+	q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+	q.opening++
+	q.next = now.Add(q.delay)
+	return true
+}
+
+// release gives back the slot of a tunnel done opening, successfully or not.
+func (q *StartQueue) release() {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.opening--
+}
+
+// leave removes the tunnel from the queue, if it is in it.
+func (q *StartQueue) leave(t *Tunnel) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if i := q.index(t); i >= 0 {
+		q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+	}
+}
+
+// index returns the position of the tunnel in the queue, -1 if it is not
+// queued. The caller must hold the queue lock.
+func (q *StartQueue) index(t *Tunnel) int {
+	for i, w := range q.waiting {
+		if w == t {
+			return i
+		}
+	}
+	return -1
+}
+
+// SetStartQueue makes the tunnel wait for its turn in the given queue, shared
+// by all the tunnels of a session, before opening. Call this before Start.
+func (t *Tunnel) SetStartQueue(q *StartQueue) {
+	t.startQueue = q
+}
+
+// errQueued is the error of the tunnels waiting for their turn to open.
+var errQueued = errors.New("queued behind other tunnels opening")
+
+// takeStartSlot tells whether the tunnel may start opening now, explaining
+// why not otherwise. The caller must hold the tunnel lock.
+func (t *Tunnel) takeStartSlot() bool {
+	if t.startQueue == nil || t.startSlot {
+		return true
+	}
+	t.startSlot = t.startQueue.acquire(t, time.Now())
+	t.startQueued = !t.startSlot
+	switch {
+	case t.startQueued:
+		t.err = errQueued
+	case errors.Is(t.err, errQueued):
+		t.err = nil
+	}
+	return t.startSlot
+}
+
+// settleStartSlot gives back the slot of the tunnel once it is done opening,
+// and its place in the queue if it stopped waiting for one, e.g. when paused.
+// It is called at the end of every check, stopping says whether the tunnel is
+// being stopped for good. The caller must hold the tunnel lock.
+func (t *Tunnel) settleStartSlot(stopping bool) {
+	if t.startQueue == nil {
+		return
+	}
+	if t.startSlot && (stopping || t.status != Opening) {
+		t.startSlot = false
+		t.startQueue.release()
+	}
+	if stopping || !t.startQueued {
+		t.startQueue.leave(t)
+	}
+	t.startQueued = false
+}
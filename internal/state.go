@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tunnelState is a copy of the state of a tunnel, published every time the
+// tunnel lock is released so that other goroutines, such as the renderer,
+// read it without waiting for the tunnel. It is never modified once
+// published.
+type tunnelState struct {
+	startedAt   time.Time
+	statusSince time.Time
+	balancer    *balancer
+	err         string
+	warning     string
+	hint        string
+	restarts    []time.Time
+	latencies   []time.Duration
+	errorLog    []TunnelError
+	proc        *ProcStats
+	config      TunnelConfig
+	upTotal     time.Duration
+	downTotal   time.Duration
+	pid         int
+	// restartsTotal and errorsTotal are the counters of the metrics.
+	restartsTotal    int
+	errorsTotal      int
+	restartsByReason [restartReasons]int
+	status           Status
+	recordedStatus   Status
+	openedOnce       bool
+	paused           bool
+	// waiting tells whether an on demand tunnel waits for connections, which
+	// counts as open.
+	waiting bool
+}
+
+// Lock takes the tunnel lock, which guards the state of the tunnel. Tunnels
+// do not share locks, a tunnel busy running a slow command holds nobody else
+// up.
+func (t *Tunnel) Lock() {
+	t.m.Lock()
+}
+
+// Unlock publishes the state of the tunnel, see GetSnapshot, and releases the
+// tunnel lock.
+func (t *Tunnel) Unlock() {
+	t.publish()
+	t.m.Unlock()
+}
+
+// publish makes the current state of the tunnel visible to GetSnapshot and
+// the getters. The caller must hold the tunnel lock.
+func (t *Tunnel) publish() {
+	s := &tunnelState{
+		startedAt:        t.startedAt,
+		statusSince:      t.statusSince,
+		balancer:         t.balancer,
+		warning:          t.warning,
+		hint:             t.hint,
+		restarts:         append([]time.Time(nil), t.restarts...),
+		latencies:        append([]time.Duration(nil), t.latencies...),
+		errorLog:         append([]TunnelError(nil), t.errorLog...),
+		proc:             t.procStats,
+		config:           t.config,
+		upTotal:          t.upTotal,
+		downTotal:        t.downTotal,
+		restartsTotal:    t.restartsTotal,
+		errorsTotal:      t.errorsTotal,
+		restartsByReason: t.restartsByReason,
+		status:           t.status,
+		recordedStatus:   t.recordedStatus,
+		openedOnce:       t.openedOnce,
+		paused:           t.paused,
+		waiting:          t.idleWake() != nil,
+	}
+	if t.err != nil {
+		s.err = t.err.Error()
+	}
+	if t.balancer != nil {
+		t.balancer.setConfig(&s.config)
+	}
+	if t.drift != "" {
+		s.warning = t.drift
+	}
+	if t.cmd != nil && t.cmd.Process != nil {
+		s.pid = t.cmd.Process.Pid
+	}
+	previous, _ := t.state.Load().(*tunnelState)
+	t.state.Store(s)
+	if previous == nil || previous.status == s.status {
+		return
+	}
+	change := StatusChange{Time: time.Now(), Tunnel: s.config.Name, Error: s.err, Previous: previous.status, Status: s.status}
+	for _, sub := range t.subscribers {
+		sub.f(change)
+	}
+}
+
+// StatusChange is a status transition of a tunnel.
+type StatusChange struct {
+	Time   time.Time
+	Tunnel string
+	// Error is the failure behind the new status, if any.
+	Error    string
+	Previous Status
+	Status   Status
+}
+
+// statusSubscriber is a callback registered with Subscribe.
+type statusSubscriber struct {
+	f func(StatusChange)
+}
+
+// Subscribe calls f on every status change of the tunnel from now on, as seen
+// when the tunnel lock is released, until the returned function is called.
+// Changes are pushed in order with the tunnel lock held: f must return
+// quickly and must not take the lock, e.g. by sending on a buffered channel
+// without blocking.
+func (t *Tunnel) Subscribe(f func(StatusChange)) func() {
+	sub := &statusSubscriber{f: f}
+	t.Lock()
+	t.subscribers = append(t.subscribers, sub)
+	t.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.Lock()
+			defer t.Unlock()
+			for i := range t.subscribers {
+				if t.subscribers[i] == sub {
+					t.subscribers = append(t.subscribers[:i], t.subscribers[i+1:]...)
+					break
+				}
+			}
+		})
+	}
+}
+
+// published returns the state of the tunnel as of the last time its lock was
+// released.
+func (t *Tunnel) published() *tunnelState {
+	return t.state.Load().(*tunnelState)
+}
+
+// age returns how long the tunnel has been open, the flag telling whether it
+// is.
+func (s *tunnelState) age(now time.Time) (time.Duration, bool) {
+	if s.status == Open {
+		return now.Sub(s.startedAt).Round(time.Second), true
+	}
+	return 0, false
+}
+
+// uptime returns how long the tunnel has been open and failing in total.
+func (s *tunnelState) uptime(now time.Time) (up, down time.Duration) {
+	up, down = s.upTotal, s.downTotal
+	if !s.statusSince.IsZero() {
+		switch d := now.Sub(s.statusSince); {
+		case s.recordedStatus == Open || s.recordedStatus == Degraded:
+			up += d
+		case s.recordedStatus.IsProblem():
+			down += d
+		}
+	}
+	return up.Round(time.Second), down.Round(time.Second)
+}
+
+// restartRate returns the number of restarts within the flap detection
+// window, along with the window itself.
+func (s *tunnelState) restartRate(now time.Time) (restarts int, window time.Duration) {
+	window = s.config.Flapping.window()
+	for _, r := range s.restarts {
+		if now.Sub(r) < window {
+			restarts++
+		}
+	}
+	return restarts, window
+}
+
+// connStats returns the stats of the connections going through the tunnel,
+// the flag being false if it is not proxied by tmancer.
+func (s *tunnelState) connStats() (ConnStats, bool) {
+	if s.balancer == nil {
+		return ConnStats{}, false
+	}
+	return s.balancer.getStats(), true
+}
+
+// GetSnapshot returns the state of the tunnel as of the last time its lock
+// was released, with the durations brought up to date. It does not take the
+// tunnel lock.
+func (t *Tunnel) GetSnapshot() TunnelSnapshot {
+	s := t.published()
+	now := time.Now()
+	c := &s.config
+	ts := TunnelSnapshot{
+		Name:       c.Name,
+		Type:       c.GetType(),
+		Target:     c.GetTarget(),
+		Context:    c.GetContext(),
+		Ports:      strconv.Itoa(c.LocalPort),
+		Pid:        s.pid,
+		Latency:    s.latency(),
+		Status:     s.status,
+		Details:    s.err,
+		Hint:       s.hint,
+		Output:     t.GetOutput(),
+		Errors:     s.errorLog,
+		Proc:       s.procStats(),
+		Connection: c.GetConnectionString(),
+		URL:        c.GetURL(),
+	}
+	ts.Age, ts.HasAge = s.age(now)
+	ts.Uptime, ts.Downtime = s.uptime(now)
+	ts.Restarts, ts.RestartWindow = s.restartRate(now)
+	if ts.Details == "" {
+		ts.Details = s.warning
+	}
+	if stats, ok := s.connStats(); ok {
+		ts.Conns = &stats
+		if ts.Details == "" {
+			ts.Details = stats.String()
+		}
+	}
+	return ts
+}
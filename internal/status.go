@@ -29,4 +29,78 @@ const (
 	// the Event Horizon.
 	// This will transition to Reopening.
 	Cooper
+	// Refreshing means that the tunnel failed because of expired credentials
+	// and its auth_refresh command is running.
+	// This will transition to Reopening.
+	Refreshing
+	// Degraded means that the tunnel process is alive but its health check
+	// keeps failing. This will transition back to Open once the check passes.
+	Degraded
+	// Failed means that the tunnel gave up, either because it exhausted its
+	// retries or because its restart policy forbids reopening it. This is a
+	// terminal status.
+	Failed
+	// Exited means that the tunnel process terminated successfully and its
+	// restart policy forbids reopening it. This is a terminal status.
+	Exited
+	// Flapping means that the tunnel restarted too many times in a short
+	// period and is cooling off. This will transition to Reopening.
+	Flapping
+	// Crashed means that tmancer itself panicked while managing the tunnel,
+	// a crash report has been written. This is a terminal status.
+	Crashed
+	// WaitingForTarget means that the target of the tunnel does not exist
+	// yet, e.g. a preview environment spinning up. This will transition to
+	// Opening once it does.
+	WaitingForTarget
+	// Throttled means that the tunnel process failed because the Kubernetes
+	// API throttled it, which does not count towards the restart policy.
+	// This will transition to Opening after a longer backoff.
+	Throttled
+	// Paused means that the tunnel is closed, either on demand or because it
+	// is outside of the work hours of the schedule. This will transition to
+	// Opening once resumed or once work hours start.
+	Paused
+	// Idle means that the tunnel was stopped because no connection went
+	// through it for its idle timeout. This will transition to Opening once
+	// resumed.
+	Idle
+	// Waiting means that a precondition of the tunnel does not hold, e.g.
+	// the VPN is not connected, which does not count towards the restart
+	// policy. This will transition to Opening once they all hold.
+	Waiting
+	// PreflightFailed means that the preflight command of the tunnel failed,
+	// e.g. for lack of permissions, which does not count towards the restart
+	// policy. This will transition to Opening once it succeeds.
+	PreflightFailed
+	// Scheduled means that the tunnel is closed outside of its active hours.
+	// This will transition to Opening once they start again.
+	Scheduled
 )
+
+// ParseStatus returns the status with the given name, e.g. "Open". The flag
+// is false if there is none.
+func ParseStatus(name string) (Status, bool) {
+	for s := Undefined; s <= Scheduled; s++ {
+		if s.String() == name {
+			return s, true
+		}
+	}
+	return Undefined, false
+}
+
+// IsTerminal tells whether a tunnel in this status will never change status
+// again.
+func (s Status) IsTerminal() bool {
+	return s == Failed || s == Exited || s == Crashed
+}
+
+// IsProblem tells whether a tunnel in this status needs attention, as opposed
+// to being open, on its way there or paused on purpose.
+func (s Status) IsProblem() bool {
+	switch s {
+	case Undefined, Close, Opening, Open, Exited, Paused, Idle, Waiting, Scheduled:
+		return false
+	}
+	return true
+}
@@ -17,15 +17,29 @@ func _() {
 	_ = x[PortBusy-6]
 	_ = x[Signal-7]
 	_ = x[Cooper-8]
+	_ = x[Refreshing-9]
+	_ = x[Degraded-10]
+	_ = x[Failed-11]
+	_ = x[Exited-12]
+	_ = x[Flapping-13]
+	_ = x[Crashed-14]
+	_ = x[WaitingForTarget-15]
+	_ = x[Throttled-16]
+	_ = x[Paused-17]
+	_ = x[Idle-18]
+	_ = x[Waiting-19]
+	_ = x[PreflightFailed-20]
+	_ = x[Scheduled-21]
 }
 
-const _Status_name = "UndefinedCloseOpeningOpenErrorReopeningPortBusySignalCooper"
+const _Status_name = "UndefinedCloseOpeningOpenErrorReopeningPortBusySignalCooperRefreshingDegradedFailedExitedFlappingCrashedWaitingForTargetThrottledPausedIdleWaitingPreflightFailedScheduled"
 
-var _Status_index = [...]uint8{0, 9, 14, 21, 25, 30, 39, 47, 53, 59}
+var _Status_index = [...]uint8{0, 9, 14, 21, 25, 30, 39, 47, 53, 59, 69, 77, 83, 89, 97, 104, 120, 129, 135, 139, 146, 161, 170}
 
 func (i Status) String() string {
-	if i < 0 || i >= Status(len(_Status_index)-1) {
+	idx := int(i) - 0
+	if i < 0 || idx >= len(_Status_index)-1 {
 		return "Status(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
-	return _Status_name[_Status_index[i]:_Status_index[i+1]]
+	return _Status_name[_Status_index[idx]:_Status_index[idx+1]]
 }
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// statusLineSegment counts the tunnels of a colour of the status line.
+type statusLineSegment struct {
+	symbol string
+	// colour is the tmux colour of the segment.
+	colour string
+	count  int
+}
+
+// ControlStatusLine prints a one line summary of the tunnels of the running
+// session, e.g. "▲12 ●1 ✖2" for 12 open tunnels, one on its way and two
+// broken, for status bars. With tmux, the segments are coloured with its
+// #[fg=...] codes.
+func ControlStatusLine(ctx context.Context, w io.Writer, tmux bool) error {
+	js := jsonSnapshot{}
+	if err := controlRequest(ctx, http.MethodGet, "/tunnels", &js); err != nil {
+		return err
+	}
+	segments := []statusLineSegment{
+		{symbol: "▲", colour: "green"},
+		{symbol: "●", colour: "yellow"},
+		{symbol: "✖", colour: "red"},
+	}
+	for i := range js.Tunnels {
+		status, _ := ParseStatus(js.Tunnels[i].Status)
+		// Same colours as the table.
+		switch statusColour(status) {
+		case green:
+			segments[0].count++
+		case yellow:
+			segments[1].count++
+		case red:
+			segments[2].count++
+		}
+	}
+	parts := make([]string, 0, len(segments))
+	for i, s := range segments {
+		// The open tunnels are always counted, the others when there are any.
+		if s.count == 0 && i > 0 {
+			continue
+		}
+		part := fmt.Sprintf("%s%d", s.symbol, s.count)
+		if tmux {
+			part = "#[fg=" + s.colour + "]" + part + "#[default]"
+		}
+		parts = append(parts, part)
+	}
+	_, err := fmt.Fprintln(w, strings.Join(parts, " "))
+	return err
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"os/exec"
+	"time"
+)
+
+const (
+	// targetPollInterval is how often a missing target is looked up again.
+	targetPollInterval = 5 * time.Second
+	targetCheckTimeout = 10 * time.Second
+)
+
+// targetExists tells whether the target of the tunnel exists: the k8s
+// service for k8s tunnels, the target_host resolving for custom ones. Tunnels
+// with no way of telling are assumed to have their target.
+//
+//nolint:gosec // I'm happy for now.
+func (c *TunnelConfig) targetExists(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, targetCheckTimeout)
+	defer cancel()
+	if c.K8s != nil {
+		args := []string{"get", "-n", c.K8s.Namespace}
+		if c.K8s.Context != "" {
+			args = append(args, "--context", c.K8s.Context)
+		}
+		args = append(args, c.K8s.Service, "-o", "name")
+		return exec.CommandContext(ctx, "kubectl", args...).Run() == nil
+	}
+	if c.TargetHost != "" {
+		_, err := net.DefaultResolver.LookupHost(ctx, c.TargetHost)
+		return err == nil
+	}
+	return true
+}
+
+// waitForTarget tells whether the tunnel must wait for its target to exist
+// before being started, in which case it moves to WaitingForTarget. The
+// caller must hold the tunnel lock.
+func (t *Tunnel) waitForTarget() bool {
+	if !t.config.WaitForTarget || t.targetFound {
+		return false
+	}
+	if t.status != WaitingForTarget {
+		t.waitingFrom = t.status
+		t.status = WaitingForTarget
+	}
+	return true
+}
+
+// checkTarget looks the target up in the background, at most every
+// targetPollInterval, and sends the result on found. The caller must hold the
+// tunnel lock.
+func (t *Tunnel) checkTarget(ctx context.Context, found chan<- bool) {
+	if t.checkingTarget || time.Since(t.targetCheckedAt) < targetPollInterval {
+		return
+	}
+	t.checkingTarget = true
+	t.targetCheckedAt = time.Now()
+	c := t.config
+	go func() {
+		found <- c.targetExists(ctx)
+	}()
+}
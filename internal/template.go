@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"encoding/json"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// varRegex matches references to the config vars, such as {{vars.context}}.
+var varRegex = regexp.MustCompile(`\{\{vars\.([A-Za-z0-9_-]+)\}\}`)
+
+// applyTemplates rebuilds the tunnel configs from the raw config file with the
+// defaults and vars applied.
+func (c *Config) applyTemplates(b []byte) error {
+	if len(c.Vars) == 0 && len(c.Defaults) == 0 {
+		return nil
+	}
+	raw := struct {
+		Tunnels []map[string]interface{} `json:"tunnels"`
+	}{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return errors.Wrap(err, "unmarshaling configs")
+	}
+	tunnels := make([]TunnelConfig, len(raw.Tunnels))
+	for i, t := range raw.Tunnels {
+		merged := mergeDefaults(c.Defaults, t)
+		expanded, err := expandVars(merged, c.Vars)
+		if err != nil {
+			return errors.Wrapf(err, "tunnel #%d", i)
+		}
+		tb, err := json.Marshal(expanded)
+		if err != nil {
+			return errors.Wrapf(err, "tunnel #%d", i)
+		}
+		if err = json.Unmarshal(tb, &tunnels[i]); err != nil {
+			return errors.Wrapf(err, "tunnel #%d", i)
+		}
+	}
+	c.Tunnels = tunnels
+	return nil
+}
+
+// mergeDefaults returns the tunnel with the defaults set for whatever it does
+// not set itself. Nested objects are merged recursively, except for k8s
+// defaults which only apply to tunnels which are k8s ones already.
+func mergeDefaults(defaults, tunnel map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(tunnel))
+	for k, v := range tunnel {
+		res[k] = v
+	}
+	for k, def := range defaults {
+		v, ok := res[k]
+		if !ok {
+			if k != "k8s" {
+				res[k] = def
+			}
+			continue
+		}
+		defObj, defIsObj := def.(map[string]interface{})
+		obj, isObj := v.(map[string]interface{})
+		if defIsObj && isObj {
+			res[k] = mergeDefaults(defObj, obj)
+		}
+	}
+	return res
+}
+
+// expandVars replaces the references to vars in all the strings of v.
+func expandVars(v interface{}, vars map[string]string) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		var err error
+		res := varRegex.ReplaceAllStringFunc(v, func(ref string) string {
+			name := varRegex.FindStringSubmatch(ref)[1]
+			value, ok := vars[name]
+			if !ok && err == nil {
+				err = errors.Errorf("unknown var %s", name)
+			}
+			return value
+		})
+		return res, err
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			expanded, err := expandVars(item, vars)
+			if err != nil {
+				return nil, err
+			}
+			res[k] = expanded
+		}
+		return res, nil
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, item := range v {
+			expanded, err := expandVars(item, vars)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = expanded
+		}
+		return res, nil
+	}
+	return v, nil
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+
+package internal
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// terminalSize returns the number of rows and columns of the terminal f is
+// attached to.
+func terminalSize(f *os.File) (rows, cols int, err error) {
+	var ws struct {
+		rows, cols, x, y uint16
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return 0, 0, errno
+	}
+	return int(ws.rows), int(ws.cols), nil
+}
+
+// NotifyResize relays the terminal resizes to c.
+func NotifyResize(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGWINCH)
+}
@@ -0,0 +1,29 @@
+package internal
+
+import (
+	"os"
+	"unsafe"
+)
+
+var procGetConsoleScreenBufferInfo = kernel32.NewProc("GetConsoleScreenBufferInfo")
+
+// terminalSize returns the number of rows and columns of the console window f
+// is attached to.
+func terminalSize(f *os.File) (rows, cols int, err error) {
+	type coord struct{ x, y int16 }
+	var info struct {
+		size, cursor             coord
+		attributes               uint16
+		left, top, right, bottom int16
+		maximum                  coord
+	}
+	r, _, err := procGetConsoleScreenBufferInfo.Call(f.Fd(), uintptr(unsafe.Pointer(&info)))
+	if r == 0 {
+		return 0, 0, err
+	}
+	return int(info.bottom-info.top) + 1, int(info.right-info.left) + 1, nil
+}
+
+// NotifyResize does nothing as consoles do not signal their resizes, the
+// table follows the console size on the next refresh instead.
+func NotifyResize(chan<- os.Signal) {}
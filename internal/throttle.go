@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"regexp"
+	"time"
+)
+
+const (
+	defaultThrottleBackoff = 10 * time.Second
+	maxThrottleBackoff     = 2 * time.Minute
+)
+
+// throttleRegex matches the output of kubectl, or of any tool based on
+// client-go, when the Kubernetes API throttles it or a TLS handshake times
+// out, both being transient.
+var throttleRegex = regexp.MustCompile(`(?i)(too many requests|\b429\b|client-side throttling|rate limit|TLS handshake timeout)`)
+
+// applyThrottle tells whether the process failed because of transient API
+// throttling, given its error. If so the tunnel is Throttled and retried after
+// a longer backoff, without going through its restart policy. The caller must
+// hold the tunnel lock.
+func (t *Tunnel) applyThrottle(err error) bool {
+	if err == nil || !throttleRegex.MatchString(err.Error()) {
+		t.throttles = 0
+		return false
+	}
+	t.throttles++
+	delay := defaultThrottleBackoff
+	for i := 1; i < t.throttles && delay < maxThrottleBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxThrottleBackoff {
+		delay = maxThrottleBackoff
+	}
+	t.status = Throttled
+	t.retryAt = time.Now().Add(jitter(delay))
+	return true
+}
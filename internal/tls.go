@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// selfSignedValidity is how long the generated certificates are valid for,
+// they are generated again on every start anyway.
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// TLS makes tmancer terminate or originate TLS on the connections going
+// through a tunnel, so that plaintext only tools can talk to endpoints
+// requiring TLS and the other way around. Like Scale, it makes tmancer proxy
+// the connections.
+type TLS struct {
+	// CertFile and KeyFile are the certificate presented on the local port
+	// when terminating. Defaults to a self-signed certificate generated at
+	// start.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// CAFile is the PEM bundle verifying the remote end when originating.
+	// Defaults to the system roots.
+	CAFile string `json:"ca_file"`
+	// ClientCertFile and ClientKeyFile are the certificate presented to the
+	// remote end when originating, for endpoints requiring mutual TLS.
+	ClientCertFile string `json:"client_cert_file"`
+	ClientKeyFile  string `json:"client_key_file"`
+	// ServerName is sent to and verified against the remote end when
+	// originating, as the tunnel target is reached through a local address.
+	ServerName string `json:"server_name"`
+	// Terminate makes the local port accept TLS connections, which are
+	// forwarded in plaintext.
+	Terminate bool `json:"terminate"`
+	// Originate makes tmancer speak TLS to the remote end, the local port
+	// accepting plaintext connections.
+	Originate bool `json:"originate"`
+	// InsecureSkipVerify accepts any certificate from the remote end when
+	// originating.
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+// serverConfig returns the TLS config of the local port, generating a
+// certificate for the given hosts if none is configured.
+func (s *TLS) serverConfig(hosts []string) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if s.CertFile != "" {
+		cert, err = tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	} else {
+		cert, err = selfSignedCert(hosts)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "loading tls certificate")
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// clientConfig returns the TLS config used to reach the remote end.
+func (s *TLS) clientConfig() (*tls.Config, error) {
+	//nolint:gosec // Only when asked to.
+	config := &tls.Config{
+		ServerName:         s.ServerName,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if s.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.ClientCertFile, s.ClientKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading tls client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if s.CAFile == "" {
+		return config, nil
+	}
+	b, err := os.ReadFile(s.CAFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading file %s", s.CAFile)
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(b) {
+		return nil, errors.Errorf("no certificate found in %s", s.CAFile)
+	}
+	return config, nil
+}
+
+// selfSignedCert generates a certificate valid for the given hosts, which
+// clients have to be told to trust or not to verify.
+func selfSignedCert(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "generating key")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "generating serial number")
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"tmancer"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "creating certificate")
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// trafficSamples is the number of one second samples the transfer rate of a
+// proxied tunnel is averaged over.
+const trafficSamples = 10
+
+// traffic counts the bytes going through a proxied tunnel.
+type traffic struct {
+	// samples are the total bytes at each of the last seconds, oldest first.
+	samples []int64
+	// in and out are the bytes received from and sent to the remote end, they
+	// are updated atomically.
+	in, out int64
+}
+
+// countingWriter adds the bytes written through it to a counter.
+type countingWriter struct {
+	w     io.Writer
+	count *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddInt64(w.count, int64(n))
+	return n, err
+}
+
+// total returns the bytes transferred in both directions.
+func (t *traffic) total() int64 {
+	return atomic.LoadInt64(&t.in) + atomic.LoadInt64(&t.out)
+}
+
+// sample records the current total. The caller must hold the balancer lock.
+func (t *traffic) sample() {
+	t.samples = append(t.samples, t.total())
+	if len(t.samples) > trafficSamples+1 {
+		t.samples = t.samples[1:]
+	}
+}
+
+// rate returns the average transfer rate over the samples, in bytes per
+// second. The caller must hold the balancer lock.
+func (t *traffic) rate() float64 {
+	if len(t.samples) < 2 {
+		return 0
+	}
+	return float64(t.samples[len(t.samples)-1]-t.samples[0]) / float64(len(t.samples)-1)
+}
+
+// sampleTraffic samples the traffic of the balancer every second until ctx is
+// done.
+func (b *balancer) sampleTraffic(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		b.m.Lock()
+		b.traffic.sample()
+		b.m.Unlock()
+	}
+}
+
+// formatBytes returns a short human readable size such as "1.2MB".
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
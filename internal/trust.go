@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// trustedFile is where the fingerprints of the commands confirmed by the user
+// are kept, relative to the user's home.
+const trustedFile = ".tmancer/trusted.json"
+
+// errNotConfirmed is returned when the user did not confirm the commands of a
+// config.
+var errNotConfirmed = errors.New("commands not confirmed")
+
+// commandLines lists the commands the tunnels of the config run, one per line
+// prefixed by the tunnel and field, sorted.
+func commandLines(config *Config) []string {
+	var lines []string
+	for i := range config.Tunnels {
+		c := &config.Tunnels[i]
+		if c.K8s != nil || c.provider != nil {
+			if args, err := c.getArgs(c.LocalPort); err == nil {
+				lines = append(lines, c.Name+": command: "+strings.Join(args, " "))
+			}
+		}
+		for field, command := range c.commands() {
+			if field == "custom" && c.Shell {
+				command = strings.Join(shell, " ") + " " + command
+			}
+			lines = append(lines, c.Name+": "+field+": "+command)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// configKey identifies the configs a session is started from, whatever the
+// working directory.
+func configKey(paths []string) string {
+	abs := make([]string, len(paths))
+	for i, p := range paths {
+		if a, err := filepath.Abs(p); err == nil {
+			p = a
+		}
+		abs[i] = p
+	}
+	return strings.Join(abs, string(os.PathListSeparator))
+}
+
+func trustedPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "getting home directory")
+	}
+	return filepath.Join(home, trustedFile), nil
+}
+
+// readTrusted returns the fingerprints of the confirmed commands by config
+// key.
+func readTrusted(path string) (map[string][]string, error) {
+	trusted := map[string][]string{}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return trusted, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", path)
+	}
+	if err = json.Unmarshal(b, &trusted); err != nil {
+		return nil, errors.Wrapf(err, "unmarshaling %s", path)
+	}
+	return trusted, nil
+}
+
+// checkAdded refuses the tunnels added to a running session which run
+// commands if the policy asks to confirm them, as there is no terminal to do
+// so.
+func (p *Policy) checkAdded(config *Config) error {
+	if p == nil || !p.ConfirmCommands || len(commandLines(config)) == 0 {
+		return nil
+	}
+	return errors.Wrap(errNotConfirmed, "tunnels running commands must be added to a config file and started from a terminal to be reviewed")
+}
+
+// Confirm makes sure that the user saw and accepted the commands of the
+// config before anything is spawned, if the policy asks for it. The commands
+// are shown the first time the configs are started and again whenever they
+// change; the answer is read from in, which must be a terminal. Confirmed
+// commands are remembered in ~/.tmancer/trusted.json.
+func (p *Policy) Confirm(config *Config, paths []string, in *os.File, out io.Writer) error {
+	if p == nil || !p.ConfirmCommands {
+		return nil
+	}
+	lines := commandLines(config)
+	if len(lines) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	fingerprint := hex.EncodeToString(sum[:])
+	path, err := trustedPath()
+	if err != nil {
+		return err
+	}
+	trusted, err := readTrusted(path)
+	if err != nil {
+		return err
+	}
+	key := configKey(paths)
+	for _, f := range trusted[key] {
+		if f == fingerprint {
+			return nil
+		}
+	}
+	if !isTerminal(in) {
+		return errors.Wrap(errNotConfirmed, "the commands of the config are new or changed, start tmancer from a terminal once to review them")
+	}
+	fmt.Fprintln(out, "The config runs these commands:")
+	for _, line := range lines {
+		fmt.Fprintln(out, "  "+line)
+	}
+	fmt.Fprint(out, "Run them? [y/N] ")
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+		return errNotConfirmed
+	}
+	// A config may be confirmed under several profiles.
+	trusted[key] = append(trusted[key], fingerprint)
+	b, err := json.MarshalIndent(trusted, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshaling trusted commands")
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return errors.Wrap(err, "creating trusted commands directory")
+	}
+	return errors.Wrapf(os.WriteFile(path, b, 0o600), "writing %s", path)
+}
@@ -0,0 +1,595 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// ANSI sequences used by the interactive table.
+const (
+	enterAltScreen = "\x1b[?1049h\x1b[?25l"
+	leaveAltScreen = "\x1b[?25h\x1b[?1049l"
+	cursorHome     = "\x1b[H"
+	clearLine      = "\x1b[K"
+	clearBelow     = "\x1b[J"
+	reverseVideo   = "\x1b[7m"
+	resetVideo     = "\x1b[0m"
+	red            = "\x1b[31m"
+	green          = "\x1b[32m"
+	yellow         = "\x1b[33m"
+	// defaultColour resets the colour only, keeping the selected row in
+	// reverse video.
+	defaultColour = "\x1b[39m"
+	// pushTitle and popTitle save and restore the title of the terminal
+	// window, setTitle sets it.
+	pushTitle = "\x1b[22;0t"
+	popTitle  = "\x1b[23;0t"
+	setTitle  = "\x1b]0;%s\x07"
+)
+
+// flashDuration is how long flash messages stay in the help bar.
+const flashDuration = 3 * time.Second
+
+// Help bars listing the keys of the interactive table and of the output view.
+const (
+	tuiHelp    = "↑/k ↓/j select  g/G top/bottom  enter output  E errors  s sort  f problems only  R restart  p pause/resume  r restart drifted  y copy  o open url  e events  a add  x export  q quit"
+	outputHelp = "↑/k ↓/j scroll  g/G top/bottom  enter/q back"
+)
+
+// KeyHandler is implemented by the renderers reacting to key presses.
+type KeyHandler interface {
+	// HandleKey handles a key press and tells whether it used it, in which
+	// case the session must be rendered again.
+	HandleKey(key byte) bool
+	// Selected returns the name of the selected tunnel, empty if none.
+	Selected() string
+	// Flash briefly shows the outcome of an action handled elsewhere.
+	Flash(message string)
+	// TakeTunnel returns the tunnel submitted with the new tunnel form, once,
+	// and whether to save it to the config file. It returns false if there
+	// is none.
+	TakeTunnel() (c TunnelConfig, persist, ok bool)
+}
+
+// tuiRenderer draws the table full screen, redrawing whole frames clipped to
+// the terminal size so that long errors and resizes cannot garble it. A row
+// can be selected, scrolling through the rows which do not fit, and its
+// recent output viewed.
+type tuiRenderer struct {
+	// startedAt is when the session started, for its uptime.
+	startedAt time.Time
+	// flashUntil is when the flash message stops being displayed.
+	flashUntil time.Time
+	f          *os.File
+	// full is the latest snapshot, printed again once the session is over.
+	full *Snapshot
+	// last is the latest snapshot as displayed, sorted and filtered.
+	last *Snapshot
+	// flash is a message displayed in the help bar for a while, e.g. to
+	// confirm a copy.
+	flash string
+	// form is the new tunnel form, displayed instead of the table, nil if
+	// none.
+	form *tunnelForm
+	// submitted is the tunnel of the latest form submitted, until taken.
+	submitted *tunnelForm
+	// viewing is the name of the tunnel whose output is displayed instead of
+	// the table, empty if none.
+	viewing string
+	// order is the order of the rows, see the Sort constants.
+	order string
+	// table formats the rows.
+	table tableRenderer
+	// offset is the index of the first row displayed.
+	offset int
+	// selected is the index of the selected row.
+	selected int
+	// scrollBack is the number of output lines hidden below the view, 0
+	// following the output as it comes.
+	scrollBack int
+	// rows is the number of rows of the latest snapshot.
+	rows int
+	// height is the number of rows fitting in the terminal.
+	height int
+	// escape is the progress through an arrow key escape sequence.
+	escape  int
+	m       sync.Mutex
+	started bool
+	// colour tells whether statuses are coloured, see https://no-color.org.
+	colour bool
+	// problemsOnly hides the tunnels which do not need attention.
+	problemsOnly bool
+	// viewingEvents tells whether the status changes of the session are
+	// displayed instead of the table.
+	viewingEvents bool
+	// viewingErrors tells whether the errors of the tunnel being viewed are
+	// displayed rather than its output.
+	viewingErrors bool
+	// title tells whether the title of the terminal window summarises the
+	// session.
+	title bool
+}
+
+func newTUIRenderer(f *os.File, formats Formats, columns []column, order string, problemsOnly, title bool) *tuiRenderer {
+	return &tuiRenderer{
+		f:            f,
+		table:        tableRenderer{formats: formats, columns: columns},
+		colour:       os.Getenv("NO_COLOR") == "",
+		order:        order,
+		problemsOnly: problemsOnly,
+		title:        title,
+	}
+}
+
+// statusColour returns the colour of the given status, so that broken tunnels
+// stand out. Empty for the statuses which are neither good nor bad.
+func statusColour(s Status) string {
+	switch s {
+	case Open:
+		return green
+	case Error, PortBusy, Signal, Failed, Crashed, PreflightFailed:
+		return red
+	case Opening, Reopening, Degraded, Flapping, Throttled, Refreshing, WaitingForTarget, Waiting, Cooper:
+		return yellow
+	}
+	return ""
+}
+
+// colourStatus colours the status, starting at the given rune, of an already
+// clipped row.
+func colourStatus(row string, status Status, start int) string {
+	colour := statusColour(status)
+	runes := []rune(row)
+	if colour == "" || start < 0 || len(runes) <= start {
+		return row
+	}
+	end := start + len(status.String())
+	if end > len(runes) {
+		end = len(runes)
+	}
+	return string(runes[:start]) + colour + string(runes[start:end]) + defaultColour + string(runes[end:])
+}
+
+// clip fits line in width columns, on a single line.
+func clip(line string, width int) string {
+	line = strings.ReplaceAll(line, "\n", " | ")
+	runes := []rune(line)
+	if width > 0 && len(runes) > width {
+		if width == 1 {
+			return "…"
+		}
+		return string(runes[:width-1]) + "…"
+	}
+	return line
+}
+
+func (r *tuiRenderer) Render(s *Snapshot) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	// Keep the selection on the same tunnel when the rows move around.
+	var selectedName string
+	if r.last != nil && r.selected < len(r.last.Tunnels) {
+		selectedName = r.last.Tunnels[r.selected].Name
+	}
+	r.full = s
+	arranged := *s
+	arranged.Tunnels = arrange(s.Tunnels, r.order, r.problemsOnly)
+	s = &arranged
+	r.last = s
+	for i := range s.Tunnels {
+		if s.Tunnels[i].Name == selectedName {
+			r.selected = i
+			break
+		}
+	}
+	rows, cols, err := terminalSize(r.f)
+	if err != nil || rows < 5 {
+		rows, cols = 24, 80
+	}
+	frame := &bytes.Buffer{}
+	if !r.started {
+		r.started = true
+		r.startedAt = s.Time
+		if !s.Started.IsZero() {
+			r.startedAt = s.Started
+		}
+		frame.WriteString(enterAltScreen)
+		if r.title {
+			frame.WriteString(pushTitle)
+		}
+	}
+	if r.title {
+		fmt.Fprintf(frame, setTitle, windowTitle(s))
+	}
+	frame.WriteString(cursorHome)
+	if r.form != nil {
+		frame.WriteString(reverseVideo + clip("New tunnel", cols) + clearLine + resetVideo + "\n")
+		r.form.render(frame, cols)
+		writeHelp(frame, formHelp, rows, cols)
+		r.f.Write(frame.Bytes()) //nolint:errcheck // Nothing to do about stdout going away.
+		return
+	}
+	if r.viewing != "" || r.viewingEvents {
+		switch {
+		case r.viewingEvents:
+			r.renderEvents(frame, rows, cols)
+		case r.viewingErrors:
+			r.renderErrors(frame, rows, cols)
+		default:
+			r.renderOutput(frame, rows, cols)
+		}
+		r.f.Write(frame.Bytes()) //nolint:errcheck // Nothing to do about stdout going away.
+		return
+	}
+	// The health, header, summary and help lines are always displayed.
+	r.height = rows - 4
+	r.rows = len(r.last.Tunnels)
+	r.clampSelection()
+	lines := r.table.format(s)
+	// Keep the health and header lines above the scrolled rows.
+	shown := make([]string, 0, 2+r.visible())
+	shown = append(shown, lines[:2]...)
+	shown = append(shown, lines[2+r.offset:2+r.offset+r.visible()]...)
+	for i, line := range shown {
+		line = clip(line, cols)
+		if i >= 2 && r.colour {
+			t := &s.Tunnels[i-2+r.offset]
+			_, start := r.table.row(t)
+			line = colourStatus(line, t.Status, start)
+		}
+		if i-2 == r.selected-r.offset {
+			line = reverseVideo + line + resetVideo
+		}
+		frame.WriteString(line + clearLine + "\n")
+	}
+	if r.rows == 0 && r.problemsOnly {
+		frame.WriteString("No tunnel needs attention." + clearLine + "\n")
+	}
+	// The summary stays right above the help bar, whatever the number of rows.
+	frame.WriteString(clearBelow + fmt.Sprintf("\x1b[%d;1H", rows-1) + clip(r.summary(), cols) + clearLine)
+	help := tuiHelp
+	if r.problemsOnly {
+		help = "problems only  " + help
+	}
+	if r.order != "" && r.order != SortConfig {
+		help = fmt.Sprintf("by %s  %s", r.order, help)
+	}
+	if r.rows > r.height {
+		help = fmt.Sprintf("%d-%d/%d  %s", r.offset+1, r.offset+r.visible(), r.rows, help)
+	}
+	if time.Now().Before(r.flashUntil) {
+		help = r.flash + "  " + help
+	}
+	writeHelp(frame, help, rows, cols)
+	r.f.Write(frame.Bytes()) //nolint:errcheck // Nothing to do about stdout going away.
+}
+
+// summary returns a line counting the tunnels by status, with the uptime of
+// the session, e.g. "12 open · 1 reopening · uptime 3h12m".
+func (r *tuiRenderer) summary() string {
+	counts := map[Status]int{}
+	for i := range r.full.Tunnels {
+		counts[r.full.Tunnels[i].Status]++
+	}
+	parts := make([]string, 0, len(counts)+1)
+	for status := Undefined; status <= Scheduled; status++ {
+		if counts[status] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[status], statusWords(status)))
+		}
+	}
+	parts = append(parts, "uptime "+r.table.formats.FormatDuration(r.full.Time.Sub(r.startedAt).Round(time.Second)))
+	return strings.Join(parts, " · ")
+}
+
+// windowTitle returns the title of the terminal window summarising the
+// session, e.g. "tmancer: 11/12 open".
+func windowTitle(s *Snapshot) string {
+	open := 0
+	for i := range s.Tunnels {
+		if s.Tunnels[i].Status == Open || s.Tunnels[i].Status == Degraded {
+			open++
+		}
+	}
+	return fmt.Sprintf("tmancer: %d/%d open", open, len(s.Tunnels))
+}
+
+// statusWords returns the status in lower case words, e.g. "port busy".
+func statusWords(s Status) string {
+	words := &strings.Builder{}
+	for i, c := range s.String() {
+		if i > 0 && unicode.IsUpper(c) {
+			words.WriteByte(' ')
+		}
+		words.WriteRune(unicode.ToLower(c))
+	}
+	return words.String()
+}
+
+// writeHelp clears the rest of the screen and writes the help bar on its
+// last line.
+func writeHelp(frame *bytes.Buffer, help string, rows, cols int) {
+	frame.WriteString(clearBelow + fmt.Sprintf("\x1b[%d;1H", rows) + reverseVideo + clip(help, cols) + clearLine + resetVideo)
+}
+
+// renderOutput writes the output view of the tunnel being viewed.
+func (r *tuiRenderer) renderOutput(frame *bytes.Buffer, rows, cols int) {
+	title := fmt.Sprintf("Output of %s", r.viewing)
+	var output []string
+	for i := range r.last.Tunnels {
+		if t := &r.last.Tunnels[i]; t.Name == r.viewing {
+			title += fmt.Sprintf(" (%s)", t.Status)
+			output = t.Output
+			break
+		}
+	}
+	if len(output) == 0 {
+		output = []string{"No output yet."}
+	}
+	r.renderLines(frame, title, output, rows, cols)
+}
+
+// renderErrors writes the latest errors of the tunnel being viewed, wrapped
+// rather than clipped so that long errors can be read in full.
+func (r *tuiRenderer) renderErrors(frame *bytes.Buffer, rows, cols int) {
+	title := fmt.Sprintf("Errors of %s", r.viewing)
+	var errs []TunnelError
+	for i := range r.last.Tunnels {
+		if t := &r.last.Tunnels[i]; t.Name == r.viewing {
+			title += fmt.Sprintf(" (%s)", t.Status)
+			errs = t.Errors
+			break
+		}
+	}
+	lines := errorLines(errs, r.table.formats, cols)
+	if len(lines) == 0 {
+		lines = []string{"No error yet."}
+	}
+	r.renderLines(frame, title, lines, rows, cols)
+}
+
+// renderEvents writes the latest status changes of the session.
+func (r *tuiRenderer) renderEvents(frame *bytes.Buffer, rows, cols int) {
+	lines := make([]string, 0, len(r.full.Events))
+	for i := range r.full.Events {
+		lines = append(lines, eventLine(&r.full.Events[i], r.table.formats))
+	}
+	if len(lines) == 0 {
+		lines = []string{"No status change yet."}
+	}
+	r.renderLines(frame, "Events", lines, rows, cols)
+}
+
+// renderLines writes a scrollable view of the lines, following the last ones
+// unless scrolled back.
+func (r *tuiRenderer) renderLines(frame *bytes.Buffer, title string, output []string, rows, cols int) {
+	// The title and help lines are always displayed.
+	height := rows - 2
+	if max := len(output) - height; r.scrollBack > max {
+		r.scrollBack = max
+	}
+	if r.scrollBack < 0 {
+		r.scrollBack = 0
+	}
+	end := len(output) - r.scrollBack
+	start := end - height
+	if start < 0 {
+		start = 0
+	}
+	frame.WriteString(reverseVideo + clip(title, cols) + clearLine + resetVideo + "\n")
+	for _, line := range output[start:end] {
+		frame.WriteString(clip(line, cols) + clearLine + "\n")
+	}
+	help := outputHelp
+	if len(output) > height {
+		help = fmt.Sprintf("%d-%d/%d  %s", start+1, end, len(output), help)
+	}
+	writeHelp(frame, help, rows, cols)
+}
+
+// visible returns the number of rows displayed.
+func (r *tuiRenderer) visible() int {
+	if r.rows < r.height {
+		return r.rows
+	}
+	return r.height
+}
+
+// clampSelection keeps the selected row within the rows available, and the
+// rows displayed around it.
+func (r *tuiRenderer) clampSelection() {
+	if r.selected >= r.rows {
+		r.selected = r.rows - 1
+	}
+	if r.selected < 0 {
+		r.selected = 0
+	}
+	if r.selected < r.offset {
+		r.offset = r.selected
+	}
+	if r.selected >= r.offset+r.height {
+		r.offset = r.selected - r.height + 1
+	}
+	if max := r.rows - r.height; r.offset > max {
+		r.offset = max
+	}
+	if r.offset < 0 {
+		r.offset = 0
+	}
+}
+
+func (r *tuiRenderer) HandleKey(key byte) bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	// Arrow keys are sent as ESC [ A and ESC [ B.
+	sequence, arrow := r.escape == 2, false
+	switch {
+	case key == '\x1b':
+		r.escape = 1
+		return false
+	case r.escape == 1 && key == 0:
+		key = keyEscape
+	case r.escape == 1 && key == '[':
+		r.escape = 2
+		return false
+	case sequence && key == 'A':
+		key, arrow = 'k', true
+	case sequence && key == 'B':
+		key, arrow = 'j', true
+	}
+	r.escape = 0
+	if r.form != nil {
+		switch {
+		case key == keyEscape:
+			r.form = nil
+		case sequence && !arrow:
+			// Other keys, such as left and right, are not used.
+		case r.form.handleKey(key, arrow):
+			r.submitted, r.form = r.form, nil
+		}
+		// Leave nothing to the table while the form is open.
+		return true
+	}
+	if r.viewing != "" || r.viewingEvents {
+		r.handleOutputKey(key)
+		// Leave nothing to the table while viewing the output.
+		return true
+	}
+	switch key {
+	case '\n', '\r':
+		if r.last != nil && r.selected < len(r.last.Tunnels) {
+			r.viewing = r.last.Tunnels[r.selected].Name
+			r.scrollBack = 0
+		}
+	case 'E':
+		if r.last != nil && r.selected < len(r.last.Tunnels) {
+			r.viewing = r.last.Tunnels[r.selected].Name
+			r.viewingErrors = true
+			r.scrollBack = 0
+		}
+	case 'k':
+		r.selected--
+	case 'j':
+		r.selected++
+	case 'g':
+		r.selected = 0
+	case 'G':
+		r.selected = r.rows - 1
+	case 's':
+		r.order = nextSort(r.order)
+	case 'f':
+		r.problemsOnly = !r.problemsOnly
+	case 'y':
+		if r.last != nil && r.selected < len(r.last.Tunnels) {
+			r.copyConnection(&r.last.Tunnels[r.selected])
+		}
+	case 'o':
+		if r.last != nil && r.selected < len(r.last.Tunnels) {
+			r.openURL(&r.last.Tunnels[r.selected])
+		}
+	case 'e':
+		r.viewingEvents = true
+		r.scrollBack = 0
+	case 'a':
+		r.form = newTunnelForm()
+	default:
+		return false
+	}
+	r.clampSelection()
+	return true
+}
+
+// Flash implements KeyHandler.
+func (r *tuiRenderer) Flash(message string) {
+	r.flash = message
+	r.flashUntil = time.Now().Add(flashDuration)
+}
+
+// TakeTunnel implements KeyHandler.
+func (r *tuiRenderer) TakeTunnel() (TunnelConfig, bool, bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.submitted == nil {
+		return TunnelConfig{}, false, false
+	}
+	f := r.submitted
+	r.submitted = nil
+	c, err := f.config()
+	return c, f.persist(), err == nil
+}
+
+// copyConnection copies the connection string of the tunnel to the clipboard
+// and reports how it went in the help bar.
+func (r *tuiRenderer) copyConnection(t *TunnelSnapshot) {
+	r.flash = "copied " + t.Connection
+	if err := copyToClipboard(t.Connection, r.f); err != nil {
+		r.flash = "copy failed: " + err.Error()
+	}
+	r.flashUntil = time.Now().Add(flashDuration)
+}
+
+// openURL opens the URL of the tunnel in the browser and reports how it went
+// in the help bar.
+func (r *tuiRenderer) openURL(t *TunnelSnapshot) {
+	r.flashUntil = time.Now().Add(flashDuration)
+	if t.URL == "" {
+		r.flash = t.Name + " has no url"
+		return
+	}
+	r.flash = "opening " + t.URL
+	if err := openBrowser(t.URL); err != nil {
+		r.flash = "open failed: " + err.Error()
+	}
+}
+
+// handleOutputKey handles a key press in the output, errors and events
+// views.
+func (r *tuiRenderer) handleOutputKey(key byte) {
+	switch key {
+	case '\n', '\r', 'q', 'e', 'E':
+		r.viewing = ""
+		r.viewingEvents = false
+		r.viewingErrors = false
+	case 'k':
+		r.scrollBack++
+	case 'j':
+		r.scrollBack--
+	case 'g':
+		// Clamped when rendering.
+		r.scrollBack = outputHistoryLines
+	case 'G':
+		r.scrollBack = 0
+	}
+}
+
+func (r *tuiRenderer) Selected() string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.last == nil || r.selected >= len(r.last.Tunnels) {
+		return ""
+	}
+	return r.last.Tunnels[r.selected].Name
+}
+
+// Close leaves the full screen table and prints the latest snapshot, so that
+// it stays in the terminal history.
+func (r *tuiRenderer) Close() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if !r.started {
+		return
+	}
+	io.WriteString(r.f, leaveAltScreen) //nolint:errcheck // Nothing to do about stdout going away.
+	if r.title {
+		io.WriteString(r.f, popTitle) //nolint:errcheck // Likewise.
+	}
+	for _, line := range r.table.format(r.full) {
+		fmt.Fprintln(r.f, line)
+	}
+	fmt.Fprintln(r.f, r.summary())
+}
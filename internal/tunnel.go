@@ -4,10 +4,9 @@ package internal
 import (
 	"context"
 	"fmt"
-	"os"
+	"net"
 	"os/exec"
 	"regexp"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,6 +14,8 @@ import (
 	"github.com/pkg/errors"
 )
 
+const defaultStartupTimeout = 30 * time.Second
+
 var signalRegex = regexp.MustCompile(`signal: ([a-z ]+)$`)
 
 // K8sInfo contains all information required to use a kubectl port forward command.
@@ -26,12 +27,205 @@ type K8sInfo struct {
 }
 
 // TunnelConfig is just what its name suggests. There are two supported configs:
-// "k8s" and "custom".
+// "k8s" and "custom", plus the types added by providers.
 type TunnelConfig struct {
-	Name      string   `json:"name"`
-	K8s       *K8sInfo `json:"k8s"`
-	Custom    string   `json:"custom"`
-	LocalPort int      `json:"local_port"`
+	K8s *K8sInfo `json:"k8s"`
+	// K8sNamespace forwards every service of a namespace, see K8sNamespace.
+	K8sNamespace *K8sNamespace  `json:"k8s_namespace"`
+	HealthCheck  *HealthCheck   `json:"health_check"`
+	Sandbox      *Sandbox       `json:"sandbox"`
+	Restart      *RestartPolicy `json:"restart"`
+	Flapping     *FlapDetection `json:"flapping"`
+	Scale        *Scale         `json:"scale"`
+	Hooks        *Hooks         `json:"hooks"`
+	VPN          *VPN           `json:"vpn"`
+	TLS          *TLS           `json:"tls"`
+	// HTTPProxy makes the tunnel a local HTTP proxy rather than a port
+	// forward, see HTTPProxy.
+	HTTPProxy *HTTPProxy `json:"http_proxy"`
+	// Weight of the tunnel in the session health score, defaults to 1. Use 0
+	// for tunnels which do not matter.
+	Weight *float64 `json:"weight"`
+	Name   string   `json:"name"`
+	Custom string   `json:"custom"`
+	// LocalPorts is a port range such as "9000-9009", used instead of
+	// LocalPort to forward many ports at once. The tunnel is expanded into one
+	// sub-forward per port, custom commands must use the {{local_port}} and
+	// {{remote_port}} placeholders.
+	LocalPorts string `json:"local_ports"`
+	// RemotePorts is the port range matching LocalPorts, defaults to the same
+	// ports. It replaces k8s.port.
+	RemotePorts string `json:"remote_ports"`
+	// PortConflict set to "rebind" moves the tunnel to the next free port
+	// when LocalPort is taken, instead of staying PortBusy.
+	PortConflict string `json:"port_conflict"`
+	// RebindRange restricts the ports picked on conflict, e.g. "5433-5439".
+	RebindRange string `json:"rebind_range"`
+	// Group is the name of the original tunnel a port range sub-forward comes
+	// from.
+	Group string `json:"-"`
+	// namespace is the name of the k8s_namespace entry the tunnel was
+	// generated from, if any.
+	namespace string
+	// Provider is the name of the provider building the tunnel command from
+	// Params, instead of k8s or custom.
+	Provider string            `json:"provider"`
+	Params   map[string]string `json:"params"`
+	// provider is the resolved Provider, nil if unset.
+	provider TunnelProvider
+	// Dynamic, if set, is run before every start of the tunnel and must print
+	// the command to run, for targets only known at runtime.
+	Dynamic string `json:"dynamic"`
+	// dynamicCommand is the latest command printed by Dynamic.
+	dynamicCommand string
+	// SecretCmd, if set, is run before every start of the tunnel, its output
+	// replacing {{secret}} in the command and set as TMANCER_SECRET in its
+	// environment.
+	SecretCmd string `json:"secret_cmd"`
+	// secrets are the secrets read before the latest start, by placeholder.
+	secrets map[string]string
+	// secretReader is the session secret reader.
+	secretReader string
+	// audit is where the spawned commands are recorded, nil if nowhere.
+	audit *AuditLog
+	// formats are the session formats, used in error messages.
+	formats Formats
+	// logSettings are the session log settings, nil if logs are disabled.
+	logSettings *LogSettings
+	// schedule is the session schedule, nil if unset.
+	schedule *Schedule
+	// notifications are the session notifications, nil if unset.
+	notifications *Notifications
+	// TargetHost is the host custom tunnels wait to resolve when
+	// WaitForTarget is set.
+	TargetHost string `json:"target_host"`
+	// AuthRefresh is run before reopening a tunnel which failed because of
+	// expired credentials, e.g. "aws sso login --profile staging".
+	AuthRefresh string `json:"auth_refresh"`
+	// Preflight is run before the first open attempt, e.g. "kubectl auth
+	// can-i get pods", the tunnel being PreflightFailed if it fails.
+	Preflight string `json:"preflight"`
+	// ReadyRegex is matched against each line the tunnel process outputs, the
+	// tunnel is only considered open once a line matches. k8s tunnels default
+	// to kubectl's "Forwarding from" line.
+	ReadyRegex string `json:"ready_regex"`
+	// StopSignal is sent to ask the tunnel process to terminate, either "TERM"
+	// (default) or "INT".
+	StopSignal string      `json:"stop_signal"`
+	Dependents []Dependent `json:"dependents"`
+	// DependsOn lists the names of the tunnels which must be open before this
+	// one is started. The tunnel is restarted when any of them reopens.
+	DependsOn []string `json:"depends_on"`
+	// Upstream is the tunnel this one goes through, e.g. a forward to a
+	// bastion. The tunnel depends on it and the {{upstream_port}} and
+	// {{upstream_host}} placeholders of its command are replaced with the
+	// local end of the upstream, as are the addresses the upstream forwards
+	// to, e.g. "bastion.internal:22" for an upstream with that TargetHost and
+	// TargetPort.
+	Upstream string `json:"upstream"`
+	// upstreamHost is the address the upstream tunnel listens on, if any.
+	upstreamHost string
+	// upstreamAddresses are the remote addresses of the upstream tunnel,
+	// rewritten to its local end in the command.
+	upstreamAddresses []string
+	// Failover lists endpoints to switch to when this one keeps failing.
+	Failover *Failover `json:"failover"`
+	// Profiles restricts the tunnel to the given profiles, see
+	// Config.Profiles.
+	Profiles []string `json:"profiles"`
+	// Bind is the address the local port listens on, e.g. 127.0.0.5 to use
+	// a loopback alias or 0.0.0.0 to share the tunnel on the network.
+	// Defaults to 127.0.0.1. Custom commands can refer to it as {{bind}}.
+	Bind string `json:"bind"`
+	// IPFamily is the IP family of the local port: "ipv4", "ipv6" or "dual"
+	// for both loopbacks. Defaults to the family of the bind address, ipv4
+	// when unset.
+	IPFamily string `json:"ip_family"`
+	// ConnectionString is what the y key of the interactive table copies to
+	// the clipboard, e.g. "postgres://app@{{host}}:{{port}}/payments".
+	// Defaults to "{{host}}:{{port}}", {{name}} is also available.
+	ConnectionString string `json:"connection_string"`
+	// URL is the web UI the tunnel fronts, e.g. Grafana, opened in the browser
+	// with the o key of the interactive table or tmancer open. It takes the
+	// same placeholders as ConnectionString, e.g.
+	// "http://{{host}}:{{port}}/admin".
+	URL string `json:"url"`
+	// Alias is a host name pointing to the address the tunnel listens on
+	// while the session runs, e.g. "payments-db.local", for the client tools
+	// which want host names rather than ports. It is added to the hosts file
+	// and answered by the DNS stub.
+	Alias string `json:"alias"`
+	// Hints overrides the suggested commands shown when the tunnel fails for
+	// a known reason, by failure kind, see the Failure constants.
+	Hints map[string]string `json:"hints"`
+	// Logs overrides the log retention settings for this tunnel.
+	Logs *LogLimits `json:"logs"`
+	// Dir, if set, is the working directory of the tunnel commands (custom,
+	// hooks, health check and auth refresh), relative to the config file.
+	// They run in the working directory of tmancer otherwise.
+	Dir string `json:"dir"`
+	// Tags let a subset of the tunnels be started with --tags.
+	Tags []string `json:"tags"`
+	// Preconditions must all hold for the tunnel to be opened, e.g. the VPN
+	// being connected. Until then the tunnel is Waiting.
+	Preconditions []Precondition `json:"preconditions"`
+	// ActiveHours, if set, are the only times the tunnel is open, e.g. on
+	// weekdays from 09:00 to 19:00. It is Scheduled the rest of the time.
+	ActiveHours []Window `json:"active_hours"`
+	// StartupTimeout is how long a tunnel can take to report that it is
+	// ready before being considered failed, defaults to 30s. Only tunnels
+	// with a ready regex report readiness.
+	StartupTimeout Duration `json:"startup_timeout"`
+	// RetryInterval overrides the retry_interval setting for this tunnel.
+	RetryInterval Duration `json:"retry_interval"`
+	// KillGrace overrides the kill_grace setting for this tunnel.
+	KillGrace Duration `json:"kill_grace"`
+	// IdleTimeout stops the tunnel once no connection went through it for
+	// that long, it is then Idle until resumed. Like Scale, it makes tmancer
+	// proxy the connections.
+	IdleTimeout Duration `json:"idle_timeout"`
+	// MaxRate caps the transfer rate of the tunnel in each direction, all
+	// its connections together, e.g. "2MBps". Like Scale, it makes tmancer
+	// proxy the connections.
+	MaxRate Rate `json:"max_rate"`
+	// LocalPort is the port the tunnel listens on. If not set, a free
+	// ephemeral port is picked at start.
+	LocalPort int `json:"local_port"`
+	// upstreamPort is the local port of the upstream tunnel, if any.
+	upstreamPort int
+	// TargetPort is the port of TargetHost the tunnel forwards to, so that
+	// the tunnels going through it can refer to TargetHost:TargetPort.
+	TargetPort int `json:"target_port"`
+	// MaxConnections limits the number of concurrent connections going
+	// through the tunnel, extra ones are queued for up to QueueTimeout and
+	// then rejected. Like Scale, it makes tmancer proxy the connections.
+	MaxConnections int `json:"max_connections"`
+	// QueueTimeout is how long connections wait for a slot when
+	// MaxConnections is reached, they are rejected right away by default.
+	QueueTimeout Duration `json:"queue_timeout"`
+	// Infra marks tunnels other tunnels rely on, such as bastions. They are
+	// reopened first after a global outage.
+	Infra bool `json:"infra"`
+	// Critical marks tunnels without which the session is not usable.
+	Critical bool `json:"critical"`
+	// WaitForTarget makes the tunnel wait for its target to exist before
+	// being started, instead of failing over and over. It applies to k8s
+	// tunnels and to custom tunnels setting TargetHost.
+	WaitForTarget bool `json:"wait_for_target"`
+	// Shell runs the custom command through "sh -c", allowing pipes, "&&"
+	// and variables.
+	Shell bool `json:"shell"`
+	// Required tunnels must open within their startup timeout, otherwise the
+	// whole session is torn down.
+	Required bool `json:"required"`
+	// CountConnections makes tmancer proxy the connections of the tunnel,
+	// like Scale, to count the active and total ones.
+	CountConnections bool `json:"count_connections"`
+	// OnDemand makes tmancer listen on the local port and only start the
+	// tunnel process once the first connection comes in, which waits for
+	// it. Combined with IdleTimeout, the tunnel goes back to waiting once
+	// unused.
+	OnDemand bool `json:"on_demand"`
 }
 
 // GetType returns the config type being used. See the description of
@@ -40,129 +234,445 @@ func (c *TunnelConfig) GetType() string {
 	if c.K8s != nil {
 		return "k8s"
 	}
+	if c.K8sNamespace != nil {
+		return "k8s_namespace"
+	}
 	if c.Custom != "" {
 		return "custom"
 	}
+	if c.Provider != "" {
+		return c.Provider
+	}
+	if c.Dynamic != "" {
+		return "dynamic"
+	}
+	if c.HTTPProxy != nil {
+		return "http_proxy"
+	}
 	return "N/A"
 }
 
+// getCommand returns the command to run for the tunnel, forwarding the given
+// local port. It is not bound to a context since the tunnel takes care of
+// terminating it gracefully.
+//
 //nolint:gosec // I'm happy for now.
-func (c *TunnelConfig) getCommand(ctx context.Context) (*exec.Cmd, error) {
+func (c *TunnelConfig) getCommand(port int) (*exec.Cmd, error) {
+	args, err := c.getArgs(port)
+	if err != nil {
+		return nil, err
+	}
+	if c.Sandbox != nil {
+		if args, err = c.Sandbox.wrap(args); err != nil {
+			return nil, err
+		}
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = c.Dir
+	// Run in a dedicated process group, so that the whole group can be
+	// terminated and terminal signals are not forwarded to it.
+	setProcessGroup(cmd)
+	if c.Sandbox != nil {
+		cmd.Env = c.Sandbox.environ()
+	}
+	c.addSecretEnv(cmd)
+	return cmd, nil
+}
+
+// getArgs returns the arguments of the command to run, including the
+// executable.
+func (c *TunnelConfig) getArgs(port int) ([]string, error) {
 	if c.K8s != nil {
-		args := []string{"port-forward", "-n", c.K8s.Namespace}
+		args := []string{"kubectl", "port-forward", "-n", c.K8s.Namespace}
 		if c.K8s.Context != "" {
 			args = append(args, "--context", c.K8s.Context)
 		}
-		args = append(args, c.K8s.Service, fmt.Sprintf("%d:%d", c.LocalPort, c.K8s.Port))
-		return exec.CommandContext(ctx, "kubectl", args...), nil
+		if c.Bind != "" || c.IPFamily != "" {
+			args = append(args, "--address", c.processBind())
+		}
+		return append(args, c.K8s.Service, fmt.Sprintf("%d:%d", port, c.K8s.Port)), nil
+	}
+	if c.provider != nil {
+		return c.provider.BuildCommand(c, c.processBind(), port)
+	}
+	if c.HTTPProxy != nil {
+		return c.httpProxyArgs(port)
+	}
+	if c.Dynamic != "" {
+		if c.dynamicCommand == "" {
+			return nil, errors.New("the dynamic command did not run")
+		}
+		return splitCommand(c.withSecrets(c.commandReplacer(port).Replace(c.dynamicCommand)))
 	}
 	if c.Custom != "" {
-		parts := strings.Split(c.Custom, " ")
-		return exec.CommandContext(ctx, parts[0], parts[1:]...), nil
+		custom := c.withSecrets(c.commandReplacer(port).Replace(c.Custom))
+		if c.Shell {
+			return append(shell[:len(shell):len(shell)], custom), nil
+		}
+		return splitCommand(custom)
 	}
 	return nil, errors.New("config is missing command information")
 }
 
+// readyRegex returns the regex matching the output line which tells that the
+// tunnel is ready, nil if the tunnel has no way of telling.
+func (c *TunnelConfig) readyRegex() (*regexp.Regexp, error) {
+	if c.ReadyRegex != "" {
+		r, err := regexp.Compile(c.ReadyRegex)
+		return r, errors.Wrapf(err, "%s: parsing ready_regex", c.Name)
+	}
+	if c.K8s != nil {
+		return forwardingRegex, nil
+	}
+	if c.HTTPProxy != nil {
+		return httpProxyReadyRegex, nil
+	}
+	return nil, nil
+}
+
 // Tunnel is our mighty tunnel structure. Do not initialise this structure
 // directly but use NewTunnel instead.
 type Tunnel struct {
-	cmd         *exec.Cmd
-	err         error
-	startedAt   time.Time
-	config      TunnelConfig
-	status      Status
+	// state is the *tunnelState last published, see GetSnapshot.
+	state     atomic.Value
+	createdAt time.Time
+	startedAt time.Time
+	// statusSince is when the status last changed.
+	statusSince     time.Time
+	openingAt       time.Time
+	retryAt         time.Time
+	flappingUntil   time.Time
+	authRefreshedAt time.Time
+	targetCheckedAt time.Time
+	// preconditionsCheckedAt is when the preconditions were last checked,
+	// unmet being the first one which did not hold, if any.
+	preconditionsCheckedAt time.Time
+	unmet                  *Precondition
+	err                    error
+	// hintErr and hintStatus are the error and status hint was computed for.
+	hintErr error
+	// bindErr is the error setPortBusy was last given.
+	bindErr string
+	// warning is a problem which does not prevent the tunnel from working.
+	warning string
+	// drift is set when a config file the process relies on changed since
+	// it started.
+	drift string
+	// hint is the suggested command to recover from the current failure.
+	hint string
+	// killReason is set when tmancer itself kills the process, so that the
+	// reason is reported instead of the resulting signal.
+	killReason error
+	cmd        *exec.Cmd
+	readyRegex *regexp.Regexp
+	// exited is closed once the current process exited.
+	exited       chan struct{}
+	outage       *OutageDetector
+	retryBudget  *RetryBudget
+	startQueue   *StartQueue
+	dependencies []*Tunnel
+	balancer     *balancer
+	log          *rotatingLog
+	history      *History
+	events       *EventLog
+	// subscribers are called on status changes, see Subscribe.
+	subscribers []*statusSubscriber
+	// output holds the last output lines of the processes of the tunnel.
+	output   *outputTail
+	restarts []time.Time
+	// latencies are the round trips of the latest successful health probes,
+	// oldest first.
+	latencies []time.Duration
+	// errorLog holds the latest errors of the tunnel, oldest first.
+	errorLog []TunnelError
+	// recordedErr is the latest error added to errorLog.
+	recordedErr error
+	// procStats is the latest usage of the tunnel process, see
+	// WatchProcesses.
+	procStats *ProcStats
+	// endpoints are the failover endpoints, endpoint being the current one.
+	endpoints []Endpoint
+	// config only changes as far as the target and local port are
+	// concerned, on failover, on rebind and when resolving dynamic commands
+	// and secrets, under the tunnel lock. Other goroutines read the rest of
+	// it as is.
+	config           TunnelConfig
+	endpoint         int
+	endpointFailures int
+	// preferredPort is the configured local port, before any rebind.
+	preferredPort int
+	status        Status
+	hintStatus    Status
+	// loggedStatus is the latest status written to the log.
+	loggedStatus Status
+	// notifiedStatus is the latest status notifyStatus looked at.
+	notifiedStatus Status
+	// recordedStatus is the latest status recorded to the history.
+	recordedStatus Status
+	healthFailures int
+	// restartsTotal and errorsTotal count the restarts and failures of the
+	// process since the session started, for the metrics.
+	restartsTotal int
+	errorsTotal   int
+	// restartsByReason breaks restartsTotal down by reason, see
+	// countRestart.
+	restartsByReason [restartReasons]int
+	// upTotal and downTotal are the time spent open and failing since the
+	// session started, up to statusSince.
+	upTotal     time.Duration
+	downTotal   time.Duration
+	throttles   int
+	retries     int
 	startedFlag int32
+	// openedOnce tells whether the tunnel has been open at least once, which
+	// is used to detect that it has come back after some downtime.
+	openedOnce bool
+	// ready tells whether the current process reported its readiness.
+	ready bool
+	// targetFound tells whether the target was found since the tunnel last
+	// failed.
+	targetFound    bool
+	checkingTarget bool
+	// checkingPreconditions tells whether the preconditions are being
+	// checked in the background.
+	checkingPreconditions bool
+	// preflighting tells whether the preflight command is running, and
+	// preflightPassed whether it succeeded.
+	preflighting    bool
+	preflightPassed bool
+	// paused tells whether the tunnel was paused on demand.
+	paused bool
+	// woken tells whether an on demand tunnel is being opened, rather than
+	// waiting for connections.
+	woken bool
+	// startSlot tells whether the tunnel holds a slot of its start queue, and
+	// startQueued whether it waited for one during the current check.
+	startSlot   bool
+	startQueued bool
+	// alerted tells whether a failure was notified, and not the recovery yet.
+	alerted bool
+	// killed tells whether tmancer itself killed the latest process.
+	killed bool
+	// waitingFrom is the status the tunnel was in before waiting for its
+	// target.
+	waitingFrom Status
+	// m is the tunnel lock, see Lock.
+	m sync.Mutex
 }
 
 // NewTunnel instantiates a usable Tunnel object.
 func NewTunnel(config TunnelConfig) *Tunnel {
-	return &Tunnel{
+	// Already checked when loading the config.
+	readyRegex, _ := config.readyRegex()
+	t := &Tunnel{
+		createdAt:   time.Now(),
 		status:      Close,
 		config:      config,
+		endpoints:   config.endpoints(),
+		readyRegex:  readyRegex,
+		output:      &outputTail{size: outputHistoryLines},
 		startedFlag: 0,
 	}
+	t.publish()
+	return t
+}
+
+// SetOutageDetector makes the tunnel report its failures to the given
+// detector, shared by all the tunnels of a session, and honour its holds. Call
+// this before Start.
+func (t *Tunnel) SetOutageDetector(d *OutageDetector) {
+	t.outage = d
+}
+
+// SetRetryBudget makes the tunnel spend from the given budget, shared by all
+// the tunnels of a session, every time it reopens. Call this before Start.
+func (t *Tunnel) SetRetryBudget(b *RetryBudget) {
+	t.retryBudget = b
 }
 
 // GetPid returns the pid of the subprocess used by this tunnel. Returns 0 if
 // the process is not available.
 func (t *Tunnel) GetPid() int {
-	if t.cmd != nil && t.cmd.Process != nil {
-		return t.cmd.Process.Pid
-	}
-	return 0
+	return t.published().pid
+}
+
+// GetLocalPort returns the local port of the tunnel, which it may have been
+// rebound to.
+func (t *Tunnel) GetLocalPort() int {
+	return t.published().config.LocalPort
+}
+
+// GetName returns the name of the tunnel.
+func (t *Tunnel) GetName() string {
+	return t.config.Name
 }
 
 // GetStatus returns the current tunnel status.
 func (t *Tunnel) GetStatus() Status {
-	return t.status
+	return t.published().status
 }
 
 // GetError returns the message of the last occurred error, empty string
 // otherwise.
 func (t *Tunnel) GetError() string {
-	if t.err == nil {
-		return ""
-	}
-	return t.err.Error()
+	return t.published().err
+}
+
+// GetWarning returns the current warning of the tunnel, empty if none.
+func (t *Tunnel) GetWarning() string {
+	return t.published().warning
+}
+
+// GetOutput returns the last output lines of the processes of the tunnel,
+// oldest first.
+func (t *Tunnel) GetOutput() []string {
+	return t.output.get()
+}
+
+// markOutput adds a line about the lifecycle of the process to the output
+// history and to the log.
+func (t *Tunnel) markOutput(event string) {
+	t.output.add(fmt.Sprintf("--- %s %s", t.config.formats.FormatTime(time.Now()), event))
+	// Log lines are timestamped already.
+	t.log.WriteLine("--- " + event)
+}
+
+// HasOpened tells whether the tunnel has been open at least once.
+func (t *Tunnel) HasOpened() bool {
+	return t.published().openedOnce
+}
+
+// MissedStartup tells whether the tunnel is required but did not open within
+// its startup timeout.
+func (t *Tunnel) MissedStartup() bool {
+	s := t.published()
+	return s.config.Required && !s.openedOnce &&
+		time.Since(t.createdAt) > s.config.StartupTimeout.Or(defaultStartupTimeout)
+}
+
+// GetConnStats returns the stats of the connections going through the tunnel.
+// The flag is false if the tunnel is not proxied by tmancer.
+func (t *Tunnel) GetConnStats() (ConnStats, bool) {
+	return t.published().connStats()
 }
 
 // GetAge returns a duration value expressing how long this tunnel has been in
 // the "Open" status. The valid flag tells whether the age is valid or not.
 // It is resets when the tunnel changes status.
 func (t *Tunnel) GetAge() (age time.Duration, valid bool) {
-	if t.status == Open {
-		return time.Since(t.startedAt).Round(time.Second), true
-	}
-	return time.Duration(0), false
+	return t.published().age(time.Now())
 }
 
-func (t *Tunnel) kill() {
-	if t.cmd == nil || t.cmd.Process == nil {
+// wakeDependents notifies the dependents of this tunnel that it is open again.
+// Failures are reported as the tunnel error.
+func (t *Tunnel) wakeDependents(ctx context.Context) {
+	err := notifyDependents(ctx, t.config.Dependents)
+	if err == nil {
 		return
 	}
-	err := t.cmd.Process.Kill()
-	if err != nil && !errors.Is(err, os.ErrProcessDone) {
-		fmt.Printf("Error while killing %s: %v\n", t.config.Name, err)
+	t.Lock()
+	t.err = errors.Wrap(err, "waking dependents")
+	t.Unlock()
+}
+
+// lsofAddress returns the lsof internet address matching the connections of
+// the given network, host and port. Unspecified and named hosts match any
+// address of the network.
+func lsofAddress(network, host string, port int) string {
+	var family string
+	switch network {
+	case "tcp4":
+		family = "4"
+	case "tcp6":
+		family = "6"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil || ip.IsUnspecified():
+		host = ""
+	case ip.To4() == nil:
+		host = "@[" + host + "]"
+	default:
+		host = "@" + host
 	}
+	return fmt.Sprintf("%sTCP%s:%d", family, host, port)
 }
 
-//nolint:gosec // I'm happy for now.
-func isPortBusy(ctx context.Context, port int) bool {
-	// Calling lsof alone is not enough to know if a TCP file means that a
-	// connection is established or not. This is because it returns any state as
-	// long as there is avalid one for the provided port:
-	//   https://en.wikipedia.org/wiki/Transmission_Control_Protocol#Protocol_operation
-	// To do that we must grep the results.
-	cmdStr := fmt.Sprintf(`lsof -n -i :%d | grep "(ESTABLISHED)"`, port)
-	cmd := exec.CommandContext(ctx, "sh", "-c", cmdStr)
-	cmd.Run() // nolint:errcheck // lsof returns error if nothing is found.
-	// If the process state is nil it means that the command could not be
-	// completed.
-	// In this case we simply treat this as busy (for now, not the best).
-	if cmd.ProcessState == nil {
-		return true
-	}
-	return cmd.ProcessState.Success()
-}
-
-// Start the tunnel with a given context, lock and wait group. Better to run
-// this in a separate goroutine.
-func (t *Tunnel) Start(ctx context.Context, m sync.Locker) {
+// Start the tunnel with a given context. Better to run this in a separate
+// goroutine. The state of the tunnel is only changed with the tunnel lock
+// held, see Lock.
+func (t *Tunnel) Start(ctx context.Context) {
 	// Make sure that this hasn't been started twice.
 	if atomic.SwapInt32(&t.startedFlag, 1) != 0 {
 		return
 	}
+	log, err := openLog(&t.config)
+	// This also publishes what was set before Start, e.g. the audit log.
+	t.Lock()
+	t.log = log
+	if err != nil {
+		t.warning = err.Error()
+	}
+	t.Unlock()
+	if t.config.HealthCheck != nil {
+		go t.watchHealth(ctx)
+	}
+	if t.config.VPN != nil {
+		go t.watchMTU(ctx)
+	}
+	lock := &heldLocker{Locker: t}
+	defer func() {
+		if r := recover(); r != nil {
+			t.crash(r, lock)
+		}
+	}()
 	ch := make(chan error)
-	var err error
+	refreshCh := make(chan error, 1)
+	targetCh := make(chan bool, 1)
+	preconditionCh := make(chan *Precondition, 1)
+	preflightCh := make(chan error, 1)
+	var readyCh chan struct{}
 	for {
-		m.Lock()
+		lock.Lock()
 		select {
 		case <-ctx.Done():
-			t.kill()
-			m.Unlock()
+			t.settleStartSlot(true)
+			balancer := t.balancer
+			lock.Unlock()
+			t.shutdown()
+			if balancer != nil {
+				balancer.stop()
+			}
+			t.recordEnd()
+			t.log.Close()
 			return
 		case err = <-ch:
+			if t.balancer != nil {
+				t.balancer.setOpen(false)
+			}
+			switch {
+			case t.killReason != nil:
+				t.markOutput("stopped: " + t.killReason.Error())
+			case err != nil:
+				// The output lines are already in the history.
+				t.markOutput("exited: " + errors.Cause(err).Error())
+			default:
+				t.markOutput("exited")
+			}
+			if t.stoppedOnPurpose() {
+				break
+			}
+			var wasOpenFor time.Duration
+			if t.status == Open || t.status == Degraded {
+				wasOpenFor = time.Since(t.startedAt)
+			}
+			clean := err == nil && t.killReason == nil
+			t.killed = t.killReason != nil
 			switch {
+			case t.killReason != nil:
+				t.status = Error
+				t.err = t.killReason
+				t.killReason = nil
 			case err == nil:
 				// Tunnel closed with no error
 				t.status = Cooper
@@ -173,40 +683,251 @@ func (t *Tunnel) Start(ctx context.Context, m sync.Locker) {
 				t.status = Error
 				t.err = err
 			}
+			// The target may be gone, e.g. a torn down preview environment.
+			t.targetFound = t.targetFound && clean
+			if clean || !t.applyThrottle(err) {
+				t.applyRestartPolicy(clean, wasOpenFor)
+			}
+			if !clean && t.status != Throttled {
+				t.recordEndpointFailure(wasOpenFor)
+			}
+			if !clean && t.outage != nil {
+				t.outage.recordFailure(time.Now())
+			}
+			if !clean {
+				t.errorsTotal++
+			}
+		case <-readyCh:
+			t.ready = true
+		case found := <-targetCh:
+			t.checkingTarget = false
+			if found {
+				t.targetFound = true
+				t.status = t.waitingFrom
+			}
+		case p := <-preconditionCh:
+			t.checkingPreconditions = false
+			t.preconditionsCheckedAt = time.Now()
+			t.unmet = p
+		case err = <-preflightCh:
+			t.preflightDone(err)
+		case err = <-refreshCh:
+			t.status = Reopening
+			if err != nil {
+				t.err = errors.Wrap(err, "refreshing auth")
+			}
 		default:
 		}
+		// Whatever went through a dependency which reopened is likely broken.
+		if (t.status == Opening || t.status == Open || t.status == Degraded) && t.killReason == nil {
+			if d := t.dependencyReopened(); d != nil {
+				t.killFor(errors.Errorf("%s reopened", d.config.Name))
+			}
+		}
+		// Leave broken tunnels waiting, e.g. for the VPN to come back.
+		if (t.status == Opening || t.status == Open || t.status == Degraded) && t.killReason == nil && t.unmet != nil {
+			t.killFor(errPreconditionUnmet)
+		}
+		if !t.status.IsTerminal() && t.status != Paused && t.status != Idle {
+			t.checkPreconditions(ctx, preconditionCh)
+		}
+		t.updateHint(lock)
+		t.logStatus()
+		t.recordStatus()
+		t.notifyStatus()
+		t.applyIdleTimeout(time.Now())
+		if t.applySchedule(time.Now()) {
+			lock.Unlock()
+			// The loop head shuts the tunnel down once ctx is done.
+			select {
+			case <-ctx.Done():
+			case <-time.After(t.config.RetryInterval.Or(defaultRetryInterval)):
+			}
+			continue
+		}
 		switch t.status {
+		case WaitingForTarget:
+			t.checkTarget(ctx, targetCh)
 		// All statuses leading to (re)opening the tunnel.
-		case Close, Reopening, Cooper, PortBusy:
+		case Close, Reopening, Cooper, PortBusy, Throttled, Waiting, PreflightFailed:
+			if t.waitForPreconditions() || t.preflight(ctx, preflightCh) {
+				break
+			}
+			// Wait for the restart policy backoff.
+			if time.Now().Before(t.retryAt) {
+				break
+			}
+			if t.waitForTarget() {
+				t.checkTarget(ctx, targetCh)
+				break
+			}
+			// Dependencies must be open first.
+			if d := t.waitingFor(); d != nil {
+				t.err = errors.Errorf("waiting for %s", d.config.Name)
+				break
+			}
+			// During an outage let infra tunnels come back first.
+			if t.status != Close && !t.config.Infra && t.outage != nil && t.outage.holds(time.Now()) {
+				break
+			}
+			// Spread reopenings rather than hammering the network all at once.
+			if t.status != Close && t.retryBudget != nil && !t.retryBudget.take(time.Now()) {
+				break
+			}
+			// Proxied tunnels forward on a private port behind the balancer.
+			if t.balancer == nil && t.config.isProxied() {
+				if !t.rebind(lock) {
+					t.status = PortBusy
+					break
+				}
+				if t.balancer, err = startBalancer(ctx, t.config); err != nil {
+					t.setPortBusy(lock, err, t.config.network(), t.config.listenBind(), t.config.LocalPort)
+					break
+				}
+			}
+			// On demand tunnels wait for a connection first.
+			if t.status == Close && t.sleepOnDemand() {
+				break
+			}
+			port := t.config.LocalPort
+			if t.balancer != nil {
+				port = t.balancer.port
+			}
+			// A matching process started by hand is as good as a new one.
+			if t.balancer == nil && t.adopt(lock, port, ch) {
+				break
+			}
+			if t.balancer == nil {
+				if !t.rebind(lock) {
+					t.status = PortBusy
+					break
+				}
+				port = t.config.LocalPort
+			}
 			// First check if the port is busy
-			if isPortBusy(ctx, t.config.LocalPort) {
-				t.status = PortBusy
+			if isPortBusy(ctx, t.config.processNetwork(), t.config.processBind(), port) {
+				t.setPortBusy(lock, errors.Errorf("local port %d is busy", port), t.config.processNetwork(), t.config.processBind(), port)
 				break
 			}
+			// Wait for the turn of the tunnel when many are opening.
+			if !t.takeStartSlot() {
+				break
+			}
+			if t.status != Close && t.status != Throttled && t.recordRestart(time.Now()) {
+				break
+			}
+			if t.config.Hooks != nil && t.config.Hooks.PreStart != "" {
+				// Do not block the other tunnels while the hook runs.
+				lock.Unlock()
+				err = t.config.runHook(ctx, "pre_start", t.config.Hooks.PreStart)
+				lock.Lock()
+				if err != nil {
+					t.status = Error
+					t.err = err
+					break
+				}
+			}
+			if t.config.Dynamic != "" {
+				// Do not block the other tunnels while looking the target up.
+				lock.Unlock()
+				command, err := t.config.resolveDynamic(ctx)
+				lock.Lock()
+				if err != nil {
+					t.status = Error
+					t.err = err
+					break
+				}
+				t.config.dynamicCommand = command
+			}
+			if t.config.needsSecrets() {
+				// Password managers may wait for the user to unlock them.
+				lock.Unlock()
+				secrets, err := t.config.readSecrets(ctx)
+				lock.Lock()
+				if err != nil {
+					t.status = Error
+					t.err = err
+					break
+				}
+				t.config.secrets = secrets
+			}
 			// Start the command in a goroutine.
-			t.cmd, err = t.config.getCommand(ctx)
+			t.drift = ""
+			t.cmd, err = t.config.getCommand(port)
 			if err != nil {
-				ch <- err
+				t.status = Error
+				t.err = err
 				break
 			}
-			go func() {
-				b, err := t.cmd.CombinedOutput()
-				ch <- errors.Wrap(err, string(b))
-			}()
-			if t.status != Reopening {
-				t.status = Opening
+			readyCh = make(chan struct{}, 1)
+			t.exited = make(chan struct{})
+			t.markOutput("started")
+			audit := t.config.auditFor("command", t.startTrigger())
+			// The process is started with the tunnel lock held, which guards
+			// cmd.Process.
+			go func(cmd *exec.Cmd, readyRegex *regexp.Regexp, readyCh chan<- struct{}, exited chan<- struct{}) {
+				err := runCommand(cmd, t, readyRegex, readyCh, t.log, t.output, audit)
+				close(exited)
+				ch <- err
+			}(t.cmd, t.readyRegex, readyCh, t.exited)
+			t.ready = false
+			t.openingAt = time.Now()
+			// Connections are waiting for on demand tunnels.
+			reopening := t.status == Reopening || t.woken
+			t.status = Opening
+			if !reopening {
 				break
 			}
 			fallthrough
 		// Transition state for the table rendering
 		case Opening:
+			if t.readyRegex != nil && !t.ready {
+				if timeout := t.config.StartupTimeout.Or(defaultStartupTimeout); time.Since(t.openingAt) > timeout {
+					t.killFor(errors.Errorf("not ready after %s", timeout))
+				}
+				break
+			}
 			t.status = Open
 			t.err = nil
 			t.startedAt = time.Now()
+			t.latencies = nil
+			t.woken = false
+			if t.balancer != nil {
+				t.balancer.setOpen(true)
+				t.balancer.wakeUp()
+			}
+			if t.openedOnce && len(t.config.Dependents) > 0 {
+				go t.wakeDependents(ctx)
+			}
+			t.openedOnce = true
+			if t.config.Hooks != nil && t.config.Hooks.PostStart != "" {
+				go t.runPostStart(ctx, t.config)
+			}
+		case Flapping:
+			if time.Now().After(t.flappingUntil) {
+				t.status = Reopening
+			}
 		case Error, Signal:
+			if t.shouldRefreshAuth() {
+				t.status = Refreshing
+				t.authRefreshedAt = time.Now()
+				go func() {
+					refreshCh <- t.refreshAuth(ctx)
+				}()
+				break
+			}
 			t.status = Reopening
 		}
-		m.Unlock()
-		time.Sleep(2 * time.Second)
+		t.settleStartSlot(false)
+		wake := t.idleWake()
+		lock.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-time.After(jitter(t.config.RetryInterval.Or(defaultRetryInterval))):
+		case <-wake:
+			lock.Lock()
+			t.wakeOnDemand()
+			lock.Unlock()
+		}
 	}
 }
@@ -0,0 +1,283 @@
+package internal
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	releasesURL   = "https://api.github.com/repos/lzambarda/tmancer/releases/latest"
+	checksumsName = "checksums.txt"
+	// signatureName is the minisign signature of the checksums.
+	signatureName = checksumsName + ".minisig"
+	// maxBinarySize protects us from filling the disk with a bogus asset.
+	maxBinarySize = 100 << 20
+)
+
+type release struct {
+	TagName string         `json:"tag_name"`
+	Assets  []releaseAsset `json:"assets"`
+}
+
+type releaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+func (r *release) asset(name string) (releaseAsset, bool) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return releaseAsset{}, false
+}
+
+// SelfUpdate replaces the running binary with the latest release published on
+// GitHub, provided that it is newer than the current version. The downloaded
+// archive is verified against the checksums published with the release, whose
+// signature is verified against ReleasePublicKey first: the checksums alone
+// would not help against a tampered release.
+func SelfUpdate(ctx context.Context) error {
+	if ReleasePublicKey == "" {
+		return errors.New("this build has no release signing key, download the release manually")
+	}
+	r := release{}
+	if err := getJSON(ctx, releasesURL, &r); err != nil {
+		return errors.Wrap(err, "fetching latest release")
+	}
+	if !isNewerVersion(r.TagName, Version) {
+		fmt.Printf("tmancer %s is already the latest version\n", Version)
+		return nil
+	}
+	archiveName := fmt.Sprintf("%s-%s-tmancer.tgz", runtime.GOOS, runtime.GOARCH)
+	archive, ok := r.asset(archiveName)
+	if !ok {
+		return errors.Errorf("release %s has no asset for %s/%s", r.TagName, runtime.GOOS, runtime.GOARCH)
+	}
+	sums, ok := r.asset(checksumsName)
+	if !ok {
+		return errors.Errorf("release %s has no %s, refusing to update", r.TagName, checksumsName)
+	}
+	signature, ok := r.asset(signatureName)
+	if !ok {
+		return errors.Errorf("release %s has no %s, refusing to update", r.TagName, signatureName)
+	}
+	fmt.Printf("Updating tmancer %s -> %s\n", Version, r.TagName)
+	expected, err := fetchChecksum(ctx, sums.URL, signature.URL, archiveName)
+	if err != nil {
+		return err
+	}
+	b, err := download(ctx, archive.URL)
+	if err != nil {
+		return errors.Wrapf(err, "downloading %s", archiveName)
+	}
+	sum := sha256.Sum256(b)
+	if actual := hex.EncodeToString(sum[:]); actual != expected {
+		return errors.Errorf("checksum mismatch for %s: expected %s, got %s", archiveName, expected, actual)
+	}
+	bin, err := extractBinary(b)
+	if err != nil {
+		return errors.Wrapf(err, "extracting %s", archiveName)
+	}
+	if err := replaceExecutable(bin); err != nil {
+		return err
+	}
+	fmt.Printf("Updated to %s\n", r.TagName)
+	return nil
+}
+
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	b, err := download(ctx, url)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(json.Unmarshal(b, v), "unmarshaling response")
+}
+
+func download(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "requesting %s", url)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("requesting %s: unexpected status %d", url, res.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, maxBinarySize))
+	return b, errors.Wrapf(err, "reading %s", url)
+}
+
+// fetchChecksum returns the sha256 of the given file as listed in a
+// "shasum -a 256" formatted file, once its signature is verified.
+func fetchChecksum(ctx context.Context, url, signatureURL, name string) (string, error) {
+	b, err := download(ctx, url)
+	if err != nil {
+		return "", errors.Wrap(err, "downloading checksums")
+	}
+	signature, err := download(ctx, signatureURL)
+	if err != nil {
+		return "", errors.Wrap(err, "downloading checksums signature")
+	}
+	if err = verifySignature(ReleasePublicKey, b, signature); err != nil {
+		return "", errors.Wrap(err, "verifying checksums")
+	}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", errors.Errorf("no checksum found for %s", name)
+}
+
+// verifySignature checks a minisign signature of message against the base64
+// public key, as printed on the last line of minisign.pub. Only the legacy
+// signatures are supported ("minisign -S -l"), the pre-hashed ones needing
+// BLAKE2b. The trusted comment is verified too.
+func verifySignature(publicKey string, message, signature []byte) error {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil || len(key) != 2+8+ed25519.PublicKeySize || string(key[:2]) != "Ed" {
+		return errors.New("invalid release public key")
+	}
+	// untrusted comment, signature, trusted comment, global signature.
+	lines := strings.Split(strings.TrimSpace(string(signature)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return errors.New("malformed signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return errors.New("malformed signature")
+	}
+	if string(sig[:2]) != "Ed" {
+		return errors.Errorf("unsupported signature algorithm %q, sign with minisign -l", sig[:2])
+	}
+	if !bytes.Equal(sig[2:10], key[2:10]) {
+		return errors.New("signed with another key")
+	}
+	pub := ed25519.PublicKey(key[10:])
+	if !ed25519.Verify(pub, message, sig[10:]) {
+		return errors.New("invalid signature")
+	}
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	comment := strings.TrimPrefix(strings.TrimRight(lines[2], "\r"), "trusted comment: ")
+	if err != nil || !ed25519.Verify(pub, append(append([]byte(nil), sig[10:]...), comment...), global) {
+		return errors.New("invalid trusted comment signature")
+	}
+	return nil
+}
+
+// extractBinary returns the content of the tmancer binary contained in the
+// given release archive.
+func extractBinary(archive []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, errors.Wrap(err, "opening gzip")
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("archive does not contain a tmancer binary")
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading tar")
+		}
+		if h.Typeflag == tar.TypeReg && filepath.Base(h.Name) == "tmancer" {
+			b, err := io.ReadAll(io.LimitReader(tr, maxBinarySize))
+			return b, errors.Wrap(err, "reading binary")
+		}
+	}
+}
+
+// replaceExecutable atomically swaps the running executable with bin. The new
+// file is written next to the current one so that the final rename does not
+// cross filesystems.
+func replaceExecutable(bin []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "locating executable")
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return errors.Wrap(err, "resolving executable")
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".tmancer-update-*")
+	if err != nil {
+		return errors.Wrap(err, "creating temporary file")
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // Gone already if renamed.
+	if _, err = tmp.Write(bin); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "writing new binary")
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.Wrap(err, "closing new binary")
+	}
+	if err = os.Chmod(tmp.Name(), 0o755); err != nil { //nolint:gosec // It is an executable.
+		return errors.Wrap(err, "making new binary executable")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), exe), "replacing executable")
+}
+
+// isNewerVersion tells whether the "vX.Y.Z" tag is newer than current.
+// Unparsable current versions (e.g. "n/a" for go install builds) are always
+// considered older.
+func isNewerVersion(tag, current string) bool {
+	t, ok := parseVersion(tag)
+	if !ok {
+		return false
+	}
+	c, ok := parseVersion(current)
+	if !ok {
+		return true
+	}
+	for i := range t {
+		if t[i] != c[i] {
+			return t[i] > c[i]
+		}
+	}
+	return false
+}
+
+func parseVersion(v string) ([3]int, bool) {
+	res := [3]int{}
+	// Drop any pre-release or git describe suffix.
+	v = strings.SplitN(strings.TrimPrefix(v, "v"), "-", 2)[0]
+	parts := strings.Split(v, ".")
+	if len(parts) != len(res) {
+		return res, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return res, false
+		}
+		res[i] = n
+	}
+	return res, true
+}
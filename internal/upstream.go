@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// upstreamPortPlaceholder is replaced with the local port of the upstream
+	// of the tunnel in its command.
+	upstreamPortPlaceholder = "{{upstream_port}}"
+	// upstreamHostPlaceholder is replaced with the address the upstream of
+	// the tunnel listens on in its command.
+	upstreamHostPlaceholder = "{{upstream_host}}"
+)
+
+// linkUpstreams makes the tunnels depend on their upstream, so that they are
+// started once it is open and restarted when it reopens.
+func (c *Config) linkUpstreams() error {
+	names := map[string]*TunnelConfig{}
+	for i := range c.Tunnels {
+		names[c.Tunnels[i].Name] = &c.Tunnels[i]
+	}
+	for i := range c.Tunnels {
+		t := &c.Tunnels[i]
+		if t.Upstream == "" {
+			continue
+		}
+		// Port ranges have several local ports, which one to go through
+		// would be anybody's guess.
+		upstream := names[t.Upstream]
+		if upstream == nil {
+			return errors.Errorf("%s: upstream %s is not a tunnel", t.Name, t.Upstream)
+		}
+		t.upstreamHost = upstream.dialHost()
+		t.upstreamAddresses = upstream.remoteAddresses()
+		if hasString(t.DependsOn, t.Upstream) {
+			continue
+		}
+		t.DependsOn = append(t.DependsOn[:len(t.DependsOn):len(t.DependsOn)], t.Upstream)
+	}
+	return nil
+}
+
+// linkDependencies lets the tunnel know about the tunnels it depends on among
+// all, indexed with dependencyIndex, including the local port of its upstream.
+func (t *Tunnel) linkDependencies(all []*Tunnel, index map[string][]int) {
+	for _, name := range t.config.DependsOn {
+		for _, j := range index[name] {
+			t.dependencies = append(t.dependencies, all[j])
+			if name == t.config.Upstream {
+				t.config.upstreamPort = all[j].published().config.LocalPort
+			}
+		}
+	}
+}
+
+// remoteAddresses returns the addresses the tunnel forwards to, as the tunnels
+// going through it would reach them without it: the names of a k8s service
+// within the cluster, or TargetHost, along with the remote port.
+func (c *TunnelConfig) remoteAddresses() []string {
+	var hosts []string
+	port := 0
+	switch {
+	case c.K8s != nil:
+		kind, name, ok := strings.Cut(c.K8s.Service, "/")
+		if !ok || (kind != "svc" && kind != "service") || c.K8s.Namespace == "" {
+			return nil
+		}
+		prefix := name + "." + c.K8s.Namespace
+		hosts = []string{prefix, prefix + ".svc", prefix + ".svc.cluster.local"}
+		port = c.K8s.Port
+	case c.TargetHost != "" && c.TargetPort > 0:
+		hosts = []string{c.TargetHost}
+		port = c.TargetPort
+	}
+	addresses := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return addresses
+}
+
+// commandReplacer replaces the placeholders of the command of the tunnel
+// listening on port, and rewrites the addresses of its upstream, see
+// remoteAddresses, to the local end of the upstream.
+func (c *TunnelConfig) commandReplacer(port int) *strings.Replacer {
+	upstream := net.JoinHostPort(c.upstreamHost, strconv.Itoa(c.upstreamPort))
+	oldnew := []string{
+		localPortPlaceholder, strconv.Itoa(port),
+		upstreamPortPlaceholder, strconv.Itoa(c.upstreamPort),
+		upstreamHostPlaceholder, c.upstreamHost,
+		bindPlaceholder, c.processBind(),
+	}
+	for _, address := range c.upstreamAddresses {
+		oldnew = append(oldnew, address, upstream)
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+// usesUpstream tells whether the command of the tunnel goes through its
+// upstream, with the placeholders or the addresses of the upstream.
+func (c *TunnelConfig) usesUpstream() bool {
+	for _, command := range []string{c.Custom, c.Dynamic} {
+		if strings.Contains(command, upstreamPortPlaceholder) || strings.Contains(command, upstreamHostPlaceholder) {
+			return true
+		}
+		for _, address := range c.upstreamAddresses {
+			if strings.Contains(command, address) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DescribeChain writes the chain of upstreams the tunnel with the given name
+// goes through to w, with the commands of its hops once the addresses of
+// their upstream are rewritten.
+func DescribeChain(config *Config, name string, w io.Writer) error {
+	names := map[string]*TunnelConfig{}
+	for i := range config.Tunnels {
+		names[config.Tunnels[i].Name] = &config.Tunnels[i]
+		// Port ranges can be referred to by their original name.
+		if group := config.Tunnels[i].Group; group != "" && names[group] == nil {
+			names[group] = &config.Tunnels[i]
+		}
+	}
+	c := names[name]
+	if c == nil {
+		return errors.Errorf("no tunnel named %s", name)
+	}
+	seen := map[string]bool{}
+	for !seen[c.Name] {
+		seen[c.Name] = true
+		listen := "a free port"
+		if c.LocalPort > 0 {
+			listen = net.JoinHostPort(c.dialHost(), strconv.Itoa(c.LocalPort))
+		}
+		fmt.Fprintf(w, "%s listens on %s\n", c.Name, listen)
+		upstream := names[c.Upstream]
+		hop := *c
+		if upstream != nil {
+			// The upstream may rebind at start, the configured port is the
+			// best guess until then.
+			hop.upstreamPort = upstream.LocalPort
+		}
+		if args, err := hop.getArgs(c.LocalPort); err == nil {
+			fmt.Fprintf(w, "  runs %s\n", strings.Join(args, " "))
+		}
+		if upstream == nil {
+			fmt.Fprintf(w, "  reaches %s\n", c.GetTarget())
+			return nil
+		}
+		if upstream.LocalPort == 0 {
+			fmt.Fprintf(w, "  goes through %s, on the port it picks at start\n", upstream.Name)
+		} else {
+			fmt.Fprintf(w, "  goes through %s\n", upstream.Name)
+		}
+		c = upstream
+	}
+	return errors.Errorf("%s: upstream %s loops back", name, c.Name)
+}
+
+// hasString tells whether s is one of values.
+func hasString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+package internal
+
+import "time"
+
+// accountStatus adds the time spent in the previous status to the open or
+// down time of the tunnel, as the status changes. The caller must hold the
+// tunnel lock.
+func (t *Tunnel) accountStatus(previous Status, now time.Time) {
+	if !t.statusSince.IsZero() {
+		switch d := now.Sub(t.statusSince); {
+		case previous == Open || previous == Degraded:
+			t.upTotal += d
+		case previous.IsProblem():
+			t.downTotal += d
+		}
+	}
+	t.statusSince = now
+}
+
+// GetUptime returns how long the tunnel has been open and failing in total
+// since the session started. Unlike the age, they are not reset when the
+// tunnel reopens, which shows the tunnels that keep dropping.
+func (t *Tunnel) GetUptime() (up, down time.Duration) {
+	return t.published().uptime(time.Now())
+}
@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	usageFile         = ".tmancer/usage.json"
+	usagePollInterval = time.Minute
+	usageCheckTimeout = 5 * time.Second
+)
+
+// TunnelUsage records when a tunnel was open and used, across sessions.
+type TunnelUsage struct {
+	// FirstSeen is when tmancer started tracking the tunnel.
+	FirstSeen time.Time `json:"first_seen"`
+	// LastOpen is when the tunnel was last seen open.
+	LastOpen time.Time `json:"last_open"`
+	// LastUsed is when a client other than tmancer itself, e.g. its health
+	// checks, was last seen connected to the tunnel.
+	LastUsed time.Time `json:"last_used"`
+}
+
+// merge returns the usage combining u and o.
+func (u TunnelUsage) merge(o TunnelUsage) TunnelUsage {
+	if u.FirstSeen.IsZero() || (!o.FirstSeen.IsZero() && o.FirstSeen.Before(u.FirstSeen)) {
+		u.FirstSeen = o.FirstSeen
+	}
+	if o.LastOpen.After(u.LastOpen) {
+		u.LastOpen = o.LastOpen
+	}
+	if o.LastUsed.After(u.LastUsed) {
+		u.LastUsed = o.LastUsed
+	}
+	return u
+}
+
+func usagePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Wrap(err, "getting home directory")
+	}
+	return filepath.Join(home, usageFile), nil
+}
+
+// LoadUsage reads the usage recorded by the previous sessions, by tunnel name.
+func LoadUsage() (map[string]TunnelUsage, error) {
+	path, err := usagePath()
+	if err != nil {
+		return nil, err
+	}
+	usage := map[string]TunnelUsage{}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading file %s", path)
+	}
+	if err = json.Unmarshal(b, &usage); err != nil {
+		return nil, errors.Wrapf(err, "unmarshaling usage of %s", path)
+	}
+	return usage, nil
+}
+
+// saveUsage merges the given usage into the recorded one, which other
+// sessions may be updating too. Sessions take turns through a lock file next
+// to it, so that none of them loses the usage recorded by the others.
+func saveUsage(seen map[string]TunnelUsage) error {
+	path, err := usagePath()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return errors.Wrap(err, "creating usage directory")
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDONLY, 0o600) //nolint:gosec // Only ever locked.
+	if err != nil {
+		return errors.Wrapf(err, "opening the lock of %s", path)
+	}
+	defer lock.Close()
+	if err = lockFile(lock); err != nil {
+		return errors.Wrapf(err, "locking %s", path)
+	}
+	usage, err := LoadUsage()
+	if err != nil {
+		return err
+	}
+	for name, u := range seen {
+		usage[name] = usage[name].merge(u)
+	}
+	b, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshaling usage")
+	}
+	// Replace the file at once, so that a crash never leaves it half written.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".usage-*")
+	if err != nil {
+		return errors.Wrap(err, "writing usage")
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name()) //nolint:errcheck // Best effort.
+	}
+	return errors.Wrap(err, "writing usage")
+}
+
+// hasClients tells whether processes other than tmancer and the tunnel
+// process, whose pid is given, are connected to the local port of the tunnel.
+//
+//nolint:gosec // I'm happy for now.
+func (c *TunnelConfig) hasClients(ctx context.Context, pid int) bool {
+	ctx, cancel := context.WithTimeout(ctx, usageCheckTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "lsof", "-n", "-F", "p", "-sTCP:ESTABLISHED",
+		"-i", lsofAddress(c.network(), c.listenBind(), c.LocalPort)).Output()
+	if err != nil {
+		// lsof fails when nothing matches.
+		return false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.HasPrefix(line, "p") {
+			continue
+		}
+		if p, _ := strconv.Atoi(line[1:]); p != os.Getpid() && p != pid {
+			return true
+		}
+	}
+	return false
+}
+
+// TrackUsage periodically records which tunnels are open and used, so that
+// unused ones can be reported across sessions. The first failure to record
+// them is written to w, and the next ones are retried silently. Run this in
+// a separate goroutine.
+func TrackUsage(ctx context.Context, s *Session, w io.Writer) {
+	failed := false
+	ticker := time.NewTicker(usagePollInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		seen := map[string]TunnelUsage{}
+		open := map[*Tunnel]int{}
+		for _, t := range s.Tunnels() {
+			u := TunnelUsage{FirstSeen: now}
+			if st := t.published(); st.status == Open || st.status == Degraded {
+				u.LastOpen = now
+				open[t] = st.pid
+			}
+			seen[t.config.Name] = u
+		}
+		for t, pid := range open {
+			if c := t.published().config; c.hasClients(ctx, pid) {
+				u := seen[t.config.Name]
+				u.LastUsed = now
+				seen[t.config.Name] = u
+			}
+		}
+		if err := saveUsage(seen); err != nil && !failed {
+			failed = true
+			fmt.Fprintf(w, "\nNot recording tunnel usage: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// UnusedTunnel is a tunnel which was not used in a while.
+type UnusedTunnel struct {
+	// LastUsed is zero if the tunnel was never used.
+	LastUsed time.Time
+	// FirstSeen is zero if the tunnel was never run.
+	FirstSeen time.Time
+	Name      string
+}
+
+// FindUnused returns the tunnels of the config which have not been used since
+// the given time, sorted by name. Tunnels tracked for a shorter time are left
+// out, as there is no telling yet.
+func FindUnused(config *Config, usage map[string]TunnelUsage, since time.Time) []UnusedTunnel {
+	var unused []UnusedTunnel
+	for i := range config.Tunnels {
+		name := config.Tunnels[i].Name
+		u, ok := usage[name]
+		switch {
+		case !ok:
+			unused = append(unused, UnusedTunnel{Name: name})
+		case u.LastUsed.IsZero() && u.FirstSeen.Before(since), !u.LastUsed.IsZero() && u.LastUsed.Before(since):
+			unused = append(unused, UnusedTunnel{Name: name, LastUsed: u.LastUsed, FirstSeen: u.FirstSeen})
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool {
+		return unused[i].Name < unused[j].Name
+	})
+	return unused
+}
+
+// ParseAge parses a duration which, on top of the time.ParseDuration units,
+// can be a number of days such as "30d".
+func ParseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, errors.Errorf("invalid number of days %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	return d, errors.Wrapf(err, "parsing duration %q", s)
+}
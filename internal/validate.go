@@ -0,0 +1,368 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+// secretRegex matches flag and variable names which are likely to carry
+// secrets.
+var secretRegex = regexp.MustCompile(`(?i)(password|passwd|secret|token|api[-_]?key|credential)`)
+
+// ValidationReport is the result of validating a config file. It is designed
+// to be consumed by CI pipelines, hence no network or child process is ever
+// involved in producing it.
+type ValidationReport struct {
+	// Errors which are not specific to a tunnel, e.g. malformed json.
+	Errors  []string       `json:"errors"`
+	Tunnels []TunnelReport `json:"tunnels"`
+	Valid   bool           `json:"valid"`
+}
+
+// TunnelReport contains the validation results of a single tunnel config.
+type TunnelReport struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Command  []string `json:"command"`
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+// Validate checks the config files at the given paths, merged as by
+// LoadConfig with the given profile, against the policy if any, and reports
+// every problem found.
+func Validate(policy *Policy, profile string, paths ...string) *ValidationReport {
+	r := &ValidationReport{
+		Errors:  []string{},
+		Tunnels: []TunnelReport{},
+	}
+	config, err := LoadConfig(profile, paths...)
+	if err != nil {
+		r.Errors = append(r.Errors, err.Error())
+		return r
+	}
+	for _, path := range paths {
+		problems, err := checkUnknownFields(path)
+		if err != nil {
+			r.Errors = append(r.Errors, err.Error())
+		}
+		r.Errors = append(r.Errors, problems...)
+	}
+	if err = policy.Check(config); err != nil {
+		r.Errors = append(r.Errors, err.Error())
+	}
+	configs := append(append([]TunnelConfig(nil), config.Tunnels...), config.namespaces...)
+	names := map[string]bool{}
+	for i := range configs {
+		tr := validateTunnel(&configs[i])
+		if configs[i].Name != "" {
+			if names[configs[i].Name] {
+				tr.Errors = append(tr.Errors, "duplicate name")
+			}
+			names[configs[i].Name] = true
+		}
+		r.Tunnels = append(r.Tunnels, tr)
+	}
+	r.Valid = len(r.Errors) == 0
+	for i := range r.Tunnels {
+		if len(r.Tunnels[i].Errors) > 0 {
+			r.Valid = false
+		}
+	}
+	return r
+}
+
+func validateTunnel(c *TunnelConfig) TunnelReport {
+	tr := TunnelReport{
+		Name:     c.Name,
+		Type:     c.GetType(),
+		Command:  []string{},
+		Errors:   []string{},
+		Warnings: []string{},
+	}
+	errorf := func(format string, args ...interface{}) {
+		tr.Errors = append(tr.Errors, fmt.Sprintf(format, args...))
+	}
+	warnf := func(format string, args ...interface{}) {
+		tr.Warnings = append(tr.Warnings, fmt.Sprintf(format, args...))
+	}
+	if c.Name == "" {
+		errorf("missing name")
+	}
+	switch {
+	case c.LocalPort < 0 || c.LocalPort > 65535:
+		errorf("local_port %d is out of range", c.LocalPort)
+	case c.LocalPort > 0 && c.LocalPort < 1024:
+		warnf("local_port %d is privileged", c.LocalPort)
+	}
+	switch c.PortConflict {
+	case "", portConflictRebind:
+	default:
+		errorf("port_conflict %q must be %s", c.PortConflict, portConflictRebind)
+	}
+	if c.RebindRange != "" {
+		if _, err := parsePortRange(c.RebindRange); err != nil {
+			errorf("rebind_range: %s", err)
+		}
+		if c.PortConflict != portConflictRebind {
+			warnf("rebind_range is only used with port_conflict %s, it is ignored", portConflictRebind)
+		}
+	}
+	if c.Bind != "" && c.Bind != "localhost" && net.ParseIP(c.Bind) == nil {
+		errorf("bind %q is not an IP address", c.Bind)
+	}
+	switch c.IPFamily {
+	case "", familyIPv4, familyIPv6, familyDual:
+	default:
+		errorf("ip_family %q must be one of %s, %s or %s", c.IPFamily, familyIPv4, familyIPv6, familyDual)
+	}
+	if ip := net.ParseIP(c.Bind); ip != nil && !ip.IsUnspecified() && c.IPFamily != "" {
+		if (ip.To4() == nil) != (c.IPFamily == familyIPv6) {
+			errorf("bind %s does not belong to ip_family %s", c.Bind, c.IPFamily)
+		}
+	}
+	if c.K8s != nil && c.Custom != "" {
+		errorf("both k8s and custom are set")
+	}
+	if c.Provider != "" && (c.K8s != nil || c.Custom != "") {
+		errorf("provider cannot be used with k8s or custom")
+	}
+	if c.Dynamic != "" && (c.K8s != nil || c.Custom != "" || c.Provider != "") {
+		errorf("dynamic cannot be used with k8s, custom or provider")
+	}
+	if c.HTTPProxy != nil && (c.K8s != nil || c.Custom != "" || c.Provider != "" || c.Dynamic != "") {
+		errorf("http_proxy cannot be used with k8s, custom, provider or dynamic")
+	}
+	if n := c.K8sNamespace; n != nil {
+		if c.K8s != nil || c.Custom != "" || c.Provider != "" || c.Dynamic != "" || c.HTTPProxy != nil {
+			errorf("k8s_namespace cannot be used with k8s, custom, provider, dynamic or http_proxy")
+		}
+		if n.Namespace == "" {
+			errorf("missing k8s_namespace.namespace")
+		}
+		if n.Ports != "" {
+			if _, err := parsePortRange(n.Ports); err != nil {
+				errorf("k8s_namespace.ports: %s", err)
+			}
+		}
+		if c.LocalPort != 0 || c.LocalPorts != "" {
+			errorf("local_port and local_ports cannot be used with k8s_namespace, see k8s_namespace.ports")
+		}
+	}
+	if strings.Contains(c.Custom, secretPlaceholder) && c.SecretCmd == "" {
+		warnf("custom uses %s without secret_cmd, it is left as is", secretPlaceholder)
+	}
+	if len(c.Params) > 0 && c.Provider == "" {
+		warnf("params are only used with provider, they are ignored")
+	}
+	if c.K8s != nil {
+		if c.K8s.Namespace == "" {
+			errorf("missing k8s.namespace")
+		}
+		if c.K8s.Service == "" {
+			errorf("missing k8s.service")
+		}
+		if c.K8s.Port <= 0 || c.K8s.Port > 65535 {
+			errorf("k8s.port %d is out of range", c.K8s.Port)
+		}
+	}
+	if c.Failover != nil {
+		if len(c.Failover.Endpoints) == 0 {
+			errorf("failover has no endpoints")
+		}
+		for i, e := range c.Failover.Endpoints {
+			if (e.K8s == nil) == (e.Custom == "") {
+				errorf("failover.endpoints[%d] must set exactly one of k8s and custom", i)
+			}
+		}
+	}
+	for i, d := range c.Dependents {
+		if d.URL == "" && d.PidFile == "" {
+			errorf("dependents[%d] is missing url or pid_file", i)
+		}
+		if d.URL != "" && d.PidFile != "" {
+			warnf("dependents[%d] has both url and pid_file, only url is used", i)
+		}
+	}
+	if _, ok := c.stopSignal(); !ok {
+		errorf("unsupported stop_signal %q", c.StopSignal)
+	}
+	if c.Restart != nil && !c.Restart.isValid() {
+		errorf("restart.policy must be one of %q, %q or %q", RestartAlways, RestartOnFailure, RestartNever)
+	}
+	if c.VPN != nil {
+		if c.VPN.ProbeHost == "" {
+			errorf("missing vpn.probe_host")
+		}
+		if _, err := exec.LookPath("ping"); err != nil {
+			warnf("ping not found in PATH, vpn MTU probes will not work")
+		}
+	}
+	if c.WaitForTarget && c.K8s == nil && c.TargetHost == "" {
+		warnf("wait_for_target needs target_host for custom tunnels, it is ignored")
+	}
+	for i, p := range c.Preconditions {
+		if (p.Host == "") == (p.Interface == "") {
+			errorf("preconditions[%d] must set exactly one of host and interface", i)
+		}
+		if p.Port < 0 || p.Port > 65535 || (p.Port > 0 && p.Host == "") {
+			errorf("preconditions[%d].port must be a port of host", i)
+		}
+	}
+	switch usesUpstream := c.usesUpstream(); {
+	case c.Upstream == "" && usesUpstream:
+		errorf("%s or %s is used without upstream", upstreamPortPlaceholder, upstreamHostPlaceholder)
+	case c.Upstream != "" && !usesUpstream && c.HTTPProxy == nil:
+		warnf("upstream is set but the command uses neither %s, %s nor an address of the upstream", upstreamPortPlaceholder, upstreamHostPlaceholder)
+	}
+	if c.Shell && c.Custom == "" {
+		warnf("shell is only used with custom, it is ignored")
+	}
+	if (c.Scale != nil || c.MaxConnections > 0 || c.TLS != nil || c.IdleTimeout.Duration > 0 || c.OnDemand || c.MaxRate.BytesPerSecond > 0) && !c.isProxied() {
+		errorf("scale, max_connections, max_rate, tls, idle_timeout and on_demand require a k8s tunnel, a provider or a custom command using %s", localPortPlaceholder)
+	}
+	if c.CountConnections && !c.canProxy() {
+		warnf("count_connections requires a k8s tunnel, a provider or a custom command using %s, it is ignored", localPortPlaceholder)
+	}
+	if s := c.TLS; s != nil {
+		if !s.Terminate && !s.Originate {
+			warnf("tls sets neither terminate nor originate, it does nothing")
+		}
+		if (s.CertFile == "") != (s.KeyFile == "") {
+			errorf("tls.cert_file and tls.key_file must be set together")
+		}
+		if (s.ClientCertFile == "") != (s.ClientKeyFile == "") {
+			errorf("tls.client_cert_file and tls.client_key_file must be set together")
+		}
+		if s.ClientCertFile != "" && !s.Originate {
+			warnf("tls.client_cert_file is only used with originate, it is ignored")
+		}
+		if s.Originate && s.ServerName == "" && !s.InsecureSkipVerify {
+			errorf("tls.originate needs tls.server_name to verify the remote end, or tls.insecure_skip_verify")
+		}
+	}
+	if hc := c.HealthCheck; hc != nil {
+		if hc.HTTP != nil && !strings.HasPrefix(hc.HTTP.Path, "/") {
+			errorf("health_check.http.path must start with /")
+		}
+		if hc.HTTP != nil && hc.Cmd != "" {
+			warnf("health_check has both cmd and http, only cmd is used")
+		}
+		if max := hc.MaxLatency.Duration; max > 0 && max >= hc.Timeout.Or(defaultHealthTimeout) {
+			warnf("health_check.max_latency is not below the timeout, slow probes time out first")
+		}
+	}
+	commands := [][2]string{{"auth_refresh", c.AuthRefresh}, {"dynamic", c.Dynamic}, {"preflight", c.Preflight}, {"secret_cmd", c.SecretCmd}}
+	if c.HealthCheck != nil {
+		commands = append(commands, [2]string{"health_check.cmd", c.HealthCheck.Cmd})
+	}
+	if h := c.Hooks; h != nil {
+		commands = append(commands,
+			[2]string{"hooks.pre_start", h.PreStart}, [2]string{"hooks.post_start", h.PostStart},
+			[2]string{"hooks.pre_stop", h.PreStop}, [2]string{"hooks.post_stop", h.PostStop})
+	}
+	for _, fc := range commands {
+		if fc[1] == "" {
+			continue
+		}
+		if _, err := splitCommand(fc[1]); err != nil {
+			errorf("%s: %v", fc[0], err)
+		}
+	}
+	if c.Dynamic != "" || c.K8sNamespace != nil {
+		// The command is only known once the dynamic command runs, or once
+		// the services are listed.
+		return tr
+	}
+	// The command is built but never started.
+	cmd, err := c.getCommand(c.LocalPort)
+	if err != nil {
+		errorf("%v", err)
+		return tr
+	}
+	tr.Command = redactArgs(cmd.Args)
+	executable := cmd.Args[0]
+	if strings.Contains(executable, "/") && !filepath.IsAbs(executable) {
+		// Relative to the directory the command runs in.
+		executable = filepath.Join(c.Dir, executable)
+	}
+	if _, err = exec.LookPath(executable); err != nil {
+		warnf("%s not found in PATH", cmd.Args[0])
+	}
+	return tr
+}
+
+// redactArgs returns a copy of args where the values of flags and variables
+// which look like secrets are replaced, as well as credentials in URLs.
+func redactArgs(args []string) []string {
+	res := make([]string, len(args))
+	redactNext := false
+	for i, a := range args {
+		switch {
+		case redactNext:
+			res[i] = redacted
+			redactNext = false
+			continue
+		case strings.HasPrefix(a, "-") && secretRegex.MatchString(a):
+			if k, _, ok := strings.Cut(a, "="); ok {
+				res[i] = k + "=" + redacted
+			} else {
+				res[i] = a
+				redactNext = true
+			}
+			continue
+		}
+		if k, _, ok := strings.Cut(a, "="); ok && secretRegex.MatchString(k) {
+			res[i] = k + "=" + redacted
+			continue
+		}
+		if u, err := url.Parse(a); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), redacted)
+				res[i] = u.String()
+				continue
+			}
+		}
+		res[i] = a
+	}
+	return res
+}
+
+// WriteJSON writes the report as indented json.
+func (r *ValidationReport) WriteJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(r)
+}
+
+// WriteText writes the report in a human readable form.
+func (r *ValidationReport) WriteText(w io.Writer) {
+	for _, e := range r.Errors {
+		fmt.Fprintf(w, "error: %s\n", e)
+	}
+	for i := range r.Tunnels {
+		t := &r.Tunnels[i]
+		name := t.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		for _, e := range t.Errors {
+			fmt.Fprintf(w, "%s: error: %s\n", name, e)
+		}
+		for _, e := range t.Warnings {
+			fmt.Fprintf(w, "%s: warning: %s\n", name, e)
+		}
+	}
+	if r.Valid {
+		fmt.Fprintln(w, "Config is valid")
+	}
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// defaultWebhookTemplate suits Slack incoming webhooks.
+const defaultWebhookTemplate = `{"text": "{{title}}: {{message}}"}`
+
+// Webhook is an HTTP endpoint events are posted to, such as a Slack incoming
+// webhook.
+type Webhook struct {
+	// URL to post to.
+	URL string `json:"url"`
+	// Template is the json body posted, defaults to a Slack message. It can
+	// refer to {{event}}, {{title}}, {{message}}, {{name}}, {{status}},
+	// {{previous_status}}, {{hint}} and {{port}}.
+	Template string `json:"template"`
+	// Events restricts the events posted, see the Event constants. Defaults
+	// to all of them.
+	Events []string `json:"events"`
+	// CriticalOnly only posts about critical tunnels.
+	CriticalOnly bool `json:"critical_only"`
+	// IgnoreQuietHours posts during the quiet hours of the schedule too, e.g.
+	// to page whoever is on call.
+	IgnoreQuietHours bool `json:"ignore_quiet_hours"`
+}
+
+func (w *Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf("invalid url %q", w.URL)
+	}
+	for _, event := range w.Events {
+		switch event {
+		case EventFailed, EventFlapping, EventGaveUp, EventRecovered, EventFailedOver:
+		default:
+			return errors.Errorf("unknown event %q", event)
+		}
+	}
+	return nil
+}
+
+// wants tells whether the event must be posted.
+func (w *Webhook) wants(e *notification) bool {
+	if w.CriticalOnly && !e.critical {
+		return false
+	}
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, event := range w.Events {
+		if event == e.event {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonEscape escapes s to be placed within a json string.
+func jsonEscape(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b[1 : len(b)-1])
+}
+
+// body returns the body to post about the event.
+func (w *Webhook) body(e *notification) string {
+	template := w.Template
+	if template == "" {
+		template = defaultWebhookTemplate
+	}
+	return strings.NewReplacer(
+		"{{event}}", jsonEscape(e.event),
+		"{{title}}", jsonEscape(e.title),
+		"{{message}}", jsonEscape(e.message),
+		"{{name}}", jsonEscape(e.name),
+		"{{status}}", jsonEscape(e.status),
+		"{{previous_status}}", jsonEscape(e.previousStatus),
+		"{{hint}}", jsonEscape(e.hint),
+		"{{port}}", strconv.Itoa(e.port),
+	).Replace(template)
+}
+
+// post posts the event, writing failures to the log of the tunnel as there is
+// no one else to tell.
+func (w *Webhook) post(e *notification, log *rotatingLog) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewBufferString(w.body(e)))
+	if err != nil {
+		log.WriteLine("--- webhook failed: " + err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Leave the url out, webhook urls are often secrets.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		log.WriteLine("--- webhook failed: " + err.Error())
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		log.WriteLine("--- webhook failed: " + res.Status)
+	}
+}
@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// wizard asks the questions of tmancer init.
+type wizard struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask prints the question and returns the answer, def if empty.
+func (w *wizard) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(w.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(w.out, "%s: ", question)
+	}
+	line, err := w.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errors.New("aborted")
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		return line, nil
+	}
+	return def, nil
+}
+
+// choose lists the options and returns the one picked by number or name,
+// anything else typed being taken as is. Without options it asks for a
+// value.
+func (w *wizard) choose(question string, options []string, def string) (string, error) {
+	for i, o := range options {
+		fmt.Fprintf(w.out, "  %2d) %s\n", i+1, o)
+	}
+	answer, err := w.ask(question, def)
+	if err != nil {
+		return "", err
+	}
+	if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(options) {
+		return options[n-1], nil
+	}
+	return answer, nil
+}
+
+// askPort asks for a port, def if empty.
+func (w *wizard) askPort(question string, def int) (int, error) {
+	for {
+		answer, err := w.ask(question, strconv.Itoa(def))
+		if err != nil {
+			return 0, err
+		}
+		port, err := strconv.Atoi(answer)
+		if err == nil && port > 0 && port <= 65535 {
+			return port, nil
+		}
+		fmt.Fprintln(w.out, "Not a port number")
+	}
+}
+
+// kubectlNamespaces returns the namespaces of the context, empty if they
+// cannot be listed, e.g. without the permission to.
+//
+//nolint:gosec // I'm happy for now.
+func kubectlNamespaces(ctx context.Context, kubeContext string) []string {
+	args := []string{"get", "namespaces", "-o", "jsonpath={.items[*].metadata.name}"}
+	if kubeContext != "" {
+		args = append(args, "--context", kubeContext)
+	}
+	out, err := exec.CommandContext(ctx, "kubectl", args...).Output()
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(out))
+}
+
+// askK8s asks for the context, namespace, service and port of a k8s tunnel,
+// picked from the live lists when kubectl can get them.
+func (w *wizard) askK8s(ctx context.Context) (map[string]interface{}, string, int, error) {
+	var contexts []string
+	for name := range kubectlContexts(ctx) {
+		contexts = append(contexts, name)
+	}
+	sort.Strings(contexts)
+	current := kubectlCurrentContext(ctx)
+	if current == notAvailable {
+		current = ""
+	}
+	kubeContext, err := w.choose("Context", contexts, current)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	namespace := ""
+	for namespace == "" {
+		if namespace, err = w.choose("Namespace", kubectlNamespaces(ctx, kubeContext), ""); err != nil {
+			return nil, "", 0, err
+		}
+	}
+	type servicePort struct {
+		service string
+		port    int
+	}
+	var ports []servicePort
+	var options []string
+	if list, err := listServices(ctx, DiscoverOptions{Context: kubeContext, Namespace: namespace}); err == nil {
+		for _, svc := range list.Items {
+			for _, p := range svc.Spec.Ports {
+				if p.Protocol != "" && p.Protocol != "TCP" {
+					continue
+				}
+				ports = append(ports, servicePort{service: svc.Metadata.Name, port: p.Port})
+				options = append(options, fmt.Sprintf("%s:%d", svc.Metadata.Name, p.Port))
+			}
+		}
+	}
+	picked := servicePort{}
+	for picked.service == "" {
+		answer, err := w.choose("Service", options, "")
+		if err != nil {
+			return nil, "", 0, err
+		}
+		for i := range options {
+			if options[i] == answer {
+				picked = ports[i]
+			}
+		}
+		if picked.service == "" && answer != "" {
+			picked.service = strings.TrimPrefix(answer, "svc/")
+		}
+	}
+	if picked.port == 0 {
+		if picked.port, err = w.askPort("Service port", 80); err != nil {
+			return nil, "", 0, err
+		}
+	}
+	k8s := map[string]interface{}{
+		"namespace": namespace,
+		"service":   "svc/" + picked.service,
+		"port":      picked.port,
+	}
+	if kubeContext != "" {
+		k8s["context"] = kubeContext
+	}
+	return k8s, picked.service, picked.port, nil
+}
+
+// suggestPort returns the first port from port, shifted if privileged, which
+// neither a tunnel of the config nor another process uses.
+func suggestPort(ctx context.Context, taken map[int]string, port int) int {
+	if port < 1024 {
+		port += privilegedPortShift
+	}
+	for ; port < 65535; port++ {
+		if _, ok := taken[port]; !ok && !isPortBusy(ctx, "tcp", defaultBind, port) {
+			break
+		}
+	}
+	return port
+}
+
+// RunWizard asks for a tunnel interactively and appends it to the config file
+// at path, created if missing, once the resulting config is valid.
+func RunWizard(ctx context.Context, path string, in io.Reader, out io.Writer) error {
+	w := &wizard{in: bufio.NewReader(in), out: out}
+	original := []byte("{\"tunnels\": []}\n")
+	mode := os.FileMode(0o644)
+	taken := map[int]string{}
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+		if original, err = os.ReadFile(path); err != nil {
+			return errors.Wrapf(err, "reading file %s", path)
+		}
+		if err = refuseEncrypted(path, original); err != nil {
+			return err
+		}
+		if taken, err = LocalPorts(path); err != nil {
+			return err
+		}
+	}
+	kind, err := w.choose("Type", []string{"k8s", "custom"}, "k8s")
+	if err != nil {
+		return err
+	}
+	tunnel := map[string]interface{}{}
+	name, remotePort := "", 0
+	switch kind {
+	case "k8s":
+		if tunnel["k8s"], name, remotePort, err = w.askK8s(ctx); err != nil {
+			return err
+		}
+	case "custom":
+		fmt.Fprintf(out, "The command can use %s and %s, e.g. ssh -N -L %s:%s:db.internal:5432 bastion\n",
+			localPortPlaceholder, bindPlaceholder, bindPlaceholder, localPortPlaceholder)
+		command := ""
+		for command == "" {
+			if command, err = w.ask("Command", ""); err != nil {
+				return err
+			}
+		}
+		tunnel["custom"] = command
+		remotePort = 8080
+	default:
+		return errors.Errorf("unknown type %s", kind)
+	}
+	for {
+		if name, err = w.ask("Name", name); err != nil {
+			return err
+		}
+		if name != "" && !nameTaken(taken, name) {
+			break
+		}
+		fmt.Fprintln(out, "Pick a name which is not used by another tunnel")
+		name = ""
+	}
+	tunnel["name"] = name
+	if tunnel["local_port"], err = w.askPort("Local port", suggestPort(ctx, taken, remotePort)); err != nil {
+		return err
+	}
+	// Validate the config with the tunnel before touching the file.
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, original, mode); err != nil {
+		return errors.Wrapf(err, "writing file %s", tmp)
+	}
+	defer os.Remove(tmp)
+	if err = UpdateConfig(tmp, []map[string]interface{}{tunnel}); err != nil {
+		return err
+	}
+	if r := Validate(nil, "", tmp); !r.Valid {
+		problems := append([]string(nil), r.Errors...)
+		for i := range r.Tunnels {
+			for _, e := range r.Tunnels[i].Errors {
+				problems = append(problems, r.Tunnels[i].Name+": "+e)
+			}
+		}
+		return errors.Errorf("the config would not be valid: %s", strings.Join(problems, ", "))
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return errors.Wrapf(err, "writing file %s", path)
+	}
+	fmt.Fprintf(out, "Added %s to %s\n", name, path)
+	return nil
+}
+
+// nameTaken tells whether a tunnel of taken has the given name.
+func nameTaken(taken map[int]string, name string) bool {
+	for _, owner := range taken {
+		if owner == name {
+			return true
+		}
+	}
+	return false
+}
@@ -1,25 +1,58 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"os/signal"
-	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/ahmetb/go-cursor"
 	"github.com/lzambarda/tmancer/internal"
 	"github.com/pkg/errors"
 )
 
-const usage = `Usage is: tmancer <config>`
+const usage = `Usage is: tmancer [start] [--detach] [--wait <duration>] [--fail-fast] [--renderer <name>] [--log-format <format>] [--no-tui]
+                  [--columns <column>[:<width>],...] [--sort <order>] [--problems-only] [--title] [--refresh <duration>] [--once]
+                  [--profile <name>] [--tags <tag>,...] [--only <name>,...] [--exclude <name>,...] [--port-offset <n>]
+                  [--policy <file>] [--dry-run] <config>...
+          tmancer validate [--json] [--profile <name>] [--policy <file>] <config>...
+          tmancer snapshot [--profile <name>] <config>...
+          tmancer describe [--profile <name>] <config>... <name>
+          tmancer doctor [--json] [--profile <name>] [--port-offset <n>] <config>...
+          tmancer report unused [--since <age>] [--profile <name>] <config>...
+          tmancer history [--since <age>] [<name>]
+          tmancer events [-n <count>]
+          tmancer errors <name>
+          tmancer export [-o <file>]
+          tmancer run [<flag>...] <config>... -- <command>
+          tmancer fwd [<flag>...] [--name <name>] [--local <port>] (--k8s-context <context> --namespace <namespace> --service <service> --port <port> | --custom <command>)
+          tmancer status
+          tmancer attach [--read-only] [--columns <column>[:<width>],...] [--sort <order>] [--problems-only] [--refresh <duration>]
+          tmancer stop
+          tmancer ps
+          tmancer statusline [--plain]
+          tmancer ctl status|restart <name>|stop <name>|start <name>|add <json>|remove <name>
+          tmancer open <name>
+          tmancer exec <config> <name> -- <command>
+          tmancer discover --from-annotations [--context <context>] [--namespace <namespace>] [--update <config>]
+          tmancer gen k8s [--context <context>] --namespace <namespace> [--update <config>]
+          tmancer gen ssh [--file <ssh_config>] [--update <config>]
+          tmancer init <config>
+          tmancer service install|uninstall [--profile <name>] <config>...
+          tmancer self-update`
 
 func main() {
-	if len(os.Args) != 2 {
+	if len(os.Args) < 2 {
 		fmt.Println(usage)
 		os.Exit(1)
 	}
@@ -30,68 +63,1310 @@ func main() {
 	case "version", "-v", "--version":
 		fmt.Printf("tmancer version %s\n", internal.Version)
 		os.Exit(0)
+	case "self-update":
+		if err := internal.SelfUpdate(context.Background()); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "validate":
+		os.Exit(validate(os.Args[2:]))
+	case "snapshot":
+		os.Exit(snapshot(os.Args[2:]))
+	case "describe":
+		os.Exit(describe(os.Args[2:]))
+	case "doctor":
+		os.Exit(doctor(os.Args[2:]))
+	case "report":
+		os.Exit(report(os.Args[2:]))
+	case "history":
+		os.Exit(history(os.Args[2:]))
+	case "events":
+		os.Exit(events(os.Args[2:]))
+	case "errors":
+		os.Exit(tunnelErrors(os.Args[2:]))
+	case "export":
+		os.Exit(export(os.Args[2:]))
+	case "start":
+		os.Exit(run(os.Args[2:], nil, false))
+	case "run":
+		os.Exit(runWith(os.Args[2:]))
+	case "fwd":
+		os.Exit(run(os.Args[2:], nil, true))
+	case "status":
+		os.Exit(ctl([]string{"status"}))
+	case "attach":
+		os.Exit(attach(os.Args[2:]))
+	case "ps":
+		os.Exit(ps())
+	case "statusline":
+		os.Exit(statusLine(os.Args[2:]))
+	case "stop":
+		os.Exit(stop())
+	case "ctl":
+		os.Exit(ctl(os.Args[2:]))
+	case "open":
+		os.Exit(open(os.Args[2:]))
+	case "exec":
+		os.Exit(execInTarget(os.Args[2:]))
+	case "discover":
+		os.Exit(discover(os.Args[2:]))
+	case "gen":
+		os.Exit(gen(os.Args[2:]))
+	case "init":
+		os.Exit(initConfig(os.Args[2:]))
+	case "service":
+		os.Exit(service(os.Args[2:]))
+	case "http-proxy":
+		// Run by the http_proxy tunnels.
+		os.Exit(httpProxy(os.Args[2:]))
+	}
+	os.Exit(run(os.Args[1:], nil, false))
+}
+
+// Exit codes of a tmancer session.
+const (
+	exitOK = 0
+	// exitUsage is returned for usage and config errors.
+	exitUsage = 1
+	// exitNeverOpened is returned when at least one tunnel never managed to
+	// open during the session.
+	exitNeverOpened = 3
+	// exitAllFailed is returned when every tunnel ended up Failed.
+	exitAllFailed = 4
+	// exitFailFast is returned when the session was torn down because of
+	// --fail-fast.
+	exitFailFast = 5
+	// exitRequired is returned when the session was torn down because a
+	// required tunnel did not open in time.
+	exitRequired = 6
+	// exitNotReady is returned when the session was torn down because it was
+	// not ready within --wait, or by run when a tunnel it waits for failed for
+	// good.
+	exitNotReady = 7
+	// exitCommandNotRun is returned by run when the command could not be
+	// started, as shells do.
+	exitCommandNotRun = 127
+)
+
+// runWith runs the run subcommand, which runs a command once the tunnels are
+// ready, and returns the exit code of the command.
+func runWith(args []string) int {
+	for i, arg := range args {
+		if arg == "--" && i+1 < len(args) {
+			return run(args[:i], args[i+1:], false)
+		}
+	}
+	fmt.Println(usage)
+	return exitUsage
+}
+
+// run runs a tmancer session and returns the exit code. If command is set, it
+// is run once the session is ready and the session ends with it, the exit
+// code being the one of the command. If fwd is set, the session runs the
+// single tunnel described by the flags rather than a config.
+func run(args, command []string, fwd bool) int {
+	fs := flag.NewFlagSet("tmancer", flag.ExitOnError)
+	detach := fs.Bool("detach", false, "run the session in the background, see tmancer status and tmancer stop")
+	wait := fs.Duration("wait", 0, "tear everything down if the required tunnels are not open in time, e.g. 60s. With --detach, wait for them before returning")
+	failFast := fs.Bool("fail-fast", false, "tear everything down as soon as a tunnel fails for good")
+	rendererFlag := fs.String("renderer", "", "how to display the session: table (default), lines, json, accessible or none")
+	logFormatFlag := fs.String("log-format", "", "format of the lines renderer: text (default) or json")
+	columns := fs.String("columns", "", "comma separated columns of the table, e.g. name:24,target,status,details")
+	sortFlag := fs.String("sort", "", "order of the table rows: config (default), status, age, port or name")
+	problemsOnly := fs.Bool("problems-only", false, "only show the tunnels which need attention in the table")
+	title := fs.Bool("title", false, "keep the terminal window title to a summary of the session, e.g. tmancer: 11/12 open")
+	noTUI := fs.Bool("no-tui", false, "print a line on every status change instead of the table, even in a terminal")
+	refresh := fs.Duration("refresh", 0, "how often the table is refreshed, overrides the refresh_interval setting")
+	once := fs.Bool("once", false, "print a single snapshot once the tunnels had a refresh interval to open, then keep running silently")
+	profile := fs.String("profile", "", "profile of the config to start")
+	tags := fs.String("tags", "", "comma separated tags of the tunnels to start, all of them by default")
+	only := fs.String("only", "", "comma separated names of the tunnels to start, all of them by default")
+	exclude := fs.String("exclude", "", "comma separated names of the tunnels not to start")
+	portOffset := fs.Int("port-offset", 0, "shift every local port, overrides the port_offset setting")
+	policyPath := fs.String("policy", "", "policy restricting the commands tunnels may run")
+	envFile := fs.String("env-file", "", "dotenv file to write the host and port of every tunnel to, e.g. ~/.tmancer/current.env")
+	httpAddr := fs.String("http-addr", "", "address on which to serve the http api, /metrics and /healthz, e.g. 127.0.0.1:9464")
+	metricsAddr := fs.String("metrics-addr", "", "deprecated, same as --http-addr")
+	dryRun := fs.Bool("dry-run", false, "print the command of every tunnel instead of running them")
+	var adHoc *fwdFlags
+	if fwd {
+		adHoc = addFwdFlags(fs)
+	}
+	paths := parseArgs(fs, args)
+	if (len(paths) == 0) != fwd {
+		fmt.Println(usage)
+		return exitUsage
 	}
 
-	configs := []internal.TunnelConfig{}
-	b, err := os.ReadFile(os.Args[1])
+	var config *internal.Config
+	var err error
+	if fwd {
+		config, err = adHoc.config()
+	} else {
+		config, err = internal.LoadConfig(*profile, paths...)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	policy, err := internal.LoadPolicy(*policyPath)
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	if err = policy.Check(config); err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	if *dryRun && *detach {
+		fmt.Println("--dry-run cannot be used with --detach")
+		return exitUsage
+	}
+	// Nothing is spawned in a dry run, which is one way to review the commands
+	// before confirming them.
+	if !*dryRun {
+		if err = policy.Confirm(config, paths, os.Stdin, os.Stdout); err != nil {
+			fmt.Println(err)
+			return exitUsage
+		}
+	}
+	if err = config.FilterNames(splitList(*only), splitList(*exclude)); err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	if err = config.FilterTags(splitList(*tags)); err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	if *dryRun {
+		return printDryRun(config, *portOffset)
+	}
+	reapOrphans()
+	if *detach && command != nil {
+		fmt.Println("--detach cannot be used with run")
+		return exitUsage
+	}
+	if *detach {
+		if fwd {
+			args = append([]string{"fwd"}, args...)
+		}
+		pid, logPath, err := internal.Detach(args)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Printf("Session running in the background (pid %d), logs in %s\n", pid, logPath)
+		if *wait == 0 {
+			return exitOK
+		}
+		// The session tears itself down if it is not ready in time.
+		ctx, cancel := context.WithTimeout(context.Background(), *wait)
+		defer cancel()
+		if err = internal.ControlWait(ctx, os.Stdout); err != nil {
+			fmt.Println(err)
+			return exitNotReady
+		}
+		fmt.Println("Ready")
+		return exitOK
+	}
+	offset := config.Settings.PortOffset
+	if *portOffset != 0 {
+		offset = *portOffset
+	}
+	if err = config.ShiftPorts(offset); err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	if err = config.AssignFreePorts(); err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	configs := config.Tunnels
+	registry, err := internal.RegisterInstance(paths, configs)
 	if err != nil {
-		panic(errors.Wrapf(err, "reading file %s", os.Args[1]))
+		fmt.Println(err)
+		return exitUsage
+	}
+	defer registry.Close()
+	if *envFile != "" {
+		config.Settings.EnvFile = *envFile
 	}
-	err = json.Unmarshal(b, &configs)
+	if config.Settings.EnvFile != "" {
+		removeEnvFile, err := internal.WriteEnvFile(config.Settings.EnvFile, configs)
+		if err != nil {
+			fmt.Println(err)
+			return exitUsage
+		}
+		defer removeEnvFile()
+	}
+	removeAliases, err := internal.AddHostAliases(config.Settings.HostsFile, configs)
 	if err != nil {
-		panic(errors.Wrap(err, "unmarshaling configs"))
+		fmt.Printf("Not adding the aliases: %s, run tmancer as root or use dns_addr\n", err)
+	}
+	if removeAliases != nil {
+		defer removeAliases()
 	}
 
-	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	stopSignals := []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+	if command != nil {
+		// Ctrl-C belongs to the command, e.g. to cancel a query in psql, the
+		// session ends with it.
+		stopSignals = stopSignals[1:]
+		signal.Notify(make(chan os.Signal, 1), syscall.SIGINT)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), stopSignals...)
+	defer cancel()
+	ctx, cancel = context.WithCancel(ctx)
 	defer cancel()
 
+	if config.Settings.DNSAddr != "" {
+		if err = internal.StartDNS(ctx, config.Settings.DNSAddr, configs); err != nil {
+			fmt.Println(err)
+			return exitUsage
+		}
+	}
+
 	// Start all the wrappers goroutines.
 	wrappers := make([]*internal.Tunnel, len(configs))
 	wg := &sync.WaitGroup{}
-	m := &sync.RWMutex{}
+	outage := internal.NewOutageDetector(configs)
+	retryBudget := internal.NewRetryBudget(config.Settings.RetryBudget)
+	startQueue := internal.NewStartQueue(config.Settings.MaxOpening, config.Settings.StartDelay.Duration)
+	eventLog := &internal.EventLog{}
+	history, err := internal.OpenHistory()
+	if err == nil {
+		defer history.Close()
+	}
+	var auditLog *internal.AuditLog
+	if policy != nil && policy.AuditLog != "" {
+		if auditLog, err = internal.OpenAuditLog(policy.AuditLog); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer auditLog.Close()
+	}
+	// redraw asks for rendering again right away, e.g. after scrolling.
+	redraw := make(chan struct{}, 1)
+	requestRedraw := func() {
+		select {
+		case redraw <- struct{}{}:
+		default:
+		}
+	}
+	metricsExporter := internal.NewMetricsExporter(config.Settings.MetricsExport)
+	// setup also applies to the tunnels added with tmancer ctl add.
+	setup := func(t *internal.Tunnel) {
+		// Status changes show up right away rather than on the next refresh.
+		t.Subscribe(func(internal.StatusChange) { requestRedraw() })
+		if metricsExporter != nil {
+			t.Subscribe(metricsExporter.StatusChanged)
+		}
+		t.SetOutageDetector(outage)
+		t.SetRetryBudget(retryBudget)
+		t.SetStartQueue(startQueue)
+		t.SetEventLog(eventLog)
+		if history != nil {
+			t.SetHistory(history)
+		}
+		if auditLog != nil {
+			t.SetAuditLog(auditLog)
+		}
+	}
 	for i, config := range configs {
 		wrappers[i] = internal.NewTunnel(config)
-		wg.Add(1)
-		go func(i int) {
-			defer wg.Done()
-			wrappers[i].Start(ctx, m)
-		}(i)
-	}
-
-	const (
-		headerFormat = "%-16s%-10s%-10s%-10s%-10s%-10s\n"
-		rowFormat    = "%-16s%-10s%-10d%-10s%-10s%-10s%s\n"
-		notAvailable = "N/A"
-	)
-	fmt.Printf(headerFormat, "NAME", "TYPE", "PORT", "PID", "AGE", "STATUS")
+		setup(wrappers[i])
+	}
+	internal.LinkDependencies(wrappers)
+	session := internal.NewSession(ctx, wg, config.Settings, policy, wrappers, setup)
+	if *httpAddr == "" {
+		*httpAddr = *metricsAddr
+	}
+	if *httpAddr != "" {
+		config.Settings.HTTPAddr = *httpAddr
+	}
+	if config.Settings.HTTPAddr != "" {
+		if err = internal.StartHTTP(ctx, config.Settings.HTTPAddr, session, config.Settings.Formats, cancel); err != nil {
+			fmt.Println(err)
+			return exitUsage
+		}
+	}
+	// Keep the control socket up until the processes are gone, for tmancer
+	// stop to know when the session is over.
+	controlCtx, stopControl := context.WithCancel(context.Background())
+	defer stopControl()
+	if err = internal.StartControlSocket(controlCtx, session, config.Settings.Formats, cancel); err != nil {
+		fmt.Printf("Control socket disabled: %s\n", err)
+	}
+	session.Start()
+
+	if *rendererFlag != "" {
+		config.Settings.Renderer = *rendererFlag
+	}
+	if *noTUI && (config.Settings.Renderer == "" || config.Settings.Renderer == internal.RendererTable) {
+		config.Settings.Renderer = internal.RendererLines
+	}
+	if *logFormatFlag != "" {
+		config.Settings.LogFormat = *logFormatFlag
+	}
+	if *columns != "" {
+		config.Settings.Columns = splitList(*columns)
+	}
+	if *sortFlag != "" {
+		config.Settings.Sort = *sortFlag
+	}
+	if *problemsOnly {
+		config.Settings.ProblemsOnly = true
+	}
+	if *title {
+		config.Settings.TerminalTitle = true
+	}
+	if *refresh != 0 {
+		config.Settings.RefreshInterval = internal.Duration{Duration: *refresh}
+	}
+	if command != nil {
+		// Keep the terminal to the command.
+		config.Settings.Renderer = internal.RendererNone
+		*once = false
+	}
+	rendererName := config.Settings.Renderer
+	newRenderer := internal.NewRenderer
+	if *once {
+		newRenderer = internal.NewOnceRenderer
+	}
+	renderer, err := newRenderer(&config.Settings, os.Stdout)
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	// Keep the json events and snapshots alone on stdout, for jq and log
+	// aggregators.
+	var messages io.Writer = os.Stdout
+	if config.Settings.LogFormat == internal.LogFormatJSON || rendererName == internal.RendererJSON || command != nil {
+		messages = os.Stderr
+	}
+	interactive := false
+	if !*once && (rendererName == "" || rendererName == internal.RendererTable) {
+		if keys, restore, err := internal.ReadKeys(); err == nil {
+			interactive = true
+			defer restore()
+			go func() {
+				h, _ := renderer.(internal.KeyHandler)
+				for key := range keys {
+					// The renderer gets the first go, e.g. to move the selection.
+					if h != nil && h.HandleKey(key) {
+						if c, persist, ok := h.TakeTunnel(); ok {
+							h.Flash(addTunnel(session, c, persist, paths))
+						}
+						requestRedraw()
+						continue
+					}
+					selected := ""
+					if h != nil {
+						selected = h.Selected()
+					}
+					switch key {
+					case 'r':
+						internal.RestartDrifted(session.Tunnels())
+					case 'R':
+						internal.RestartTunnels(session.Tunnels(), selected)
+					case 'p':
+						internal.TogglePause(session.Tunnels(), selected)
+					case 'x':
+						path, err := internal.ExportSession(session.Tunnels())
+						if h != nil {
+							if err != nil {
+								h.Flash("export failed: " + err.Error())
+							} else {
+								h.Flash("exported to " + path)
+							}
+						}
+					case 'q':
+						cancel()
+					}
+					requestRedraw()
+				}
+			}()
+		}
+		winch := make(chan os.Signal, 1)
+		internal.NotifyResize(winch)
+		defer signal.Stop(winch)
+		go func() {
+			for range winch {
+				requestRedraw()
+			}
+		}()
+	}
+	go internal.WatchConfigFiles(ctx, session, interactive)
+	go internal.TrackUsage(ctx, session, messages)
+	go internal.WatchProcesses(ctx, session)
+	go internal.WatchNetwork(ctx, session, config.Settings.NetworkWatch)
+	go internal.WatchNamespaces(ctx, session, config)
+	go internal.WatchConfigDirs(ctx, session, config.GetDirs(), func() (*internal.Config, error) {
+		// As loaded above, once confirmed.
+		reloaded, err := internal.LoadConfig(*profile, paths...)
+		if err != nil {
+			return nil, err
+		}
+		if err = reloaded.FilterNames(splitList(*only), splitList(*exclude)); err != nil {
+			return nil, err
+		}
+		if err = reloaded.FilterTags(splitList(*tags)); err != nil {
+			return nil, err
+		}
+		return reloaded, reloaded.ShiftPorts(offset)
+	})
+	if metricsExporter != nil {
+		go metricsExporter.Run(ctx, session)
+	}
+	if config.Settings.EnvFile != "" {
+		go internal.WatchEnvFile(ctx, config.Settings.EnvFile, session)
+	}
+	go registry.Track(ctx, session)
+	rendered := make(chan struct{})
+	go func() {
+		defer close(rendered)
+		// A crashing renderer must not take the tunnels down with it.
+		defer func() {
+			if r := recover(); r != nil {
+				path, err := internal.WriteCrashReport("renderer", r, nil)
+				if err != nil {
+					fmt.Fprintf(messages, "\nRenderer crashed (%v): %v\n", r, err)
+					return
+				}
+				fmt.Fprintf(messages, "\nRenderer crashed, report in %s\n", path)
+			}
+		}()
+		if *once {
+			// Give the tunnels a chance to open before the snapshot.
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(config.Settings.GetRefreshInterval()):
+			}
+		}
+		for {
+			renderer.Render(internal.TakeSnapshot(session.Tunnels()))
+			select {
+			case <-ctx.Done():
+				return
+			case <-redraw:
+			case <-time.After(config.Settings.GetRefreshInterval()):
+			}
+		}
+	}()
+
+	// Stop the session once there is nothing left to do, when a required
+	// tunnel does not open in time or on the first unrecoverable failure in
+	// fail-fast mode.
+	var forcedExit int32
 	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
 		for {
-			// Avoid overwriting the waiting message
 			select {
 			case <-ctx.Done():
 				return
-			default:
+			case <-ticker.C:
 			}
-			m.RLock()
-			for i, c := range configs {
-				pid := notAvailable
-				if t := wrappers[i].GetPid(); t != 0 {
-					pid = strconv.Itoa(t)
+			tunnels := session.Tunnels()
+			failed, missed, allTerminal := "", "", len(tunnels) > 0
+			for _, w := range tunnels {
+				status := w.GetStatus()
+				if status == internal.Failed && failed == "" {
+					failed = w.GetName()
 				}
-				ageStr := notAvailable
-				if age, valid := wrappers[i].GetAge(); valid {
-					ageStr = age.String()
+				if w.MissedStartup() && missed == "" {
+					missed = w.GetName()
 				}
-				fmt.Printf(rowFormat, c.Name, c.GetType(), c.LocalPort, pid, ageStr, wrappers[i].GetStatus(), wrappers[i].GetError())
+				allTerminal = allTerminal && status.IsTerminal()
+			}
+			if missed != "" {
+				atomic.StoreInt32(&forcedExit, exitRequired)
+				fmt.Fprintf(messages, "\nRequired tunnel %s did not open in time, tearing everything down", missed)
+				cancel()
+				return
+			}
+			if *failFast && failed != "" {
+				atomic.StoreInt32(&forcedExit, exitFailFast)
+				fmt.Fprintf(messages, "\nTunnel %s failed, tearing everything down", failed)
+				cancel()
+				return
+			}
+			if allTerminal {
+				cancel()
+				return
 			}
-			m.RUnlock()
-			time.Sleep(5 * time.Second)
-			fmt.Print(cursor.MoveUp(len(configs)))
 		}
 	}()
 
+	if *wait > 0 {
+		go func() {
+			waitCtx, cancelWait := context.WithTimeout(ctx, *wait)
+			defer cancelWait()
+			err := internal.WaitReady(waitCtx, wrappers)
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			atomic.StoreInt32(&forcedExit, exitNotReady)
+			if waitCtx.Err() != nil {
+				fmt.Fprintf(messages, "\nNot ready after %s, tearing everything down", *wait)
+			} else {
+				fmt.Fprintf(messages, "\nNot ready, %v, tearing everything down", err)
+			}
+			cancel()
+		}()
+	}
+	commandExit := int32(-1)
+	if command != nil {
+		go func() {
+			code := runWhenReady(ctx, wrappers, command)
+			atomic.StoreInt32(&commandExit, int32(code))
+			cancel()
+		}()
+	}
+
 	<-ctx.Done()
-	fmt.Println("\nWaiting for processes to end")
+	// Avoid overwriting the waiting message.
+	<-rendered
+	renderer.Close()
+	fmt.Fprintln(messages, "\nWaiting for processes to end")
 	wg.Wait()
-	fmt.Println("Done")
+	fmt.Fprintln(messages, "Done")
+	tunnels := session.Tunnels()
+	if code := atomic.LoadInt32(&commandExit); code >= 0 {
+		return int(code)
+	}
+	if code := atomic.LoadInt32(&forcedExit); code != 0 {
+		return int(code)
+	}
+	return exitCode(tunnels)
+}
+
+// addTunnel adds the tunnel of the new tunnel form of the table to the
+// session, saving it to the first config file if persist, and returns the
+// outcome to flash.
+func addTunnel(session *internal.Session, c internal.TunnelConfig, persist bool, paths []string) string {
+	if persist && len(paths) == 0 {
+		return "not added: there is no config file to save to"
+	}
+	names, err := session.Add(c, true)
+	if err != nil {
+		return "not added: " + err.Error()
+	}
+	message := "added " + strings.Join(names, ", ")
+	if !persist {
+		return message
+	}
+	if err = internal.SaveTunnel(paths[0], c); err != nil {
+		return message + ", not saved: " + err.Error()
+	}
+	return message + " to " + paths[0]
+}
+
+// runWhenReady waits for the session to be ready, then runs the command with
+// the tunnel ports in its environment and returns its exit code. It returns
+// -1 if the session ended first, and exitNotReady if a tunnel it waits for
+// will never open.
+func runWhenReady(ctx context.Context, wrappers []*internal.Tunnel, command []string) int {
+	if err := internal.WaitReady(ctx, wrappers); err != nil {
+		if ctx.Err() != nil {
+			return -1
+		}
+		fmt.Fprintf(os.Stderr, "\nNot running %s, %v\n", command[0], err)
+		return exitNotReady
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// As they run, e.g. rebound to another port.
+	cmd.Env = append(os.Environ(), internal.TunnelEnv(wrappers)...)
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			// As shells do.
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	fmt.Fprintln(os.Stderr, err)
+	return exitCommandNotRun
+}
+
+// printDryRun prints the commands of the tunnels of the config, shifted by the
+// port offset, and returns the exit code. It has no side effect: no orphan is
+// reaped and no free port is looked for.
+func printDryRun(config *internal.Config, portOffset int) int {
+	offset := config.Settings.PortOffset
+	if portOffset != 0 {
+		offset = portOffset
+	}
+	if err := config.ShiftPorts(offset); err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	if err := config.DryRun(os.Stdout); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return exitOK
+}
+
+// reapOrphans offers to terminate the tunnel processes left behind by previous
+// sessions, which would keep their ports busy otherwise.
+func reapOrphans() {
+	orphans, err := internal.FindOrphans()
+	if err != nil || len(orphans) == 0 {
+		return
+	}
+	fmt.Println("Processes left behind by a previous session are still running:")
+	pids := make([]string, len(orphans))
+	for i, o := range orphans {
+		fmt.Printf("  %d (%s): %s\n", o.Pid, o.Tunnel, o.Command)
+		pids[i] = fmt.Sprintf("-%d", o.Pid)
+	}
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		fmt.Printf("Kill them with: kill -- %s\n", strings.Join(pids, " "))
+		return
+	}
+	fmt.Print("Kill them? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+		return
+	}
+	if err = internal.ReapOrphans(orphans); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// exitCode returns the exit code of a session given its tunnels.
+func exitCode(wrappers []*internal.Tunnel) int {
+	allFailed, neverOpened := true, false
+	for _, w := range wrappers {
+		allFailed = allFailed && w.GetStatus() == internal.Failed
+		neverOpened = neverOpened || !w.HasOpened()
+	}
+	switch {
+	case len(wrappers) > 0 && allFailed:
+		return exitAllFailed
+	case neverOpened:
+		return exitNeverOpened
+	}
+	return exitOK
+}
+
+// splitList splits a comma separated flag value, empty if the flag is not set.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// fwdFlags describe the single tunnel of tmancer fwd.
+type fwdFlags struct {
+	name, k8sContext, namespace, service, custom *string
+	port, local                                  *int
+}
+
+// addFwdFlags adds the flags describing the tunnel of tmancer fwd to fs.
+func addFwdFlags(fs *flag.FlagSet) *fwdFlags {
+	return &fwdFlags{
+		name:       fs.String("name", "", "name of the tunnel, defaults to the service or fwd"),
+		k8sContext: fs.String("k8s-context", "", "kubectl context of the service, defaults to the current one"),
+		namespace:  fs.String("namespace", "", "namespace of the service"),
+		service:    fs.String("service", "", "service to forward, e.g. postgres or pod/postgres-0"),
+		port:       fs.Int("port", 0, "port of the service"),
+		local:      fs.Int("local", 0, "local port, a free one by default"),
+		custom:     fs.String("custom", "", "command to run instead of forwarding a k8s service, see the custom tunnel config"),
+	}
+}
+
+// config returns the config of the tunnel described by the flags.
+func (f *fwdFlags) config() (*internal.Config, error) {
+	if (*f.service == "") == (*f.custom == "") {
+		return nil, errors.New("either --service or --custom is needed")
+	}
+	if *f.service != "" && (*f.namespace == "" || *f.port == 0) {
+		return nil, errors.New("--service needs --namespace and --port")
+	}
+	t := internal.TunnelConfig{Name: *f.name, LocalPort: *f.local, Custom: *f.custom}
+	if *f.service != "" {
+		service := *f.service
+		if !strings.Contains(service, "/") {
+			service = "svc/" + service
+		}
+		t.K8s = &internal.K8sInfo{Context: *f.k8sContext, Namespace: *f.namespace, Service: service, Port: *f.port}
+		if t.Name == "" {
+			t.Name = service[strings.Index(service, "/")+1:]
+		}
+	}
+	if t.Name == "" {
+		t.Name = "fwd"
+	}
+	return internal.NewConfig(internal.Settings{}, []internal.TunnelConfig{t})
+}
+
+// parseArgs parses the flags wherever they are among the positional arguments,
+// so that "tmancer config.json --profile staging" works too, and returns the
+// positional ones.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		_ = fs.Parse(args) // ExitOnError.
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...)
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// validate runs the validate subcommand and returns the exit code.
+func validate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print a machine-readable report")
+	profile := fs.String("profile", "", "profile of the config to validate")
+	policyPath := fs.String("policy", "", "policy restricting the commands tunnels may run")
+	paths := parseArgs(fs, args)
+	if len(paths) == 0 {
+		fmt.Println(usage)
+		return 1
+	}
+	policy, err := internal.LoadPolicy(*policyPath)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	report := internal.Validate(policy, *profile, paths...)
+	if *asJSON {
+		if err = report.WriteJSON(os.Stdout); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	} else {
+		report.WriteText(os.Stdout)
+	}
+	if !report.Valid {
+		return 1
+	}
+	return 0
+}
+
+// snapshot runs the snapshot subcommand and returns the exit code.
+func snapshot(args []string) int {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	profile := fs.String("profile", "", "profile of the config the session runs")
+	paths := parseArgs(fs, args)
+	if len(paths) == 0 {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	config, err := internal.LoadConfig(*profile, paths...)
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	if err = e.Encode(internal.Describe(context.Background(), config)); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// describe runs the describe subcommand and returns the exit code.
+func describe(args []string) int {
+	fs := flag.NewFlagSet("describe", flag.ExitOnError)
+	profile := fs.String("profile", "", "profile of the config the tunnel belongs to")
+	paths := parseArgs(fs, args)
+	if len(paths) < 2 {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	name := paths[len(paths)-1]
+	config, err := internal.LoadConfig(*profile, paths[:len(paths)-1]...)
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	if err = internal.DescribeChain(config, name, os.Stdout); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// doctor runs the doctor subcommand and returns the exit code.
+func doctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print a machine-readable report")
+	profile := fs.String("profile", "", "profile of the config to check")
+	portOffset := fs.Int("port-offset", 0, "shift every local port, overrides the port_offset setting")
+	paths := parseArgs(fs, args)
+	if len(paths) == 0 {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	config, err := internal.LoadConfig(*profile, paths...)
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	offset := config.Settings.PortOffset
+	if *portOffset != 0 {
+		offset = *portOffset
+	}
+	if err = config.ShiftPorts(offset); err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	report := internal.Doctor(context.Background(), config)
+	if *asJSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		if err = e.Encode(report); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	} else {
+		report.WriteText(os.Stdout)
+	}
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
+
+// report runs the report subcommand and returns the exit code.
+func report(args []string) int {
+	if len(args) == 0 || args[0] != "unused" {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	fs := flag.NewFlagSet("report unused", flag.ExitOnError)
+	sinceFlag := fs.String("since", "30d", "how long tunnels must have been unused for, e.g. 30d")
+	profile := fs.String("profile", "", "profile of the config to report about")
+	paths := parseArgs(fs, args[1:])
+	if len(paths) == 0 {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	age, err := internal.ParseAge(*sinceFlag)
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	config, err := internal.LoadConfig(*profile, paths...)
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	recorded, err := internal.LoadUsage()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	unused := internal.FindUnused(config, recorded, time.Now().Add(-age))
+	if len(unused) == 0 {
+		fmt.Printf("Every tunnel was used in the last %s\n", *sinceFlag)
+		return 0
+	}
+	const dateLayout = "2006-01-02"
+	fmt.Printf("%-24s%s\n", "NAME", "LAST USED")
+	for _, u := range unused {
+		lastUsed := u.LastUsed.Format(dateLayout)
+		switch {
+		case u.FirstSeen.IsZero():
+			lastUsed = "never run"
+		case u.LastUsed.IsZero():
+			lastUsed = "never, tracked since " + u.FirstSeen.Format(dateLayout)
+		}
+		fmt.Printf("%-24s%s\n", u.Name, lastUsed)
+	}
+	return 0
+}
+
+// history runs the history subcommand, which shows the reliability of the
+// tunnels over the last days, and returns the exit code.
+func history(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	sinceFlag := fs.String("since", "7d", "period to show, e.g. 7d or 12h")
+	names := parseArgs(fs, args)
+	if len(names) > 1 {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	since, err := internal.ParseAge(*sinceFlag)
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	name := ""
+	if len(names) == 1 {
+		name = names[0]
+	}
+	if err = internal.ShowHistory(os.Stdout, name, since); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// events runs the events subcommand, which prints the latest status changes
+// of the running session, and returns the exit code.
+func events(args []string) int {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	count := fs.Int("n", 20, "number of status changes to print, 0 for all of them")
+	if len(parseArgs(fs, args)) > 0 {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	if err := internal.ControlEvents(context.Background(), os.Stdout, *count); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// tunnelErrors runs the errors subcommand, which prints the latest errors of a
+// tunnel of the running session in full, and returns the exit code.
+func tunnelErrors(args []string) int {
+	fs := flag.NewFlagSet("errors", flag.ExitOnError)
+	names := parseArgs(fs, args)
+	if len(names) != 1 {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	if err := internal.ControlErrors(context.Background(), os.Stdout, names[0]); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// export runs the export subcommand, which saves the tunnels of the running
+// session as a config, and returns the exit code.
+func export(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	output := fs.String("o", "", "file to write the config to, instead of printing it")
+	if len(parseArgs(fs, args)) > 0 {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	b := &bytes.Buffer{}
+	if err := internal.ControlExport(context.Background(), b); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if *output == "" {
+		os.Stdout.Write(b.Bytes()) //nolint:errcheck // Nothing to do about it.
+		return 0
+	}
+	if err := os.WriteFile(*output, b.Bytes(), 0o600); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// ctl runs the ctl subcommand, which drives the running session, and returns
+// the exit code.
+func ctl(args []string) int {
+	ctx := context.Background()
+	var err error
+	switch {
+	case len(args) == 1 && args[0] == "status":
+		err = internal.ControlStatus(ctx, os.Stdout)
+	case len(args) == 2 && (args[0] == "restart" || args[0] == "stop" || args[0] == "start"):
+		err = internal.ControlTunnel(ctx, args[1], args[0])
+	case len(args) == 2 && args[0] == "add":
+		var names []string
+		if names, err = internal.ControlAdd(ctx, args[1]); err == nil {
+			fmt.Printf("Added %s\n", strings.Join(names, ", "))
+		}
+	case len(args) == 2 && args[0] == "remove":
+		err = internal.ControlRemove(ctx, args[1])
+	default:
+		fmt.Println(usage)
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// attach runs the attach subcommand, which displays the live table of the
+// running session in another terminal, and returns the exit code.
+func attach(args []string) int {
+	fs := flag.NewFlagSet("attach", flag.ExitOnError)
+	readOnly := fs.Bool("read-only", false, "only display the table, without acting on the tunnels")
+	columns := fs.String("columns", "", "comma separated columns of the table, e.g. name:24,target,status,details")
+	sortFlag := fs.String("sort", "", "order of the table rows: config (default), status, age, port or name")
+	problemsOnly := fs.Bool("problems-only", false, "only show the tunnels which need attention in the table")
+	refresh := fs.Duration("refresh", 0, "how often the table is refreshed")
+	if len(parseArgs(fs, args)) > 0 {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	settings := internal.Settings{
+		Sort:            *sortFlag,
+		ProblemsOnly:    *problemsOnly,
+		RefreshInterval: internal.Duration{Duration: *refresh},
+	}
+	if *columns != "" {
+		settings.Columns = splitList(*columns)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := internal.Attach(ctx, &settings, os.Stdout, *readOnly); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// stop runs the stop subcommand, which ends the running session, and returns
+// the exit code.
+func stop() int {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := internal.ControlStop(ctx); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println("Stopped")
+	return 0
+}
+
+// ps runs the ps subcommand, which lists the tunnels of all the running
+// sessions, and returns the exit code.
+func ps() int {
+	if err := internal.ControlPs(context.Background(), os.Stdout); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// statusLine runs the statusline subcommand, which prints a summary of the
+// running session for the tmux status bar, and returns the exit code.
+func statusLine(args []string) int {
+	fs := flag.NewFlagSet("statusline", flag.ExitOnError)
+	plain := fs.Bool("plain", false, "print the summary without the tmux colour codes")
+	_ = fs.Parse(args) // ExitOnError.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := internal.ControlStatusLine(ctx, os.Stdout, !*plain); err != nil {
+		// Keep the status bar clean.
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// httpProxy runs the http-proxy subcommand, which is the process of the
+// http_proxy tunnels, and returns the exit code.
+func httpProxy(args []string) int {
+	fs := flag.NewFlagSet("http-proxy", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:3128", "address to serve the proxy on")
+	socks := fs.String("socks", "", "address of the SOCKS5 proxy to route connections through")
+	_ = fs.Parse(args) // ExitOnError.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := internal.ServeHTTPProxy(ctx, *listen, *socks, os.Stdout); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// open runs the open subcommand, which opens the url of a tunnel of the
+// running session in the browser, and returns the exit code.
+func open(args []string) int {
+	if len(args) != 1 {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	if err := internal.ControlOpen(context.Background(), args[0]); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// execInTarget runs the exec subcommand and returns the exit code.
+func execInTarget(args []string) int {
+	if len(args) < 4 || args[2] != "--" {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	config, err := internal.LoadConfig("", args[0])
+	if err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	code, err := internal.Exec(config, args[1], args[3:])
+	if err != nil {
+		fmt.Println(err)
+	}
+	return code
+}
+
+// discover runs the discover subcommand and returns the exit code.
+func discover(args []string) int {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	fromAnnotations := fs.Bool("from-annotations", false, "look for services annotated with tmancer.io/port-forward")
+	opts := internal.DiscoverOptions{}
+	fs.StringVar(&opts.Context, "context", "", "kubectl context, defaults to the current one")
+	fs.StringVar(&opts.Namespace, "namespace", "", "namespace to scan, defaults to all of them")
+	update := fs.String("update", "", "config file to add the tunnels to, instead of printing them")
+	_ = fs.Parse(args) // ExitOnError.
+	if !*fromAnnotations || fs.NArg() != 0 {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	tunnels, err := internal.Discover(context.Background(), opts)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if *update != "" {
+		if err = internal.UpdateConfig(*update, tunnels); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Printf("%d tunnels discovered\n", len(tunnels))
+		return 0
+	}
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	if err = e.Encode(tunnels); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// initConfig runs the init subcommand, which adds a tunnel to a config file
+// interactively, and returns the exit code.
+func initConfig(args []string) int {
+	if len(args) != 1 {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	if err := internal.RunWizard(context.Background(), args[0], os.Stdin, os.Stdout); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// service runs the service subcommand, which installs or uninstalls a user
+// service starting the session at login, and returns the exit code.
+func service(args []string) int {
+	if len(args) == 0 || (args[0] != "install" && args[0] != "uninstall") {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	fs := flag.NewFlagSet("service", flag.ExitOnError)
+	profile := fs.String("profile", "", "profile of the config to start")
+	paths := parseArgs(fs, args[1:])
+	if len(paths) == 0 {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	s, err := internal.NewService(paths, *profile)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if args[0] == "uninstall" {
+		if err = s.Uninstall(); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Printf("Removed %s\n", s.Path)
+		return 0
+	}
+	// Rather than restarting forever on a broken config.
+	if _, err = internal.LoadConfig(*profile, paths...); err != nil {
+		fmt.Println(err)
+		return exitUsage
+	}
+	if err = s.Install(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("Installed %s, starting at login with its output in %s\n", s.Path, s.Log)
+	return 0
+}
+
+// gen runs the gen subcommand, which writes the tunnel configs of every
+// service of a namespace or of the forwards of an ssh_config, and returns the
+// exit code.
+func gen(args []string) int {
+	if len(args) == 0 || (args[0] != "k8s" && args[0] != "ssh") {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	opts := internal.DiscoverOptions{}
+	var sshConfig *string
+	if args[0] == "k8s" {
+		fs.StringVar(&opts.Context, "context", "", "kubectl context, defaults to the current one")
+		fs.StringVar(&opts.Namespace, "namespace", "", "namespace of the services")
+	} else {
+		sshConfig = fs.String("file", "", "ssh_config file to read, defaults to ~/.ssh/config")
+	}
+	update := fs.String("update", "", "config file to add the tunnels to, instead of printing them")
+	_ = fs.Parse(args[1:]) // ExitOnError.
+	if (sshConfig == nil && opts.Namespace == "") || fs.NArg() != 0 {
+		fmt.Println(usage)
+		return exitUsage
+	}
+	taken := map[int]string{}
+	if *update != "" {
+		var err error
+		if taken, err = internal.LocalPorts(*update); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	var tunnels []map[string]interface{}
+	var err error
+	if sshConfig != nil {
+		tunnels, err = internal.GenerateSSH(*sshConfig, taken)
+	} else {
+		tunnels, err = internal.GenerateK8s(context.Background(), opts, taken)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if *update != "" {
+		if err = internal.UpdateConfig(*update, tunnels); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Printf("%d tunnels generated\n", len(tunnels))
+		return 0
+	}
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	if err = e.Encode(tunnels); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
 }
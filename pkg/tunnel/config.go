@@ -0,0 +1,210 @@
+package tunnel
+
+import (
+	"time"
+
+	"github.com/lzambarda/tmancer/internal"
+)
+
+// Config configures a tunnel, see the configuration section of the README
+// for the meaning of its fields. Exactly one of K8s, Custom and Provider is
+// set.
+type Config struct {
+	K8s *K8sInfo
+	// HealthCheck probes the tunnel once open, nil for the default dial of
+	// the local port.
+	HealthCheck *HealthCheck
+	Name        string
+	// Custom is the command opening the tunnel, with {{local_port}} as the
+	// local port and {{bind}} as the local address.
+	Custom string
+	// Provider is the name of the tunnel type, see RegisterProvider, Params
+	// being what it is given.
+	Provider string
+	// Bind is the local address the tunnel listens on, defaults to
+	// localhost.
+	Bind string
+	// ReadyRegex is matched against the output of the tunnel process to tell
+	// that it is open.
+	ReadyRegex string
+	// Dir is the working directory of the tunnel process.
+	Dir    string
+	Params map[string]string
+	Tags   []string
+	// DependsOn are the names of the tunnels which must be open first.
+	DependsOn []string
+	// StartupTimeout, RetryInterval and KillGrace default to the settings
+	// of tmancer.
+	StartupTimeout time.Duration
+	RetryInterval  time.Duration
+	KillGrace      time.Duration
+	// LocalPort is the port the tunnel listens on, 0 for a free one.
+	LocalPort int
+	// Required tunnels are the ones WaitReady waits for, all of them if none
+	// is.
+	Required bool
+}
+
+// K8sInfo is the kubectl port-forward target of a tunnel.
+type K8sInfo struct {
+	Context   string
+	Namespace string
+	Service   string
+	Port      int
+}
+
+// HealthCheck probes an open tunnel, the zero values picking the defaults of
+// tmancer.
+type HealthCheck struct {
+	// Cmd, if set, is run instead of dialing the local port and must exit
+	// with 0.
+	Cmd        string
+	Interval   time.Duration
+	Timeout    time.Duration
+	MaxLatency time.Duration
+	// Failures is the number of consecutive failed probes after which the
+	// tunnel is Degraded.
+	Failures int
+	// Restart the tunnel process once it is Degraded.
+	Restart bool
+}
+
+// Settings apply to all the tunnels of a supervisor, some of them act as
+// defaults for the tunnel configs. The zero values pick the defaults of
+// tmancer.
+type Settings struct {
+	RetryInterval time.Duration
+	KillGrace     time.Duration
+	// StartDelay is how long to wait between two tunnels starting to open.
+	StartDelay time.Duration
+	// RetryBudget is how many failed tunnels may be reopened per second.
+	RetryBudget int
+	// MaxOpening is how many tunnels may be opening at once, 0 for no limit.
+	MaxOpening int
+	// PortOffset shifts every local port.
+	PortOffset int
+}
+
+// Provider builds the tunnels of a custom type, set with Config.Provider.
+type Provider interface {
+	// BuildCommand returns the command opening the tunnel on the given local
+	// address, including the executable.
+	BuildCommand(c *Config, bind string, port int) ([]string, error)
+	// Health returns the health check of the tunnels which have none, nil
+	// for the default one.
+	Health(c *Config) *HealthCheck
+	// Readiness returns the ready regex of the tunnels which have none, empty
+	// to consider them open as soon as their process runs.
+	Readiness(c *Config) string
+}
+
+// provider adapts a Provider to the tmancer one.
+type provider struct {
+	p Provider
+}
+
+func (p provider) BuildCommand(c *internal.TunnelConfig, bind string, port int) ([]string, error) {
+	return p.p.BuildCommand(fromTunnelConfig(c), bind, port)
+}
+
+func (p provider) Health(c *internal.TunnelConfig) *internal.HealthCheck {
+	return p.p.Health(fromTunnelConfig(c)).toHealthCheck()
+}
+
+func (p provider) Readiness(c *internal.TunnelConfig) string {
+	return p.p.Readiness(fromTunnelConfig(c))
+}
+
+// toTunnelConfig returns the tmancer config of the tunnel.
+func (c *Config) toTunnelConfig() internal.TunnelConfig {
+	tc := internal.TunnelConfig{
+		HealthCheck:    c.HealthCheck.toHealthCheck(),
+		Name:           c.Name,
+		Custom:         c.Custom,
+		Provider:       c.Provider,
+		Bind:           c.Bind,
+		ReadyRegex:     c.ReadyRegex,
+		Dir:            c.Dir,
+		Params:         c.Params,
+		Tags:           c.Tags,
+		DependsOn:      c.DependsOn,
+		StartupTimeout: internal.Duration{Duration: c.StartupTimeout},
+		RetryInterval:  internal.Duration{Duration: c.RetryInterval},
+		KillGrace:      internal.Duration{Duration: c.KillGrace},
+		LocalPort:      c.LocalPort,
+		Required:       c.Required,
+	}
+	if c.K8s != nil {
+		tc.K8s = &internal.K8sInfo{Context: c.K8s.Context, Namespace: c.K8s.Namespace, Service: c.K8s.Service, Port: c.K8s.Port}
+	}
+	return tc
+}
+
+// fromTunnelConfig returns the config of the tmancer tunnel, as far as Config
+// goes.
+func fromTunnelConfig(tc *internal.TunnelConfig) *Config {
+	c := &Config{
+		HealthCheck:    fromHealthCheck(tc.HealthCheck),
+		Name:           tc.Name,
+		Custom:         tc.Custom,
+		Provider:       tc.Provider,
+		Bind:           tc.Bind,
+		ReadyRegex:     tc.ReadyRegex,
+		Dir:            tc.Dir,
+		Params:         tc.Params,
+		Tags:           tc.Tags,
+		DependsOn:      tc.DependsOn,
+		StartupTimeout: tc.StartupTimeout.Duration,
+		RetryInterval:  tc.RetryInterval.Duration,
+		KillGrace:      tc.KillGrace.Duration,
+		LocalPort:      tc.LocalPort,
+		Required:       tc.Required,
+	}
+	if tc.K8s != nil {
+		c.K8s = &K8sInfo{Context: tc.K8s.Context, Namespace: tc.K8s.Namespace, Service: tc.K8s.Service, Port: tc.K8s.Port}
+	}
+	return c
+}
+
+// toHealthCheck returns the tmancer health check, nil if h is.
+func (h *HealthCheck) toHealthCheck() *internal.HealthCheck {
+	if h == nil {
+		return nil
+	}
+	return &internal.HealthCheck{
+		Cmd:        h.Cmd,
+		Interval:   internal.Duration{Duration: h.Interval},
+		Timeout:    internal.Duration{Duration: h.Timeout},
+		MaxLatency: internal.Duration{Duration: h.MaxLatency},
+		Failures:   h.Failures,
+		Restart:    h.Restart,
+	}
+}
+
+// fromHealthCheck returns the health check of tmancer as far as HealthCheck
+// goes, nil if h is.
+func fromHealthCheck(h *internal.HealthCheck) *HealthCheck {
+	if h == nil {
+		return nil
+	}
+	return &HealthCheck{
+		Cmd:        h.Cmd,
+		Interval:   h.Interval.Duration,
+		Timeout:    h.Timeout.Duration,
+		MaxLatency: h.MaxLatency.Duration,
+		Failures:   h.Failures,
+		Restart:    h.Restart,
+	}
+}
+
+// toSettings returns the tmancer settings.
+func (s *Settings) toSettings() internal.Settings {
+	return internal.Settings{
+		RetryInterval: internal.Duration{Duration: s.RetryInterval},
+		KillGrace:     internal.Duration{Duration: s.KillGrace},
+		StartDelay:    internal.Duration{Duration: s.StartDelay},
+		RetryBudget:   s.RetryBudget,
+		MaxOpening:    s.MaxOpening,
+		PortOffset:    s.PortOffset,
+	}
+}
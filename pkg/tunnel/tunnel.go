@@ -0,0 +1,237 @@
+// Package tunnel lets other Go tools embed the tunnel supervision of tmancer
+// instead of running the binary. A Supervisor keeps a set of tunnels open,
+// reopening them as configured, and reports their status changes:
+//
+//	s, err := tunnel.New(tunnel.Settings{}, tunnel.Config{
+//		Name:      "db",
+//		LocalPort: 5432,
+//		K8s:       &tunnel.K8sInfo{Namespace: "payments", Service: "postgres", Port: 5432},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	if err = s.Start(ctx); err != nil {
+//		return err
+//	}
+//	defer s.Stop()
+//	events, unsubscribe := s.Subscribe()
+//	defer unsubscribe()
+//	for e := range events {
+//		log.Printf("%s went from %s to %s", e.Tunnel, e.Previous, e.Status)
+//	}
+package tunnel
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lzambarda/tmancer/internal"
+	"github.com/pkg/errors"
+)
+
+// Status is the status of a tunnel, named as tmancer displays it.
+type Status string
+
+// Statuses of the tunnels, see their documentation in tmancer.
+const (
+	Close            Status = "Close"
+	Opening          Status = "Opening"
+	Open             Status = "Open"
+	Error            Status = "Error"
+	Reopening        Status = "Reopening"
+	PortBusy         Status = "PortBusy"
+	Signal           Status = "Signal"
+	Cooper           Status = "Cooper"
+	Refreshing       Status = "Refreshing"
+	Degraded         Status = "Degraded"
+	Failed           Status = "Failed"
+	Exited           Status = "Exited"
+	Flapping         Status = "Flapping"
+	Crashed          Status = "Crashed"
+	WaitingForTarget Status = "WaitingForTarget"
+	Throttled        Status = "Throttled"
+	Paused           Status = "Paused"
+	Idle             Status = "Idle"
+	Waiting          Status = "Waiting"
+	PreflightFailed  Status = "PreflightFailed"
+	Scheduled        Status = "Scheduled"
+)
+
+// status returns the status of a tmancer tunnel.
+func status(s internal.Status) Status {
+	return Status(s.String())
+}
+
+// RegisterProvider makes the provider available to the tunnels under the given
+// name. Call this before New or Load.
+func RegisterProvider(name string, p Provider) {
+	internal.RegisterProvider(name, provider{p: p})
+}
+
+// subscriptionSize is the number of status changes a subscriber can lag
+// behind before missing some.
+const subscriptionSize = 64
+
+// Event is a status change of a tunnel.
+type Event struct {
+	Time   time.Time
+	Tunnel string
+	// Error is the failure behind the status, if any.
+	Error string
+	// Previous is the status the tunnel left.
+	Previous Status
+	Status   Status
+}
+
+// TunnelStatus is the state of a tunnel.
+type TunnelStatus struct {
+	Name string
+	// Error is the failure behind the status, if any.
+	Error  string
+	Status Status
+	Port   int
+	// Pid is the pid of the tunnel process, 0 if it is not running.
+	Pid int
+}
+
+// Supervisor keeps a set of tunnels open. A supervisor can only be started
+// once.
+type Supervisor struct {
+	cancel  context.CancelFunc
+	m       *sync.Mutex
+	wg      *sync.WaitGroup
+	tunnels []*internal.Tunnel
+}
+
+// New returns a supervisor of the given tunnels. The configs are checked as
+// if they were loaded from a file.
+func New(settings Settings, configs ...Config) (*Supervisor, error) {
+	tunnels := make([]internal.TunnelConfig, len(configs))
+	for i := range configs {
+		tunnels[i] = configs[i].toTunnelConfig()
+	}
+	config, err := internal.NewConfig(settings.toSettings(), tunnels)
+	if err != nil {
+		return nil, err
+	}
+	return newSupervisor(config)
+}
+
+// Load returns a supervisor of the tunnels of the given config files, with the
+// given profile if not empty, as tmancer would start them.
+func Load(profile string, paths ...string) (*Supervisor, error) {
+	config, err := internal.LoadConfig(profile, paths...)
+	if err != nil {
+		return nil, err
+	}
+	return newSupervisor(config)
+}
+
+// newSupervisor returns a supervisor of the tunnels of the config, once their
+// local ports are shifted by the port offset and the ones set to 0 are given
+// a free port, as tmancer does.
+func newSupervisor(config *internal.Config) (*Supervisor, error) {
+	if err := config.ShiftPorts(config.Settings.PortOffset); err != nil {
+		return nil, err
+	}
+	if err := config.AssignFreePorts(); err != nil {
+		return nil, err
+	}
+	s := &Supervisor{
+		m:  &sync.Mutex{},
+		wg: &sync.WaitGroup{},
+	}
+	outage := internal.NewOutageDetector(config.Tunnels)
+	retryBudget := internal.NewRetryBudget(config.Settings.RetryBudget)
+	startQueue := internal.NewStartQueue(config.Settings.MaxOpening, config.Settings.StartDelay.Duration)
+	for _, c := range config.Tunnels {
+		t := internal.NewTunnel(c)
+		t.SetOutageDetector(outage)
+		t.SetRetryBudget(retryBudget)
+		t.SetStartQueue(startQueue)
+		s.tunnels = append(s.tunnels, t)
+	}
+	internal.LinkDependencies(s.tunnels)
+	return s, nil
+}
+
+// Start starts the tunnels and returns right away, they run until ctx is done
+// or Stop is called.
+func (s *Supervisor) Start(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.cancel != nil {
+		return errors.New("already started")
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	for _, t := range s.tunnels {
+		s.wg.Add(1)
+		go func(t *internal.Tunnel) {
+			defer s.wg.Done()
+			t.Start(ctx)
+		}(t)
+	}
+	return nil
+}
+
+// Stop stops the tunnels and waits for their processes to end.
+func (s *Supervisor) Stop() {
+	s.m.Lock()
+	cancel := s.cancel
+	s.m.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	s.wg.Wait()
+}
+
+// Status returns the state of the tunnels, in the order of their configs.
+// Once stopped, the tunnels keep the status they had when Stop was called.
+func (s *Supervisor) Status() []TunnelStatus {
+	res := make([]TunnelStatus, len(s.tunnels))
+	for i, t := range s.tunnels {
+		res[i] = TunnelStatus{
+			Name:   t.GetName(),
+			Port:   t.GetLocalPort(),
+			Status: status(t.GetStatus()),
+			Error:  t.GetError(),
+			Pid:    t.GetPid(),
+		}
+	}
+	return res
+}
+
+// WaitReady waits for the tunnels to be open, except for the optional ones.
+// It fails if one of them fails for good, or once ctx is done.
+func (s *Supervisor) WaitReady(ctx context.Context) error {
+	return internal.WaitReady(ctx, s.tunnels)
+}
+
+// Subscribe returns a channel receiving the status changes of the tunnels
+// from now on. Status changes are dropped rather than holding the tunnels up
+// when the channel is not drained. The returned function unsubscribes and
+// closes the channel.
+func (s *Supervisor) Subscribe() (<-chan Event, func()) {
+	events := make(chan Event, subscriptionSize)
+	unsubscribes := make([]func(), len(s.tunnels))
+	for i, t := range s.tunnels {
+		unsubscribes[i] = t.Subscribe(func(c internal.StatusChange) {
+			select {
+			case events <- Event{Time: c.Time, Tunnel: c.Tunnel, Error: c.Error, Previous: status(c.Previous), Status: status(c.Status)}:
+			default:
+			}
+		})
+	}
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			for _, unsubscribe := range unsubscribes {
+				unsubscribe()
+			}
+			// No tunnel sends anymore.
+			close(events)
+		})
+	}
+}